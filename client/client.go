@@ -0,0 +1,282 @@
+// Package client is the Go SDK for the verve unique request counting service.
+//
+//	c := client.New("http://localhost:8080", client.WithTimeout(2*time.Second))
+//	result, err := c.Accept(ctx, 42)
+//	if err == nil && result.Duplicate {
+//		// id 42 was already counted in the current window
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client talks to a verve server. It is safe for concurrent use and reuses connections.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default pooled HTTP client. The client isn't changed, so it can
+// be shared.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout sets the timeout of every single attempt, in any order with WithHTTPClient; 0
+// leaves attempts to the context and the HTTP client's own timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the initial backoff,
+// which doubles after every attempt.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Transport: transport},
+		timeout:    5 * time.Second,
+		maxRetries: 3,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AcceptResult is the outcome of submitting a single id.
+type AcceptResult struct {
+	ID        int
+	Duplicate bool
+	// Invalid is set by AcceptBatch for ids the server rejected.
+	Invalid bool
+}
+
+// Stats describes the current reporting window.
+type Stats struct {
+	UniqueRequestCount int       `json:"unique_request_count"`
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+type acceptResponse struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+func (r acceptResponse) result() AcceptResult {
+	return AcceptResult{ID: r.ID, Duplicate: r.Status == "duplicate", Invalid: r.Status == "invalid"}
+}
+
+// APIError is returned when the server rejects a request.
+type APIError struct {
+	StatusCode int
+	// Code is the machine readable error code of the v2 API, e.g. "invalid_id".
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("verve: server returned %d: %s", e.StatusCode, e.Message)
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) == nil && resp.Error.Code != "" {
+		return &APIError{StatusCode: statusCode, Code: resp.Error.Code, Message: resp.Error.Message}
+	}
+	return &APIError{StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// Accept submits id to the current window.
+func (c *Client) Accept(ctx context.Context, id int) (AcceptResult, error) {
+	payload, err := json.Marshal(map[string]int{"id": id})
+	if err != nil {
+		return AcceptResult{}, err
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/api/v2/verve/accept", payload)
+	if err != nil {
+		return AcceptResult{}, err
+	}
+
+	var resp acceptResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return AcceptResult{}, fmt.Errorf("verve: invalid accept response: %w", err)
+	}
+	return resp.result(), nil
+}
+
+// AcceptBatch submits several ids in one request and returns their results in the same order.
+func (c *Client) AcceptBatch(ctx context.Context, ids []int) ([]AcceptResult, error) {
+	payload, err := json.Marshal(map[string][]int{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/api/v2/verve/accept/batch", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Results []acceptResponse `json:"results"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("verve: invalid batch response: %w", err)
+	}
+	if len(resp.Results) != len(ids) {
+		return nil, fmt.Errorf("verve: got %d batch results for %d ids", len(resp.Results), len(ids))
+	}
+
+	results := make([]AcceptResult, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = r.result()
+	}
+	return results, nil
+}
+
+// Stats returns the unique id count of the current window.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	body, err := c.do(ctx, http.MethodGet, "/api/v2/verve/stats", nil)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return Stats{}, fmt.Errorf("verve: invalid stats response: %w", err)
+	}
+	return stats, nil
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context whose requests carry key in an Idempotency-Key header and
+// are retried after any failure. Without one, a submission is only retried when the server
+// can't have seen it: it wasn't sent, or was answered with 429. Once an accept was counted, a
+// resend would answer that the id is a duplicate, so only set a key when that is acceptable or
+// a gateway in front of the server answers repeats of a key with the first response.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// do sends the request, retrying network errors, 429s and 5xx responses with exponential backoff.
+// POSTs are only retried for errors that can't have been processed, unless they carry an
+// idempotency key.
+func (c *Client) do(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	retry := retryable
+	if method == http.MethodPost && key == "" {
+		retry = notProcessed
+	}
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		body, err := c.attempt(ctx, method, path, payload)
+		if err == nil || attempt >= c.maxRetries || ctx.Err() != nil || !retry(err) {
+			return body, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key, _ := ctx.Value(idempotencyKey{}).(string); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// notProcessed reports whether err means the server didn't act on the request: the connection
+// couldn't be made, or the server refused it with 429 before looking at it.
+func notProcessed(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
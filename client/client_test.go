@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcceptRetries(t *testing.T) {
+	var calls atomic.Int32
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"id": 1, "status": "accepted"}`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+
+	// A 502 may have come after the id was counted, so it isn't resent
+	if _, err := c.Accept(context.Background(), 1); err == nil || calls.Load() != 1 {
+		t.Errorf("got %v after %d calls, want the 502 without a retry", err, calls.Load())
+	}
+
+	calls.Store(0)
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	if result, err := c.Accept(ctx, 1); err != nil || result.Duplicate || calls.Load() != 2 {
+		t.Errorf("got %+v, %v after %d calls, want accepted on the retry", result, err, calls.Load())
+	}
+	if keys[len(keys)-1] != "k1" {
+		t.Errorf("got Idempotency-Key %q, want k1", keys[len(keys)-1])
+	}
+}
+
+func TestAcceptRetriesUnsent(t *testing.T) {
+	// Nothing listens on the address once the server is closed, so the dial fails every time
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	if !notProcessed(func() error {
+		_, err := New(srv.URL, WithRetries(0, 0)).Accept(context.Background(), 1)
+		return err
+	}()) {
+		t.Error("a failed dial isn't taken as not processed")
+	}
+}
+
+func TestTimeoutLeavesSharedClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte(`{"id": 1, "status": "accepted"}`))
+	}))
+	defer srv.Close()
+
+	for name, opts := range map[string][]Option{
+		"timeout first": {WithTimeout(20 * time.Millisecond), WithHTTPClient(&http.Client{})},
+		"client first":  {WithHTTPClient(&http.Client{}), WithTimeout(20 * time.Millisecond)},
+	} {
+		c := New(srv.URL, append(opts, WithRetries(0, 0))...)
+		if _, err := c.Accept(context.Background(), 1); err == nil {
+			t.Errorf("%s: an attempt outlived the timeout", name)
+		}
+		if c.httpClient.Timeout != 0 {
+			t.Errorf("%s: the shared HTTP client's timeout was changed to %v", name, c.httpClient.Timeout)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Command consumer reads the unique-count Kafka topic the service publishes to, validates every
+// message against the count message schema and writes the valid ones to stdout as JSON lines
+// and, with -postgres, to the verve_window_counts table.
+//
+// It is the reference implementation of a downstream consumer, and an end-to-end check:
+//
+//	go run ./cmd/consumer -brokers localhost:9092 -max-messages 1 -timeout 2m -strict
+//
+// exits 0 once a valid window report arrived, and 1 on an invalid message or the timeout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("consumer", flag.ContinueOnError)
+	brokers := flags.String("brokers", getEnv("KAFKA_BROKER", "localhost:9092"), "comma-separated Kafka brokers")
+	topic := flags.String("topic", getEnv("KAFKA_TOPIC", "unique-id-count"), "topic the service publishes window counts to")
+	group := flags.String("group", "verve-consumer", "consumer group, whose committed offsets are resumed from")
+	format := flags.String("format", getEnv("KAFKA_FORMAT", "json"), "payload format, json or protobuf")
+	dsn := flags.String("postgres", getEnv("POSTGRES_DSN", ""), "also write valid messages to this Postgres database")
+	maxMessages := flags.Int("max-messages", 0, "exit after this many valid messages, 0 consumes until interrupted")
+	timeout := flags.Duration("timeout", 0, "fail when -max-messages weren't consumed within this time")
+	strict := flags.Bool("strict", false, "fail on the first invalid message and on unknown JSON fields, instead of skipping it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "json" && *format != "protobuf" {
+		log.Printf("-format must be json or protobuf")
+		return 2
+	}
+
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, *timeout)
+		defer cancel()
+	}
+
+	var db *postgresWriter
+	if *dsn != "" {
+		var err error
+		if db, err = newPostgresWriter(runCtx, *dsn); err != nil {
+			log.Printf("Failed to connect to Postgres: %v", err)
+			return 1
+		}
+		defer db.Close()
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: strings.Split(*brokers, ","),
+		GroupID: *group,
+		Topic:   *topic,
+	})
+	defer reader.Close()
+
+	out := json.NewEncoder(os.Stdout)
+	valid, invalid := 0, 0
+	for *maxMessages == 0 || valid < *maxMessages {
+		msg, err := reader.FetchMessage(runCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("Timed out after %d of %d messages", valid, *maxMessages)
+				return 1
+			}
+			if runCtx.Err() != nil {
+				break
+			}
+			log.Printf("Failed to read from %s: %v", *topic, err)
+			return 1
+		}
+
+		m, err := decodeMessage(*format, msg.Value, *strict)
+		if err != nil {
+			invalid++
+			log.Printf("Invalid message at partition %d offset %d (key %q): %v", msg.Partition, msg.Offset, msg.Key, err)
+			if *strict {
+				return 1
+			}
+		} else {
+			if db != nil {
+				if err := db.write(runCtx, m); err != nil {
+					// Not committed, so the message is read again after a restart
+					log.Printf("Failed to write the window ending %s to Postgres: %v", m.Timestamp, err)
+					return 1
+				}
+			}
+			out.Encode(m)
+			valid++
+		}
+		if err := reader.CommitMessages(runCtx, msg); err != nil {
+			log.Printf("Failed to commit offset %d: %v", msg.Offset, err)
+		}
+	}
+	log.Printf("Consumed %d valid and %d invalid messages from %s", valid, invalid, *topic)
+	return 0
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// countMessage is a message of the unique-count topic: a window or rollup report, or the
+// message of one tenant when Tenant is set. It mirrors the JSON payload and the protobuf
+// CountMessage documented in extensions/payload_format.go.
+type countMessage struct {
+	UniqueRequestCount *int                      `json:"unique_request_count"`
+	Timestamp          string                    `json:"timestamp"`
+	Version            string                    `json:"version"`
+	GitSHA             string                    `json:"git_sha"`
+	InstanceID         string                    `json:"instance_id"`
+	Backend            string                    `json:"backend"`
+	Tenant             string                    `json:"tenant,omitempty"`
+	Window             string                    `json:"window,omitempty"`
+	Buckets            map[string]int            `json:"buckets,omitempty"`
+	Dimensions         map[string]map[string]int `json:"dimensions,omitempty"`
+	Tenants            map[string]int            `json:"tenants,omitempty"`
+	Period             string                    `json:"period,omitempty"`
+	PeriodStart        string                    `json:"period_start,omitempty"`
+	Approximate        bool                      `json:"approximate,omitempty"`
+	Overflowed         bool                      `json:"overflowed,omitempty"`
+	Duplicates         int                       `json:"duplicates,omitempty"`
+	TopDuplicates      map[string]int            `json:"top_duplicates,omitempty"`
+	Regions            map[string]int            `json:"regions,omitempty"`
+	MissingRegions     []string                  `json:"missing_regions,omitempty"`
+	SketchDigest       string                    `json:"sketch_digest,omitempty"`
+	// Reconciliation is passed through as is.
+	Reconciliation json.RawMessage `json:"reconciliation,omitempty"`
+}
+
+// tenantIDPattern is the service's rule for tenant ids.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// decodeMessage decodes a payload of format, json or protobuf. With strict, JSON fields the
+// schema doesn't know are rejected instead of ignored.
+func decodeMessage(format string, payload []byte, strict bool) (countMessage, error) {
+	var m countMessage
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(&m); err != nil {
+			return m, fmt.Errorf("not a JSON count message: %w", err)
+		}
+	case "protobuf":
+		if err := decodeProtobuf(payload, &m); err != nil {
+			return m, fmt.Errorf("not a protobuf count message: %w", err)
+		}
+	default:
+		return m, fmt.Errorf("unknown format %q, expected json or protobuf", format)
+	}
+	return m, m.validate()
+}
+
+// validate checks the fields every consumer relies on.
+func (m countMessage) validate() error {
+	if m.UniqueRequestCount == nil {
+		return errors.New("'unique_request_count' is missing")
+	}
+	if *m.UniqueRequestCount < 0 {
+		return errors.New("'unique_request_count' is negative")
+	}
+	if _, err := time.Parse(time.RFC3339, m.Timestamp); err != nil {
+		return fmt.Errorf("'timestamp' is not RFC 3339: %q", m.Timestamp)
+	}
+	if m.Version == "" || m.InstanceID == "" {
+		return errors.New("'version' and 'instance_id' are required")
+	}
+	if m.Tenant != "" && !tenantIDPattern.MatchString(m.Tenant) {
+		return fmt.Errorf("'tenant' is not a tenant id: %q", m.Tenant)
+	}
+	if m.Window != "" {
+		if d, err := time.ParseDuration(m.Window); err != nil || d < time.Second {
+			return fmt.Errorf("'window' is not a duration of at least 1s: %q", m.Window)
+		}
+	}
+	switch m.Period {
+	case "":
+		if m.PeriodStart != "" {
+			return errors.New("'period_start' is set without a 'period'")
+		}
+	case "hour", "day":
+		if _, err := time.Parse(time.RFC3339, m.PeriodStart); err != nil {
+			return fmt.Errorf("'period_start' is not RFC 3339: %q", m.PeriodStart)
+		}
+	default:
+		return fmt.Errorf("'period' must be hour or day, got %q", m.Period)
+	}
+	for name, counts := range map[string]map[string]int{"buckets": m.Buckets, "tenants": m.Tenants, "top_duplicates": m.TopDuplicates, "regions": m.Regions} {
+		if err := nonNegative(name, counts); err != nil {
+			return err
+		}
+	}
+	for dim, counts := range m.Dimensions {
+		if err := nonNegative("dimensions."+dim, counts); err != nil {
+			return err
+		}
+	}
+	if m.Duplicates < 0 {
+		return errors.New("'duplicates' is negative")
+	}
+	return nil
+}
+
+func nonNegative(name string, counts map[string]int) error {
+	for key, n := range counts {
+		if n < 0 {
+			return fmt.Errorf("'%s.%s' is negative", name, key)
+		}
+	}
+	return nil
+}
+
+// decodeProtobuf reads a CountMessage. Unknown fields are skipped like protobuf does, so newer
+// producers stay readable.
+func decodeProtobuf(b []byte, m *countMessage) error {
+	count := 0
+	m.UniqueRequestCount = &count
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var err error
+		switch {
+		case typ == protowire.VarintType && num <= 19:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			switch num {
+			case 1:
+				count = int(v)
+			case 12:
+				m.Approximate = v != 0
+			case 14:
+				m.Overflowed = v != 0
+			case 15:
+				m.Duplicates = int(v)
+			}
+		case typ == protowire.BytesType && (num <= 19 || num == 21):
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				err = m.setBytes(num, v)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (m *countMessage) setBytes(num protowire.Number, v []byte) error {
+	texts := map[protowire.Number]*string{
+		2: &m.Timestamp, 3: &m.Version, 4: &m.GitSHA, 5: &m.InstanceID, 6: &m.Backend,
+		10: &m.Period, 11: &m.PeriodStart, 13: &m.Tenant, 19: &m.Window, 21: &m.SketchDigest,
+	}
+	counts := map[protowire.Number]*map[string]int{7: &m.Buckets, 9: &m.Tenants, 16: &m.TopDuplicates, 17: &m.Regions}
+	switch {
+	case texts[num] != nil:
+		*texts[num] = string(v)
+	case counts[num] != nil:
+		return addEntry(counts[num], v)
+	case num == 8:
+		var name string
+		values := map[string]int{}
+		err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				name = string(v)
+			case num == 2 && typ == protowire.BytesType:
+				return addEntry(&values, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if m.Dimensions == nil {
+			m.Dimensions = map[string]map[string]int{}
+		}
+		m.Dimensions[name] = values
+	case num == 18:
+		m.MissingRegions = append(m.MissingRegions, string(v))
+	}
+	return nil
+}
+
+// addEntry adds a map<string, int64> entry message to counts.
+func addEntry(counts *map[string]int, entry []byte) error {
+	var key string
+	var value int
+	err := eachField(entry, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key = string(v)
+		case num == 2 && typ == protowire.VarintType:
+			n, _ := protowire.ConsumeVarint(v)
+			value = int(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *counts == nil {
+		*counts = map[string]int{}
+	}
+	(*counts)[key] = value
+	return nil
+}
+
+// eachField calls fn with every field of a nested message: the contents of length-delimited
+// fields, the raw encoding of the others.
+func eachField(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		v := b[:n]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
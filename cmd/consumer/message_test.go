@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoString and protoCount build the fields the service's protobuf payload writes.
+func protoString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func protoCount(b []byte, num protowire.Number, key string, n uint64) []byte {
+	entry := protoString(nil, 1, key)
+	entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, n)
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, entry)
+}
+
+func protoHeader(count uint64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, count)
+	b = protoString(b, 2, "2026-10-14T07:00:00Z")
+	b = protoString(b, 3, "v1.2.0")
+	return protoString(b, 5, "verve-0")
+}
+
+func TestDecodeMessage(t *testing.T) {
+	count := func(n int) *int { return &n }
+	tests := []struct {
+		name    string
+		format  string
+		payload []byte
+		want    countMessage
+	}{
+		{
+			name:    "json window report",
+			format:  "json",
+			payload: []byte(`{"unique_request_count": 3, "timestamp": "2026-10-14T07:00:00Z", "version": "v1.2.0", "instance_id": "verve-0", "tenants": {"acme": 2}}`),
+			want:    countMessage{UniqueRequestCount: count(3), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", Tenants: map[string]int{"acme": 2}},
+		},
+		{
+			name:    "json tenant window",
+			format:  "json",
+			payload: []byte(`{"unique_request_count": 1, "timestamp": "2026-10-14T07:00:00Z", "version": "v1.2.0", "instance_id": "verve-0", "tenant": "acme", "window": "5m0s"}`),
+			want:    countMessage{UniqueRequestCount: count(1), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", Tenant: "acme", Window: "5m0s"},
+		},
+		{
+			name:    "json regions",
+			format:  "json",
+			payload: []byte(`{"unique_request_count": 7, "timestamp": "2026-10-14T07:00:00Z", "version": "v1.2.0", "instance_id": "verve-0", "regions": {"eu": 4, "us": 3}, "missing_regions": ["ap"]}`),
+			want:    countMessage{UniqueRequestCount: count(7), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", Regions: map[string]int{"eu": 4, "us": 3}, MissingRegions: []string{"ap"}},
+		},
+		{
+			name:    "protobuf tenant window",
+			format:  "protobuf",
+			payload: protoString(protoString(protoHeader(1), 13, "acme"), 19, "5m0s"),
+			want:    countMessage{UniqueRequestCount: count(1), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", Tenant: "acme", Window: "5m0s"},
+		},
+		{
+			name:    "protobuf regions",
+			format:  "protobuf",
+			payload: protoString(protoCount(protoCount(protoHeader(7), 17, "eu", 4), 17, "us", 3), 18, "ap"),
+			want:    countMessage{UniqueRequestCount: count(7), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", Regions: map[string]int{"eu": 4, "us": 3}, MissingRegions: []string{"ap"}},
+		},
+		{
+			name:    "protobuf sketch digest",
+			format:  "protobuf",
+			payload: protoString(protoHeader(2), 21, "sha256:9f86d081"),
+			want:    countMessage{UniqueRequestCount: count(2), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0", SketchDigest: "sha256:9f86d081"},
+		},
+		{
+			name:   "protobuf skips unknown fields",
+			format: "protobuf",
+			payload: protowire.AppendBytes(protowire.AppendTag(protoHeader(2), 20, protowire.BytesType),
+				protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 5)),
+			want: countMessage{UniqueRequestCount: count(2), Timestamp: "2026-10-14T07:00:00Z", Version: "v1.2.0", InstanceID: "verve-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeMessage(tt.format, tt.payload, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageRejects(t *testing.T) {
+	const header = `"timestamp": "2026-10-14T07:00:00Z", "version": "v1.2.0", "instance_id": "verve-0"`
+	tests := []struct {
+		name    string
+		format  string
+		payload []byte
+		strict  bool
+		want    string
+	}{
+		{"unknown format", "avro", nil, false, "unknown format"},
+		{"missing count", "json", []byte(`{` + header + `}`), false, "'unique_request_count' is missing"},
+		{"unknown field when strict", "json", []byte(`{"unique_request_count": 1, "extra": 1, ` + header + `}`), true, "unknown field"},
+		{"short window", "json", []byte(`{"unique_request_count": 1, "window": "500ms", ` + header + `}`), false, "'window' is not a duration"},
+		{"unparsable window", "json", []byte(`{"unique_request_count": 1, "window": "soon", ` + header + `}`), false, "'window' is not a duration"},
+		{"negative region", "json", []byte(`{"unique_request_count": 1, "regions": {"eu": -1}, ` + header + `}`), false, "'regions.eu' is negative"},
+		{"bad tenant", "json", []byte(`{"unique_request_count": 1, "tenant": "Acme Corp", ` + header + `}`), false, "'tenant' is not a tenant id"},
+		{"protobuf short window", "protobuf", protoString(protoHeader(1), 19, "10ms"), false, "'window' is not a duration"},
+		{"protobuf truncated", "protobuf", protoHeader(1)[:5], false, "not a protobuf count message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeMessage(tt.format, tt.payload, tt.strict)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageLenient(t *testing.T) {
+	payload := []byte(`{"unique_request_count": 1, "extra": 1, "timestamp": "2026-10-14T07:00:00Z", "version": "v1.2.0", "instance_id": "verve-0"}`)
+	if _, err := decodeMessage("json", payload, false); err != nil {
+		t.Errorf("unknown fields are ignored without strict, got %v", err)
+	}
+}
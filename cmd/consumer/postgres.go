@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresWriter keeps one row per window, tenant and period. Kafka delivers at least once, so
+// a redelivered message overwrites its row instead of adding another.
+type postgresWriter struct {
+	pool *pgxpool.Pool
+}
+
+func newPostgresWriter(ctx context.Context, dsn string) (*postgresWriter, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS verve_window_counts (
+		window_end TIMESTAMPTZ NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		period TEXT NOT NULL DEFAULT '',
+		window_length TEXT NOT NULL DEFAULT '',
+		unique_request_count BIGINT NOT NULL,
+		instance_id TEXT NOT NULL,
+		message JSONB NOT NULL,
+		received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (window_end, tenant, period, window_length)
+	)`)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create postgres window count table: %w", err)
+	}
+	return &postgresWriter{pool: pool}, nil
+}
+
+func (w *postgresWriter) write(ctx context.Context, m countMessage) error {
+	doc, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	end, _ := time.Parse(time.RFC3339, m.Timestamp)
+	_, err = w.pool.Exec(ctx, `INSERT INTO verve_window_counts
+		(window_end, tenant, period, window_length, unique_request_count, instance_id, message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (window_end, tenant, period, window_length) DO UPDATE SET
+		unique_request_count = EXCLUDED.unique_request_count, instance_id = EXCLUDED.instance_id,
+		message = EXCLUDED.message, received_at = now()`,
+		end, m.Tenant, m.Period, m.Window, *m.UniqueRequestCount, m.InstanceID, doc)
+	return err
+}
+
+func (w *postgresWriter) Close() {
+	w.pool.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type adminActorKey struct{}
+
+// adminAllowed is ADMIN_ALLOWED_CIDRS; when set, only clients in it may use the admin API.
+var adminAllowed []netip.Prefix
+
+// adminTokens maps the named tokens of ADMIN_TOKENS ("alice:<token>,bob:<token>") to their
+// names. ADMIN_TOKEN is a shared token without a name.
+func adminTokens() map[string]string {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(getEnv("ADMIN_TOKENS", ""), ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && name != "" && token != "" {
+			tokens[token] = name
+		}
+	}
+	if token := getEnv("ADMIN_TOKEN", ""); token != "" {
+		tokens[token] = ""
+	}
+	return tokens
+}
+
+// requireAdmin only lets requests through that carry "Authorization: Bearer <token>" with
+// ADMIN_TOKEN or one of ADMIN_TOKENS, from ADMIN_ALLOWED_CIDRS when it is set, and audits every
+// call and every failed attempt. The admin API is disabled when neither token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens := adminTokens()
+		if len(tokens) == 0 {
+			writeErrorV2(w, http.StatusForbidden, "admin_disabled", "Admin API is disabled, set ADMIN_TOKEN to enable it")
+			return
+		}
+		if len(adminAllowed) > 0 && !containsAddr(adminAllowed, realIP.resolve(r)) {
+			auditAuthFailure(r, "admin_allowlist")
+			writeErrorV2(w, http.StatusForbidden, "forbidden", "The admin API isn't reachable from this address")
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, found := "", false
+		for token, tokenName := range tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				name, found = tokenName, true
+			}
+		}
+		if !found {
+			auditAuthFailure(r, "admin")
+			writeErrorV2(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid admin token")
+			return
+		}
+
+		// A named token identifies its holder; the shared token only says it was an admin
+		if name != "" {
+			r = r.WithContext(context.WithValue(r.Context(), adminActorKey{}, name))
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		details := map[string]interface{}{"method": r.Method, "path": r.URL.Path, "status": rec.status}
+		// Anyone holding the token can send any name, so it is kept apart from the actor
+		if claimed := r.Header.Get("X-Admin-Actor"); claimed != "" {
+			details["claimed_actor"] = claimed
+		}
+		audit.record(auditEntry{
+			Action:     "admin.request",
+			Actor:      adminActor(r),
+			RemoteAddr: clientIP(r),
+			RequestID:  requestID(r),
+			Details:    details,
+		})
+	}
+}
+
+// statusRecorder remembers the status code a handler responded with, and how much it wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Flush keeps streaming responses like the export streaming through the recorder.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func auditAuthFailure(r *http.Request, scope string) {
+	audit.recordAuthFailure(auditEntry{
+		Action:     "auth.failure",
+		Actor:      "anonymous",
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details:    map[string]interface{}{"scope": scope, "method": r.Method, "path": r.URL.Path},
+	})
+}
+
+// requireInternal protects the ops and debug routes of the internal listener with
+// "Authorization: Bearer <INTERNAL_TOKEN>". Without INTERNAL_TOKEN the listener relies on only
+// being reachable from inside (e.g. bound to 127.0.0.1).
+func requireInternal(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getEnv("INTERNAL_TOKEN", "")
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			auditAuthFailure(r, "internal")
+			writeErrorV2(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid internal token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminActor identifies who performed an admin operation for the audit log: the name of its
+// token, or "admin" for a caller using the shared ADMIN_TOKEN.
+func adminActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(adminActorKey{}).(string); ok {
+		return actor
+	}
+	return "admin"
+}
+
+type retractRequest struct {
+	ID int `json:"id"`
+	// Tenant and Endpoint are needed to rebuild the dedupe key under the id_tenant, id_endpoint
+	// and matching hash key strategies.
+	Tenant   string `json:"tenant,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type retractResponse struct {
+	ID        int  `json:"id"`
+	Retracted bool `json:"retracted"`
+}
+
+// Retract an id from the current window, e.g. when a producer sent test traffic
+func retractHandler(w http.ResponseWriter, r *http.Request) {
+	var req retractRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"id\": 1, \"reason\": \"test traffic\"}")
+		return
+	}
+	if req.ID <= 0 {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_id", "'id' must be a positive integer")
+		return
+	}
+
+	remover, ok := dedup.(Remover)
+	if !ok {
+		writeErrorV2(w, http.StatusNotImplemented, "retract_unsupported", "The configured dedupe backend can't retract ids")
+		return
+	}
+
+	in := dedupeInput{id: req.ID, tenant: req.Tenant, endpoint: req.Endpoint}
+	key := storedKey(in)
+	retracted, err := removeFromWindow(r.Context(), remover, key, in)
+	if err != nil {
+		log.Printf("Error retracting ID: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "retract_failed", "Failed to retract id")
+		return
+	}
+
+	details := map[string]interface{}{
+		"id":        req.ID,
+		"tenant":    req.Tenant,
+		"reason":    req.Reason,
+		"retracted": retracted,
+	}
+	// The audit log is written to disk, so in privacy mode it only gets the hashed key
+	if idHash != nil {
+		delete(details, "id")
+		details["key"] = key
+	}
+	audit.record(auditEntry{
+		Action:     "retract",
+		Actor:      adminActor(r),
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details:    details,
+	})
+
+	writeJSON(w, http.StatusOK, retractResponse{ID: req.ID, Retracted: retracted})
+}
+
+// removeFromWindow removes key from the dedupe backend and, when it was there, takes in out of
+// the window's per-instance breakdowns. in.id is 0 when only the stored key is known.
+func removeFromWindow(ctx context.Context, remover Remover, key string, in dedupeInput) (bool, error) {
+	removed, err := remover.Remove(ctx, key)
+	if err != nil || !removed {
+		return removed, err
+	}
+	replicator.replicate(replicateRemove, key)
+	idSets.remove(key)
+	if buckets != nil && in.id > 0 {
+		buckets.retract(in.id)
+	}
+	if metadata != nil {
+		metadata.retract(key)
+	}
+	if reconciler != nil {
+		reconciler.retract()
+	}
+	if in.tenant != "" {
+		tenantCounts.retract(in.tenant)
+	}
+	return true, nil
+}
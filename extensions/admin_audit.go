@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type auditResponse struct {
+	Entries []storedAuditEntry `json:"entries"`
+	Chain   auditChain         `json:"chain"`
+}
+
+// Query the audit log, newest entries last, and verify its hash chain
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	action, actor := query.Get("action"), query.Get("actor")
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeErrorV2(w, http.StatusBadRequest, "invalid_range", "'since' must be an RFC 3339 time")
+			return
+		}
+	}
+	limit := 100
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > 10000 {
+			writeErrorV2(w, http.StatusBadRequest, "invalid_limit", "'limit' must be between 1 and 10000")
+			return
+		}
+		limit = n
+	}
+
+	// Keep the last limit matches
+	entries := []storedAuditEntry{}
+	chain, err := audit.query(func(_ int, entry storedAuditEntry) {
+		if action != "" && entry.Action != action || actor != "" && entry.Actor != actor {
+			return
+		}
+		if !since.IsZero() {
+			if t, err := time.Parse(time.RFC3339Nano, entry.Time); err != nil || t.Before(since) {
+				return
+			}
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		writeErrorV2(w, http.StatusInternalServerError, "audit_read_failed", "Failed to read the audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, auditResponse{Entries: entries, Chain: chain})
+}
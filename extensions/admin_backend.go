@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type backendSwitchRequest struct {
+	Backend string `json:"backend"`
+	// Drain defaults to true; without it the closing window is reported from the new backend
+	// without the old one's ids, e.g. when the old backend is the Redis that went down.
+	Drain *bool `json:"drain"`
+}
+
+type backendStatusResponse struct {
+	Backend string         `json:"backend"`
+	Pending *pendingSwitch `json:"pending,omitempty"`
+}
+
+// Show the dedupe backend in use and the switch waiting for the next window boundary
+func backendStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, backendStatusResponse{Backend: activeBackend(), Pending: backendSwitch.scheduled()})
+}
+
+// Switch this instance's dedupe backend at the next window boundary, e.g. back to Redis after
+// an outage was ridden out on the in-memory backend
+func switchBackendHandler(w http.ResponseWriter, r *http.Request) {
+	var req backendSwitchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"backend\": \"redis\", \"drain\": true}")
+		return
+	}
+	req.Backend = strings.TrimSpace(req.Backend)
+	if !slices.Contains([]string{"redis", "cuckoo", "roaring", "bolt", "memcached", "dynamodb", "postgres"}, req.Backend) {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_backend", "'backend' must be one of redis, cuckoo, roaring, bolt, memcached, dynamodb or postgres")
+		return
+	}
+	drain := req.Drain == nil || *req.Drain
+	if err := checkBackendSwitch(req.Backend, drain); err != nil {
+		writeErrorV2(w, http.StatusConflict, "switch_refused", err.Error())
+		return
+	}
+
+	pending, err := backendSwitch.schedule(req.Backend, drain, adminActor(r))
+	if err != nil {
+		log.Printf("Error opening the %s dedupe backend: %v\n", req.Backend, err)
+		writeErrorV2(w, http.StatusServiceUnavailable, "backend_unavailable", "Failed to open the "+req.Backend+" dedupe backend: "+err.Error())
+		return
+	}
+	audit.record(auditEntry{
+		Action:     "backend.switch_requested",
+		Actor:      adminActor(r),
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details:    map[string]interface{}{"from": activeBackend(), "to": req.Backend, "drain": drain},
+	})
+	writeJSON(w, http.StatusAccepted, backendStatusResponse{Backend: activeBackend(), Pending: pending})
+}
+
+// Cancel a switch that hasn't happened yet
+func cancelBackendSwitchHandler(w http.ResponseWriter, r *http.Request) {
+	if backendSwitch.cancelPending() == nil {
+		writeErrorV2(w, http.StatusNotFound, "no_pending_switch", "No dedupe backend switch is pending")
+		return
+	}
+	writeJSON(w, http.StatusOK, backendStatusResponse{Backend: activeBackend()})
+}
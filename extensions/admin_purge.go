@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type purgeRequest struct {
+	ID int `json:"id,omitempty"`
+	// Key is the key as stored by the dedupe backend, e.g. a hash:... dedupe key, for purging
+	// without the raw id.
+	Key      string `json:"key,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type purgeResponse struct {
+	Subject string `json:"subject"`
+	// Window tells whether the id was in the current window.
+	Window bool `json:"window"`
+	// Synced lists the local snapshots rewritten without it.
+	Synced []string `json:"synced"`
+}
+
+// Purge an id from the state that still holds it to honour a deletion request: the current
+// window, its snapshots and ID set, and the duplicate webhook and reports not sent yet. Window
+// reports, rollups and history only hold counts, and ids from earlier windows were already
+// flushed. What already left the service isn't recalled: sent duplicate webhooks and reports,
+// the ID sets exported for earlier windows, and a traffic recording (RECORD_PATH), which is
+// append-only and keeps the raw ids.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"id\": 1, \"reason\": \"deletion request\"}")
+		return
+	}
+	if (req.ID <= 0) == (req.Key == "") {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_subject", "Exactly one of a positive 'id' or a 'key' is required")
+		return
+	}
+
+	remover, ok := dedup.(Remover)
+	if !ok {
+		writeErrorV2(w, http.StatusNotImplemented, "purge_unsupported", "The configured dedupe backend can't remove ids")
+		return
+	}
+
+	in := dedupeInput{id: req.ID, tenant: req.Tenant, endpoint: req.Endpoint}
+	key := req.Key
+	if key == "" {
+		key = storedKey(in)
+	}
+	removed, err := removeFromWindow(r.Context(), remover, key, in)
+	if err != nil {
+		log.Printf("Error purging ID: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "purge_failed", "Failed to purge id")
+		return
+	}
+
+	duplicates.forget(key)
+	duplicateReports.forget(key)
+	if err := duplicateHook.forget(r.Context(), key); err != nil {
+		log.Printf("Error dropping purged ID from the duplicate webhook queue: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "purge_failed", "Removed the id but failed to drop its queued duplicates")
+		return
+	}
+
+	resp := purgeResponse{Subject: purgeSubject(key), Window: removed, Synced: []string{}}
+	if syncer, ok := dedup.(Syncer); ok {
+		synced, err := syncer.Sync(r.Context())
+		if err != nil {
+			log.Printf("Error writing snapshot after purge: %v\n", err)
+			writeErrorV2(w, http.StatusInternalServerError, "purge_failed", "Removed the id but failed to rewrite the snapshot")
+			return
+		}
+		if synced {
+			resp.Synced = append(resp.Synced, "dedupe snapshot")
+		}
+	}
+
+	// The purge is audited by a hash of the stored key, so the audit log doesn't keep the id it
+	// was asked to forget while the subject can still prove the purge happened.
+	audit.record(auditEntry{
+		Action:     "purge",
+		Actor:      adminActor(r),
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details: map[string]interface{}{
+			"subject": resp.Subject,
+			"reason":  req.Reason,
+			"window":  removed,
+		},
+	})
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func purgeSubject(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
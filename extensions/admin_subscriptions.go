@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// subscriptionView is how the admin API shows a subscription: its auth only by type, secrets
+// are never returned.
+type subscriptionView struct {
+	ID        string              `json:"id"`
+	URL       string              `json:"url"`
+	Auth      string              `json:"auth,omitempty"`
+	Format    string              `json:"format,omitempty"`
+	Filters   subscriptionFilters `json:"filters"`
+	Paused    bool                `json:"paused"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+func viewSubscription(s subscription) subscriptionView {
+	view := subscriptionView{
+		ID:        s.ID,
+		URL:       s.URL,
+		Format:    s.Format,
+		Filters:   s.Filters,
+		Paused:    s.Paused,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+	}
+	if s.Auth != nil {
+		view.Auth = s.Auth.Type
+	}
+	return view
+}
+
+type subscriptionRequest struct {
+	URL string `json:"url"`
+	// Auth is raw, so an update without it keeps the stored secrets and "auth": null drops them.
+	Auth    json.RawMessage     `json:"auth"`
+	Format  string              `json:"format"`
+	Filters subscriptionFilters `json:"filters"`
+	Paused  bool                `json:"paused"`
+}
+
+// apply sets the fields of req on s.
+func (req subscriptionRequest) apply(s *subscription) error {
+	s.URL, s.Format, s.Filters, s.Paused = req.URL, req.Format, req.Filters, req.Paused
+	if req.Auth == nil {
+		return nil
+	}
+	s.Auth = nil
+	return json.Unmarshal(req.Auth, &s.Auth)
+}
+
+// requireSubscriptions rejects subscription requests while no SUBSCRIPTION_STORE is configured.
+func requireSubscriptions(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subscriptions == nil {
+			writeErrorV2(w, http.StatusNotImplemented, "subscriptions_disabled", "Subscriptions are disabled, set SUBSCRIPTION_STORE to enable them")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeSubscriptionStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSubscriptionNotFound) {
+		writeErrorV2(w, http.StatusNotFound, "subscription_not_found", "Subscription not found")
+		return
+	}
+	log.Printf("Subscription store error: %v\n", err)
+	writeErrorV2(w, http.StatusInternalServerError, "subscription_store_failed", "Failed to access subscription store")
+}
+
+func auditSubscription(r *http.Request, action string, s subscription) {
+	details := map[string]interface{}{"subscription": s.ID}
+	if s.URL != "" {
+		details["url"], details["paused"] = s.URL, s.Paused
+	}
+	audit.record(auditEntry{
+		Action:     action,
+		Actor:      adminActor(r),
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details:    details,
+	})
+}
+
+// List subscriptions
+func listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := subscriptions.List(r.Context())
+	if err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+	views := make([]subscriptionView, 0, len(list))
+	for _, s := range list {
+		views = append(views, viewSubscription(s))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"subscriptions": views})
+}
+
+// Create a subscription
+func createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"url\": \"https://example.com/hook\", \"auth\": {\"type\": \"bearer\", \"token\": \"...\"}}")
+		return
+	}
+	now := time.Now().UTC()
+	s := subscription{ID: newSubscriptionID(), CreatedAt: now, UpdatedAt: now}
+	if err := req.apply(&s); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_subscription", "'auth' must be an object like {\"type\": \"bearer\", \"token\": \"...\"}")
+		return
+	}
+	if err := s.validate(); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_subscription", err.Error())
+		return
+	}
+	if err := subscriptions.Put(r.Context(), s); err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+
+	auditSubscription(r, "subscription.create", s)
+	writeJSON(w, http.StatusCreated, viewSubscription(s))
+}
+
+// Show a subscription
+func getSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := subscriptions.Get(r.Context(), r.PathValue("subscription"))
+	if err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, viewSubscription(s))
+}
+
+// Update a subscription
+func updateSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"url\": \"https://example.com/hook\", \"paused\": true}")
+		return
+	}
+	s, err := subscriptions.Get(r.Context(), r.PathValue("subscription"))
+	if err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+	if err := req.apply(&s); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_subscription", "'auth' must be an object like {\"type\": \"bearer\", \"token\": \"...\"}")
+		return
+	}
+	s.UpdatedAt = time.Now().UTC()
+	if err := s.validate(); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_subscription", err.Error())
+		return
+	}
+	if err := subscriptions.Put(r.Context(), s); err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+
+	auditSubscription(r, "subscription.update", s)
+	writeJSON(w, http.StatusOK, viewSubscription(s))
+}
+
+// Delete a subscription
+func deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("subscription")
+	if err := subscriptions.Delete(r.Context(), id); err != nil {
+		writeSubscriptionStoreError(w, err)
+		return
+	}
+	auditSubscription(r, "subscription.delete", subscription{ID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
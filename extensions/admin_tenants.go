@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// tenantView is how the admin API shows a tenant: API keys only by their key id.
+type tenantView struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	Window     string    `json:"window,omitempty"`
+	Quota      int       `json:"quota,omitempty"`
+	KafkaTopic string    `json:"kafka_topic,omitempty"`
+	APIKeys    []string  `json:"api_keys"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func viewTenant(t tenant) tenantView {
+	view := tenantView{
+		ID:         t.ID,
+		Name:       t.Name,
+		Window:     t.Window,
+		Quota:      t.Quota,
+		KafkaTopic: t.KafkaTopic,
+		APIKeys:    []string{},
+		CreatedAt:  t.CreatedAt,
+		UpdatedAt:  t.UpdatedAt,
+	}
+	for _, hash := range t.KeyHashes {
+		view.APIKeys = append(view.APIKeys, keyID(hash))
+	}
+	return view
+}
+
+type tenantRequest struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Window     string `json:"window"`
+	Quota      int    `json:"quota"`
+	KafkaTopic string `json:"kafka_topic"`
+}
+
+type apiKeyResponse struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	// Key is only returned when it is created, like SigningSecret, which signs the key's
+	// requests under REPLAY_PROTECTION.
+	Key           string `json:"key"`
+	SigningSecret string `json:"signing_secret"`
+}
+
+// requireTenants rejects tenant requests while no TENANT_STORE is configured.
+func requireTenants(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenants == nil {
+			writeErrorV2(w, http.StatusNotImplemented, "tenants_disabled", "Tenant management is disabled, set TENANT_STORE to enable it")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeTenantStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTenantNotFound) {
+		writeErrorV2(w, http.StatusNotFound, "tenant_not_found", "Tenant not found")
+		return
+	}
+	log.Printf("Tenant store error: %v\n", err)
+	writeErrorV2(w, http.StatusInternalServerError, "tenant_store_failed", "Failed to access tenant store")
+}
+
+func auditTenant(r *http.Request, action string, details map[string]interface{}) {
+	audit.record(auditEntry{
+		Action:     action,
+		Actor:      adminActor(r),
+		RemoteAddr: clientIP(r),
+		RequestID:  requestID(r),
+		Details:    details,
+	})
+}
+
+// List tenants
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := tenants.List(r.Context())
+	if err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+	views := make([]tenantView, 0, len(list))
+	for _, t := range list {
+		views = append(views, viewTenant(t))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tenants": views})
+}
+
+// Create a tenant
+func createTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var req tenantRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"id\": \"acme\", \"window\": \"1m\", \"quota\": 1000}")
+		return
+	}
+	now := time.Now().UTC()
+	t := tenant{ID: req.ID, Name: req.Name, Window: req.Window, Quota: req.Quota, KafkaTopic: req.KafkaTopic, CreatedAt: now, UpdatedAt: now}
+	if err := t.validate(); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_tenant", err.Error())
+		return
+	}
+
+	_, err := tenants.Get(r.Context(), t.ID)
+	switch {
+	case err == nil:
+		writeErrorV2(w, http.StatusConflict, "tenant_exists", "A tenant with this id already exists")
+		return
+	case !errors.Is(err, errTenantNotFound):
+		writeTenantStoreError(w, err)
+		return
+	}
+	if err := tenants.Put(r.Context(), t); err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+	quotas.set(t.ID, t.Quota)
+
+	auditTenant(r, "tenant.create", map[string]interface{}{"tenant": t.ID, "window": t.Window, "quota": t.Quota, "kafka_topic": t.KafkaTopic})
+	writeJSON(w, http.StatusCreated, viewTenant(t))
+}
+
+// Show a tenant
+func getTenantHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := tenants.Get(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, viewTenant(t))
+}
+
+// Update a tenant
+func updateTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var req tenantRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"window\": \"1m\", \"quota\": 1000}")
+		return
+	}
+	var invalid error
+	t, err := tenants.Update(r.Context(), r.PathValue("tenant"), func(t *tenant) error {
+		t.Name, t.Window, t.Quota, t.KafkaTopic = req.Name, req.Window, req.Quota, req.KafkaTopic
+		t.UpdatedAt = time.Now().UTC()
+		invalid = t.validate()
+		return invalid
+	})
+	if invalid != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_tenant", invalid.Error())
+		return
+	}
+	if err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+	quotas.set(t.ID, t.Quota)
+
+	auditTenant(r, "tenant.update", map[string]interface{}{"tenant": t.ID, "window": t.Window, "quota": t.Quota, "kafka_topic": t.KafkaTopic})
+	writeJSON(w, http.StatusOK, viewTenant(t))
+}
+
+// Delete a tenant and its API keys
+func deleteTenantHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("tenant")
+	if err := tenants.Delete(r.Context(), id); err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+	quotas.set(id, 0)
+	auditTenant(r, "tenant.delete", map[string]interface{}{"tenant": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create an API key for a tenant
+func tenantKeysHandler(w http.ResponseWriter, r *http.Request) {
+	key, hash := newAPIKey()
+	secret := newSigningSecret()
+	t, err := tenants.Update(r.Context(), r.PathValue("tenant"), func(t *tenant) error {
+		t.KeyHashes = append(t.KeyHashes, hash)
+		if t.SigningSecrets == nil {
+			t.SigningSecrets = map[string]string{}
+		}
+		t.SigningSecrets[keyID(hash)] = secret
+		t.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+
+	auditTenant(r, "tenant.key.create", map[string]interface{}{"tenant": t.ID, "key_id": keyID(hash)})
+	writeJSON(w, http.StatusCreated, apiKeyResponse{ID: keyID(hash), Tenant: t.ID, Key: key, SigningSecret: secret})
+}
+
+// Revoke an API key of a tenant
+func tenantKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("key")
+	t, err := tenants.Update(r.Context(), r.PathValue("tenant"), func(t *tenant) error {
+		if !t.removeKey(id) {
+			return errKeyNotFound
+		}
+		t.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if errors.Is(err, errKeyNotFound) {
+		writeErrorV2(w, http.StatusNotFound, "key_not_found", "API key not found")
+		return
+	}
+	if err != nil {
+		writeTenantStoreError(w, err)
+		return
+	}
+
+	auditTenant(r, "tenant.key.revoke", map[string]interface{}{"tenant": t.ID, "key_id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticatedKey marks requests whose X-API-Key tenantFromAPIKey resolved to a tenant.
+type authenticatedKey struct{}
+
+// tenantFromAPIKey resolves the caller's tenant from its X-API-Key while a tenant store is
+// configured. The tenant is then only taken from the key, never from a caller's X-Tenant-ID.
+func tenantFromAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenants == nil {
+			next(w, r)
+			return
+		}
+
+		r.Header.Del("X-Tenant-ID")
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			id, err := tenants.TenantForKey(r.Context(), hashAPIKey(key))
+			if errors.Is(err, errTenantNotFound) {
+				auditAuthFailure(r, "api_key")
+				writeErrorV2(w, http.StatusUnauthorized, "invalid_api_key", "Unknown API key")
+				return
+			}
+			if err != nil {
+				writeTenantStoreError(w, err)
+				return
+			}
+			r.Header.Set("X-Tenant-ID", id)
+			r = r.WithContext(context.WithValue(r.Context(), authenticatedKey{}, true))
+			rateLimiter.validated(keyID(hashAPIKey(key)))
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type batchRequest struct {
+	IDs []jsonID `json:"ids"`
+}
+
+// batchResponse holds one result per submitted id, in request order: "ok", "duplicate" or "invalid".
+type batchResponse struct {
+	Results []string `json:"results"`
+	// acceptDetails is only set for callers that get verbose responses
+	*acceptDetails
+}
+
+type statsResponse struct {
+	UniqueRequestCount int    `json:"unique_request_count"`
+	Timestamp          string `json:"timestamp"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v\n", err)
+	}
+}
+
+// acceptBodyLimit is the largest body the accept handler of path reads, 0 for the v1 accept,
+// which takes its id from the query.
+func acceptBodyLimit(path string) int64 {
+	maxIDs := int64(getEnvInt("BATCH_MAX_IDS", 1000))
+	switch path {
+	case "/api/v2/verve/accept":
+		return 4096
+	case "/api/verve/accept/batch":
+		return maxIDs*24 + 1024
+	case "/api/v2/verve/accept/batch":
+		return maxIDs*24 + 2048
+	}
+	return 0
+}
+
+// Accept several ids in one request
+func acceptBatchHandler(w http.ResponseWriter, r *http.Request) {
+	maxIDs := getEnvInt("BATCH_MAX_IDS", 1000)
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, acceptBodyLimit("/api/verve/accept/batch"))).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body, expected {\"ids\": [...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxIDs {
+		http.Error(w, fmt.Sprintf("Batch must contain between 1 and %d ids", maxIDs), http.StatusBadRequest)
+		return
+	}
+
+	base := newDedupeInput(r, 0, "", nil)
+	ins := make([]dedupeInput, len(req.IDs))
+	for i, id := range req.IDs {
+		ins[i] = base
+		ins[i].id = int(id)
+	}
+
+	statuses, err := acceptStatuses(r.Context(), ins)
+	duplicateHook.recordAll(r, ins, statuses, err)
+	resp := batchResponse{Results: make([]string, len(req.IDs)), acceptDetails: callers.details(r)}
+	for i, status := range statuses {
+		if status == statusAccepted {
+			status = "ok"
+		}
+		resp.Results[i] = status
+	}
+	shardHints.set(w, ins...)
+	// A batch out of budget still answers 503, with what it did check
+	status := http.StatusOK
+	if budgetExceeded(r, err) {
+		budgetExceededTotal.WithLabelValues(r.URL.Path).Inc()
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// Report the unique id count of the current window
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	count, err := statsCounts.get(r.Context())
+	if budgetExceeded(r, err) {
+		writeBudgetExceeded(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error counting unique ids: %v\n", err)
+		http.Error(w, "Failed to count unique ids", http.StatusInternalServerError)
+		return
+	}
+	if etag, modified := statsCounts.validators(count); notModified(w, r, etag, modified) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statsResponse{
+		UniqueRequestCount: count,
+		Timestamp:          time.Now().Format(time.RFC3339),
+	})
+}
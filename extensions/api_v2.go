@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The v2 API speaks JSON in both directions; the contract is documented in Readme.md.
+
+type acceptV2Request struct {
+	ID       jsonID            `json:"id"`
+	Endpoint string            `json:"endpoint,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type batchV2Request struct {
+	IDs []jsonID `json:"ids"`
+	// Metadata applies to every id of the batch.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type acceptV2Response struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	// acceptDetails is only set for callers that get verbose responses
+	*acceptDetails
+}
+
+type batchV2Response struct {
+	Results    []acceptV2Response `json:"results"`
+	Accepted   int                `json:"accepted"`
+	Duplicates int                `json:"duplicates"`
+	Invalid    int                `json:"invalid"`
+	// Unchecked counts the ids the request's budget ran out before, which are worth retrying.
+	Unchecked int `json:"unchecked,omitempty"`
+	*acceptDetails
+}
+
+// batchV2BudgetResponse is the 503 of a batch that ran out of its budget, with the statuses
+// of the ids it did check.
+type batchV2BudgetResponse struct {
+	Error errorV2 `json:"error"`
+	batchV2Response
+}
+
+type errorV2Response struct {
+	Error errorV2 `json:"error"`
+}
+
+type errorV2 struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	statusAccepted  = "accepted"
+	statusDuplicate = "duplicate"
+	statusInvalid   = "invalid"
+	// statusUnchecked is an id of a batch that ran out of its request budget before it was
+	// checked.
+	statusUnchecked = "unchecked"
+)
+
+func writeErrorV2(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorV2Response{Error: errorV2{Code: code, Message: message}})
+}
+
+// acceptStatus accepts a single id. The error is only for telling a blown request budget apart;
+// ids that couldn't be checked are reported as duplicates either way.
+func acceptStatus(reqCtx context.Context, in dedupeInput) (string, error) {
+	if in.id <= 0 {
+		return statusInvalid, nil
+	}
+	unique, err := isUniqueID(reqCtx, in)
+	if !unique {
+		return statusDuplicate, err
+	}
+	return statusAccepted, nil
+}
+
+// acceptStatuses is acceptStatus for a whole batch, using a single AddBatch call when the
+// dedupe backend supports it. Once the request budget runs out, the ids without a result are
+// unchecked; those already checked keep their status.
+func acceptStatuses(reqCtx context.Context, ins []dedupeInput) ([]string, error) {
+	traffic.record(ins)
+	batcher, ok := dedup.(BatchAdder)
+	// A batch comes from one tenant, whose own window is checked id by id
+	if !ok || (len(ins) > 0 && tenantWindows.lookup(ins[0].tenant) != nil) {
+		statuses := make([]string, len(ins))
+		var lastErr error
+		for i, in := range ins {
+			if errors.Is(reqCtx.Err(), context.DeadlineExceeded) && in.id > 0 {
+				statuses[i] = statusUnchecked
+				continue
+			}
+			var err error
+			if statuses[i], err = acceptStatus(reqCtx, in); err != nil {
+				lastErr = err
+				if errors.Is(err, context.DeadlineExceeded) {
+					statuses[i] = statusUnchecked
+				}
+			}
+		}
+		return statuses, lastErr
+	}
+
+	statuses := make([]string, len(ins))
+	var keys []string
+	var valid []int
+	for i, in := range ins {
+		if in.id <= 0 {
+			statuses[i] = statusInvalid
+			continue
+		}
+		keys = append(keys, storedKey(in))
+		valid = append(valid, i)
+	}
+
+	start := time.Now()
+	added, err := batcher.AddBatch(reqCtx, keys)
+	scaling.observeDedupe(time.Since(start))
+	if err != nil {
+		log.Printf("Error checking IDs in dedupe store: %v\n", err)
+	}
+	unique := 0
+	for j, i := range valid {
+		// Like acceptStatus, ids that couldn't be checked are reported as duplicates, or as
+		// unchecked once the budget ran out
+		if j >= len(added) {
+			statuses[i] = statusDuplicate
+			if errors.Is(err, context.DeadlineExceeded) {
+				statuses[i] = statusUnchecked
+			}
+			continue
+		}
+		if !added[j] {
+			duplicates.record(keys[j], ins[i].tenant)
+			statuses[i] = statusDuplicate
+			continue
+		}
+		statuses[i] = statusAccepted
+		replicator.replicate(replicateAdd, keys[j])
+		recordUnique(ins[i], keys[j])
+		unique++
+	}
+	countUnique(reqCtx, unique)
+	return statuses, err
+}
+
+func acceptV2Handler(w http.ResponseWriter, r *http.Request) {
+	var req acceptV2Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, acceptBodyLimit("/api/v2/verve/accept"))).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"id\": 1}")
+		return
+	}
+	if req.ID <= 0 {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_id", "'id' must be a positive integer")
+		return
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	if req.Endpoint != "" && !endpointParam {
+		writeErrorV2(w, http.StatusBadRequest, "endpoint_disabled", "'endpoint' is disabled, register a subscription through the admin API instead")
+		return
+	}
+
+	in := newDedupeInput(r, int(req.ID), req.Endpoint, req.Metadata)
+	traffic.record([]dedupeInput{in})
+	status, err := acceptStatus(r.Context(), in)
+	if budgetExceeded(r, err) {
+		writeBudgetExceeded(w, r)
+		return
+	}
+	if status == statusDuplicate && err == nil {
+		duplicateHook.record(r, in)
+	}
+	shardHints.set(w, in)
+	writeJSON(w, http.StatusOK, acceptV2Response{ID: int(req.ID), Status: status, acceptDetails: callers.details(r)})
+
+	if status == statusAccepted && req.Endpoint != "" {
+		notifyEndpoint(req.Endpoint)
+	}
+}
+
+func acceptBatchV2Handler(w http.ResponseWriter, r *http.Request) {
+	maxIDs := getEnvInt("BATCH_MAX_IDS", 1000)
+	var req batchV2Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, acceptBodyLimit("/api/v2/verve/accept/batch"))).Decode(&req); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON object like {\"ids\": [1, 2]}")
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxIDs {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_batch_size", fmt.Sprintf("Batch must contain between 1 and %d ids", maxIDs))
+		return
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+
+	base := newDedupeInput(r, 0, "", req.Metadata)
+	ins := make([]dedupeInput, len(req.IDs))
+	for i, id := range req.IDs {
+		ins[i] = base
+		ins[i].id = int(id)
+	}
+
+	statuses, err := acceptStatuses(r.Context(), ins)
+	duplicateHook.recordAll(r, ins, statuses, err)
+	resp := batchV2Response{Results: make([]acceptV2Response, len(req.IDs)), acceptDetails: callers.details(r)}
+	for i, status := range statuses {
+		id := int(req.IDs[i])
+		resp.Results[i] = acceptV2Response{ID: id, Status: status}
+		switch status {
+		case statusAccepted:
+			resp.Accepted++
+		case statusDuplicate:
+			resp.Duplicates++
+		case statusUnchecked:
+			resp.Unchecked++
+		default:
+			resp.Invalid++
+		}
+	}
+	shardHints.set(w, ins...)
+	if budgetExceeded(r, err) {
+		budgetExceededTotal.WithLabelValues(r.URL.Path).Inc()
+		writeJSON(w, http.StatusServiceUnavailable, batchV2BudgetResponse{
+			Error:           errorV2{Code: "deadline_exceeded", Message: "Deadline exceeded, the batch didn't complete within its latency budget; retry the unchecked ids"},
+			batchV2Response: resp,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func statsV2Handler(w http.ResponseWriter, r *http.Request) {
+	count, err := statsCounts.get(r.Context())
+	if budgetExceeded(r, err) {
+		writeBudgetExceeded(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error counting unique ids: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "count_failed", "Failed to count unique ids")
+		return
+	}
+	if etag, modified := statsCounts.validators(count); notModified(w, r, etag, modified) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statsResponse{
+		UniqueRequestCount: count,
+		Timestamp:          time.Now().Format(time.RFC3339),
+	})
+}
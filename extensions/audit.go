@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time       string                 `json:"time"`
+	Action     string                 `json:"action"`
+	Actor      string                 `json:"actor"`
+	RemoteAddr string                 `json:"remote_addr,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	// Prev is the hash of the previous entry and Hash the HMAC-SHA256 of this entry's JSON
+	// without Hash under AUDIT_LOG_KEY (a plain SHA-256 without it), chaining the entries so
+	// that editing or removing one breaks every later hash.
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// storedAuditEntry is an auditEntry as read back: Details are kept as written, so that
+// re-encoding an entry reproduces the bytes its hash was computed over.
+type storedAuditEntry struct {
+	Time       string          `json:"time"`
+	Action     string          `json:"action"`
+	Actor      string          `json:"actor"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	Prev       string          `json:"prev"`
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// auditLog appends JSON lines describing admin and security relevant operations to a file.
+type auditLog struct {
+	path string
+	key  []byte
+
+	mu   sync.Mutex
+	file *os.File
+	head string
+	// size is how many bytes of the file hold complete entries.
+	size int64
+
+	failures authFailureLimit
+}
+
+// newAuditLog opens the log at path. key keys the chain, so that only who holds it can rewrite
+// the log; without a key anyone who can write the file can recompute the hashes too.
+func newAuditLog(path, key string, failuresPerMinute int) (*auditLog, error) {
+	a := &auditLog{path: path, key: []byte(key), failures: authFailureLimit{perMinute: failuresPerMinute}}
+	chain, err := a.verify(-1, nil)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !chain.Valid {
+		log.Printf("Warning: audit log %s fails verification at line %d, continuing the chain from its last entry\n", path, chain.BrokenAt)
+	}
+	a.head = chain.Head
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a.file, a.size = file, info.Size()
+	return a, nil
+}
+
+func (a *auditLog) hash(b []byte) string {
+	if len(a.key) == 0 {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.Prev = a.head
+	unsigned, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v\n", err)
+		return
+	}
+	entry.Hash = a.hash(unsigned)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v\n", err)
+		return
+	}
+	n, err := a.file.Write(append(line, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit entry: %v\n", err)
+		return
+	}
+	a.head = entry.Hash
+}
+
+// recordAuthFailure records a failed authentication unless more than AUDIT_AUTH_FAILURES_PER_MINUTE
+// already were this minute, so unauthenticated callers can't grow the log without bound. The
+// first entry of the next minute that gets through counts those that didn't.
+func (a *auditLog) recordAuthFailure(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	allowed, suppressed := a.failures.allow(time.Now())
+	if !allowed {
+		auditFailuresSuppressed.Inc()
+		return
+	}
+	if suppressed > 0 {
+		entry.Details["suppressed_before"] = suppressed
+	}
+	a.record(entry)
+}
+
+// authFailureLimit allows perMinute auth failures per wall-clock minute, none limited when
+// perMinute is 0.
+type authFailureLimit struct {
+	perMinute int
+
+	mu         sync.Mutex
+	minute     int64
+	seen       int
+	suppressed int
+}
+
+// allow reports whether another failure may be recorded, and how many weren't since the last
+// one that was.
+func (l *authFailureLimit) allow(now time.Time) (bool, int) {
+	if l.perMinute <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if minute := now.Unix() / 60; minute != l.minute {
+		l.minute, l.seen = minute, 0
+	}
+	if l.seen >= l.perMinute {
+		l.suppressed++
+		return false, 0
+	}
+	l.seen++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// auditChain is the result of verifying the log.
+type auditChain struct {
+	Valid   bool `json:"valid"`
+	Entries int  `json:"entries"`
+	// BrokenAt is the first line whose hash or link doesn't match.
+	BrokenAt int `json:"broken_at,omitempty"`
+	// Head is the hash of the last entry; recording it elsewhere also makes a truncated log
+	// detectable.
+	Head string `json:"head"`
+}
+
+// verify reads the first size bytes of the log, all of it when size is negative, checking every
+// entry's hash and link, and passes each entry to fn.
+func (a *auditLog) verify(size int64, fn func(line int, entry storedAuditEntry)) (auditChain, error) {
+	chain := auditChain{Valid: true}
+	file, err := os.Open(a.path)
+	if err != nil {
+		return chain, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if size >= 0 {
+		r = io.LimitReader(file, size)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	prev := ""
+	for line := 1; scanner.Scan(); line++ {
+		chain.Entries++
+		var entry storedAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			if chain.Valid {
+				chain.Valid, chain.BrokenAt = false, line
+			}
+			continue
+		}
+
+		hash := entry.Hash
+		entry.Hash = ""
+		unsigned, err := json.Marshal(entry)
+		if err != nil {
+			return chain, err
+		}
+		if chain.Valid && (entry.Prev != prev || a.hash(unsigned) != hash) {
+			chain.Valid, chain.BrokenAt = false, line
+		}
+		entry.Hash = hash
+		prev = hash
+		chain.Head = hash
+
+		if fn != nil {
+			fn(line, entry)
+		}
+	}
+	return chain, scanner.Err()
+}
+
+// query verifies the log like verify, up to the entries written when it is called. The log is
+// only appended to, so that prefix doesn't change while it is read, and actions recorded
+// meanwhile don't wait for the read.
+func (a *auditLog) query(fn func(line int, entry storedAuditEntry)) (auditChain, error) {
+	if a == nil {
+		return auditChain{}, errors.New("audit log is not open")
+	}
+	a.mu.Lock()
+	size := a.size
+	a.mu.Unlock()
+	return a.verify(size, fn)
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
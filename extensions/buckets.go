@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type idRange struct {
+	name     string
+	min, max int
+}
+
+// idBuckets breaks the unique count of a window down by id range or by hash bucket, so a segment
+// that stops sending traffic (e.g. one partner's id range) shows up as a zero bucket.
+type idBuckets struct {
+	ranges     []idRange
+	hashBucket int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// parseIDRanges parses a list like "1-999,1000-4999,5000-" where an open upper bound is unlimited.
+func parseIDRanges(spec string) ([]idRange, error) {
+	var ranges []idRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid id range %q", part)
+		}
+
+		r := idRange{name: part, max: int(^uint(0) >> 1)}
+		var err error
+		if r.min, err = strconv.Atoi(lo); err != nil {
+			return nil, fmt.Errorf("invalid id range %q", part)
+		}
+		if hi != "" {
+			if r.max, err = strconv.Atoi(hi); err != nil || r.max < r.min {
+				return nil, fmt.Errorf("invalid id range %q", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// newIDBuckets returns nil when neither ID_BUCKET_RANGES nor ID_HASH_BUCKETS is configured.
+func newIDBuckets(rangeSpec string, hashBuckets int) (*idBuckets, error) {
+	b := &idBuckets{hashBucket: hashBuckets, counts: map[string]int{}}
+	switch {
+	case rangeSpec != "":
+		ranges, err := parseIDRanges(rangeSpec)
+		if err != nil {
+			return nil, err
+		}
+		b.ranges = ranges
+	case hashBuckets <= 0:
+		return nil, nil
+	}
+	return b, nil
+}
+
+func (b *idBuckets) bucket(id int) string {
+	if b.ranges != nil {
+		for _, r := range b.ranges {
+			if id >= r.min && id <= r.max {
+				return r.name
+			}
+		}
+		return "other"
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(id)))
+	return strconv.Itoa(int(h.Sum32() % uint32(b.hashBucket)))
+}
+
+// record counts a unique id in its bucket.
+func (b *idBuckets) record(id int) {
+	name := b.bucket(id)
+	b.mu.Lock()
+	b.counts[name]++
+	b.mu.Unlock()
+}
+
+// retract undoes record for an id removed from the current window.
+func (b *idBuckets) retract(id int) {
+	name := b.bucket(id)
+	b.mu.Lock()
+	if b.counts[name] > 0 {
+		b.counts[name]--
+	}
+	b.mu.Unlock()
+}
+
+// flush returns the counts of the finished window, including empty buckets, and starts a new one.
+func (b *idBuckets) flush() map[string]int {
+	b.mu.Lock()
+	counts := b.counts
+	b.counts = map[string]int{}
+	b.mu.Unlock()
+
+	if b.ranges != nil {
+		for _, r := range b.ranges {
+			counts[r.name] += 0
+		}
+	} else {
+		for i := 0; i < b.hashBucket; i++ {
+			counts[strconv.Itoa(i)] += 0
+		}
+	}
+	return counts
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// requestBudget gives a request a deadline of REQUEST_BUDGET (e.g. 50ms), which its dedupe
+// calls inherit through the request context. A slow dependency then fails the request with a
+// 503 instead of holding it, and everything queued behind it, for as long as it takes.
+func requestBudget(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		budget := getEnvDuration("REQUEST_BUDGET", 0)
+		if budget <= 0 {
+			next(w, r)
+			return
+		}
+		budgetCtx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next(w, r.WithContext(budgetCtx))
+	}
+}
+
+// budgetExceeded reports whether err is r running out of its request budget.
+func budgetExceeded(r *http.Request, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+func writeBudgetExceeded(w http.ResponseWriter, r *http.Request) {
+	budgetExceededTotal.WithLabelValues(r.URL.Path).Inc()
+	const message = "Deadline exceeded, the request didn't complete within its latency budget"
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeErrorV2(w, http.StatusServiceUnavailable, "deadline_exceeded", message)
+		return
+	}
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
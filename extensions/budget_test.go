@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// partialBatches checks the first id of a batch, then runs out of time.
+type partialBatches struct{ countingDedup }
+
+func (*partialBatches) AddBatch(context.Context, []string) ([]bool, error) {
+	return []bool{true}, context.DeadlineExceeded
+}
+
+func TestBatchOutOfBudgetKeepsStatuses(t *testing.T) {
+	dedupeKey, _ = parseKeyStrategy("id")
+	old := dedup
+	dedup = &partialBatches{}
+	defer func() { dedup = old }()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/api/v2/verve/accept/batch", strings.NewReader(`{"ids": [1, 2, -3]}`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	acceptBatchV2Handler(rec, r)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", rec.Code)
+	}
+	var resp batchV2BudgetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, result := range resp.Results {
+		got = append(got, result.Status)
+	}
+	if strings.Join(got, ",") != "accepted,unchecked,invalid" || resp.Error.Code != "deadline_exceeded" || resp.Unchecked != 1 {
+		t.Errorf("got statuses %v, error %q and %d unchecked, want accepted,unchecked,invalid with deadline_exceeded", got, resp.Error.Code, resp.Unchecked)
+	}
+}
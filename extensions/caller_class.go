@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// callers tells internal callers from external ones; main replaces it with the configured one.
+// Without INTERNAL_CIDRS and INTERNAL_API_KEY_IDS every caller is external.
+var callers = &callerClassifier{verbose: "internal"}
+
+// windowOpened is when the current window started, in Unix nanoseconds.
+var windowOpened atomic.Int64
+
+// callerClassifier decides how much accept responses say. Internal callers, those from
+// INTERNAL_CIDRS or with an API key in INTERNAL_API_KEY_IDS, get the window metadata with
+// their answer; external ones keep the minimal response. VERBOSE_RESPONSES=all or none gives
+// every caller the same.
+type callerClassifier struct {
+	networks []netip.Prefix
+	keyIDs   map[string]bool
+	verbose  string
+}
+
+func newCallerClassifier(cidrs, keyIDs, verbose string) (*callerClassifier, error) {
+	if verbose != "internal" && verbose != "all" && verbose != "none" {
+		return nil, fmt.Errorf("unknown VERBOSE_RESPONSES %q, expected internal, all or none", verbose)
+	}
+	networks, err := parseCIDRList(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	c := &callerClassifier{networks: networks, keyIDs: map[string]bool{}, verbose: verbose}
+	for _, id := range strings.Split(keyIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			c.keyIDs[id] = true
+		}
+	}
+	return c, nil
+}
+
+// class is "internal" or "external". The address is the one clientIP resolved, so behind
+// TRUSTED_PROXIES the proxies themselves don't make every caller internal.
+func (c *callerClassifier) class(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" && c.keyIDs[keyID(hashAPIKey(key))] {
+		return "internal"
+	}
+	if addr, err := netip.ParseAddr(clientIP(r)); err == nil {
+		for _, network := range c.networks {
+			if network.Contains(addr.Unmap()) {
+				return "internal"
+			}
+		}
+	}
+	return "external"
+}
+
+// acceptDetails is the window metadata of a verbose accept response.
+type acceptDetails struct {
+	Window     windowInfo `json:"window"`
+	InstanceID string     `json:"instance_id"`
+	Backend    string     `json:"backend"`
+	Tenant     string     `json:"tenant,omitempty"`
+}
+
+type windowInfo struct {
+	// Start is when the window the ids were counted in opened, End when it is due to close.
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Length string `json:"length"`
+}
+
+// details returns what the accept response to r carries beyond the answer, nil for a minimal
+// response.
+func (c *callerClassifier) details(r *http.Request) *acceptDetails {
+	class := c.class(r)
+	callerRequests.WithLabelValues(class).Inc()
+	if c.verbose == "none" || (c.verbose == "internal" && class != "internal") {
+		return nil
+	}
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	start, end, length := currentWindow(tenant)
+	return &acceptDetails{
+		Window: windowInfo{
+			Start:  start.Format(time.RFC3339),
+			End:    end.Format(time.RFC3339),
+			Length: length.String(),
+		},
+		InstanceID: instanceID(),
+		Backend:    activeBackend(),
+		Tenant:     tenant,
+	}
+}
+
+// currentWindow returns when the window counting tenant's ids opened, when it is due to close
+// and its length.
+func currentWindow(tenant string) (start, end time.Time, length time.Duration) {
+	// An aligned service window closes on the minute, the first one included; other windows
+	// tick from when they started
+	length, start = time.Minute, startedAt
+	if opened := windowOpened.Load(); opened != 0 {
+		start = time.Unix(0, opened)
+	}
+	end = start.Add(time.Minute)
+	if windowsAligned() {
+		end = start.Truncate(time.Minute).Add(time.Minute)
+	}
+	if w := tenantWindows.lookup(tenant); w != nil {
+		length, start = w.interval, time.Unix(0, w.opened.Load())
+		end = start.Add(length)
+	}
+	return start, end, length
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentWindowEnd(t *testing.T) {
+	start := time.Date(2026, 10, 14, 7, 0, 30, 0, time.UTC)
+	windowOpened.Store(start.UnixNano())
+	defer windowOpened.Store(0)
+
+	// A window ticking from startup closes a minute after it opened
+	if _, end, _ := currentWindow(""); !end.Equal(start.Add(time.Minute)) {
+		t.Errorf("got end %v, want %v", end, start.Add(time.Minute))
+	}
+
+	// An aligned window closes on the next minute
+	idHash = &idHasher{}
+	defer func() { idHash = nil }()
+	if _, end, _ := currentWindow(""); !end.Equal(start.Truncate(time.Minute).Add(time.Minute)) {
+		t.Errorf("got end %v for an aligned window, want the next minute", end)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// windowClock turns reporter ticks into window boundaries that only move forward. The ticker
+// runs on the monotonic clock, but reports are timestamped with the wall clock, which NTP
+// corrections and VM pauses move on their own. Comparing the wall and monotonic time between
+// two ticks shows such a jump; a boundary the wall clock would put at or before the previous
+// one is placed after it instead, by the monotonic time that passed, so windows never overlap
+// or have a negative length.
+type windowClock struct {
+	interval  time.Duration
+	tolerance time.Duration
+
+	// last is the previous boundary as published, taken the time (with its monotonic reading)
+	// it was taken at.
+	last  time.Time
+	taken time.Time
+	// skewed is set when the last boundary saw the wall clock jump.
+	skewed bool
+}
+
+func newWindowClock(start time.Time, interval, tolerance time.Duration) *windowClock {
+	return &windowClock{interval: interval, tolerance: tolerance, last: start.Round(0), taken: start}
+}
+
+// boundary returns the end of the window closing at the tick now.
+func (c *windowClock) boundary(now time.Time) time.Time {
+	elapsed := now.Sub(c.taken)
+	skew := now.Round(0).Sub(c.taken.Round(0)) - elapsed
+	clockSkew.Set(skew.Seconds())
+	c.skewed = skew > c.tolerance || skew < -c.tolerance
+	switch {
+	case skew > c.tolerance:
+		clockSkewEvents.WithLabelValues("forward").Inc()
+		log.Printf("Wall clock jumped forward by %v during the window\n", skew.Round(time.Millisecond))
+	case skew < -c.tolerance:
+		clockSkewEvents.WithLabelValues("backward").Inc()
+		log.Printf("Wall clock jumped back by %v during the window\n", (-skew).Round(time.Millisecond))
+	}
+	// Ticks that couldn't be delivered are dropped, so a paused process closes one long window
+	if elapsed > c.interval*3/2 {
+		clockSkewEvents.WithLabelValues("late").Inc()
+		log.Printf("Window closed %v late, the process was paused or starved\n", (elapsed - c.interval).Round(time.Millisecond))
+	}
+
+	end := now.Round(0)
+	// Timestamps have second resolution, so the boundary has to be in a later second
+	if !end.Truncate(time.Second).After(c.last.Truncate(time.Second)) {
+		end = c.last.Add(max(elapsed, time.Second))
+		windowBoundariesAdjusted.Inc()
+		log.Printf("Window ending at %s by the wall clock would overlap the previous one ending %s, ending it at %s\n",
+			now.Format(time.RFC3339), c.last.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	c.last, c.taken = end, now
+	return end
+}
+
+// untilMinute is how long after now the next wall-clock minute starts.
+func untilMinute(now time.Time) time.Duration {
+	return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+}
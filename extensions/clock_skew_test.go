@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUntilMinute(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 37, 500_000_000, time.UTC)
+	if got := untilMinute(now); got != 22500*time.Millisecond {
+		t.Errorf("got %v until the minute, want 22.5s", got)
+	}
+	if got := untilMinute(now.Truncate(time.Minute)); got != time.Minute {
+		t.Errorf("got %v on the minute, want the next one a minute away", got)
+	}
+}
+
+func TestWindowClockSkewed(t *testing.T) {
+	start := time.Now()
+	c := newWindowClock(start, time.Minute, time.Second)
+	if c.boundary(start.Add(time.Minute)); c.skewed {
+		t.Error("a tick without a jump counted as skewed")
+	}
+	// The wall clock can't be moved here; a negative tolerance takes any tick for a jump
+	c.tolerance = -time.Nanosecond
+	if c.boundary(start.Add(2 * time.Minute)); !c.skewed {
+		t.Error("a jump beyond the tolerance didn't mark the clock skewed")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaCompression is the codec of every Kafka writer (KAFKA_COMPRESSION).
+var kafkaCompression kafka.Compression
+
+// parseKafkaCompression parses KAFKA_COMPRESSION: none, gzip, snappy, lz4 or zstd.
+func parseKafkaCompression(spec string) (kafka.Compression, error) {
+	switch spec {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown Kafka compression %q, expected none, gzip, snappy, lz4 or zstd", spec)
+	}
+}
+
+// decompressBody decodes batch bodies sent with Content-Encoding zstd or gzip. The handler's
+// body limit applies to the decoded bytes, so a small body can't expand past it; zstd frames
+// asking for a window over 8 MiB are refused before anything is allocated for them.
+func decompressBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body io.ReadCloser
+		var err error
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+			next(w, r)
+			return
+		case "zstd":
+			var d *zstd.Decoder
+			d, err = zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20), zstd.WithDecoderLowmem(true))
+			if err == nil {
+				body = d.IOReadCloser()
+			}
+		case "gzip":
+			body, err = gzip.NewReader(r.Body)
+		default:
+			w.Header().Set("Accept-Encoding", "zstd, gzip")
+			writeBodyError(w, r, http.StatusUnsupportedMediaType, "unsupported_encoding", fmt.Sprintf("Content-Encoding %q is not supported, use zstd or gzip", encoding))
+			return
+		}
+		if err != nil {
+			writeBodyError(w, r, http.StatusBadRequest, "invalid_body", "Failed to decompress the request body")
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		next(w, r)
+	}
+}
+
+func writeBodyError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeErrorV2(w, status, code, message)
+		return
+	}
+	http.Error(w, message, status)
+}
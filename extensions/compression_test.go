@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressedBatchBodies(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	post := func(encoding string, body []byte) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest(http.MethodPost, h.Server.URL+"/api/v2/verve/accept/batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp, decoded
+	}
+
+	enc, _ := zstd.NewWriter(nil)
+	zstdBody := enc.EncodeAll([]byte(`{"ids": [1, 2]}`), nil)
+	var gzipBody bytes.Buffer
+	gz := gzip.NewWriter(&gzipBody)
+	gz.Write([]byte(`{"ids": [2, 3]}`))
+	gz.Close()
+
+	if resp, body := post("zstd", zstdBody); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, %v for a zstd body, want 200", resp.StatusCode, body)
+	}
+	if resp, body := post("gzip", gzipBody.Bytes()); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, %v for a gzip body, want 200", resp.StatusCode, body)
+	}
+	if err := expectCount(h.Client, 3); err != nil {
+		t.Error(err)
+	}
+
+	if resp, _ := post("br", []byte("x")); resp.StatusCode != http.StatusUnsupportedMediaType || resp.Header.Get("Accept-Encoding") != "zstd, gzip" {
+		t.Errorf("got %d, Accept-Encoding %q for a br body, want 415 naming the supported encodings", resp.StatusCode, resp.Header.Get("Accept-Encoding"))
+	}
+	if resp, _ := post("gzip", []byte(`{"ids": [4]}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d for a body that isn't gzip, want 400", resp.StatusCode)
+	}
+}
+
+func TestParseKafkaCompression(t *testing.T) {
+	if c, err := parseKafkaCompression("zstd"); err != nil || c == 0 {
+		t.Errorf("zstd: got %v, %v", c, err)
+	}
+	if c, err := parseKafkaCompression(""); err != nil || c != 0 {
+		t.Errorf("the default: got %v, %v, want none", c, err)
+	}
+	if _, err := parseKafkaCompression("brotli"); err == nil {
+		t.Error("an unknown codec was accepted")
+	}
+}
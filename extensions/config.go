@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// clusterConfig holds settings shared by all instances through the Coordinator. Environment
+// variables set on the instance take precedence over it.
+var clusterConfig map[string]string
+
+// lookupEnv returns the value of key from the environment, falling back to the cluster configuration.
+func lookupEnv(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return clusterConfig[key]
+}
+
+// getEnv returns the value of the environment variable key, or fallback if it is unset.
+func getEnv(key, fallback string) string {
+	if value := lookupEnv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt parses the environment variable key as an int, falling back on unset or invalid values.
+func getEnvInt(key string, fallback int) int {
+	value := lookupEnv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %d\n", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvDuration parses the environment variable key as a time.Duration (e.g. "30s"),
+// falling back on unset or invalid values.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := lookupEnv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v\n", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool parses the environment variable key as a bool, falling back on unset or invalid values.
+func getEnvBool(key string, fallback bool) bool {
+	value := lookupEnv(key)
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %t\n", value, key, fallback)
+		return fallback
+	}
+	return b
+}
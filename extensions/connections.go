@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// connTracker follows the connections of one listener through http.Server.ConnState, for the
+// connection gauges and the per-connection request and lifetime histograms.
+type connTracker struct {
+	addr string
+
+	mu    sync.Mutex
+	conns map[net.Conn]*connStats
+}
+
+type connStats struct {
+	opened   time.Time
+	state    http.ConnState
+	requests int
+}
+
+func newConnTracker(addr string) *connTracker {
+	return &connTracker{addr: addr, conns: map[net.Conn]*connStats{}}
+}
+
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.conns[c]
+	if !ok {
+		if state != http.StateNew {
+			return
+		}
+		stats = &connStats{opened: time.Now(), state: state}
+		t.conns[c] = stats
+		connectionsAccepted.WithLabelValues(t.addr).Inc()
+		openConnections.WithLabelValues(t.addr, state.String()).Inc()
+		return
+	}
+
+	openConnections.WithLabelValues(t.addr, stats.state.String()).Dec()
+	switch state {
+	case http.StateActive:
+		stats.requests++
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+		connectionsClosed.WithLabelValues(t.addr).Inc()
+		connectionRequests.Observe(float64(stats.requests))
+		connectionLifetime.Observe(time.Since(stats.opened).Seconds())
+		return
+	}
+	stats.state = state
+	openConnections.WithLabelValues(t.addr, state.String()).Inc()
+}
+
+// limitListener accepts at most max connections at a time. While it is at the limit it stops
+// accepting, so new connections wait in the kernel's accept queue; how long Accept waited for a
+// free slot is recorded as the accept wait.
+type limitListener struct {
+	net.Listener
+	addr  string
+	slots chan struct{}
+}
+
+func newLimitListener(l net.Listener, addr string, max int) *limitListener {
+	connectionLimit.WithLabelValues(addr).Set(float64(max))
+	return &limitListener{Listener: l, addr: addr, slots: make(chan struct{}, max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	var wait time.Duration
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		connectionLimitReached.WithLabelValues(l.addr).Inc()
+		start := time.Now()
+		l.slots <- struct{}{}
+		wait = time.Since(start)
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	acceptWait.WithLabelValues(l.addr).Observe(wait.Seconds())
+	return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// quicLimitListener is limitListener for QUIC: it accepts at most max connections at a time,
+// leaving new ones in quic-go's accept queue, and frees a slot when a connection ends.
+type quicLimitListener struct {
+	http3.QUICEarlyListener
+	addr  string
+	slots chan struct{}
+}
+
+func newQUICLimitListener(l http3.QUICEarlyListener, addr string, max int) *quicLimitListener {
+	connectionLimit.WithLabelValues(addr).Set(float64(max))
+	return &quicLimitListener{QUICEarlyListener: l, addr: addr, slots: make(chan struct{}, max)}
+}
+
+func (l *quicLimitListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	var wait time.Duration
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		connectionLimitReached.WithLabelValues(l.addr).Inc()
+		start := time.Now()
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait = time.Since(start)
+	}
+	conn, err := l.QUICEarlyListener.Accept(ctx)
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	acceptWait.WithLabelValues(l.addr).Observe(wait.Seconds())
+	go func() {
+		<-conn.Context().Done()
+		<-l.slots
+	}()
+	return conn, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// fakeQUICConn is a connection that ends when its context is cancelled.
+type fakeQUICConn struct {
+	quic.EarlyConnection
+	ctx context.Context
+}
+
+func (c fakeQUICConn) Context() context.Context { return c.ctx }
+
+// fakeQUICListener hands out the connections sent on conns.
+type fakeQUICListener struct{ conns chan quic.EarlyConnection }
+
+func (l fakeQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+func (fakeQUICListener) Addr() net.Addr { return &net.UDPAddr{} }
+func (fakeQUICListener) Close() error   { return nil }
+
+func TestQUICLimitListener(t *testing.T) {
+	inner := fakeQUICListener{conns: make(chan quic.EarlyConnection, 2)}
+	l := newQUICLimitListener(inner, "udp-test", 1)
+	first, closeFirst := context.WithCancel(context.Background())
+	inner.conns <- fakeQUICConn{ctx: first}
+	inner.conns <- fakeQUICConn{ctx: context.Background()}
+
+	if _, err := l.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// At the limit, the second connection waits until the first one ends
+	waitCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Accept(waitCtx); err == nil {
+		t.Fatal("accepted a connection over the limit")
+	}
+	closeFirst()
+	acceptCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := l.Accept(acceptCtx); err != nil {
+		t.Errorf("got %v once the first connection ended, want the second accepted", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Coordinator provides the cluster-wide primitives shared by all server instances: leader
+// election for the window reporter, distributed locks and shared configuration.
+type Coordinator interface {
+	// Campaign competes for leadership until ctx is done, keeping IsLeader up to date.
+	Campaign(ctx context.Context)
+	// IsLeader reports whether this instance currently holds leadership.
+	IsLeader() bool
+	// Lock acquires the named cluster-wide lock, blocking until it is held or ctx is done.
+	Lock(ctx context.Context, name string) (unlock func(), err error)
+	// Config returns the cluster configuration shared by all instances.
+	Config(ctx context.Context) (map[string]string, error)
+	Close() error
+}
+
+func newCoordinator(kind string) (Coordinator, error) {
+	ttl := getEnvDuration("LEADER_TTL", 10*time.Second)
+	switch kind {
+	case "none":
+		return localCoordinator{}, nil
+	case "redis":
+		return &redisCoordinator{client: redisDB, id: instanceID(), ttl: ttl}, nil
+	case "etcd":
+		endpoints := strings.Split(getEnv("ETCD_ENDPOINTS", "localhost:2379"), ",")
+		return newEtcdCoordinator(endpoints, ttl)
+	default:
+		return nil, fmt.Errorf("unknown coordinator %q", kind)
+	}
+}
+
+// instanceID identifies this server instance within the cluster.
+func instanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// localCoordinator is used when a single instance runs on its own: it is always the leader.
+type localCoordinator struct{}
+
+func (localCoordinator) Campaign(ctx context.Context) {}
+
+func (localCoordinator) IsLeader() bool { return true }
+
+func (localCoordinator) Lock(ctx context.Context, name string) (func(), error) {
+	return func() {}, nil
+}
+
+func (localCoordinator) Config(ctx context.Context) (map[string]string, error) {
+	return nil, nil
+}
+
+func (localCoordinator) Close() error { return nil }
+
+// leaderFlag is embedded by coordinators to track leadership.
+type leaderFlag struct {
+	leader atomic.Bool
+}
+
+func (f *leaderFlag) IsLeader() bool {
+	return f.leader.Load()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	etcdLeaderPrefix = "/verve/leader"
+	etcdLockPrefix   = "/verve/locks/"
+	etcdConfigPrefix = "/verve/config/"
+)
+
+// etcdCoordinator implements the Coordinator on top of etcd's lease based election and
+// mutex recipes, for Kubernetes-native deployments that already run an etcd-compatible store.
+type etcdCoordinator struct {
+	leaderFlag
+	client *clientv3.Client
+	id     string
+	ttl    time.Duration
+}
+
+func newEtcdCoordinator(endpoints []string, ttl time.Duration) (*etcdCoordinator, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdCoordinator{client: client, id: instanceID(), ttl: ttl}, nil
+}
+
+func (c *etcdCoordinator) session(ctx context.Context) (*concurrency.Session, error) {
+	return concurrency.NewSession(c.client,
+		concurrency.WithTTL(int(c.ttl.Seconds())),
+		concurrency.WithContext(ctx),
+	)
+}
+
+func (c *etcdCoordinator) Campaign(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := c.campaignOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("etcd election failed: %v. Retrying in %v...", err, c.ttl)
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.ttl):
+			}
+		}
+	}
+}
+
+// campaignOnce waits to be elected and holds leadership until the session is lost.
+func (c *etcdCoordinator) campaignOnce(ctx context.Context) error {
+	session, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, etcdLeaderPrefix)
+	if err := election.Campaign(ctx, c.id); err != nil {
+		return err
+	}
+	c.leader.Store(true)
+	log.Printf("Leadership changed, instance %s leader: true", c.id)
+
+	select {
+	case <-ctx.Done():
+		election.Resign(context.Background())
+	case <-session.Done():
+	}
+	c.leader.Store(false)
+	log.Printf("Leadership changed, instance %s leader: false", c.id)
+	return nil
+}
+
+func (c *etcdCoordinator) Lock(ctx context.Context, name string) (func(), error) {
+	session, err := c.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := concurrency.NewMutex(session, etcdLockPrefix+name)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return func() {
+		mutex.Unlock(context.Background())
+		session.Close()
+	}, nil
+}
+
+func (c *etcdCoordinator) Config(ctx context.Context) (map[string]string, error) {
+	resp, err := c.client.Get(ctx, etcdConfigPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		config[strings.TrimPrefix(string(kv.Key), etcdConfigPrefix)] = string(kv.Value)
+	}
+	return config, nil
+}
+
+func (c *etcdCoordinator) Close() error {
+	return c.client.Close()
+}
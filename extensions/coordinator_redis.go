@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisLeaderKey     = "verve:leader"
+	redisLockPrefix    = "verve:lock:"
+	redisClusterConfig = "verve:config"
+)
+
+// Extend a key's TTL only while we still own it
+var redisRenewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Delete a key only while we still own it
+var redisReleaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// redisCoordinator implements leader election and locks with SET NX PX keys owned by a token.
+type redisCoordinator struct {
+	leaderFlag
+	client *redis.Client
+	id     string
+	ttl    time.Duration
+}
+
+func (c *redisCoordinator) Campaign(ctx context.Context) {
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		leader := c.acquire(ctx, redisLeaderKey, c.id)
+		if leader != c.leader.Swap(leader) {
+			log.Printf("Leadership changed, instance %s leader: %t", c.id, leader)
+		}
+
+		select {
+		case <-ctx.Done():
+			redisReleaseScript.Run(context.Background(), c.client, []string{redisLeaderKey}, c.id)
+			c.leader.Store(false)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire takes key for token, or renews it if token already holds it.
+func (c *redisCoordinator) acquire(ctx context.Context, key, token string) bool {
+	ok, err := c.client.SetNX(ctx, key, token, c.ttl).Result()
+	if err != nil {
+		log.Printf("Error acquiring %s in Redis: %v\n", key, err)
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	renewed, err := redisRenewScript.Run(ctx, c.client, []string{key}, token, c.ttl.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("Error renewing %s in Redis: %v\n", key, err)
+		return false
+	}
+	return renewed == 1
+}
+
+func (c *redisCoordinator) Lock(ctx context.Context, name string) (func(), error) {
+	key := redisLockPrefix + name
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	for {
+		ok, err := c.client.SetNX(ctx, key, token, c.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			renewCtx, stop := context.WithCancel(context.Background())
+			go c.renew(renewCtx, key, token)
+			return func() {
+				stop()
+				redisReleaseScript.Run(context.Background(), c.client, []string{key}, token)
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// renew extends a held lock every third of its TTL until ctx is done, so a holder that runs
+// longer than the TTL doesn't lose it to another instance halfway.
+func (c *redisCoordinator) renew(ctx context.Context, key, token string) {
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewed, err := redisRenewScript.Run(ctx, c.client, []string{key}, token, c.ttl.Milliseconds()).Int()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error renewing %s in Redis: %v\n", key, err)
+			continue
+		}
+		if renewed == 0 && ctx.Err() == nil {
+			log.Printf("Lost %s, it expired before it was renewed\n", key)
+			return
+		}
+	}
+}
+
+func (c *redisCoordinator) Config(ctx context.Context) (map[string]string, error) {
+	return c.client.HGetAll(ctx, redisClusterConfig).Result()
+}
+
+func (c *redisCoordinator) Close() error { return nil }
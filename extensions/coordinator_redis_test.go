@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisLockRenewed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	c := &redisCoordinator{client: client, id: "a", ttl: 60 * time.Millisecond}
+
+	unlock, err := c.Lock(context.Background(), "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// miniredis only expires keys when told to, so a short TTL shows whether it was extended
+	key := redisLockPrefix + "topic"
+	mr.SetTTL(key, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if ttl := mr.TTL(key); ttl != c.ttl {
+		t.Errorf("got TTL %v while the lock is held, want it renewed to %v", ttl, c.ttl)
+	}
+	unlock()
+	if mr.Exists(key) {
+		t.Error("the lock wasn't released")
+	}
+}
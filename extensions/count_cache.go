@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// countCache serves the window count to endpoint notifications and the stats endpoints. Every
+// accepted request with an endpoint, or dashboard poll, would otherwise run a full count against
+// the dedupe backend; with the cache it is at most one count per ttl, shared by the requests
+// that arrive while it runs.
+type countCache struct {
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.Mutex
+	count   int
+	expires time.Time
+	// window counts the windows this instance has seen flushed, so a count read before a flush
+	// isn't cached after it. changed is when the count last changed, for the Last-Modified of
+	// the stats responses.
+	window  uint64
+	changed time.Time
+}
+
+func newCountCache(ttl time.Duration) *countCache {
+	return &countCache{ttl: ttl}
+}
+
+func (c *countCache) get(ctx context.Context) (int, error) {
+	if c.ttl <= 0 {
+		count, err := dedup.Count(ctx)
+		if err == nil {
+			c.mu.Lock()
+			c.observe(count)
+			c.mu.Unlock()
+		}
+		return count, err
+	}
+
+	c.mu.Lock()
+	if time.Now().Before(c.expires) {
+		count := c.count
+		c.mu.Unlock()
+		return count, nil
+	}
+	window := c.window
+	c.mu.Unlock()
+
+	// Keyed by window, so requests after an invalidate don't share a count read before it
+	v, err, _ := c.group.Do(strconv.FormatUint(window, 10), func() (interface{}, error) {
+		count, err := dedup.Count(ctx)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		// A count read across an invalidate may be the old window's, so it isn't cached
+		if c.window == window {
+			c.observe(count)
+			c.expires = time.Now().Add(c.ttl)
+		}
+		c.mu.Unlock()
+		return count, nil
+	})
+	return v.(int), err
+}
+
+// observe records a freshly read count. c.mu is held.
+func (c *countCache) observe(count int) {
+	if count != c.count || c.changed.IsZero() {
+		c.changed = time.Now()
+	}
+	c.count = count
+}
+
+// invalidate drops the cached count once the window was flushed, so notifications never carry
+// the previous window's count.
+func (c *countCache) invalidate() {
+	c.mu.Lock()
+	c.expires = time.Time{}
+	c.window++
+	c.changed = time.Now()
+	c.mu.Unlock()
+}
+
+// validators returns an ETag and Last-Modified time for a response carrying count. The ETag is
+// weak since the response timestamp changes while the count doesn't, and names the window by
+// when it started, so it survives a restart and matches across instances in aligned windows.
+func (c *countCache) validators(count int) (string, time.Time) {
+	start, _, _ := currentWindow("")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf(`W/"%d-%d"`, start.Unix(), count), c.changed
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countingDedup counts its Count calls; a count waits for release while it is set.
+type countingDedup struct {
+	count   int
+	calls   int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *countingDedup) Add(context.Context, string) (bool, error) { return true, nil }
+func (d *countingDedup) Flush(context.Context) (int, error)        { return d.count, nil }
+func (d *countingDedup) Count(context.Context) (int, error) {
+	d.calls++
+	if d.release != nil {
+		d.started <- struct{}{}
+		<-d.release
+	}
+	return d.count, nil
+}
+
+func TestCountCacheInvalidate(t *testing.T) {
+	fake := &countingDedup{count: 7, started: make(chan struct{}), release: make(chan struct{})}
+	old := dedup
+	dedup = fake
+	defer func() { dedup = old }()
+	c := newCountCache(time.Hour)
+
+	// A count still running when the window is flushed isn't cached for the next window
+	done := make(chan int)
+	go func() {
+		count, _ := c.get(context.Background())
+		done <- count
+	}()
+	<-fake.started
+	c.invalidate()
+	fake.release <- struct{}{}
+	if count := <-done; count != 7 {
+		t.Fatalf("got count %d, want 7", count)
+	}
+
+	fake.release, fake.count = nil, 0
+	if count, _ := c.get(context.Background()); count != 0 || fake.calls != 2 {
+		t.Errorf("got count %d after %d counts, want 0 from a second count", count, fake.calls)
+	}
+	c.get(context.Background())
+	if fake.calls != 2 {
+		t.Errorf("got %d counts, want the second one cached", fake.calls)
+	}
+}
+
+func TestCountCacheValidators(t *testing.T) {
+	start := time.Date(2026, 10, 14, 7, 0, 0, 0, time.UTC)
+	windowOpened.Store(start.UnixNano())
+	defer windowOpened.Store(0)
+
+	etag, _ := newCountCache(0).validators(42)
+	if want := `W/"` + strconv.FormatInt(start.Unix(), 10) + `-42"`; etag != want {
+		t.Errorf("got ETag %s, want %s", etag, want)
+	}
+}
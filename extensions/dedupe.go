@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Deduplicator records the ids seen in the current reporting window.
+type Deduplicator interface {
+	// Add records id and reports whether it is the first time id was seen in the current window.
+	Add(ctx context.Context, id string) (bool, error)
+	// Count returns the number of unique ids in the current window.
+	Count(ctx context.Context) (int, error)
+	// Flush returns the final count of the current window and starts a new one.
+	Flush(ctx context.Context) (int, error)
+}
+
+// backgroundRunner is implemented by deduplicators that need a background task, which the
+// lifecycle manager runs until shutdown.
+type backgroundRunner interface {
+	Run(ctx context.Context) error
+}
+
+// Remover is implemented by deduplicators that can retract an id from the current window.
+type Remover interface {
+	// Remove forgets id and reports whether it was present in the current window.
+	Remove(ctx context.Context, id string) (bool, error)
+}
+
+// Syncer is implemented by deduplicators that keep the window in local files between writes,
+// so that a purge can write its removal out right away.
+type Syncer interface {
+	// Sync writes the current window out and reports whether there was anything to write to.
+	Sync(ctx context.Context) (bool, error)
+}
+
+// MemoryReporter is implemented by deduplicators that keep the window in this process's memory.
+type MemoryReporter interface {
+	// MemoryBytes estimates the memory the current window takes up.
+	MemoryBytes() uint64
+}
+
+// BatchAdder is implemented by deduplicators that can add many ids in fewer round trips than
+// one Add per id.
+type BatchAdder interface {
+	// AddBatch records ids and reports, per id, whether it was seen for the first time. On an
+	// error it still reports the leading ids whose result is known, which may be none.
+	AddBatch(ctx context.Context, ids []string) ([]bool, error)
+}
+
+// Lister is implemented by deduplicators that can list the ids of the current window, so a
+// backend switch can drain them into the next backend.
+type Lister interface {
+	// Each calls fn with every id of the current window, stopping at the first error.
+	Each(ctx context.Context, fn func(id string) error) error
+}
+
+// sharedBackends are the dedupe backends whose state is shared by all server instances.
+var sharedBackends = map[string]bool{
+	"redis":     true,
+	"memcached": true,
+	"dynamodb":  true,
+	"postgres":  true,
+}
+
+func newDeduplicator(backend string) (Deduplicator, error) {
+	switch backend {
+	case "redis":
+		if shards := getEnv("REDIS_SHARDS", ""); shards != "" {
+			ring, err := newRedisRing(strings.Split(shards, ","))
+			if err != nil {
+				return nil, err
+			}
+			d := &redisDeduplicator{client: ring, ttl: 1 * time.Minute, pipelineSize: getEnvInt("REDIS_PIPELINE_SIZE", 100)}
+			return d, d.setLayout(getEnv("REDIS_LAYOUT", "keys"), len(ring.Options().Addrs))
+		}
+		d := &redisDeduplicator{client: redisDB, ttl: 1 * time.Minute, pipelineSize: getEnvInt("REDIS_PIPELINE_SIZE", 100), replicas: replicas}
+		return d, d.setLayout(getEnv("REDIS_LAYOUT", "keys"), 1)
+	case "cuckoo":
+		return newCuckooDeduplicator(getEnvInt("CUCKOO_CAPACITY", 1<<20)), nil
+	case "roaring":
+		return newRoaringDeduplicator(
+			getEnv("ROARING_SNAPSHOT_PATH", ""),
+			getEnvDuration("ROARING_SNAPSHOT_INTERVAL", 10*time.Second),
+			uint64(getEnvInt("ROARING_MEMORY_BUDGET_MB", 0))<<20,
+		)
+	case "bolt":
+		return newBoltDeduplicator(getEnv("BOLT_PATH", "dedupe.db"))
+	case "memcached":
+		servers := strings.Split(getEnv("MEMCACHED_SERVERS", "localhost:11211"), ",")
+		return newMemcachedDeduplicator(servers, 2*time.Minute)
+	case "dynamodb":
+		return newDynamoDeduplicator(ctx,
+			getEnv("DYNAMODB_TABLE", "verve-dedupe"),
+			getEnv("DYNAMODB_ENDPOINT", ""),
+			getEnvBool("DYNAMODB_CREATE_TABLE", false),
+			2*time.Minute,
+		)
+	case "postgres":
+		return newPostgresDeduplicator(ctx, getEnv("POSTGRES_DSN", ""), getEnv("POSTGRES_TABLE", "verve_ids"))
+	default:
+		return nil, fmt.Errorf("unknown dedupe backend %q", backend)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltWindowBucket = []byte("window")
+
+// boltDeduplicator keeps the current window in an embedded bbolt database, so a single-instance
+// deployment keeps its dedupe state across restarts without running Redis.
+type boltDeduplicator struct {
+	db *bolt.DB
+}
+
+func newBoltDeduplicator(path string) (*boltDeduplicator, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltWindowBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDeduplicator{db: db}, nil
+}
+
+func (d *boltDeduplicator) Add(_ context.Context, id string) (bool, error) {
+	var unique bool
+	// Batch coalesces concurrent writers into a single fsync
+	err := d.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltWindowBucket)
+		if b.Get([]byte(id)) != nil {
+			unique = false
+			return nil
+		}
+		unique = true
+		return b.Put([]byte(id), []byte{1})
+	})
+	return unique, err
+}
+
+func (d *boltDeduplicator) Remove(_ context.Context, id string) (bool, error) {
+	var found bool
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltWindowBucket)
+		found = b.Get([]byte(id)) != nil
+		if !found {
+			return nil
+		}
+		return b.Delete([]byte(id))
+	})
+	return found, err
+}
+
+func (d *boltDeduplicator) Count(_ context.Context) (int, error) {
+	var count int
+	err := d.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(boltWindowBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+func (d *boltDeduplicator) Each(_ context.Context, fn func(id string) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWindowBucket).ForEach(func(k, _ []byte) error {
+			return fn(string(k))
+		})
+	})
+}
+
+func (d *boltDeduplicator) Flush(_ context.Context) (int, error) {
+	var count int
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		count = tx.Bucket(boltWindowBucket).Stats().KeyN
+		if err := tx.DeleteBucket(boltWindowBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(boltWindowBucket)
+		return err
+	})
+	return count, err
+}
+
+func (d *boltDeduplicator) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// canaryDeduplicator answers CANARY_PERCENT of the keys from a canary backend (CANARY_BACKEND)
+// to try it on real traffic. The slice is picked by key hash, so an id always goes to the same
+// backend and keeps being deduplicated. The primary still sees every key and stays the
+// source of the window count, which keeps a rollback to it lossless; for the canary slice both
+// are asked side by side and their decisions and latencies compared in metrics. A failing
+// canary falls back to the primary's decision, it never fails a request.
+type canaryDeduplicator struct {
+	primary Deduplicator
+	canary  Deduplicator
+	percent uint64
+}
+
+func newCanaryDeduplicator(primary, canary Deduplicator, percent int) *canaryDeduplicator {
+	return &canaryDeduplicator{primary: primary, canary: canary, percent: uint64(percent)}
+}
+
+func (d *canaryDeduplicator) canaried(key string) bool {
+	return xxhash.Sum64String(key)%100 < d.percent
+}
+
+// timedAdd adds key to backend, observing the latency under role.
+func timedAdd(ctx context.Context, backend Deduplicator, role, key string) (bool, error) {
+	start := time.Now()
+	unique, err := backend.Add(ctx, key)
+	canaryAddLatency.WithLabelValues(role).Observe(time.Since(start).Seconds())
+	return unique, err
+}
+
+func (d *canaryDeduplicator) Add(ctx context.Context, key string) (bool, error) {
+	if !d.canaried(key) {
+		return timedAdd(ctx, d.primary, "primary", key)
+	}
+
+	var canaryUnique bool
+	var canaryErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		canaryUnique, canaryErr = timedAdd(ctx, d.canary, "canary", key)
+	}()
+	unique, err := timedAdd(ctx, d.primary, "primary", key)
+	<-done
+	if err != nil {
+		return unique, err
+	}
+	return d.decide(unique, canaryUnique, canaryErr), nil
+}
+
+// decide compares the decisions on a canaried key and returns the one to answer with.
+func (d *canaryDeduplicator) decide(primaryUnique, canaryUnique bool, canaryErr error) bool {
+	switch {
+	case canaryErr != nil:
+		canaryDecisions.WithLabelValues("canary_error").Inc()
+		return primaryUnique
+	case primaryUnique == canaryUnique:
+		canaryDecisions.WithLabelValues("match").Inc()
+	case canaryUnique:
+		canaryDecisions.WithLabelValues("canary_unique").Inc()
+	default:
+		canaryDecisions.WithLabelValues("canary_duplicate").Inc()
+	}
+	return canaryUnique
+}
+
+// AddBatch sends the whole batch to the primary and the canary slice to the canary at the
+// same time, using AddBatch wherever a backend has it.
+func (d *canaryDeduplicator) AddBatch(ctx context.Context, keys []string) ([]bool, error) {
+	var canaryKeys []string
+	var canaryAt []int
+	for i, key := range keys {
+		if d.canaried(key) {
+			canaryKeys = append(canaryKeys, key)
+			canaryAt = append(canaryAt, i)
+		}
+	}
+
+	var canaryAdded []bool
+	var canaryErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if len(canaryKeys) > 0 {
+			canaryAdded, canaryErr = timedAddBatch(ctx, d.canary, "canary", canaryKeys)
+		}
+	}()
+	added, err := timedAddBatch(ctx, d.primary, "primary", keys)
+	<-done
+	if err != nil {
+		return added, err
+	}
+	for j, i := range canaryAt {
+		var unique bool
+		if canaryErr == nil {
+			unique = canaryAdded[j]
+		}
+		added[i] = d.decide(added[i], unique, canaryErr)
+	}
+	return added, nil
+}
+
+// timedAddBatch is timedAdd for a batch; the latency observed is the whole batch's.
+func timedAddBatch(ctx context.Context, backend Deduplicator, role string, keys []string) ([]bool, error) {
+	start := time.Now()
+	defer func() { canaryAddLatency.WithLabelValues(role + "_batch").Observe(time.Since(start).Seconds()) }()
+	if batcher, ok := backend.(BatchAdder); ok {
+		return batcher.AddBatch(ctx, keys)
+	}
+	added := make([]bool, len(keys))
+	for i, key := range keys {
+		var err error
+		if added[i], err = backend.Add(ctx, key); err != nil {
+			return added[:i], err
+		}
+	}
+	return added, nil
+}
+
+func (d *canaryDeduplicator) Count(ctx context.Context) (int, error) {
+	return d.primary.Count(ctx)
+}
+
+// Flush ends the window on both backends. The canary's count only covers its slice, it is
+// exported to compare against the share of the primary's it should be.
+func (d *canaryDeduplicator) Flush(ctx context.Context) (int, error) {
+	if count, err := d.canary.Flush(ctx); err != nil {
+		log.Printf("Error flushing canary dedupe backend: %v\n", err)
+	} else {
+		canaryWindowCount.WithLabelValues("canary").Set(float64(count))
+	}
+	count, err := d.primary.Flush(ctx)
+	if err == nil {
+		canaryWindowCount.WithLabelValues("primary").Set(float64(count))
+	}
+	return count, err
+}
+
+// Remove forgets key on both backends; the primary's answer counts.
+func (d *canaryDeduplicator) Remove(ctx context.Context, key string) (bool, error) {
+	remover, ok := d.primary.(Remover)
+	if !ok {
+		return false, fmt.Errorf("the %s dedupe backend can't remove ids", activeBackend())
+	}
+	if canary, ok := d.canary.(Remover); ok && d.canaried(key) {
+		if _, err := canary.Remove(ctx, key); err != nil {
+			log.Printf("Error removing id from canary dedupe backend: %v\n", err)
+		}
+	}
+	return remover.Remove(ctx, key)
+}
+
+func (d *canaryDeduplicator) Sync(ctx context.Context) (bool, error) {
+	var synced bool
+	for _, backend := range []Deduplicator{d.primary, d.canary} {
+		if syncer, ok := backend.(Syncer); ok {
+			ok, err := syncer.Sync(ctx)
+			if err != nil {
+				return synced, err
+			}
+			synced = synced || ok
+		}
+	}
+	return synced, nil
+}
+
+// Run runs the background tasks of both backends.
+func (d *canaryDeduplicator) Run(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, backend := range []Deduplicator{d.primary, d.canary} {
+		if runner, ok := backend.(backgroundRunner); ok {
+			g.Go(func() error { return runner.Run(ctx) })
+		}
+	}
+	return g.Wait()
+}
+
+// MemoryBytes adds up what both backends keep in this process.
+func (d *canaryDeduplicator) MemoryBytes() uint64 {
+	var total uint64
+	for _, backend := range []Deduplicator{d.primary, d.canary} {
+		if reporter, ok := backend.(MemoryReporter); ok {
+			total += reporter.MemoryBytes()
+		}
+	}
+	return total
+}
+
+func (d *canaryDeduplicator) Close() error {
+	var errs []error
+	for _, backend := range []Deduplicator{d.primary, d.canary} {
+		if closer, ok := backend.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
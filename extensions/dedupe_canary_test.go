@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCanaryRoutesBySlice(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	canary := newCuckooDeduplicator(1024)
+	d := newCanaryDeduplicator(backendSwitch, canary, 30)
+	dedup = d
+
+	expected := 0
+	for id := 1; id <= 200; id++ {
+		acceptIDs(t, h, id)
+		if d.canaried(strconv.Itoa(id)) {
+			expected++
+		}
+	}
+	if expected < 40 || expected > 80 {
+		t.Fatalf("%d of 200 ids in a 30%% canary slice", expected)
+	}
+	if count, _ := canary.Count(ctx); count != expected {
+		t.Errorf("the canary saw %d ids, want the %d of its slice", count, expected)
+	}
+	if count, _ := backendSwitch.Count(ctx); count != 200 {
+		t.Errorf("the primary saw %d ids, want every one", count)
+	}
+	// The slice is fixed by the id, so a canaried id is still found a duplicate
+	for id := 1; id <= 200; id++ {
+		if d.canaried(strconv.Itoa(id)) {
+			if status, err := h.AcceptAs("acme", id); err != nil || status != statusDuplicate {
+				t.Errorf("canaried id %d again: got %q, %v, want a duplicate", id, status, err)
+			}
+			break
+		}
+	}
+}
+
+func TestCanaryReportsMismatches(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	canary := newCuckooDeduplicator(1024)
+	dedup = newCanaryDeduplicator(backendSwitch, canary, 100)
+	decisions := func(result string) float64 { return testutil.ToFloat64(canaryDecisions.WithLabelValues(result)) }
+	match, canaryDuplicate, canaryUnique, canaryError := decisions("match"), decisions("canary_duplicate"), decisions("canary_unique"), decisions("canary_error")
+
+	acceptIDs(t, h, 1)
+	if got := decisions("match") - match; got != 1 {
+		t.Errorf("%v matches for a new id on both backends, want 1", got)
+	}
+
+	// Only the canary has id 2: its duplicate answers
+	canary.Add(ctx, "2")
+	if status, err := h.AcceptAs("acme", 2); err != nil || status != statusDuplicate {
+		t.Errorf("id 2 known to the canary only: got %q, %v, want the canary's duplicate", status, err)
+	}
+	if got := decisions("canary_duplicate") - canaryDuplicate; got != 1 {
+		t.Errorf("%v canary_duplicate decisions, want 1", got)
+	}
+
+	// Only the primary has id 3: the canary's unique answers
+	backendSwitch.Add(ctx, "3")
+	if status, err := h.AcceptAs("acme", 3); err != nil || status != statusAccepted {
+		t.Errorf("id 3 known to the primary only: got %q, %v, want the canary's unique", status, err)
+	}
+	if got := decisions("canary_unique") - canaryUnique; got != 1 {
+		t.Errorf("%v canary_unique decisions, want 1", got)
+	}
+
+	// A failing canary falls back to the primary
+	dedup = newCanaryDeduplicator(backendSwitch, newTrackedDedup(true), 100)
+	acceptIDs(t, h, 4)
+	if got := decisions("canary_error") - canaryError; got != 1 {
+		t.Errorf("%v canary_error decisions, want 1", got)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+const (
+	cuckooBucketSize = 4
+	cuckooMaxKicks   = 500
+)
+
+var errCuckooFull = errors.New("cuckoo filter is full")
+
+// cuckooHash is the CUCKOO_HASH function fingerprints and buckets are derived from.
+var cuckooHash = fnv64a
+
+// cuckooFilter is a cuckoo filter with 16-bit fingerprints and 4-way buckets.
+// Unlike a Bloom filter it supports deleting previously inserted items.
+type cuckooFilter struct {
+	buckets []cuckooBucket
+	mask    uint64
+	// victim holds a fingerprint that could not be relocated once the filter filled up.
+	victim      uint16
+	victimIndex uint64
+}
+
+func newCuckooFilter(capacity int) *cuckooFilter {
+	n := uint64(1)
+	for n*cuckooBucketSize < uint64(capacity) {
+		n <<= 1
+	}
+	return &cuckooFilter{
+		buckets: make([]cuckooBucket, n),
+		mask:    n - 1,
+	}
+}
+
+// indexes returns the fingerprint of key and its two candidate buckets.
+func (f *cuckooFilter) indexes(key string) (uint16, uint64, uint64) {
+	sum := cuckooHash(key)
+
+	fp := uint16(sum >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i1 := sum & f.mask
+	return fp, i1, f.altIndex(i1, fp)
+}
+
+func (f *cuckooFilter) altIndex(i uint64, fp uint16) uint64 {
+	return (i ^ (uint64(fp) * 0x5bd1e995)) & f.mask
+}
+
+func (f *cuckooFilter) lookup(key string) bool {
+	fp, i1, i2 := f.indexes(key)
+	if f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		return true
+	}
+	return f.buckets[i1].contains(fp) || f.buckets[i2].contains(fp)
+}
+
+func (f *cuckooFilter) insert(key string) error {
+	if f.victim != 0 {
+		return errCuckooFull
+	}
+
+	fp, i1, i2 := f.indexes(key)
+	if f.buckets[i1].add(fp) || f.buckets[i2].add(fp) {
+		return nil
+	}
+
+	// Both buckets are full: evict random entries until every fingerprint has a home.
+	i := i1
+	if rand.Intn(2) == 0 {
+		i = i2
+	}
+	for k := 0; k < cuckooMaxKicks; k++ {
+		slot := rand.Intn(cuckooBucketSize)
+		fp, f.buckets[i][slot] = f.buckets[i][slot], fp
+		i = f.altIndex(i, fp)
+		if f.buckets[i].add(fp) {
+			return nil
+		}
+	}
+
+	f.victim, f.victimIndex = fp, i
+	return nil
+}
+
+func (f *cuckooFilter) delete(key string) bool {
+	fp, i1, i2 := f.indexes(key)
+	if f.buckets[i1].remove(fp) || f.buckets[i2].remove(fp) {
+		f.reinsertVictim()
+		return true
+	}
+	if f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		f.victim, f.victimIndex = 0, 0
+		return true
+	}
+	return false
+}
+
+// reinsertVictim moves the stashed fingerprint back into the table once a slot frees up.
+func (f *cuckooFilter) reinsertVictim() {
+	if f.victim == 0 {
+		return
+	}
+	fp, i := f.victim, f.victimIndex
+	if f.buckets[i].add(fp) || f.buckets[f.altIndex(i, fp)].add(fp) {
+		f.victim, f.victimIndex = 0, 0
+	}
+}
+
+func (f *cuckooFilter) reset() {
+	clear(f.buckets)
+	f.victim, f.victimIndex = 0, 0
+}
+
+type cuckooBucket [cuckooBucketSize]uint16
+
+func (b *cuckooBucket) contains(fp uint16) bool {
+	for _, v := range b {
+		if v == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cuckooBucket) add(fp uint16) bool {
+	for i, v := range b {
+		if v == 0 {
+			b[i] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cuckooBucket) remove(fp uint16) bool {
+	for i, v := range b {
+		if v == fp {
+			b[i] = 0
+			return true
+		}
+	}
+	return false
+}
+
+// cuckooDeduplicator is an in-process, memory-efficient Deduplicator that supports retracting ids.
+// Fingerprint collisions can make a new id look like a duplicate, so counts are approximate.
+type cuckooDeduplicator struct {
+	mu     sync.Mutex
+	filter *cuckooFilter
+	count  int
+}
+
+func newCuckooDeduplicator(capacity int) *cuckooDeduplicator {
+	return &cuckooDeduplicator{filter: newCuckooFilter(capacity)}
+}
+
+func (d *cuckooDeduplicator) Add(_ context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filter.lookup(id) {
+		return false, nil
+	}
+	if err := d.filter.insert(id); err != nil {
+		return false, err
+	}
+	d.count++
+	return true, nil
+}
+
+func (d *cuckooDeduplicator) Remove(_ context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.filter.delete(id) {
+		return false, nil
+	}
+	d.count--
+	return true, nil
+}
+
+func (d *cuckooDeduplicator) Count(_ context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count, nil
+}
+
+// MemoryBytes is the fixed size of the filter's buckets.
+func (d *cuckooDeduplicator) MemoryBytes() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return uint64(len(d.filter.buckets)) * cuckooBucketSize * 2
+}
+
+func (d *cuckooDeduplicator) Flush(_ context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := d.count
+	d.filter.reset()
+	d.count = 0
+	return count, nil
+}
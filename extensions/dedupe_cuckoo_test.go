@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestCuckooAddRemove(t *testing.T) {
+	d := newCuckooDeduplicator(1024)
+	ctx := context.Background()
+
+	if added, _ := d.Add(ctx, "1"); !added {
+		t.Fatal("a new id was taken as a duplicate")
+	}
+	if added, _ := d.Add(ctx, "1"); added {
+		t.Error("a repeated id was added")
+	}
+	if removed, _ := d.Remove(ctx, "1"); !removed {
+		t.Error("an added id couldn't be removed")
+	}
+	if removed, _ := d.Remove(ctx, "1"); removed {
+		t.Error("a removed id was removed again")
+	}
+	if added, _ := d.Add(ctx, "1"); !added {
+		t.Error("a removed id wasn't added again")
+	}
+	d.Add(ctx, "2")
+	if count, _ := d.Flush(ctx); count != 2 {
+		t.Errorf("flushed %d ids, want 2", count)
+	}
+	if added, _ := d.Add(ctx, "1"); !added {
+		t.Error("an id of the flushed window was taken as a duplicate")
+	}
+}
+
+func TestCuckooFullAndVictim(t *testing.T) {
+	d := newCuckooDeduplicator(8)
+	ctx := context.Background()
+
+	var added []string
+	var err error
+	for i := 0; err == nil; i++ {
+		var ok bool
+		id := strconv.Itoa(i)
+		if ok, err = d.Add(ctx, id); ok {
+			added = append(added, id)
+		}
+	}
+	if !errors.Is(err, errCuckooFull) {
+		t.Fatalf("got %v filling the filter, want errCuckooFull", err)
+	}
+	if d.filter.victim == 0 {
+		t.Fatal("the filter filled up without stashing a victim")
+	}
+	// Every added id is still found, the victim included
+	for _, id := range added {
+		if ok, _ := d.Add(ctx, id); ok {
+			t.Errorf("id %s was lost when the filter filled up", id)
+		}
+	}
+
+	// Freeing a slot in one of its buckets takes the victim back into the table, so the filter
+	// accepts ids again
+	removed := 0
+	for _, id := range added {
+		if d.filter.victim == 0 {
+			break
+		}
+		if ok, _ := d.Remove(ctx, id); !ok {
+			t.Fatalf("added id %s couldn't be removed from the full filter", id)
+		}
+		removed++
+	}
+	if d.filter.victim != 0 {
+		t.Fatal("the victim wasn't reinserted once the filter emptied")
+	}
+	if ok, err := d.Add(ctx, added[0]); err != nil || !ok {
+		t.Errorf("got %t, %v adding a removed id after the victim was reinserted", ok, err)
+	}
+	if count, _ := d.Count(ctx); count != len(added)-removed+1 {
+		t.Errorf("got count %d, want %d", count, len(added)-removed+1)
+	}
+}
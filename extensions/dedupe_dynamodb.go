@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const dynamoGenerationKey = "generation"
+
+// dynamoDeduplicator stores ids in a DynamoDB table using conditional PutItem, for serverless
+// deployments on AWS. Like the memcached backend, windows are namespaced by a generation number
+// and every window keeps its own counter item; old items are removed by DynamoDB TTL.
+type dynamoDeduplicator struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+}
+
+func newDynamoDeduplicator(ctx context.Context, table, endpoint string, createTable bool, ttl time.Duration) (*dynamoDeduplicator, error) {
+	// Adaptive retries back off client side while on-demand tables throttle during scale-up
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRetryMode(aws.RetryModeAdaptive),
+		config.WithRetryMaxAttempts(5),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	d := &dynamoDeduplicator{client: client, table: table, ttl: ttl}
+
+	if err := d.ensureTable(ctx, createTable); err != nil {
+		return nil, err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item: map[string]types.AttributeValue{
+			"pk":  &types.AttributeValueMemberS{Value: dynamoGenerationKey},
+			"gen": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionFailed) {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ensureTable checks that the table exists, creating an on-demand (PAY_PER_REQUEST) table with
+// TTL enabled when createTable is set.
+func (d *dynamoDeduplicator) ensureTable(ctx context.Context, createTable bool) error {
+	_, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	var notFound *types.ResourceNotFoundException
+	if err == nil || !errors.As(err, &notFound) {
+		return err
+	}
+	if !createTable {
+		return fmt.Errorf("dynamodb table %s does not exist", d.table)
+	}
+
+	_, err = d.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(d.table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(d.client)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)}, 2*time.Minute); err != nil {
+		return err
+	}
+
+	_, err = d.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(d.table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expires_at"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Created DynamoDB table %s", d.table)
+	return nil
+}
+
+func (d *dynamoDeduplicator) generation(ctx context.Context) (string, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: dynamoGenerationKey}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	gen, ok := out.Item["gen"].(*types.AttributeValueMemberN)
+	if !ok {
+		return "", errors.New("dynamodb generation item is missing")
+	}
+	return gen.Value, nil
+}
+
+func (d *dynamoDeduplicator) idKey(generation, id string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: generation + "#id#" + id}
+}
+
+func (d *dynamoDeduplicator) countKey(generation string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: generation + "#count"}
+}
+
+// counterUpdate adjusts the window counter by delta in the same transaction as the id write.
+func (d *dynamoDeduplicator) counterUpdate(generation string, delta int, expiresAt string) *types.Update {
+	return &types.Update{
+		TableName:        aws.String(d.table),
+		Key:              map[string]types.AttributeValue{"pk": d.countKey(generation)},
+		UpdateExpression: aws.String("ADD #count :delta SET expires_at = :expires_at"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta":      &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+			":expires_at": &types.AttributeValueMemberN{Value: expiresAt},
+		},
+	}
+}
+
+func isConditionalCheckFailure(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dynamoDeduplicator) Add(ctx context.Context, id string) (bool, error) {
+	generation, err := d.generation(ctx)
+	if err != nil {
+		return false, err
+	}
+	expiresAt := strconv.FormatInt(time.Now().Add(d.ttl).Unix(), 10)
+
+	_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName: aws.String(d.table),
+				Item: map[string]types.AttributeValue{
+					"pk":         d.idKey(generation, id),
+					"expires_at": &types.AttributeValueMemberN{Value: expiresAt},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+			{Update: d.counterUpdate(generation, 1, expiresAt)},
+		},
+	})
+	if isConditionalCheckFailure(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *dynamoDeduplicator) Remove(ctx context.Context, id string) (bool, error) {
+	generation, err := d.generation(ctx)
+	if err != nil {
+		return false, err
+	}
+	expiresAt := strconv.FormatInt(time.Now().Add(d.ttl).Unix(), 10)
+
+	_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Delete: &types.Delete{
+				TableName:           aws.String(d.table),
+				Key:                 map[string]types.AttributeValue{"pk": d.idKey(generation, id)},
+				ConditionExpression: aws.String("attribute_exists(pk)"),
+			}},
+			{Update: d.counterUpdate(generation, -1, expiresAt)},
+		},
+	})
+	if isConditionalCheckFailure(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *dynamoDeduplicator) countFor(ctx context.Context, generation string) (int, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]types.AttributeValue{"pk": d.countKey(generation)},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	count, ok := out.Item["count"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(count.Value)
+}
+
+func (d *dynamoDeduplicator) Count(ctx context.Context) (int, error) {
+	generation, err := d.generation(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return d.countFor(ctx, generation)
+}
+
+func (d *dynamoDeduplicator) Flush(ctx context.Context) (int, error) {
+	generation, err := d.generation(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Start the next window first so late requests don't land in the one being reported
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.table),
+		Key:              map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: dynamoGenerationKey}},
+		UpdateExpression: aws.String("ADD gen :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return d.countFor(ctx, generation)
+}
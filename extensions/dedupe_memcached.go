@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const memcachedGenerationKey = "verve:generation"
+
+// memcachedDeduplicator stores ids with add-with-TTL semantics in memcached. Memcached can't
+// list keys, so every window lives under a generation prefix with its own counter key, and
+// Flush moves all instances to the next generation while the old keys simply expire.
+type memcachedDeduplicator struct {
+	client *memcache.Client
+	ttl    time.Duration
+}
+
+func newMemcachedDeduplicator(servers []string, ttl time.Duration) (*memcachedDeduplicator, error) {
+	client := memcache.New(servers...)
+	if err := client.Ping(); err != nil {
+		return nil, err
+	}
+
+	d := &memcachedDeduplicator{client: client, ttl: ttl}
+	if err := d.createGeneration(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// createGeneration adds the generation key unless another instance already has. The key has
+// no TTL, but memcached still drops it when it evicts or restarts, so it's created again then
+// with the clock as its value: a fresh generation that can't reuse the ids of an earlier one.
+func (d *memcachedDeduplicator) createGeneration() error {
+	err := d.client.Add(&memcache.Item{
+		Key:   memcachedGenerationKey,
+		Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+	})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return nil
+	}
+	return err
+}
+
+func (d *memcachedDeduplicator) generation() (string, error) {
+	item, err := d.client.Get(memcachedGenerationKey)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		if err := d.createGeneration(); err != nil {
+			return "", err
+		}
+		item, err = d.client.Get(memcachedGenerationKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
+}
+
+// key maps id into the window's namespace, hashing ids that aren't valid memcached keys. Ids
+// have an "id:" of their own, so an id like "count" can't be the counter key.
+func (d *memcachedDeduplicator) key(generation, id string) string {
+	if len(id) > 200 || strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		sum := sha1.Sum([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+	return "verve:" + generation + ":id:" + id
+}
+
+func (d *memcachedDeduplicator) countKey(generation string) string {
+	return "verve:" + generation + ":count"
+}
+
+func (d *memcachedDeduplicator) Add(_ context.Context, id string) (bool, error) {
+	generation, err := d.generation()
+	if err != nil {
+		return false, err
+	}
+
+	err = d.client.Add(&memcache.Item{
+		Key:        d.key(generation, id),
+		Value:      []byte{1},
+		Expiration: int32(d.ttl.Seconds()),
+	})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.client.Increment(d.countKey(generation), 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = d.client.Add(&memcache.Item{
+			Key:        d.countKey(generation),
+			Value:      []byte("1"),
+			Expiration: int32(d.ttl.Seconds()),
+		})
+		if errors.Is(err, memcache.ErrNotStored) {
+			// Another instance created the counter first
+			_, err = d.client.Increment(d.countKey(generation), 1)
+		}
+	}
+	return true, err
+}
+
+func (d *memcachedDeduplicator) Remove(_ context.Context, id string) (bool, error) {
+	generation, err := d.generation()
+	if err != nil {
+		return false, err
+	}
+
+	err = d.client.Delete(d.key(generation, id))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.client.Decrement(d.countKey(generation), 1)
+	return true, err
+}
+
+func (d *memcachedDeduplicator) countFor(generation string) (int, error) {
+	item, err := d.client.Get(d.countKey(generation))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(item.Value)))
+}
+
+func (d *memcachedDeduplicator) Count(_ context.Context) (int, error) {
+	generation, err := d.generation()
+	if err != nil {
+		return 0, err
+	}
+	return d.countFor(generation)
+}
+
+func (d *memcachedDeduplicator) Flush(_ context.Context) (int, error) {
+	generation, err := d.generation()
+	if err != nil {
+		return 0, err
+	}
+
+	// Start the next window first so late requests don't land in the one being reported
+	_, err = d.client.Increment(memcachedGenerationKey, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = d.createGeneration()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return d.countFor(generation)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemcachedCounterOutsideIDs(t *testing.T) {
+	d := &memcachedDeduplicator{}
+	if key := d.key("7", "count"); key == d.countKey("7") {
+		t.Errorf("id count is stored as the counter key %s", key)
+	}
+	if key := d.key("7", "a b"); key == d.key("7", "count") || len(key) != len("verve:7:id:")+40 {
+		t.Errorf("got key %s for an id memcached can't store, want its hash under the ids", key)
+	}
+}
+
+// fakeMemcached speaks the part of the memcached text protocol the deduplicator uses, without
+// expiry.
+type fakeMemcached struct {
+	mu    sync.Mutex
+	items map[string]string
+}
+
+func newFakeMemcached(t *testing.T) (*fakeMemcached, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	m := &fakeMemcached{items: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m, ln.Addr().String()
+}
+
+func (m *fakeMemcached) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+}
+
+func (m *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		m.mu.Lock()
+		switch fields[0] {
+		case "version":
+			rw.WriteString("VERSION fake\r\n")
+		case "gets", "get":
+			for _, key := range fields[1:] {
+				if value, ok := m.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", key, len(value), value)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "add", "set":
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, data); err != nil {
+				m.mu.Unlock()
+				return
+			}
+			if _, ok := m.items[fields[1]]; ok && fields[0] == "add" {
+				rw.WriteString("NOT_STORED\r\n")
+			} else {
+				m.items[fields[1]] = string(data[:size])
+				rw.WriteString("STORED\r\n")
+			}
+		case "incr", "decr":
+			value, ok := m.items[fields[1]]
+			if !ok {
+				rw.WriteString("NOT_FOUND\r\n")
+				break
+			}
+			n, _ := strconv.ParseUint(value, 10, 64)
+			delta, _ := strconv.ParseUint(fields[2], 10, 64)
+			if fields[0] == "incr" {
+				n += delta
+			} else {
+				n -= min(n, delta)
+			}
+			m.items[fields[1]] = strconv.FormatUint(n, 10)
+			fmt.Fprintf(rw, "%d\r\n", n)
+		case "delete":
+			if _, ok := m.items[fields[1]]; !ok {
+				rw.WriteString("NOT_FOUND\r\n")
+				break
+			}
+			delete(m.items, fields[1])
+			rw.WriteString("DELETED\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		m.mu.Unlock()
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestMemcachedRecreatesEvictedGeneration(t *testing.T) {
+	server, addr := newFakeMemcached(t)
+	d, err := newMemcachedDeduplicator([]string{addr}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if added, err := d.Add(ctx, "1"); err != nil || !added {
+		t.Fatalf("Add(1) = %v, %v, want true", added, err)
+	}
+	server.delete(memcachedGenerationKey)
+	if added, err := d.Add(ctx, "1"); err != nil || !added {
+		t.Fatalf("Add(1) after the generation key was evicted = %v, %v, want true in a fresh window", added, err)
+	}
+	if count, err := d.Count(ctx); err != nil || count != 1 {
+		t.Errorf("Count() = %d, %v, want 1", count, err)
+	}
+
+	server.delete(memcachedGenerationKey)
+	if _, err := d.Flush(ctx); err != nil {
+		t.Fatalf("Flush() with the generation key evicted: %v", err)
+	}
+	if added, err := d.Add(ctx, "2"); err != nil || !added {
+		t.Errorf("Add(2) after the flush = %v, %v, want true", added, err)
+	}
+}
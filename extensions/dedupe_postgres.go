@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresDeduplicator stores ids in a table partitioned by window, for teams whose only
+// approved shared store is Postgres. Inserts use ON CONFLICT DO NOTHING, counts only scan the
+// current window's partition and old windows are dropped as a whole partition.
+type postgresDeduplicator struct {
+	pool  *pgxpool.Pool
+	table string
+}
+
+func newPostgresDeduplicator(ctx context.Context, dsn, table string) (*postgresDeduplicator, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	d := &postgresDeduplicator{pool: pool, table: table}
+	if err := d.migrate(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create postgres dedupe tables: %w", err)
+	}
+	return d, nil
+}
+
+func (d *postgresDeduplicator) ident(suffix string) string {
+	return pgx.Identifier{d.table + suffix}.Sanitize()
+}
+
+func (d *postgresDeduplicator) partition(window int64) string {
+	return d.ident(fmt.Sprintf("_%d", window))
+}
+
+func (d *postgresDeduplicator) migrate(ctx context.Context) error {
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			window_id BIGINT NOT NULL,
+			id TEXT NOT NULL,
+			PRIMARY KEY (window_id, id)
+		) PARTITION BY LIST (window_id)`, d.ident("")),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+			current BIGINT NOT NULL
+		)`, d.ident("_window")),
+		fmt.Sprintf(`INSERT INTO %s (current) VALUES (0) ON CONFLICT DO NOTHING`, d.ident("_window")),
+	}
+	for _, stmt := range statements {
+		if _, err := d.pool.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	window, err := d.currentWindow(ctx, d.pool)
+	if err != nil {
+		return err
+	}
+	return d.createPartition(ctx, d.pool, window)
+}
+
+type pgExecutor interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func (d *postgresDeduplicator) currentWindow(ctx context.Context, db pgExecutor) (int64, error) {
+	var window int64
+	err := db.QueryRow(ctx, fmt.Sprintf(`SELECT current FROM %s`, d.ident("_window"))).Scan(&window)
+	return window, err
+}
+
+func (d *postgresDeduplicator) createPartition(ctx context.Context, db pgExecutor, window int64) error {
+	_, err := db.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES IN (%d)`,
+		d.partition(window), d.ident(""), window))
+	return err
+}
+
+func (d *postgresDeduplicator) Add(ctx context.Context, id string) (bool, error) {
+	tag, err := d.pool.Exec(ctx, fmt.Sprintf(
+		`INSERT INTO %s (window_id, id) SELECT current, $1 FROM %s ON CONFLICT DO NOTHING`,
+		d.ident(""), d.ident("_window")), id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (d *postgresDeduplicator) Remove(ctx context.Context, id string) (bool, error) {
+	tag, err := d.pool.Exec(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE window_id = (SELECT current FROM %s) AND id = $1`,
+		d.ident(""), d.ident("_window")), id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (d *postgresDeduplicator) countWindow(ctx context.Context, window int64) (int, error) {
+	var count int
+	err := d.pool.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s`, d.partition(window))).Scan(&count)
+	return count, err
+}
+
+func (d *postgresDeduplicator) Count(ctx context.Context) (int, error) {
+	window, err := d.currentWindow(ctx, d.pool)
+	if err != nil {
+		return 0, err
+	}
+	return d.countWindow(ctx, window)
+}
+
+func (d *postgresDeduplicator) Flush(ctx context.Context) (int, error) {
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var window int64
+	err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT current FROM %s FOR UPDATE`, d.ident("_window"))).Scan(&window)
+	if err != nil {
+		return 0, err
+	}
+
+	// Start the next window first so late requests don't land in the one being reported
+	if err := d.createPartition(ctx, tx, window+1); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE %s SET current = $1`, d.ident("_window")), window+1); err != nil {
+		return 0, err
+	}
+	// The previous window was already reported; drop it as a whole partition
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, d.partition(window-1))); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return d.countWindow(ctx, window)
+}
+
+func (d *postgresDeduplicator) Close() error {
+	d.pool.Close()
+	return nil
+}
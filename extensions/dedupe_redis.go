@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisIDPrefix namespaces id keys so they aren't confused with coordination keys.
+const redisIDPrefix = "verve:id:"
+
+// redisSetPrefix namespaces the SETs of REDIS_LAYOUT=set, apart from the id keys, so neither
+// layout's scans see the other's keys.
+const redisSetPrefix = "verve:set:"
+
+// redisSetsPerShard is how many SETs a window is spread over per node, so a ring still shards it.
+const redisSetsPerShard = 16
+
+// redisDeduplicator stores every id as its own key so that dedupe works across server instances,
+// or, with REDIS_LAYOUT=set, as members of the window's SETs. The client is either a single node
+// or a client-side sharded ring of independent nodes.
+type redisDeduplicator struct {
+	client redis.Cmdable
+	ttl    time.Duration
+	// pipelineSize is the maximum number of SETNX commands sent in one round trip by AddBatch.
+	pipelineSize int
+	// replicas serve Count when REDIS_REPLICAS is set; Flush stays on the primary.
+	replicas *redisReplicaSet
+	// prefix namespaces the ids of a separate window, e.g. a tenant's; empty uses redisIDPrefix.
+	prefix string
+	// sets is how many SETs hold the window with REDIS_LAYOUT=set; 0 is a key per id.
+	sets int
+}
+
+// setLayout applies REDIS_LAYOUT: keys, a key per id that expires on its own, or set, the
+// window's ids as SET members, which counts in O(1) and closes a window atomically.
+func (d *redisDeduplicator) setLayout(layout string, shards int) error {
+	switch layout {
+	case "keys":
+		d.sets = 0
+	case "set":
+		d.sets = redisSetsPerShard * max(shards, 1)
+	default:
+		return fmt.Errorf("unknown REDIS_LAYOUT %q, expected keys or set", layout)
+	}
+	return nil
+}
+
+// setKey is the SET holding id with REDIS_LAYOUT=set.
+func (d *redisDeduplicator) setKey(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return d.setKeyAt(int(h.Sum32() % uint32(d.sets)))
+}
+
+func (d *redisDeduplicator) setKeyAt(part int) string {
+	return redisSetPrefix + strings.TrimPrefix(d.keyPrefix(), "verve:") + strconv.Itoa(part)
+}
+
+// setKeys are all the SETs of the window; each lives on one node of a ring.
+func (d *redisDeduplicator) setKeys() []string {
+	keys := make([]string, d.sets)
+	for i := range keys {
+		keys[i] = d.setKeyAt(i)
+	}
+	return keys
+}
+
+func (d *redisDeduplicator) keyPrefix() string {
+	if d.prefix == "" {
+		return redisIDPrefix
+	}
+	return d.prefix
+}
+
+// newRedisRing shards ids across independent (non-cluster) Redis nodes with consistent
+// hashing, to scale beyond a single node's throughput.
+func newRedisRing(addrs []string) (*redis.Ring, error) {
+	shards := make(map[string]string, len(addrs))
+	for i, addr := range addrs {
+		shards[fmt.Sprintf("shard%d", i)] = strings.TrimSpace(addr)
+	}
+
+	ring := redis.NewRing(&redis.RingOptions{Addrs: shards, ContextTimeoutEnabled: true})
+	err := ring.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+		return shard.Ping(ctx).Err()
+	})
+	if err != nil {
+		ring.Close()
+		return nil, err
+	}
+	return ring, nil
+}
+
+// forEachShard runs fn against every node backing the deduplicator.
+func (d *redisDeduplicator) forEachShard(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error {
+	if ring, ok := d.client.(*redis.Ring); ok {
+		return ring.ForEachShard(ctx, fn)
+	}
+	return fn(ctx, d.client.(*redis.Client))
+}
+
+func (d *redisDeduplicator) Add(ctx context.Context, id string) (bool, error) {
+	if d.sets > 0 {
+		added, err := d.AddBatch(ctx, []string{id})
+		return err == nil && added[0], err
+	}
+	return d.client.SetNX(ctx, d.keyPrefix()+id, true, d.ttl).Result()
+}
+
+// AddBatch pipelines SETNX calls; a ring splits every pipeline by shard and sends them in parallel.
+func (d *redisDeduplicator) AddBatch(ctx context.Context, ids []string) ([]bool, error) {
+	size := d.pipelineSize
+	if size <= 0 {
+		size = len(ids)
+	}
+
+	added := make([]bool, len(ids))
+	for start := 0; start < len(ids); start += size {
+		end := min(start+size, len(ids))
+		cmds := make([]redis.Cmder, 0, end-start)
+		_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			touched := map[string]bool{}
+			for _, id := range ids[start:end] {
+				if d.sets == 0 {
+					cmds = append(cmds, pipe.SetNX(ctx, d.keyPrefix()+id, true, d.ttl))
+					continue
+				}
+				key := d.setKey(id)
+				cmds = append(cmds, pipe.SAdd(ctx, key, id))
+				touched[key] = true
+			}
+			// A SET outlives its window by the TTL when no flush removes it
+			for key := range touched {
+				pipe.Expire(ctx, key, d.ttl)
+			}
+			return nil
+		})
+		if err != nil {
+			// The earlier pipelines' results stand; this one's may or may not have landed
+			return added[:start], err
+		}
+		for i, cmd := range cmds {
+			switch cmd := cmd.(type) {
+			case *redis.BoolCmd:
+				added[start+i] = cmd.Val()
+			case *redis.IntCmd:
+				added[start+i] = cmd.Val() == 1
+			}
+		}
+	}
+	return added, nil
+}
+
+func (d *redisDeduplicator) Remove(ctx context.Context, id string) (bool, error) {
+	if d.sets > 0 {
+		removed, err := d.client.SRem(ctx, d.setKey(id), id).Result()
+		return removed == 1, err
+	}
+	deleted, err := d.client.Del(ctx, d.keyPrefix()+id).Result()
+	return deleted == 1, err
+}
+
+// cardinality sums the SETs on client; those living on other nodes count 0 there.
+func (d *redisDeduplicator) cardinality(ctx context.Context, pipe redis.Pipeliner) []*redis.IntCmd {
+	cards := make([]*redis.IntCmd, d.sets)
+	for i, key := range d.setKeys() {
+		cards[i] = pipe.SCard(ctx, key)
+	}
+	return cards
+}
+
+func sumCounts(cmds []*redis.IntCmd) int64 {
+	var n int64
+	for _, cmd := range cmds {
+		n += cmd.Val()
+	}
+	return n
+}
+
+func (d *redisDeduplicator) Count(ctx context.Context) (int, error) {
+	var count atomic.Int64
+	err := d.forEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		return d.replicas.read(ctx, client, func(client *redis.Client) error {
+			if d.sets > 0 {
+				var cards []*redis.IntCmd
+				_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+					cards = d.cardinality(ctx, pipe)
+					return nil
+				})
+				count.Add(sumCounts(cards))
+				return err
+			}
+			keys, err := client.Keys(ctx, d.keyPrefix()+"*").Result()
+			if err != nil {
+				return err
+			}
+			count.Add(int64(len(keys)))
+			return nil
+		})
+	})
+	return int(count.Load()), err
+}
+
+// Each scans every shard, so ids added by other instances are listed too. A ring's shards are
+// scanned in parallel, one fn call at a time.
+func (d *redisDeduplicator) Each(ctx context.Context, fn func(id string) error) error {
+	var mu sync.Mutex
+	return d.forEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		if d.sets > 0 {
+			for _, key := range d.setKeys() {
+				iter := client.SScan(ctx, key, 0, "", 1000).Iterator()
+				for iter.Next(ctx) {
+					mu.Lock()
+					err := fn(iter.Val())
+					mu.Unlock()
+					if err != nil {
+						return err
+					}
+				}
+				if err := iter.Err(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		iter := client.Scan(ctx, 0, d.keyPrefix()+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			err := fn(strings.TrimPrefix(iter.Val(), d.keyPrefix()))
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	})
+}
+
+func (d *redisDeduplicator) Flush(ctx context.Context) (int, error) {
+	// Shards only ever hold disjoint ids, so the window count is the sum of all shards
+	var count atomic.Int64
+	err := d.forEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		if d.sets > 0 {
+			// Counted and removed in one transaction, so no add lands in between
+			var cards []*redis.IntCmd
+			_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				cards = d.cardinality(ctx, pipe)
+				pipe.Unlink(ctx, d.setKeys()...)
+				return nil
+			})
+			count.Add(sumCounts(cards))
+			return err
+		}
+		keys, err := client.Keys(ctx, d.keyPrefix()+"*").Result()
+		if err != nil {
+			return err
+		}
+
+		// Clean up old keys
+		for _, key := range keys {
+			client.Del(ctx, key)
+		}
+		count.Add(int64(len(keys)))
+		return nil
+	})
+	return int(count.Load()), err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// BenchmarkRedisAddBatch compares a pipelined batch with one SETNX round trip per id. Every
+// iteration uses fresh ids, so each SETNX stores a key as it would for new traffic.
+func BenchmarkRedisAddBatch(b *testing.B) {
+	mr := miniredis.RunT(b)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b.Cleanup(func() { client.Close() })
+	d := &redisDeduplicator{client: client, ttl: time.Minute, pipelineSize: 100}
+	ctx := context.Background()
+
+	const batchSize = 1000
+	batch := func(n int) []string {
+		ids := make([]string, batchSize)
+		for i := range ids {
+			ids[i] = strconv.Itoa(n*batchSize + i)
+		}
+		return ids
+	}
+
+	b.Run("pipelined", func(b *testing.B) {
+		mr.FlushAll()
+		for n := 0; n < b.N; n++ {
+			if _, err := d.AddBatch(ctx, batch(n)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per-id", func(b *testing.B) {
+		mr.FlushAll()
+		for n := 0; n < b.N; n++ {
+			for _, id := range batch(n) {
+				if _, err := d.Add(ctx, id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestRedisSetLayout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	d := &redisDeduplicator{client: client, ttl: time.Minute, pipelineSize: 2}
+	if err := d.setLayout("set", 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if added, _ := d.Add(ctx, "1"); !added {
+		t.Fatal("first add wasn't new")
+	}
+	added, err := d.AddBatch(ctx, []string{"1", "2", "3", "2"})
+	if err != nil || added[0] || !added[1] || !added[2] || added[3] {
+		t.Fatalf("got %v, %v, want only 2 and 3 new", added, err)
+	}
+	for _, key := range mr.Keys() {
+		if !strings.HasPrefix(key, redisSetPrefix+"id:") {
+			t.Errorf("the set layout wrote %s", key)
+		}
+	}
+	if count, _ := d.Count(ctx); count != 3 {
+		t.Errorf("got count %d, want 3", count)
+	}
+	if removed, _ := d.Remove(ctx, "3"); !removed {
+		t.Error("3 wasn't removed")
+	}
+	if count, err := d.Flush(ctx); err != nil || count != 2 {
+		t.Errorf("got flush %d, %v, want 2", count, err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("the flush left %v", keys)
+	}
+	if err := d.setLayout("hll", 1); err == nil {
+		t.Error("accepted an unknown layout")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// roaringDeduplicator keeps the ids of the current window in a compressed roaring bitmap.
+// Counts are exact and dense integer id ranges take a fraction of the memory of a hash map.
+type roaringDeduplicator struct {
+	mu     sync.Mutex
+	bitmap *roaring64.Bitmap
+	// path is where snapshots of the current window are persisted; empty disables persistence.
+	path     string
+	interval time.Duration
+
+	// budget is the size in bytes the bitmap may grow to before it is spilled into spilled,
+	// which holds the rest of the window on disk; 0 keeps everything in memory.
+	budget  uint64
+	spilled *spillSegment
+	adds    int
+	// spilling is the bitmap being merged into spilled in the background, and spillDone is
+	// closed once it is; both are nil between spills. spilling isn't changed while set.
+	spilling  *roaring64.Bitmap
+	spillDone chan struct{}
+}
+
+// roaringBudgetCheckEvery is how many adds go by between checks of the bitmap size, which
+// walks all containers.
+const roaringBudgetCheckEvery = 1024
+
+func newRoaringDeduplicator(path string, interval time.Duration, budget uint64) (*roaringDeduplicator, error) {
+	d := &roaringDeduplicator{bitmap: roaring64.New(), path: path, interval: interval, budget: budget}
+	if path == "" {
+		return d, nil
+	}
+	if err := d.restoreSpill(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := d.bitmap.ReadFrom(file); err != nil {
+		return nil, fmt.Errorf("failed to load roaring snapshot %s: %w", path, err)
+	}
+	log.Printf("Restored %d ids from roaring snapshot %s", d.bitmap.GetCardinality(), path)
+	return d, d.dropSpilledFromBitmap()
+}
+
+// restoreSpill reopens the spill segment written next to the snapshot.
+func (d *roaringDeduplicator) restoreSpill() error {
+	segment, err := openSpillSegment(spillPath(d.path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open roaring spill segment: %w", err)
+	}
+	d.spilled = segment
+	spilledIDs.Set(float64(segment.n))
+	log.Printf("Restored %d spilled ids from %s", segment.n, segment.file.Name())
+	return nil
+}
+
+// dropSpilledFromBitmap removes the ids a crash left both in the snapshot and in the spill
+// segment, which would otherwise be counted twice.
+func (d *roaringDeduplicator) dropSpilledFromBitmap() error {
+	if d.spilled == nil {
+		return nil
+	}
+	var both []uint64
+	it := d.bitmap.Iterator()
+	for it.HasNext() {
+		id := it.Next()
+		found, err := d.spilled.contains(id)
+		if err != nil {
+			return err
+		}
+		if found {
+			both = append(both, id)
+		}
+	}
+	for _, id := range both {
+		d.bitmap.Remove(id)
+	}
+	return nil
+}
+
+// spill starts moving the bitmap into the spill segment once it outgrew the budget, unless a
+// spill is already running. Adds go on in an empty bitmap meanwhile, so none waits for the
+// merge. d.mu is held.
+func (d *roaringDeduplicator) spill() {
+	if d.adds++; d.budget == 0 || d.spilling != nil || d.adds%roaringBudgetCheckEvery != 0 || d.bitmap.GetSizeInBytes() < d.budget {
+		return
+	}
+	d.spilling, d.bitmap = d.bitmap, roaring64.New()
+	d.spillDone = make(chan struct{})
+	go d.mergeSpill(d.spilling, d.spilled, d.spillDone)
+}
+
+// mergeSpill merges bitmap into the segment old, without d.mu: neither changes until done is
+// closed.
+func (d *roaringDeduplicator) mergeSpill(bitmap *roaring64.Bitmap, old *spillSegment, done chan struct{}) {
+	defer close(done)
+	path := spillPath(d.path)
+	if old != nil {
+		path = old.file.Name()
+	}
+	start := time.Now()
+	segment, err := mergeSpillSegment(path, old, bitmap, roaring64.New())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.spilling, d.spillDone = nil, nil
+	if err != nil {
+		// Keep growing in memory rather than lose ids
+		log.Printf("Failed to spill roaring window to disk: %v\n", err)
+		d.bitmap.Or(bitmap)
+		return
+	}
+	old.Close()
+	log.Printf("Spilled %d ids to %s in %v, %d ids on disk\n", bitmap.GetCardinality(), path, time.Since(start), segment.n)
+	d.spilled = segment
+	roaringSpills.Inc()
+	spilledIDs.Set(float64(segment.n))
+}
+
+// waitSpill waits for a running spill to finish, for what changes the segment. d.mu is held,
+// and released while waiting.
+func (d *roaringDeduplicator) waitSpill() {
+	for d.spillDone != nil {
+		done := d.spillDone
+		d.mu.Unlock()
+		<-done
+		d.mu.Lock()
+	}
+}
+
+// clearSpill deletes the spill segment at the end of a window. d.mu is held.
+func (d *roaringDeduplicator) clearSpill() {
+	if d.spilled == nil {
+		return
+	}
+	d.spilled.Close()
+	if err := os.Remove(d.spilled.file.Name()); err != nil {
+		log.Printf("Failed to remove roaring spill segment: %v\n", err)
+	}
+	d.spilled = nil
+	spilledIDs.Set(0)
+}
+
+func parseRoaringID(id string) (uint64, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("roaring backend requires numeric ids, got %q", id)
+	}
+	return n, nil
+}
+
+func (d *roaringDeduplicator) Add(_ context.Context, id string) (bool, error) {
+	n, err := parseRoaringID(id)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bitmap.Contains(n) || d.spilling != nil && d.spilling.Contains(n) {
+		return false, nil
+	}
+	if found, err := d.spilled.contains(n); err != nil || found {
+		return false, err
+	}
+	d.bitmap.Add(n)
+	d.spill()
+	return true, nil
+}
+
+func (d *roaringDeduplicator) Remove(_ context.Context, id string) (bool, error) {
+	n, err := parseRoaringID(id)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bitmap.CheckedRemove(n) {
+		return true, nil
+	}
+	d.waitSpill()
+	if d.bitmap.CheckedRemove(n) {
+		return true, nil
+	}
+	// Retractions are rare, so a spilled id is removed by rewriting the segment without it
+	if found, err := d.spilled.contains(n); err != nil || !found {
+		return false, err
+	}
+	segment, err := mergeSpillSegment(d.spilled.file.Name(), d.spilled, roaring64.New(), roaring64.BitmapOf(n))
+	if err != nil {
+		return false, err
+	}
+	d.spilled.Close()
+	d.spilled = segment
+	spilledIDs.Set(float64(segment.n))
+	return true, nil
+}
+
+func (d *roaringDeduplicator) Count(_ context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count(), nil
+}
+
+// MemoryBytes is the size of the bitmaps; spilled ids are on disk.
+func (d *roaringDeduplicator) MemoryBytes() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := d.bitmap.GetSizeInBytes()
+	if d.spilling != nil {
+		size += d.spilling.GetSizeInBytes()
+	}
+	return size
+}
+
+// count merges the bitmaps with the spilled ids, which are all disjoint. d.mu is held.
+func (d *roaringDeduplicator) count() int {
+	count := int(d.bitmap.GetCardinality())
+	if d.spilling != nil {
+		count += int(d.spilling.GetCardinality())
+	}
+	if d.spilled != nil {
+		count += int(d.spilled.n)
+	}
+	return count
+}
+
+// Each holds the lock while it lists the bitmap and the spilled ids, so adds wait for it.
+func (d *roaringDeduplicator) Each(_ context.Context, fn func(id string) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waitSpill()
+	for it := d.bitmap.Iterator(); it.HasNext(); {
+		if err := fn(strconv.FormatUint(it.Next(), 10)); err != nil {
+			return err
+		}
+	}
+	return d.spilled.each(func(n uint64) error {
+		return fn(strconv.FormatUint(n, 10))
+	})
+}
+
+func (d *roaringDeduplicator) Flush(_ context.Context) (int, error) {
+	d.mu.Lock()
+	d.waitSpill()
+	count := d.count()
+	d.bitmap.Clear()
+	d.clearSpill()
+	d.mu.Unlock()
+
+	// Persist the empty window so a restart doesn't resurrect ids that were already reported
+	if err := d.snapshot(); err != nil {
+		log.Printf("Failed to write roaring snapshot: %v\n", err)
+	}
+	return count, nil
+}
+
+func (d *roaringDeduplicator) Sync(_ context.Context) (bool, error) {
+	return d.path != "", d.snapshot()
+}
+
+// Close removes a temporary spill segment; one next to the snapshot is kept for the restart.
+func (d *roaringDeduplicator) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waitSpill()
+	if d.path == "" {
+		d.clearSpill()
+	}
+	return d.spilled.Close()
+}
+
+// snapshot atomically writes the current window to d.path.
+func (d *roaringDeduplicator) snapshot() error {
+	if d.path == "" {
+		return nil
+	}
+
+	// Ids still being spilled are only in memory, so they are snapshotted with the bitmap
+	var buf bytes.Buffer
+	d.mu.Lock()
+	bitmap := d.bitmap
+	if d.spilling != nil {
+		bitmap = roaring64.Or(d.bitmap, d.spilling)
+	}
+	_, err := bitmap.WriteTo(&buf)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+// Run periodically persists the current window so it survives restarts, and writes a final
+// snapshot on shutdown.
+func (d *roaringDeduplicator) Run(ctx context.Context) error {
+	if d.path == "" {
+		return nil
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return d.snapshot()
+		case <-ticker.C:
+			if err := d.snapshot(); err != nil {
+				log.Printf("Failed to write roaring snapshot: %v\n", err)
+			}
+		}
+	}
+}
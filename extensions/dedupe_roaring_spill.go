@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// spillSegment is the part of a roaring window that was moved to disk: the ids as sorted
+// big endian uint64s, looked up by binary search with positional reads, so the page cache
+// rather than the heap holds the hot part.
+type spillSegment struct {
+	file *os.File
+	n    int64
+}
+
+func openSpillSegment(path string) (*spillSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &spillSegment{file: file, n: info.Size() / 8}, nil
+}
+
+func (s *spillSegment) at(i int64) (uint64, error) {
+	var buf [8]byte
+	if _, err := s.file.ReadAt(buf[:], i*8); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (s *spillSegment) contains(id uint64) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	lo, hi := int64(0), s.n
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		v, err := s.at(mid)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case v == id:
+			return true, nil
+		case v < id:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// each calls fn with every id of the segment in order.
+func (s *spillSegment) each(fn func(id uint64) error) error {
+	if s == nil {
+		return nil
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, 0, s.n*8), 64<<10)
+	var buf [8]byte
+	for i := int64(0); i < s.n; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return err
+		}
+		if err := fn(binary.BigEndian.Uint64(buf[:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spillSegment) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// mergeSpillSegment writes the ids of old that aren't in removed, plus add, to path as a new
+// segment replacing old. Both inputs are sorted, so old is streamed rather than loaded, and
+// add and old are expected to be disjoint.
+func mergeSpillSegment(path string, old *spillSegment, add, removed *roaring64.Bitmap) (*spillSegment, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, 64<<10)
+	var buf [8]byte
+	write := func(id uint64) error {
+		binary.BigEndian.PutUint64(buf[:], id)
+		_, err := w.Write(buf[:])
+		return err
+	}
+	it := add.Iterator()
+	err = old.each(func(id uint64) error {
+		for it.HasNext() && it.PeekNext() < id {
+			if err := write(it.Next()); err != nil {
+				return err
+			}
+		}
+		if removed.Contains(id) {
+			return nil
+		}
+		return write(id)
+	})
+	for err == nil && it.HasNext() {
+		err = write(it.Next())
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return openSpillSegment(path)
+}
+
+// spillPath is where the roaring backend spills to: next to its snapshot, so that both survive
+// a restart together, or a fresh temporary file without one.
+func spillPath(snapshotPath string) string {
+	if snapshotPath != "" {
+		return snapshotPath + ".spill"
+	}
+	dir := getEnv("ROARING_SPILL_DIR", os.TempDir())
+	return filepath.Join(dir, "verve-roaring-"+instanceID()+"-"+time.Now().Format("20060102T150405")+".spill")
+}
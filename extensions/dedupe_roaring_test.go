@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestRoaringSpillInBackground(t *testing.T) {
+	t.Setenv("ROARING_SPILL_DIR", t.TempDir())
+	d, err := newRoaringDeduplicator("", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx := context.Background()
+
+	// Sparse ids outgrow the budget on every check, so spills overlap with the adds
+	const n = 10 * roaringBudgetCheckEvery
+	for i := 1; i <= n; i++ {
+		if added, err := d.Add(ctx, strconv.Itoa(i*100000)); err != nil || !added {
+			t.Fatalf("add %d: got %v, %v", i, added, err)
+		}
+	}
+	for _, i := range []int{1, n / 2, n} {
+		if added, _ := d.Add(ctx, strconv.Itoa(i*100000)); added {
+			t.Errorf("id %d was added twice", i*100000)
+		}
+	}
+	if removed, err := d.Remove(ctx, "100000"); err != nil || !removed {
+		t.Errorf("got %v, %v removing a spilled id", removed, err)
+	}
+	if count, _ := d.Flush(ctx); count != n-1 {
+		t.Errorf("got count %d, want %d", count, n-1)
+	}
+	if d.spilled != nil || d.spilling != nil {
+		t.Error("the flush left spilled ids behind")
+	}
+}
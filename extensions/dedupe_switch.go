@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// backendSwitch is the primary dedup, which the admin API can switch to another backend.
+var backendSwitch *switchingDeduplicator
+
+// backendDrainBatch is how many ids a backend switch adds to the new backend at a time.
+const backendDrainBatch = 1000
+
+// switchingDeduplicator serves the primary dedupe backend and swaps it for another one at a
+// window boundary when an operator asks for it, e.g. from the in-memory backend an instance
+// fell back to during a Redis outage back to Redis, without a restart.
+//
+// At the boundary the closing window's ids are drained from the old backend into the new
+// one, so the window is reported from the new backend in full. Requests wait for the drain.
+type switchingDeduplicator struct {
+	mu      sync.RWMutex
+	current Deduplicator
+	backend string
+	// switched is closed when the backend is swapped, restarting Run on the new one.
+	switched chan struct{}
+
+	pendingMu sync.Mutex
+	pending   *pendingSwitch
+}
+
+// pendingSwitch is a switch waiting for the next window boundary. Its backend is opened when
+// the switch is requested, so an unreachable backend is refused right away.
+type pendingSwitch struct {
+	Backend     string    `json:"backend"`
+	Drain       bool      `json:"drain"`
+	RequestedAt time.Time `json:"requested_at"`
+	RequestedBy string    `json:"requested_by"`
+
+	to Deduplicator
+}
+
+func newSwitchingDeduplicator(current Deduplicator, backend string) *switchingDeduplicator {
+	return &switchingDeduplicator{current: current, backend: backend, switched: make(chan struct{})}
+}
+
+// activeBackend is the name of the dedupe backend currently in use.
+func activeBackend() string {
+	if backendSwitch == nil {
+		return dedupeBackend
+	}
+	backendSwitch.mu.RLock()
+	defer backendSwitch.mu.RUnlock()
+	return backendSwitch.backend
+}
+
+// checkBackendSwitch tells whether the instance may switch to backend, with the same rules
+// main applies to DEDUPE_BACKEND.
+func checkBackendSwitch(backend string, drain bool) error {
+	current := activeBackend()
+	switch {
+	case backendSwitch == nil:
+		return fmt.Errorf("this instance can't switch dedupe backends")
+	case backend == current:
+		return fmt.Errorf("the %s dedupe backend is already in use", backend)
+	case backend == "roaring" && (getEnv("DEDUPE_KEY", "id") != "id" || idHash != nil):
+		return fmt.Errorf("the roaring dedupe backend only supports DEDUPE_KEY=id without PRIVACY_MODE")
+	case windowCap != nil && windowCap.approximate && sharedBackends[backend]:
+		return fmt.Errorf("WINDOW_OVERFLOW=approximate protects the memory of in-process backends, %s is shared", backend)
+	}
+	if drain {
+		backendSwitch.mu.RLock()
+		_, ok := backendSwitch.current.(Lister)
+		backendSwitch.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("the %s dedupe backend can't list its ids to drain them; switch without draining", current)
+		}
+	}
+	return nil
+}
+
+// schedule opens backend and switches to it at the next window boundary, replacing a switch
+// that was already pending.
+func (d *switchingDeduplicator) schedule(backend string, drain bool, actor string) (*pendingSwitch, error) {
+	if backend == "redis" && redisDB == nil && getEnv("REDIS_SHARDS", "") == "" {
+		rdb, err := connectRedis()
+		if err != nil {
+			return nil, fmt.Errorf("connect to Redis: %w", err)
+		}
+		redisDB = rdb
+	}
+	to, err := newDeduplicator(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pendingSwitch{Backend: backend, Drain: drain, RequestedAt: time.Now().UTC(), RequestedBy: actor, to: to}
+	d.pendingMu.Lock()
+	replaced := d.pending
+	d.pending = p
+	d.pendingMu.Unlock()
+	replaced.cancel()
+	return p, nil
+}
+
+// cancelPending drops the pending switch, returning it; nil when there was none.
+func (d *switchingDeduplicator) cancelPending() *pendingSwitch {
+	if d == nil {
+		return nil
+	}
+	d.pendingMu.Lock()
+	p := d.pending
+	d.pending = nil
+	d.pendingMu.Unlock()
+	p.cancel()
+	return p
+}
+
+// scheduled is the switch waiting for the next window boundary, nil when there is none.
+func (d *switchingDeduplicator) scheduled() *pendingSwitch {
+	if d == nil {
+		return nil
+	}
+	d.pendingMu.Lock()
+	defer d.pendingMu.Unlock()
+	return d.pending
+}
+
+// cancel closes the backend opened for a switch that won't happen.
+func (p *pendingSwitch) cancel() {
+	if p == nil {
+		return
+	}
+	if closer, ok := p.to.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// atBoundary carries out the pending switch, if any, before the closing window is flushed.
+// A failed drain keeps the old backend, so the window is still reported from it.
+func (d *switchingDeduplicator) atBoundary(ctx context.Context) {
+	d.pendingMu.Lock()
+	p := d.pending
+	d.pending = nil
+	d.pendingMu.Unlock()
+	if p == nil {
+		return
+	}
+
+	d.mu.Lock()
+	from, old := d.backend, d.current
+	drained, err := 0, error(nil)
+	if p.Drain {
+		drained, err = drainBackend(ctx, old, p.to)
+	}
+	if err == nil {
+		d.current, d.backend = p.to, p.Backend
+		// Empty an in-process backend before its background task writes a last snapshot, so a
+		// later switch back (or a restart onto a persistent one) doesn't resurrect this window's
+		// ids. A shared one is only emptied by the leader, which drained the window out of it;
+		// on other instances it still holds the window the leader is about to report
+		if !sharedBackends[from] || coordinator.IsLeader() {
+			if _, ferr := old.Flush(ctx); ferr != nil {
+				log.Printf("Error flushing the old %s dedupe backend: %v\n", from, ferr)
+			}
+		}
+		close(d.switched)
+		d.switched = make(chan struct{})
+	}
+	d.mu.Unlock()
+
+	details := map[string]interface{}{"from": from, "to": p.Backend, "drain": p.Drain, "drained": drained, "requested_by": p.RequestedBy}
+	if err != nil {
+		backendSwitches.WithLabelValues(from, p.Backend, "failed").Inc()
+		log.Printf("Error switching the dedupe backend from %s to %s, keeping %s: %v\n", from, p.Backend, from, err)
+		details["error"] = err.Error()
+		audit.record(auditEntry{Action: "backend.switch_failed", Actor: "instance " + instanceID(), Details: details})
+		p.cancel()
+		return
+	}
+	backendSwitches.WithLabelValues(from, p.Backend, "switched").Inc()
+	backendSwitchDrained.Add(float64(drained))
+	attributeLogs()
+	log.Printf("Switched the dedupe backend from %s to %s, %d ids drained\n", from, p.Backend, drained)
+	audit.record(auditEntry{Action: "backend.switch", Actor: "instance " + instanceID(), Details: details})
+}
+
+// drainBackend adds the ids of from's current window to to, returning how many were added.
+func drainBackend(ctx context.Context, from, to Deduplicator) (int, error) {
+	lister, ok := from.(Lister)
+	if !ok {
+		return 0, errors.New("the old backend can't list its ids")
+	}
+	drained := 0
+	batch := make([]string, 0, backendDrainBatch)
+	add := func() error {
+		if batcher, ok := to.(BatchAdder); ok {
+			if _, err := batcher.AddBatch(ctx, batch); err != nil {
+				return err
+			}
+		} else {
+			for _, id := range batch {
+				if _, err := to.Add(ctx, id); err != nil {
+					return err
+				}
+			}
+		}
+		drained += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err := lister.Each(ctx, func(id string) error {
+		if batch = append(batch, id); len(batch) == backendDrainBatch {
+			return add()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = add()
+	}
+	return drained, err
+}
+
+func (d *switchingDeduplicator) Add(ctx context.Context, key string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current.Add(ctx, key)
+}
+
+func (d *switchingDeduplicator) AddBatch(ctx context.Context, keys []string) ([]bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if batcher, ok := d.current.(BatchAdder); ok {
+		return batcher.AddBatch(ctx, keys)
+	}
+	added := make([]bool, len(keys))
+	for i, key := range keys {
+		var err error
+		if added[i], err = d.current.Add(ctx, key); err != nil {
+			return added[:i], err
+		}
+	}
+	return added, nil
+}
+
+func (d *switchingDeduplicator) Count(ctx context.Context) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current.Count(ctx)
+}
+
+func (d *switchingDeduplicator) Flush(ctx context.Context) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current.Flush(ctx)
+}
+
+func (d *switchingDeduplicator) Remove(ctx context.Context, key string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	remover, ok := d.current.(Remover)
+	if !ok {
+		return false, fmt.Errorf("the %s dedupe backend can't remove ids", d.backend)
+	}
+	return remover.Remove(ctx, key)
+}
+
+func (d *switchingDeduplicator) Each(ctx context.Context, fn func(id string) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	lister, ok := d.current.(Lister)
+	if !ok {
+		return fmt.Errorf("the %s dedupe backend can't list ids", d.backend)
+	}
+	return lister.Each(ctx, fn)
+}
+
+func (d *switchingDeduplicator) Sync(ctx context.Context) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if syncer, ok := d.current.(Syncer); ok {
+		return syncer.Sync(ctx)
+	}
+	return false, nil
+}
+
+func (d *switchingDeduplicator) MemoryBytes() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if reporter, ok := d.current.(MemoryReporter); ok {
+		return reporter.MemoryBytes()
+	}
+	return 0
+}
+
+// Run runs the current backend's background task, restarting it on the new backend after a
+// switch. The old backend is closed once its task returned, so a last snapshot isn't written
+// to a closed backend.
+func (d *switchingDeduplicator) Run(ctx context.Context) error {
+	for {
+		d.mu.RLock()
+		current, backend, switched := d.current, d.backend, d.switched
+		d.mu.RUnlock()
+
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			if runner, ok := current.(backgroundRunner); ok {
+				done <- runner.Run(runCtx)
+				return
+			}
+			<-runCtx.Done()
+			done <- nil
+		}()
+
+		select {
+		case <-ctx.Done():
+			cancel()
+			return <-done
+		case <-switched:
+			cancel()
+			if err := <-done; err != nil {
+				log.Printf("Error stopping the old %s dedupe backend: %v\n", backend, err)
+			}
+			if closer, ok := current.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					log.Printf("Error closing the old %s dedupe backend: %v\n", backend, err)
+				}
+			}
+		}
+	}
+}
+
+func (d *switchingDeduplicator) Close() error {
+	d.cancelPending()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if closer, ok := d.current.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// trackedDedup is a cuckoo backend that tells when its background task runs and when it is
+// closed.
+type trackedDedup struct {
+	*cuckooDeduplicator
+	failAdds bool
+	running  chan struct{}
+	closed   chan struct{}
+}
+
+func newTrackedDedup(failAdds bool) *trackedDedup {
+	return &trackedDedup{cuckooDeduplicator: newCuckooDeduplicator(1024), failAdds: failAdds, running: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+func (d *trackedDedup) Add(ctx context.Context, id string) (bool, error) {
+	if d.failAdds {
+		return false, errors.New("backend unavailable")
+	}
+	return d.cuckooDeduplicator.Add(ctx, id)
+}
+
+func (d *trackedDedup) Run(ctx context.Context) error {
+	d.running <- struct{}{}
+	<-ctx.Done()
+	return nil
+}
+
+func (d *trackedDedup) Close() error {
+	close(d.closed)
+	return nil
+}
+
+// acceptIDs accepts ids on the harness, failing the test unless each is new.
+func acceptIDs(t *testing.T, h *integrationHarness, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		if status, err := h.AcceptAs("acme", id); err != nil || status != statusAccepted {
+			t.Fatalf("accept %d: got %q, %v", id, status, err)
+		}
+	}
+}
+
+func TestBackendSwitchDrains(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	acceptIDs(t, h, 1, 2, 3)
+
+	if _, err := backendSwitch.schedule("roaring", true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	report, _, err := h.CloseWindow(time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Backend != "roaring" || report.UniqueRequestCount != 3 {
+		t.Errorf("got a report of %d ids from %s, want the 3 drained ids from roaring", report.UniqueRequestCount, report.Backend)
+	}
+	if keys := h.Redis.Keys(); len(keys) != 0 {
+		t.Errorf("the old redis backend kept %v", keys)
+	}
+	if p := backendSwitch.scheduled(); p != nil {
+		t.Errorf("switch to %s still pending", p.Backend)
+	}
+}
+
+func TestBackendSwitchFailedDrainKeepsBackend(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	acceptIDs(t, h, 1, 2)
+
+	to := newTrackedDedup(true)
+	backendSwitch.pending = &pendingSwitch{Backend: "cuckoo", Drain: true, to: to}
+	report, _, err := h.CloseWindow(time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Backend != "redis" || report.UniqueRequestCount != 2 || activeBackend() != "redis" {
+		t.Errorf("got a report of %d ids from %s, want the 2 ids from the redis backend kept", report.UniqueRequestCount, report.Backend)
+	}
+	select {
+	case <-to.closed:
+	default:
+		t.Error("the backend the drain failed into wasn't closed")
+	}
+}
+
+func TestBackendSwitchWithoutDrain(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go backendSwitch.Run(runCtx)
+	acceptIDs(t, h, 1, 2)
+
+	tracked := newTrackedDedup(false)
+	backendSwitch.pending = &pendingSwitch{Backend: "cuckoo", to: tracked}
+	report, _, err := h.CloseWindow(time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Backend != "cuckoo" || report.UniqueRequestCount != 0 {
+		t.Errorf("got a report of %d ids from %s, want an empty window from cuckoo", report.UniqueRequestCount, report.Backend)
+	}
+	if keys := h.Redis.Keys(); len(keys) != 0 {
+		t.Errorf("the old redis backend kept %v", keys)
+	}
+	select {
+	case <-tracked.running:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't restart on the new backend")
+	}
+
+	// Switching away again closes the backend once its task returned
+	acceptIDs(t, h, 3)
+	if _, err := backendSwitch.schedule("roaring", false, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.CloseWindow(time.Date(2024, 1, 1, 0, 2, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tracked.closed:
+	case <-time.After(time.Second):
+		t.Error("Run didn't close the old backend")
+	}
+}
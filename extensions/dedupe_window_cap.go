@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// windowCap is set with WINDOW_MAX_UNIQUE; it is also the outermost dedup.
+var windowCap *windowCapDeduplicator
+
+// windowCapDeduplicator watches the window for more unique ids than WINDOW_MAX_UNIQUE. An
+// overflowing window is alerted on as soon as this instance has added that many, or when a
+// shared backend's count says so at the flush, and its report is marked overflowed.
+//
+// With WINDOW_OVERFLOW=approximate the backend stops taking ids once the window overflows:
+// the rest of the window is deduplicated by a cuckoo filter of WINDOW_MAX_UNIQUE ids, and
+// counted by a HyperLogLog fed every id of the window, so ids seen both before and after the
+// switch count once. The report is then approximate. Ids from before the switch are no longer
+// recognised as duplicates, which is the price of not growing the backend any further.
+type windowCapDeduplicator struct {
+	inner       Deduplicator
+	max         int
+	approximate bool
+
+	mu sync.Mutex
+	// unique counts the ids this instance added to the backend in the window.
+	unique     int
+	overflowed bool
+	// sketch and overflow are only kept with WINDOW_OVERFLOW=approximate; overflow is set once
+	// the window switched to it.
+	sketch   *hyperLogLog
+	overflow *cuckooDeduplicator
+	// last describes the window the last Flush ended.
+	last windowOverflow
+}
+
+type windowOverflow struct {
+	overflowed  bool
+	approximate bool
+}
+
+// parseWindowOverflow parses WINDOW_OVERFLOW: report (default) or approximate.
+func parseWindowOverflow(mode string) (approximate bool, err error) {
+	switch mode {
+	case "", "report":
+		return false, nil
+	case "approximate":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown window overflow mode %q, expected report or approximate", mode)
+	}
+}
+
+func newWindowCapDeduplicator(inner Deduplicator, max int, approximate bool) *windowCapDeduplicator {
+	d := &windowCapDeduplicator{inner: inner, max: max, approximate: approximate}
+	if approximate {
+		d.sketch = &hyperLogLog{}
+	}
+	return d
+}
+
+// window returns the overflow store once the window switched to it, after feeding the sketch.
+func (d *windowCapDeduplicator) window(keys ...string) *cuckooDeduplicator {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sketch != nil {
+		for _, key := range keys {
+			d.sketch.add(key)
+		}
+	}
+	return d.overflow
+}
+
+// counted records n ids added to the backend, raising the alarm when they overflow the window.
+func (d *windowCapDeduplicator) counted(n int) {
+	if n == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unique += n; d.unique <= d.max || d.overflowed {
+		return
+	}
+	d.overflowed = true
+	d.alert(d.unique)
+	if d.approximate {
+		d.overflow = newCuckooDeduplicator(d.max)
+		log.Printf("Switching the rest of the window to approximate counting\n")
+	}
+}
+
+func (d *windowCapDeduplicator) alert(count int) {
+	windowOverflows.Inc()
+	windowOverflowing.Set(1)
+	log.Printf("Window overflow: %d unique ids, more than WINDOW_MAX_UNIQUE %d\n", count, d.max)
+	audit.record(auditEntry{
+		Action:  "window.overflow",
+		Actor:   "instance " + instanceID(),
+		Details: map[string]interface{}{"unique_request_count": count, "max": d.max},
+	})
+}
+
+func (d *windowCapDeduplicator) Add(ctx context.Context, key string) (bool, error) {
+	if overflow := d.window(key); overflow != nil {
+		return overflow.Add(ctx, key)
+	}
+	unique, err := d.inner.Add(ctx, key)
+	if err == nil && unique {
+		d.counted(1)
+	}
+	return unique, err
+}
+
+func (d *windowCapDeduplicator) AddBatch(ctx context.Context, keys []string) ([]bool, error) {
+	if overflow := d.window(keys...); overflow != nil {
+		added := make([]bool, len(keys))
+		for i, key := range keys {
+			var err error
+			if added[i], err = overflow.Add(ctx, key); err != nil {
+				return added[:i], err
+			}
+		}
+		return added, nil
+	}
+
+	var added []bool
+	var err error
+	if batcher, ok := d.inner.(BatchAdder); ok {
+		added, err = batcher.AddBatch(ctx, keys)
+	} else {
+		added = make([]bool, len(keys))
+		for i, key := range keys {
+			if added[i], err = d.inner.Add(ctx, key); err != nil {
+				added = added[:i]
+				break
+			}
+		}
+	}
+	// The ids added before an error count too
+	n := 0
+	for _, unique := range added {
+		if unique {
+			n++
+		}
+	}
+	d.counted(n)
+	return added, err
+}
+
+// Count is the sketch's estimate once the window switched to approximate counting.
+func (d *windowCapDeduplicator) Count(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	if d.overflow != nil {
+		defer d.mu.Unlock()
+		return d.sketch.estimate(), nil
+	}
+	d.mu.Unlock()
+	return d.inner.Count(ctx)
+}
+
+func (d *windowCapDeduplicator) Flush(ctx context.Context) (int, error) {
+	count, err := d.inner.Flush(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last := windowOverflow{overflowed: d.overflowed, approximate: d.overflow != nil}
+	if last.approximate && err == nil {
+		count = max(d.sketch.estimate(), d.max)
+	}
+	if err == nil && count > d.max && !last.overflowed {
+		// A shared backend overflowed with ids added by other instances
+		last.overflowed = true
+		d.alert(count)
+	}
+	d.last = last
+	d.unique, d.overflowed, d.overflow = 0, false, nil
+	if d.sketch != nil {
+		d.sketch = &hyperLogLog{}
+	}
+	windowOverflowing.Set(0)
+	return count, err
+}
+
+// lastWindow describes the window ended by the last Flush.
+func (d *windowCapDeduplicator) lastWindow() windowOverflow {
+	if d == nil {
+		return windowOverflow{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.last
+}
+
+// Remove forgets key in the backend, and in the overflow store once the window switched.
+func (d *windowCapDeduplicator) Remove(ctx context.Context, key string) (bool, error) {
+	d.mu.Lock()
+	overflow := d.overflow
+	d.mu.Unlock()
+	if overflow != nil {
+		if removed, _ := overflow.Remove(ctx, key); removed {
+			return true, nil
+		}
+	}
+	remover, ok := d.inner.(Remover)
+	if !ok {
+		return false, fmt.Errorf("the %s dedupe backend can't remove ids", activeBackend())
+	}
+	removed, err := remover.Remove(ctx, key)
+	if removed {
+		d.mu.Lock()
+		d.unique--
+		d.mu.Unlock()
+	}
+	return removed, err
+}
+
+func (d *windowCapDeduplicator) Sync(ctx context.Context) (bool, error) {
+	if syncer, ok := d.inner.(Syncer); ok {
+		return syncer.Sync(ctx)
+	}
+	return false, nil
+}
+
+func (d *windowCapDeduplicator) Run(ctx context.Context) error {
+	if runner, ok := d.inner.(backgroundRunner); ok {
+		return runner.Run(ctx)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// MemoryBytes adds the sketch and the overflow store to what the backend keeps in this process.
+func (d *windowCapDeduplicator) MemoryBytes() uint64 {
+	var total uint64
+	if reporter, ok := d.inner.(MemoryReporter); ok {
+		total = reporter.MemoryBytes()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sketch != nil {
+		total += hllRegisters
+	}
+	if d.overflow != nil {
+		total += d.overflow.MemoryBytes()
+	}
+	return total
+}
+
+func (d *windowCapDeduplicator) Close() error {
+	if closer, ok := d.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
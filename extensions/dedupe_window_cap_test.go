@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingFlush is a backend whose flush fails.
+type failingFlush struct{ countingDedup }
+
+func (*failingFlush) Flush(context.Context) (int, error) { return 0, errors.New("backend down") }
+
+func TestWindowCapApproximateFlushError(t *testing.T) {
+	dedupeKey, _ = parseKeyStrategy("id")
+	d := newWindowCapDeduplicator(&failingFlush{}, 2, true)
+	ctx := context.Background()
+	for _, key := range []string{"1", "2", "3", "4"} {
+		d.Add(ctx, key)
+	}
+	if d.overflow == nil {
+		t.Fatal("the window didn't switch to approximate counting")
+	}
+	if _, err := d.Flush(ctx); err == nil {
+		t.Error("an approximate window's failed flush was reported as a success")
+	}
+}
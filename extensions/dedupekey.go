@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dedupeInput is everything a dedupe key can be derived from.
+type dedupeInput struct {
+	id       int
+	endpoint string
+	tenant   string
+	metadata map[string]string
+	header   http.Header
+	query    url.Values
+	// arrived is when the request was attributed to its window, which picks the privacy salt.
+	arrived time.Time
+}
+
+func newDedupeInput(r *http.Request, id int, endpoint string, meta map[string]string) dedupeInput {
+	return dedupeInput{
+		id:       id,
+		endpoint: endpoint,
+		tenant:   r.Header.Get("X-Tenant-ID"),
+		metadata: meta,
+		header:   r.Header,
+		query:    r.URL.Query(),
+		arrived:  arrivedAt(r),
+	}
+}
+
+// keyStrategy decides what "unique" means by mapping a request to its dedupe key.
+type keyStrategy func(in dedupeInput) string
+
+// parseKeyStrategy parses DEDUPE_KEY: id (default), id_tenant, id_endpoint, or
+// hash:<attr>,<attr>... with attributes id, tenant, endpoint, header:<name>, query:<name>
+// and metadata:<key>.
+func parseKeyStrategy(spec string) (keyStrategy, error) {
+	switch spec {
+	case "", "id":
+		return func(in dedupeInput) string {
+			return strconv.Itoa(in.id)
+		}, nil
+	case "id_tenant":
+		return func(in dedupeInput) string {
+			return idNormalize.fold(in.tenant) + ":" + strconv.Itoa(in.id)
+		}, nil
+	case "id_endpoint":
+		return func(in dedupeInput) string {
+			return strconv.Itoa(in.id) + ":" + in.endpoint
+		}, nil
+	}
+
+	attrs, ok := strings.CutPrefix(spec, "hash:")
+	if !ok {
+		return nil, fmt.Errorf("unknown dedupe key strategy %q", spec)
+	}
+
+	var getters []func(in dedupeInput) string
+	for _, attr := range strings.Split(attrs, ",") {
+		attr = strings.TrimSpace(attr)
+		kind, name, _ := strings.Cut(attr, ":")
+		switch {
+		case attr == "id":
+			getters = append(getters, func(in dedupeInput) string { return strconv.Itoa(in.id) })
+		case attr == "tenant":
+			getters = append(getters, func(in dedupeInput) string { return idNormalize.fold(in.tenant) })
+		case attr == "endpoint":
+			getters = append(getters, func(in dedupeInput) string { return in.endpoint })
+		case kind == "header" && name != "":
+			getters = append(getters, func(in dedupeInput) string { return idNormalize.fold(in.header.Get(name)) })
+		case kind == "query" && name != "":
+			getters = append(getters, func(in dedupeInput) string { return idNormalize.fold(in.query.Get(name)) })
+		case kind == "metadata" && name != "":
+			getters = append(getters, func(in dedupeInput) string { return idNormalize.fold(in.metadata[name]) })
+		default:
+			return nil, fmt.Errorf("unknown dedupe key attribute %q", attr)
+		}
+	}
+
+	return func(in dedupeInput) string {
+		h := sha256.New()
+		for _, get := range getters {
+			value := get(in)
+			// Length prefixes keep ("ab", "c") and ("a", "bc") apart
+			fmt.Fprintf(h, "%d:%s|", len(value), value)
+		}
+		return hex.EncodeToString(h.Sum(nil)[:16])
+	}, nil
+}
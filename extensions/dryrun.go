@@ -0,0 +1,19 @@
+package main
+
+import "log"
+
+// dryRun (DRY_RUN or --dry-run) makes the Kafka, Graphite and Redis stream sinks and endpoint
+// notifications build their messages as usual but log them instead of sending them, so a new
+// configuration can be tried next to production without anything downstream seeing it.
+var dryRun bool
+
+// skipDryRun logs what target would have been sent and reports whether sending should be
+// skipped.
+func skipDryRun(target, format string, args ...interface{}) bool {
+	if !dryRun {
+		return false
+	}
+	dryRunSkipped.WithLabelValues(target).Inc()
+	log.Printf("Dry run, not sending to "+target+": "+format+"\n", args...)
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// duplicateReports publishes a duplicate report for every window; nil without
+// DUPLICATE_REPORT_TOPIC and DUPLICATE_REPORT_URL.
+var duplicateReports *duplicateReporter
+
+// duplicateReport summarises a window's duplicate submissions on one instance, for producer
+// teams to find their retry storms. Keys are dedupe keys as stored, so hashes in privacy mode.
+type duplicateReport struct {
+	Timestamp  string `json:"timestamp"`
+	InstanceID string `json:"instance_id"`
+	// DuplicateHits counts every duplicate submission, DistinctIDs the ids they repeated
+	// (a HyperLogLog estimate).
+	DuplicateHits int            `json:"duplicate_hits"`
+	DistinctIDs   int            `json:"distinct_ids"`
+	TopIDs        map[string]int `json:"top_ids,omitempty"`
+	TopTenants    map[string]int `json:"top_tenants,omitempty"`
+
+	// seq orders the queued reports for forget.
+	seq uint64
+}
+
+// duplicateReporter sends the reports off the window reporter's path, to a Kafka topic and or a
+// URL. Duplicates are counted per instance, so every instance publishes its own report, keyed
+// by instance id. Reports wait in a small queue; a full queue drops the newest.
+type duplicateReporter struct {
+	writer kafkaMessageWriter
+	url    string
+	client *http.Client
+	queue  chan duplicateReport
+
+	mu  sync.Mutex
+	seq uint64
+	// purged holds the keys to drop from the reports queued up to the seq they map to.
+	purged map[string]uint64
+}
+
+func newDuplicateReporter(topic, url string, timeout time.Duration) *duplicateReporter {
+	d := &duplicateReporter{url: url, client: &http.Client{Timeout: timeout}, queue: make(chan duplicateReport, 10), purged: map[string]uint64{}}
+	if topic != "" {
+		d.writer = &kafka.Writer{
+			Addr:                   kafka.TCP(getEnv("KAFKA_BROKER", "")),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+			Compression:            kafkaCompression,
+		}
+	}
+	return d
+}
+
+// enqueue queues the report of the window ending at timestamp; windows without duplicates are
+// reported too, so a quiet producer is told apart from a missing report.
+func (d *duplicateReporter) enqueue(timestamp string, summary duplicateSummary) {
+	if d == nil {
+		return
+	}
+	report := duplicateReport{
+		Timestamp:     timestamp,
+		InstanceID:    instanceID(),
+		DuplicateHits: summary.Total,
+		DistinctIDs:   summary.Distinct,
+		TopIDs:        summary.TopKeys,
+		TopTenants:    summary.TopTenants,
+	}
+	// Queued under mu, so reports reach run in seq order
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	report.seq = d.seq
+	select {
+	case d.queue <- report:
+	default:
+		duplicateReportsSent.WithLabelValues("queue", "dropped").Inc()
+	}
+}
+
+// forget drops a purged key from the reports still queued and from the next one, whose window
+// may have been flushed before the purge reached the tracker.
+func (d *duplicateReporter) forget(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.purged[key] = d.seq + 1
+	d.mu.Unlock()
+}
+
+// scrub removes the purged keys from report. Later reports were queued after report, so the
+// purges that only reach up to it are done with.
+func (d *duplicateReporter) scrub(report *duplicateReport) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, seq := range d.purged {
+		if report.seq <= seq {
+			delete(report.TopIDs, key)
+		}
+		if seq <= report.seq {
+			delete(d.purged, key)
+		}
+	}
+}
+
+func (d *duplicateReporter) run(runCtx context.Context) error {
+	if d.writer != nil {
+		defer d.writer.Close()
+	}
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case report := <-d.queue:
+			d.publish(runCtx, report)
+		}
+	}
+}
+
+func (d *duplicateReporter) publish(runCtx context.Context, report duplicateReport) {
+	d.scrub(&report)
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Failed to marshal duplicate report: %v\n", err)
+		return
+	}
+	if skipDryRun("duplicate report", "%s", payload) {
+		return
+	}
+	publishCtx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+
+	if d.writer != nil {
+		err := d.writer.WriteMessages(publishCtx, kafka.Message{Key: []byte(report.InstanceID), Value: payload})
+		d.count("kafka", err)
+	}
+	if d.url != "" {
+		d.count("url", d.post(publishCtx, payload))
+	}
+}
+
+func (d *duplicateReporter) post(publishCtx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(publishCtx, http.MethodPost, d.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *duplicateReporter) count(destination string, err error) {
+	if err != nil {
+		log.Printf("Failed to publish duplicate report to %s: %v\n", destination, err)
+		duplicateReportsSent.WithLabelValues(destination, "failed").Inc()
+		return
+	}
+	duplicateReportsSent.WithLabelValues(destination, "sent").Inc()
+}
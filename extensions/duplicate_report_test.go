@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/harness"
+)
+
+func TestDuplicateReportPerWindow(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	posted := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- body
+	}))
+	defer receiver.Close()
+	topic := &harness.Kafka{Topic: "duplicates"}
+	duplicateReports = newDuplicateReporter("", receiver.URL, time.Second)
+	duplicateReports.writer = topic
+	oldTracker := duplicates
+	duplicates = newDuplicateTracker(10)
+	defer func() { duplicateReports, duplicates = nil, oldTracker }()
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go duplicateReports.run(runCtx)
+
+	for _, id := range []int{1, 1, 1, 2, 2, 3} {
+		h.AcceptAs("acme", id)
+	}
+	windowEnd := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+	if _, _, err := h.CloseWindow(windowEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	var fromURL duplicateReport
+	select {
+	case body := <-posted:
+		json.Unmarshal(body, &fromURL)
+	case <-time.After(time.Second):
+		t.Fatal("no duplicate report was posted")
+	}
+	if fromURL.Timestamp != windowEnd.Format(time.RFC3339) || fromURL.DuplicateHits != 3 || fromURL.DistinctIDs != 2 {
+		t.Errorf("unexpected duplicate report %+v", fromURL)
+	}
+	if fromURL.TopIDs["1"] != 2 || fromURL.TopIDs["2"] != 1 || fromURL.TopTenants["acme"] != 3 {
+		t.Errorf("got top ids %v and tenants %v, want 1 repeated twice, 2 once, all by acme", fromURL.TopIDs, fromURL.TopTenants)
+	}
+	msgs := topic.Messages("duplicates")
+	if len(msgs) != 1 || string(msgs[0].Key) != instanceID() {
+		t.Fatalf("got %d duplicate reports on the topic, want 1 keyed by the instance", len(msgs))
+	}
+	var fromKafka duplicateReport
+	json.Unmarshal(msgs[0].Value, &fromKafka)
+	if fromKafka.DuplicateHits != fromURL.DuplicateHits || fromKafka.Timestamp != fromURL.Timestamp {
+		t.Errorf("the topic got %+v, the URL %+v", fromKafka, fromURL)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// duplicateHook is set with DUPLICATE_WEBHOOK_URL.
+var duplicateHook *duplicateWebhook
+
+// duplicateEvent is one duplicate submission, with what identifies the client that sent it.
+type duplicateEvent struct {
+	// ID is left out in privacy mode, Key is then the hash the id was deduplicated under.
+	ID        int    `json:"id,omitempty"`
+	Key       string `json:"key"`
+	Tenant    string `json:"tenant,omitempty"`
+	APIKeyID  string `json:"api_key_id,omitempty"`
+	Client    string `json:"client"`
+	UserAgent string `json:"user_agent,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Path      string `json:"path"`
+	Timestamp string `json:"timestamp"`
+
+	// forget marks a purge of Key rather than a duplicate, see forget.
+	forget bool
+}
+
+type duplicateBatch struct {
+	InstanceID string           `json:"instance_id"`
+	Duplicates []duplicateEvent `json:"duplicates"`
+}
+
+// duplicateWebhook posts duplicate submissions to a URL in batches of up to batchSize, at least
+// every interval while there are any, so producer teams can see which of their retries re-send
+// ids. Events are queued without blocking the request; a full queue drops them.
+type duplicateWebhook struct {
+	url       string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+	queue     chan duplicateEvent
+}
+
+func newDuplicateWebhook(url string, batchSize, queueSize int, interval, timeout time.Duration) *duplicateWebhook {
+	return &duplicateWebhook{
+		url:       url,
+		batchSize: max(batchSize, 1),
+		interval:  interval,
+		client:    &http.Client{Timeout: timeout},
+		queue:     make(chan duplicateEvent, queueSize),
+	}
+}
+
+// record queues the duplicate submission of in by r; it is a no-op without a webhook.
+func (d *duplicateWebhook) record(r *http.Request, in dedupeInput) {
+	if d == nil {
+		return
+	}
+	event := duplicateEvent{
+		ID:        in.id,
+		Key:       storedKey(in),
+		Tenant:    in.tenant,
+		Client:    clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: requestID(r),
+		Path:      r.URL.Path,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if idHash != nil {
+		event.ID = 0
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		event.APIKeyID = keyID(hashAPIKey(key))
+	}
+	select {
+	case d.queue <- event:
+	default:
+		duplicateWebhookEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+// recordAll queues the duplicates among a batch's statuses. An error means some ids couldn't be
+// checked and were only reported as duplicates to be safe, so none of them are passed on.
+func (d *duplicateWebhook) recordAll(r *http.Request, ins []dedupeInput, statuses []string, err error) {
+	if d == nil || err != nil {
+		return
+	}
+	for i, status := range statuses {
+		if status == statusDuplicate {
+			d.record(r, ins[i])
+		}
+	}
+}
+
+// forget drops the queued duplicates of a purged key. It goes through the queue, so every event
+// queued before it is already batched when run sees it and no later one is touched.
+func (d *duplicateWebhook) forget(ctx context.Context, key string) error {
+	if d == nil {
+		return nil
+	}
+	select {
+	case d.queue <- duplicateEvent{Key: key, forget: true}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches queued duplicates until runCtx is done, then delivers what is still queued. Sends
+// are bounded by the client timeout rather than runCtx, so a batch in flight at shutdown lands.
+func (d *duplicateWebhook) run(runCtx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	var batch []duplicateEvent
+	add := func(event duplicateEvent) {
+		if event.forget {
+			batch = slices.DeleteFunc(batch, func(e duplicateEvent) bool { return e.Key == event.Key })
+			return
+		}
+		if batch = append(batch, event); len(batch) >= d.batchSize {
+			d.send(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case event := <-d.queue:
+			add(event)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				d.send(batch)
+				batch = nil
+			}
+		case <-runCtx.Done():
+			for {
+				select {
+				case event := <-d.queue:
+					add(event)
+				default:
+					if len(batch) > 0 {
+						d.send(batch)
+					}
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (d *duplicateWebhook) send(events []duplicateEvent) {
+	payload, err := json.Marshal(duplicateBatch{InstanceID: instanceID(), Duplicates: events})
+	if err != nil {
+		log.Printf("Failed to marshal duplicate webhook payload: %v\n", err)
+		return
+	}
+	if skipDryRun("duplicate webhook", "%d duplicates to %s", len(events), d.url) {
+		return
+	}
+
+	err = func() error {
+		resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}()
+	if err != nil {
+		duplicateWebhookEvents.WithLabelValues("failed").Add(float64(len(events)))
+		log.Printf("Failed to send %d duplicates to the duplicate webhook: %v\n", len(events), err)
+		return
+	}
+	duplicateWebhookEvents.WithLabelValues("sent").Add(float64(len(events)))
+}
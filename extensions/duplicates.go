@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// duplicates counts the duplicates of the window for the report; it is only kept when something
+// reports them (SINKS=file, DUPLICATE_REPORT_TOPIC or DUPLICATE_REPORT_URL).
+var duplicates *duplicateTracker
+
+// duplicateTracker counts this instance's duplicate ids per window and finds the most repeated
+// ones with the Space-Saving algorithm: 4*k counters are kept, and a new id takes over the
+// smallest one, so the top k are found in fixed memory however many distinct ids repeat. A
+// count can be overestimated by at most the count of the counter it took over. The tenants that
+// sent the duplicates are ranked the same way, and the distinct duplicated ids are estimated
+// with a HyperLogLog.
+type duplicateTracker struct {
+	k int
+
+	mu       sync.Mutex
+	total    int
+	counts   map[string]int
+	tenants  map[string]int
+	distinct *hyperLogLog
+}
+
+// duplicateSummary is what a window's duplicates come down to.
+type duplicateSummary struct {
+	Total int
+	// Distinct estimates how many ids were duplicated at least once.
+	Distinct   int
+	TopKeys    map[string]int
+	TopTenants map[string]int
+}
+
+func newDuplicateTracker(k int) *duplicateTracker {
+	return &duplicateTracker{k: k, counts: map[string]int{}, tenants: map[string]int{}, distinct: &hyperLogLog{}}
+}
+
+// record counts a duplicate of key, the dedupe key as stored (hashed in privacy mode), sent by
+// tenant.
+func (t *duplicateTracker) record(key, tenant string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	t.distinct.add(key)
+	if t.k <= 0 {
+		return
+	}
+	spaceSave(t.counts, key, 4*t.k)
+	if tenant != "" {
+		spaceSave(t.tenants, tenant, 4*t.k)
+	}
+}
+
+// spaceSave counts key in counts, which holds at most capacity counters.
+func spaceSave(counts map[string]int, key string, capacity int) {
+	if _, ok := counts[key]; ok || len(counts) < capacity {
+		counts[key]++
+		return
+	}
+	smallest, least := "", 0
+	for k, n := range counts {
+		if smallest == "" || n < least {
+			smallest, least = k, n
+		}
+	}
+	delete(counts, smallest)
+	counts[key] = least + 1
+}
+
+// forget drops a purged key from the window's top keys. Total and Distinct only count, so they
+// keep it.
+func (t *duplicateTracker) forget(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.counts, key)
+	t.mu.Unlock()
+}
+
+// flush returns the finished window's duplicates and starts counting the next one's.
+func (t *duplicateTracker) flush() duplicateSummary {
+	if t == nil {
+		return duplicateSummary{}
+	}
+	t.mu.Lock()
+	summary := duplicateSummary{Total: t.total, Distinct: t.distinct.estimate()}
+	counts, tenants := t.counts, t.tenants
+	t.total, t.counts, t.tenants, t.distinct = 0, map[string]int{}, map[string]int{}, &hyperLogLog{}
+	t.mu.Unlock()
+
+	summary.Distinct = min(summary.Distinct, summary.Total)
+	summary.TopKeys, summary.TopTenants = topCounts(counts, t.k), topCounts(tenants, t.k)
+	return summary
+}
+
+// topCounts returns the k largest counts, nil when there are none.
+func topCounts(counts map[string]int, k int) map[string]int {
+	keys := sortedKeys(counts)
+	sort.SliceStable(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	if len(keys) > k {
+		keys = keys[:k]
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	top := make(map[string]int, len(keys))
+	for _, key := range keys {
+		top[key] = counts[key]
+	}
+	return top
+}
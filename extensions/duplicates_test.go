@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDuplicateReporterForget(t *testing.T) {
+	d := newDuplicateReporter("", "", time.Second)
+	d.enqueue("2026-10-14T07:01:00Z", duplicateSummary{TopKeys: map[string]int{"1": 3, "2": 2}})
+	d.forget("1")
+	// The window flushed before the purge reached the tracker is queued after it
+	d.enqueue("2026-10-14T07:02:00Z", duplicateSummary{TopKeys: map[string]int{"1": 2}})
+	d.enqueue("2026-10-14T07:03:00Z", duplicateSummary{TopKeys: map[string]int{"1": 4}})
+
+	for i, want := range []int{1, 0, 1} {
+		report := <-d.queue
+		d.scrub(&report)
+		if len(report.TopIDs) != want {
+			t.Errorf("report %d: got top ids %v, want %d", i, report.TopIDs, want)
+		}
+	}
+	if len(d.purged) != 0 {
+		t.Errorf("got purges %v left after the reports they cover", d.purged)
+	}
+}
+
+func TestDuplicateWebhookForget(t *testing.T) {
+	batches := make(chan duplicateBatch, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch duplicateBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		batches <- batch
+	}))
+	defer server.Close()
+
+	dedupeKey, _ = parseKeyStrategy("id")
+	d := newDuplicateWebhook(server.URL, 10, 10, time.Hour, time.Second)
+	r := httptest.NewRequest(http.MethodGet, "/api/verve/accept", nil)
+	d.record(r, dedupeInput{id: 1})
+	d.record(r, dedupeInput{id: 2})
+	if err := d.forget(context.Background(), storedKey(dedupeInput{id: 1})); err != nil {
+		t.Fatal(err)
+	}
+	d.record(r, dedupeInput{id: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.run(ctx)
+	batch := <-batches
+	if len(batch.Duplicates) != 2 || batch.Duplicates[0].ID != 2 || batch.Duplicates[1].ID != 1 {
+		t.Errorf("got duplicates %+v, want 2 and the 1 queued after the purge", batch.Duplicates)
+	}
+}
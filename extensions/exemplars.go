@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceExemplar labels an observation with the trace it was made in, so a dashboard can jump
+// from a slow bucket or a jump in the count to a trace of it. Only traces a caller propagated
+// and sampled get one: the service exports no spans of its own, so the traces it starts, like
+// unsampled ones, aren't recorded anywhere.
+func traceExemplar(ctx context.Context) prometheus.Labels {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	if !ok || tc.traceID == "" || !tc.sampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": tc.traceID}
+}
+
+// observeTraced observes v, with the trace of ctx as exemplar when there is one.
+func observeTraced(ctx context.Context, o prometheus.Observer, v float64) {
+	if exemplar := traceExemplar(ctx); exemplar != nil {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, exemplar)
+			return
+		}
+	}
+	o.Observe(v)
+}
+
+// addTraced adds v to c, with the trace of ctx as exemplar when there is one.
+func addTraced(ctx context.Context, c prometheus.Counter, v float64) {
+	if exemplar := traceExemplar(ctx); exemplar != nil {
+		if ea, ok := c.(prometheus.ExemplarAdder); ok {
+			ea.AddWithExemplar(v, exemplar)
+			return
+		}
+	}
+	c.Add(v)
+}
+
+// countUnique counts n ids new in the current window for verve_unique_ids_total.
+func countUnique(ctx context.Context, n int) {
+	if n > 0 {
+		addTraced(ctx, uniqueIDs, float64(n))
+	}
+}
+
+// instrumented observes how long the requests of route took in verve_http_request_duration_seconds.
+func instrumented(route string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			scaling.countRequest()
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(rec, r)
+			observeTraced(r.Context(), requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)), time.Since(start).Seconds())
+		}
+	}
+}
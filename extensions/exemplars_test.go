@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceExemplarOnlyForCallerTraces(t *testing.T) {
+	var got map[string]string
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = traceExemplar(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got != nil {
+		t.Errorf("got exemplar %v for a trace the service started", got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got exemplar %v for a sampled caller trace, want its trace id", got)
+	}
+}
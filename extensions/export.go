@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportRow is one exported window.
+type exportRow struct {
+	Timestamp          string `json:"timestamp"`
+	UniqueRequestCount int    `json:"unique_request_count"`
+	Period             string `json:"period"`
+	Approximate        bool   `json:"approximate"`
+	// Compacted rows sum the finer windows they replaced, see historyCompactor.
+	Compacted bool `json:"compacted,omitempty"`
+}
+
+// Stream the window history between from and to as a CSV or JSON download
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		writeErrorV2(w, http.StatusNotImplemented, "history_disabled", "Window history is disabled, add 'history' to SINKS to enable it")
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErrorV2(w, http.StatusBadRequest, "invalid_range", "'to' must be an RFC 3339 time")
+			return
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErrorV2(w, http.StatusBadRequest, "invalid_range", "'from' must be an RFC 3339 time")
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_range", "'from' must be before 'to'")
+		return
+	}
+
+	// Minute windows by default; period=hour or period=day exports rollups instead
+	period := query.Get("period")
+	if period == "minute" {
+		period = ""
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_format", "'format' must be csv or json")
+		return
+	}
+
+	// A first pass over the range yields the validators, so polling an unchanged range costs a
+	// scan but no encoding or transfer
+	sum := fnv.New64a()
+	var modified time.Time
+	err = history.Scan(r.Context(), from, to, func(report windowReport) error {
+		if report.Period == period {
+			fmt.Fprintf(sum, "%s %d %t\n", report.Timestamp, report.UniqueRequestCount, report.Approximate)
+			if t := reportTime(report); t.After(modified) {
+				modified = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error scanning window history: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "history_failed", "Failed to read the window history")
+		return
+	}
+	if notModified(w, r, fmt.Sprintf(`W/"%s-%x"`, format, sum.Sum64()), modified) {
+		return
+	}
+
+	filename := fmt.Sprintf("verve-windows-%s-%s.%s", from.Format("20060102T150405Z"), to.Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	flusher, _ := w.(http.Flusher)
+
+	var write func(row exportRow) error
+	var finish func() error
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "unique_request_count", "period", "approximate"})
+		write = func(row exportRow) error {
+			return cw.Write([]string{row.Timestamp, strconv.Itoa(row.UniqueRequestCount), row.Period, strconv.FormatBool(row.Approximate)})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		// A JSON array written element by element, so large ranges aren't buffered
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		w.Write([]byte("["))
+		first := true
+		write = func(row exportRow) error {
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			return enc.Encode(row)
+		}
+		finish = func() error {
+			_, err := w.Write([]byte("]\n"))
+			return err
+		}
+	}
+
+	rows := 0
+	err = history.Scan(r.Context(), from, to, func(report windowReport) error {
+		if report.Period != period {
+			return nil
+		}
+		rowPeriod := report.Period
+		if rowPeriod == "" {
+			rowPeriod = "minute"
+		}
+		if err := write(exportRow{
+			Timestamp:          report.Timestamp,
+			UniqueRequestCount: report.UniqueRequestCount,
+			Period:             rowPeriod,
+			Approximate:        report.Approximate,
+			Compacted:          report.Compacted,
+		}); err != nil {
+			return err
+		}
+		if rows++; rows%500 == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, so the download is cut short instead
+		log.Printf("Error exporting window history: %v\n", err)
+		return
+	}
+	if err := finish(); err != nil {
+		log.Printf("Error exporting window history: %v\n", err)
+	}
+}
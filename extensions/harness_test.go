@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/client"
+	"github.com/abhishek818/verve-technical-challenge/harness"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// integrationHarness wires the service onto the harness package: the real routes, middleware
+// and window reporter serve from the redis dedupe backend on its miniredis, publishing through
+// the kafka sink into its in-memory Kafka. It is how features that need Redis or Kafka are
+// checked end to end without either running.
+//
+// It sets the package state main would, so only one harness may exist per process.
+type integrationHarness struct {
+	Redis  *miniredis.Miniredis
+	Kafka  *harness.Kafka
+	Server *harness.Server
+	Client *client.Client
+
+	rdb *harness.Redis
+}
+
+// harnessTopic is the report topic of the harness.
+const harnessTopic = "unique-id-count"
+
+func newIntegrationHarness() (*integrationHarness, error) {
+	rdb, err := harness.NewRedis()
+	if err != nil {
+		return nil, err
+	}
+	h := &integrationHarness{Redis: rdb.Server, Kafka: &harness.Kafka{Topic: harnessTopic}, rdb: rdb}
+
+	redisDB = rdb.Client
+	coordinator = localCoordinator{}
+	dedupeKey, _ = parseKeyStrategy("id")
+	tenants, tenantWindows = nil, nil
+	kafkaKey, _ = parseMessageKeyStrategy("tenant", "unique-id-count")
+	kafkaFormat = jsonPayload{}
+	kafkaWriter, tenantWriter = h.Kafka, h.Kafka
+	primary, err := newDeduplicator("redis")
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	dedupeBackend = "redis"
+	backendSwitch = newSwitchingDeduplicator(primary, "redis")
+	dedup = backendSwitch
+	sinks = []Sink{&kafkaSink{}}
+	notifications = newNotifier(1, 10, 1, 10, time.Second)
+	registerRoutes()
+
+	h.Server = harness.NewServer(newHandler())
+	h.Client = h.Server.Client
+	return h, nil
+}
+
+func (h *integrationHarness) Close() {
+	if h.Server != nil {
+		h.Server.Close()
+	}
+	h.rdb.Close()
+}
+
+// AcceptAs accepts id through the v2 API on behalf of tenant, returning the status.
+func (h *integrationHarness) AcceptAs(tenant string, id int) (string, error) {
+	return h.Server.AcceptAs(tenant, id)
+}
+
+// CloseWindow ends the window at the given time, like the ticker does, and returns the report
+// and tenant messages published to Kafka for it.
+func (h *integrationHarness) CloseWindow(at time.Time) (windowReport, []tenantReport, error) {
+	before := len(h.Kafka.Messages(harnessTopic))
+	reportWindow(at)
+
+	var report *windowReport
+	var tenantMessages []tenantReport
+	for _, m := range h.Kafka.Messages(harnessTopic)[before:] {
+		// Tenants without a topic of their own share the report topic
+		var msg struct {
+			windowReport
+			Tenant string `json:"tenant"`
+		}
+		if err := json.Unmarshal(m.Value, &msg); err != nil {
+			return windowReport{}, nil, err
+		}
+		if msg.Timestamp != at.Format(time.RFC3339) {
+			continue
+		}
+		if msg.Tenant != "" {
+			tenantMessages = append(tenantMessages, tenantReport{Tenant: msg.Tenant, UniqueRequestCount: msg.UniqueRequestCount, Timestamp: msg.Timestamp})
+			continue
+		}
+		report = &msg.windowReport
+	}
+	if report == nil {
+		return windowReport{}, nil, fmt.Errorf("no report published for the window ending %s", at.Format(time.RFC3339))
+	}
+	return *report, tenantMessages, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// startedAt is when the process started, for the uptime in heartbeats.
+var startedAt = time.Now()
+
+// heartbeatMessage is published every HEARTBEAT_INTERVAL by every instance, whether or not there
+// is traffic, so that consumers can tell a quiet window from a dead service.
+type heartbeatMessage struct {
+	InstanceID    string  `json:"instance_id"`
+	Version       string  `json:"version"`
+	Backend       string  `json:"backend"`
+	Timestamp     string  `json:"timestamp"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Leader        bool    `json:"leader"`
+	// LastWindow is the timestamp of the last window this instance published, empty when it
+	// hasn't published one since it started.
+	LastWindow string          `json:"last_window,omitempty"`
+	Health     map[string]bool `json:"health"`
+}
+
+// sinkHealth remembers the outcome of the last publish to every sink.
+type sinkHealth struct {
+	mu         sync.Mutex
+	ok         map[string]bool
+	lastWindow string
+}
+
+var sinkStatus = &sinkHealth{ok: map[string]bool{}}
+
+// publishTo publishes report to s and records the outcome for the heartbeat.
+func publishTo(ctx context.Context, s Sink, report windowReport) error {
+	err := s.Publish(ctx, report)
+
+	sinkStatus.mu.Lock()
+	defer sinkStatus.mu.Unlock()
+	sinkStatus.ok[s.Name()] = err == nil
+	if err == nil && report.Period == "" && report.Timestamp > sinkStatus.lastWindow {
+		sinkStatus.lastWindow = report.Timestamp
+	}
+	return err
+}
+
+// heartbeater publishes heartbeats to topic, or only exports them as metrics without one.
+type heartbeater struct {
+	interval time.Duration
+	writer   kafkaMessageWriter
+}
+
+func newHeartbeater(interval time.Duration, topic string) *heartbeater {
+	h := &heartbeater{interval: interval}
+	if topic != "" {
+		h.writer = &kafka.Writer{
+			Addr:                   kafka.TCP(getEnv("KAFKA_BROKER", "")),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+			Compression:            kafkaCompression,
+		}
+	}
+	return h
+}
+
+func (h *heartbeater) run(runCtx context.Context) error {
+	if h.writer != nil {
+		defer h.writer.Close()
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.beat(runCtx)
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *heartbeater) beat(runCtx context.Context) {
+	now := time.Now()
+	msg := heartbeatMessage{
+		InstanceID:    instanceID(),
+		Version:       currentBuild().Version,
+		Backend:       activeBackend(),
+		Timestamp:     now.UTC().Format(time.RFC3339),
+		UptimeSeconds: now.Sub(startedAt).Seconds(),
+		Leader:        coordinator.IsLeader(),
+		Health:        checkHealth(runCtx),
+	}
+	sinkStatus.mu.Lock()
+	msg.LastWindow = sinkStatus.lastWindow
+	sinkStatus.mu.Unlock()
+
+	heartbeatTimestamp.Set(float64(now.Unix()))
+	uptimeSeconds.Set(msg.UptimeSeconds)
+	if t, err := time.Parse(time.RFC3339, msg.LastWindow); err == nil {
+		lastWindowPublished.Set(float64(t.Unix()))
+	}
+	for check, ok := range msg.Health {
+		if ok {
+			healthCheck.WithLabelValues(check).Set(1)
+		} else {
+			healthCheck.WithLabelValues(check).Set(0)
+		}
+	}
+
+	if h.writer == nil {
+		return
+	}
+	value, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal heartbeat: %v\n", err)
+		return
+	}
+	if skipDryRun("heartbeat", "%s", value) {
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(runCtx, h.interval)
+	defer cancel()
+	resources.kafkaWrites.Add(1)
+	defer resources.kafkaWrites.Add(-1)
+	if err := h.writer.WriteMessages(writeCtx, kafka.Message{Key: []byte(msg.InstanceID), Value: value}); err != nil && runCtx.Err() == nil {
+		log.Printf("Failed to publish heartbeat: %v\n", err)
+	}
+}
+
+// checkHealth reports whether the dedupe backend answers, every sink took its last report, and
+// the notification queue has room.
+func checkHealth(runCtx context.Context) map[string]bool {
+	health := map[string]bool{}
+
+	countCtx, cancel := context.WithTimeout(runCtx, 5*time.Second)
+	defer cancel()
+	_, err := notifyCounts.get(countCtx)
+	health["dedupe"] = err == nil
+
+	sinkStatus.mu.Lock()
+	health["sinks"] = true
+	for _, ok := range sinkStatus.ok {
+		health["sinks"] = health["sinks"] && ok
+	}
+	sinkStatus.mu.Unlock()
+
+	health["notifications"] = len(notifications.queue) < cap(notifications.queue)
+	return health
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/harness"
+)
+
+// stubSink fails every publish when err is set.
+type stubSink struct {
+	name string
+	err  error
+}
+
+func (s stubSink) Name() string                                { return s.name }
+func (s stubSink) Publish(context.Context, windowReport) error { return s.err }
+
+func TestHeartbeatReportsHealth(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	sinkStatus = &sinkHealth{ok: map[string]bool{}}
+	defer func() { sinkStatus = &sinkHealth{ok: map[string]bool{}} }()
+	heartbeats := &harness.Kafka{Topic: "heartbeats"}
+	beater := newHeartbeater(time.Minute, "")
+	beater.writer = heartbeats
+
+	report := windowReport{Timestamp: "2024-01-01T00:01:00Z"}
+	publishTo(ctx, stubSink{name: "kafka"}, report)
+	beater.beat(ctx)
+	publishTo(ctx, stubSink{name: "graphite", err: errors.New("unreachable")}, report)
+	beater.beat(ctx)
+
+	msgs := heartbeats.Messages("heartbeats")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d heartbeats, want 2", len(msgs))
+	}
+	var healthy, failing heartbeatMessage
+	json.Unmarshal(msgs[0].Value, &healthy)
+	json.Unmarshal(msgs[1].Value, &failing)
+	if string(msgs[0].Key) != instanceID() || !healthy.Leader || healthy.Backend != "redis" || healthy.LastWindow != report.Timestamp {
+		t.Errorf("unexpected heartbeat %+v", healthy)
+	}
+	if !healthy.Health["dedupe"] || !healthy.Health["sinks"] || !healthy.Health["notifications"] {
+		t.Errorf("got health %v with every dependency working", healthy.Health)
+	}
+	if failing.Health["sinks"] || !failing.Health["dedupe"] {
+		t.Errorf("got health %v after a sink failed", failing.Health)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyStore keeps published window reports for later queries such as the export endpoint.
+type historyStore interface {
+	Append(ctx context.Context, report windowReport) error
+	// Scan calls fn for every report with a timestamp in [from, to), oldest first.
+	Scan(ctx context.Context, from, to time.Time, fn func(windowReport) error) error
+	// Remove deletes the reports of period ("" for minute windows) with a timestamp in [from, to).
+	Remove(ctx context.Context, period string, from, to time.Time) error
+}
+
+func newHistoryStore(kind string, retention time.Duration) (historyStore, error) {
+	switch kind {
+	case "redis":
+		if redisDB == nil {
+			return nil, fmt.Errorf("redis history store requires a Redis connection")
+		}
+		return &redisHistory{client: redisDB, replicas: replicas, retention: retention}, nil
+	case "bolt":
+		return newBoltHistory(getEnv("HISTORY_PATH", "history.db"), retention)
+	default:
+		return nil, fmt.Errorf("unknown history store %q", kind)
+	}
+}
+
+// historySink records every report in the history store.
+type historySink struct {
+	store historyStore
+}
+
+func (historySink) Name() string { return "history" }
+
+func (s historySink) Publish(ctx context.Context, report windowReport) error {
+	return s.store.Append(ctx, report)
+}
+
+func reportTime(report windowReport) time.Time {
+	t, err := time.Parse(time.RFC3339, report.Timestamp)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+const redisHistoryKey = "verve:history"
+
+// redisHistory is a sorted set of report JSON scored by report time, shared by all replicas.
+type redisHistory struct {
+	client *redis.Client
+	// replicas serve Scan when REDIS_REPLICAS is set.
+	replicas  *redisReplicaSet
+	retention time.Duration
+}
+
+func (h *redisHistory) Append(ctx context.Context, report windowReport) error {
+	member, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	at := reportTime(report)
+	_, err = h.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, redisHistoryKey, redis.Z{Score: float64(at.Unix()), Member: member})
+		if h.retention > 0 {
+			pipe.ZRemRangeByScore(ctx, redisHistoryKey, "-inf", "("+strconv.FormatInt(at.Add(-h.retention).Unix(), 10))
+		}
+		return nil
+	})
+	return err
+}
+
+func (h *redisHistory) Scan(ctx context.Context, from, to time.Time, fn func(windowReport) error) error {
+	const page = 1000
+	for offset := int64(0); ; offset += page {
+		var members []string
+		err := h.replicas.read(ctx, h.client, func(client *redis.Client) error {
+			var err error
+			members, err = client.ZRangeByScore(ctx, redisHistoryKey, &redis.ZRangeBy{
+				Min:    strconv.FormatInt(from.Unix(), 10),
+				Max:    "(" + strconv.FormatInt(to.Unix(), 10),
+				Offset: offset,
+				Count:  page,
+			}).Result()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			var report windowReport
+			if err := json.Unmarshal([]byte(member), &report); err != nil {
+				continue
+			}
+			if err := fn(report); err != nil {
+				return err
+			}
+		}
+		if len(members) < page {
+			return nil
+		}
+	}
+}
+
+func (h *redisHistory) Remove(ctx context.Context, period string, from, to time.Time) error {
+	members, err := h.client.ZRangeByScore(ctx, redisHistoryKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10),
+		Max: "(" + strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	var remove []interface{}
+	for _, member := range members {
+		var report windowReport
+		if err := json.Unmarshal([]byte(member), &report); err == nil && report.Period == period {
+			remove = append(remove, member)
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	return h.client.ZRem(ctx, redisHistoryKey, remove...).Err()
+}
+
+var boltHistoryBucket = []byte("history")
+
+// boltHistory keeps reports in a local bbolt file, keyed by big endian report time followed by
+// the period so that minute windows and rollups ending at the same time don't collide.
+type boltHistory struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+func newBoltHistory(path string, retention time.Duration) (*boltHistory, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltHistoryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltHistory{db: db, retention: retention}, nil
+}
+
+func boltHistoryKey(t time.Time, period string) []byte {
+	key := make([]byte, 8, 8+len(period))
+	binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	return append(key, period...)
+}
+
+func (h *boltHistory) Append(_ context.Context, report windowReport) error {
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	at := reportTime(report)
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltHistoryBucket)
+		// Drop reports that fell out of the retention period
+		if h.retention > 0 {
+			cutoff := boltHistoryKey(at.Add(-h.retention), "")
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return b.Put(boltHistoryKey(at, report.Period), value)
+	})
+}
+
+func (h *boltHistory) Scan(_ context.Context, from, to time.Time, fn func(windowReport) error) error {
+	return h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltHistoryBucket).Cursor()
+		end := boltHistoryKey(to, "")
+		for k, v := c.Seek(boltHistoryKey(from, "")); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			var report windowReport
+			if err := json.Unmarshal(v, &report); err != nil {
+				continue
+			}
+			if err := fn(report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (h *boltHistory) Remove(_ context.Context, period string, from, to time.Time) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		// Collected first, deleting under a cursor can make it skip the next key
+		b := tx.Bucket(boltHistoryBucket)
+		c := b.Cursor()
+		end := boltHistoryKey(to, "")
+		var remove [][]byte
+		for k, _ := c.Seek(boltHistoryKey(from, "")); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			if string(k[8:]) == period {
+				remove = append(remove, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (h *boltHistory) Close() error {
+	return h.db.Close()
+}
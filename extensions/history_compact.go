@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// downsampleTier replaces the reports of period older than after with one report per into.
+type downsampleTier struct {
+	period string
+	into   rollupPeriod
+	after  time.Duration
+}
+
+// historyCompactor downsamples the history store (HISTORY_DOWNSAMPLE): minute windows older
+// than HISTORY_MINUTE_RETENTION become hours, hours older than HISTORY_HOUR_RETENTION become
+// days, and days are kept for HISTORY_RETENTION, forever by default. Where the hour or day
+// rollup (ROLLUPS) was recorded it replaces the finer reports as is. Otherwise the finer
+// counts are summed into a report marked compacted: ids seen in several of the finer windows
+// are counted once in each, so the sum is an upper bound of the unique count, not the count.
+type historyCompactor struct {
+	store    historyStore
+	tiers    []downsampleTier
+	interval time.Duration
+}
+
+func newHistoryCompactor(store historyStore, minuteRetention, hourRetention, interval time.Duration) *historyCompactor {
+	return &historyCompactor{
+		store: store,
+		tiers: []downsampleTier{
+			{period: "", into: rollupPeriods["hour"], after: minuteRetention},
+			{period: "hour", into: rollupPeriods["day"], after: hourRetention},
+		},
+		interval: interval,
+	}
+}
+
+func (c *historyCompactor) run(runCtx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		// A shared history is compacted by the leader alone
+		if _, shared := c.store.(*redisHistory); !shared || coordinator.IsLeader() {
+			if err := c.compact(runCtx, time.Now()); err != nil && runCtx.Err() == nil {
+				log.Printf("Error compacting window history: %v\n", err)
+			}
+		}
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// compactGroup are the reports of one tier that go into one coarser report.
+type compactGroup struct {
+	count   int
+	reports int
+}
+
+func (c *historyCompactor) compact(ctx context.Context, now time.Time) error {
+	for _, tier := range c.tiers {
+		cutoff := tier.into.start(now.Add(-tier.after))
+		groups := map[time.Time]*compactGroup{}
+		recorded := map[time.Time]bool{}
+		err := c.store.Scan(ctx, time.Unix(0, 0), now, func(report windowReport) error {
+			switch report.Period {
+			case tier.period:
+				if start := tier.into.start(reportStart(report)); start.Before(cutoff) {
+					g, ok := groups[start]
+					if !ok {
+						g = &compactGroup{}
+						groups[start] = g
+					}
+					g.count += report.UniqueRequestCount
+					g.reports++
+				}
+			case tier.into.name:
+				if start, err := time.Parse(time.RFC3339, report.PeriodStart); err == nil {
+					recorded[start.UTC()] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		starts := make([]time.Time, 0, len(groups))
+		for start := range groups {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+		for _, start := range starts {
+			g, end := groups[start], tier.into.end(start)
+			// The coarser report is written before the finer ones go, so a failure in between
+			// leaves both rather than neither
+			if !recorded[start] {
+				build := currentBuild()
+				err := c.store.Append(ctx, windowReport{
+					UniqueRequestCount: g.count,
+					Timestamp:          end.Format(time.RFC3339),
+					Version:            build.Version,
+					GitSHA:             build.GitSHA,
+					InstanceID:         instanceID(),
+					Backend:            activeBackend(),
+					Period:             tier.into.name,
+					PeriodStart:        start.Format(time.RFC3339),
+					Approximate:        true,
+					Compacted:          true,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			// Reports are stamped when their period ends, so a period's are in (start, end]
+			if err := c.store.Remove(ctx, tier.period, start.Add(time.Second), end.Add(time.Second)); err != nil {
+				return err
+			}
+			historyCompacted.WithLabelValues(periodName(tier.period)).Add(float64(g.reports))
+		}
+		if len(starts) > 0 {
+			log.Printf("Compacted the window history: %d %s periods downsampled to %s\n", len(starts), periodName(tier.period), tier.into.name)
+		}
+	}
+	return nil
+}
+
+// reportStart is a point inside the period a report covers.
+func reportStart(report windowReport) time.Time {
+	if start, err := time.Parse(time.RFC3339, report.PeriodStart); err == nil {
+		return start
+	}
+	// Minute windows are stamped when they close
+	return reportTime(report).Add(-time.Second)
+}
+
+func periodName(period string) string {
+	if period == "" {
+		return "minute"
+	}
+	return period
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// idNormalize is the ID_NORMALIZE pipeline; main replaces it with the configured one.
+var idNormalize = &idNormalizer{}
+
+// idNormalizer brings the ids and key attributes of different producers into one spelling, so
+// that " 7", "7.0" and 7 are the same id, and tenant "Acme" the same as "acme".
+type idNormalizer struct {
+	// trim drops whitespace around raw ids.
+	trim bool
+	// canonical parses any decimal spelling of an integer, see canonicalInt, and accepts JSON
+	// ids sent as strings.
+	canonical bool
+	// casefold lowercases the string attributes of dedupe keys: the tenant of id_tenant and
+	// the tenant, header, query and metadata attributes of hash keys.
+	casefold bool
+}
+
+// parseIDNormalize parses ID_NORMALIZE, a comma separated list of trim, canonical and casefold.
+// The empty list, or "none", parses ids strictly as before.
+func parseIDNormalize(spec string) (*idNormalizer, error) {
+	n := &idNormalizer{}
+	if strings.TrimSpace(spec) == "none" {
+		return n, nil
+	}
+	for _, step := range strings.Split(spec, ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "":
+		case "trim":
+			n.trim = true
+		case "canonical":
+			n.canonical = true
+		case "casefold":
+			n.casefold = true
+		default:
+			return nil, fmt.Errorf("unknown id normalization %q, expected trim, canonical or casefold", step)
+		}
+	}
+	return n, nil
+}
+
+func (n *idNormalizer) String() string {
+	var steps []string
+	for _, step := range []struct {
+		name string
+		on   bool
+	}{{"trim", n.trim}, {"canonical", n.canonical}, {"casefold", n.casefold}} {
+		if step.on {
+			steps = append(steps, step.name)
+		}
+	}
+	return layerList(steps)
+}
+
+// parseID parses a raw id through the pipeline.
+func (n *idNormalizer) parseID(raw string) (int, error) {
+	if n.trim {
+		raw = strings.TrimSpace(raw)
+	}
+	if n.canonical {
+		return canonicalInt(raw)
+	}
+	return strconv.Atoi(raw)
+}
+
+// fold is applied to the string attributes of dedupe keys.
+func (n *idNormalizer) fold(s string) string {
+	if n.casefold {
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// canonicalInt parses a decimal spelling of an integer: an optional sign, leading zeros and a
+// fraction or exponent that leaves an integer, e.g. "+007", "7.0", "7e0" or "0.7e1".
+func canonicalInt(s string) (int, error) {
+	invalid := fmt.Errorf("%q is not an integer", s)
+	if len(s) > 64 {
+		return 0, invalid
+	}
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e < -64 || e > 64 {
+			return 0, invalid
+		}
+		mantissa, exp = s[:i], e
+	}
+	sign := ""
+	if mantissa != "" && (mantissa[0] == '+' || mantissa[0] == '-') {
+		sign, mantissa = mantissa[:1], mantissa[1:]
+	}
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	digits := whole + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, invalid
+	}
+
+	digits = strings.TrimLeft(digits, "0")
+	if exp -= len(frac); exp < 0 {
+		cut := max(len(digits)+exp, 0)
+		if strings.Trim(digits[cut:], "0") != "" {
+			return 0, invalid
+		}
+		digits = digits[:cut]
+	} else if digits != "" {
+		digits += strings.Repeat("0", exp)
+	}
+	if digits == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(sign + digits)
+}
+
+// jsonID is an id in a v2 or batch request body. It decodes like an int unless ID_NORMALIZE
+// has canonical, in which case strings and non-canonical numbers go through the pipeline. trim
+// alone doesn't change it, a JSON number has no whitespace to drop.
+type jsonID int
+
+func (id *jsonID) UnmarshalJSON(b []byte) error {
+	n := idNormalize
+	if !n.canonical {
+		return json.Unmarshal(b, (*int)(id))
+	}
+	raw := string(b)
+	switch {
+	case raw == "null":
+		return nil
+	case strings.HasPrefix(raw, `"`):
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return err
+		}
+	}
+	v, err := n.parseID(raw)
+	if err != nil {
+		return err
+	}
+	*id = jsonID(v)
+	return nil
+}
+
+// idHashes are the hash functions the cuckoo filter and the rollup sketches can be configured
+// with (CUCKOO_HASH, ROLLUP_HASH).
+var idHashes = map[string]func(key string) uint64{
+	"xxhash": xxhash.Sum64String,
+	"fnv":    fnv64a,
+}
+
+func newIDHash(name string) (func(key string) uint64, error) {
+	h, ok := idHashes[strings.TrimSpace(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q, expected one of %s", name, strings.Join(sortedKeys(idHashes), ", "))
+	}
+	return h, nil
+}
+
+func fnv64a(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
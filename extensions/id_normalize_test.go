@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONIDStringsOnlyCanonical(t *testing.T) {
+	old := idNormalize
+	defer func() { idNormalize = old }()
+	decode := func(spec, body string) (int, error) {
+		n, err := parseIDNormalize(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idNormalize = n
+		var id jsonID
+		err = json.Unmarshal([]byte(body), &id)
+		return int(id), err
+	}
+
+	for _, spec := range []string{"none", "trim"} {
+		if _, err := decode(spec, `" 7"`); err == nil {
+			t.Errorf("ID_NORMALIZE=%s accepted a string id", spec)
+		}
+		if id, err := decode(spec, `7`); err != nil || id != 7 {
+			t.Errorf("ID_NORMALIZE=%s: got %d, %v for 7", spec, id, err)
+		}
+	}
+	if id, err := decode("trim,canonical", `" 7.0"`); err != nil || id != 7 {
+		t.Errorf("ID_NORMALIZE=trim,canonical: got %d, %v for \" 7.0\", want 7", id, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// idExtractor finds the raw id of a v1 accept request, reporting false when it isn't there.
+type idExtractor func(r *http.Request) (string, bool)
+
+// extractID is the ID_SOURCE in use.
+var extractID, _ = parseIDSource("query:id")
+
+// parseIDSource parses ID_SOURCE: a comma separated list of query:<name>, header:<name> and
+// json:<path> (a dot separated path into a JSON body, with numeric elements indexing arrays,
+// e.g. json:user.id or json:events.0.id), tried in order until one has a value.
+func parseIDSource(spec string) (idExtractor, error) {
+	var extractors []idExtractor
+	for _, source := range strings.Split(spec, ",") {
+		kind, name, ok := strings.Cut(strings.TrimSpace(source), ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid id source %q, expected query:<name>, header:<name> or json:<path>", source)
+		}
+		switch kind {
+		case "query":
+			extractors = append(extractors, func(r *http.Request) (string, bool) {
+				value := r.URL.Query().Get(name)
+				return value, value != ""
+			})
+		case "header":
+			extractors = append(extractors, func(r *http.Request) (string, bool) {
+				value := r.Header.Get(name)
+				return value, value != ""
+			})
+		case "json":
+			path := strings.Split(name, ".")
+			extractors = append(extractors, func(r *http.Request) (string, bool) {
+				return jsonPath(r, path)
+			})
+		default:
+			return nil, fmt.Errorf("unknown id source %q", kind)
+		}
+	}
+
+	return func(r *http.Request) (string, bool) {
+		for _, extract := range extractors {
+			if value, ok := extract(r); ok {
+				return value, true
+			}
+		}
+		return "", false
+	}, nil
+}
+
+// jsonPath looks path up in the JSON body of r. The body is read once and put back, so several
+// json sources can share it.
+func jsonPath(r *http.Request, path []string) (string, bool) {
+	if r.Body == nil {
+		return "", false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return "", false
+	}
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			value = v[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		return v.String(), true
+	case string:
+		return v, v != ""
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIDSourceOrder(t *testing.T) {
+	extract, err := parseIDSource("json:events.0.id, header:X-User-ID, query:id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, target, header, body string
+		want                       string
+		found                      bool
+	}{
+		{name: "json path", target: "/?id=3", header: "2", body: `{"events": [{"id": 1}]}`, want: "1", found: true},
+		{name: "json string", target: "/", body: `{"events": [{"id": "7"}]}`, want: "7", found: true},
+		{name: "header after a missing path", target: "/?id=3", header: "2", body: `{"events": []}`, want: "2", found: true},
+		{name: "query after a body that isn't JSON", target: "/?id=3", body: "id=1", want: "3", found: true},
+		{name: "nowhere", target: "/", body: `{"events": [{"id": null}]}`},
+	} {
+		r := httptest.NewRequest("POST", tc.target, strings.NewReader(tc.body))
+		if tc.header != "" {
+			r.Header.Set("X-User-ID", tc.header)
+		}
+		if got, ok := extract(r); got != tc.want || ok != tc.found {
+			t.Errorf("%s: got %q, %t, want %q, %t", tc.name, got, ok, tc.want, tc.found)
+		}
+	}
+}
+
+func TestIDSourceKeepsBody(t *testing.T) {
+	extract, err := parseIDSource("json:a,json:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"b": 5}`))
+	if got, ok := extract(r); got != "5" || !ok {
+		t.Errorf("got %q, %t from the second json source, want 5", got, ok)
+	}
+}
+
+func TestParseIDSourceRejects(t *testing.T) {
+	for _, spec := range []string{"id", "query:", "cookie:id"} {
+		if _, err := parseIDSource(spec); err == nil {
+			t.Errorf("ID_SOURCE=%q was accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// The TCP ingest protocol (INGEST_TCP_ADDR) is a stream of length-prefixed frames in both
+// directions:
+//
+//	frame = uvarint(len(payload)) payload
+//	batch = 0x01 uvarint(seq) uvarint(n) n*uvarint(id)          producer -> server
+//	ack   = 0x81 uvarint(seq) status uvarint(n) bitmap          server -> producer
+//	error = 0xff uvarint(seq) message                           server -> producer, then close
+//
+// Bit i of the ack bitmap (byte i/8, least significant bit first) is set when the i-th id of
+// the batch was new in the window. The status is tcpStatusOK, tcpStatusUnavailable (standby or
+// a resource cap, nothing was recorded, retry later) or tcpStatusFailed (the dedupe backend
+// failed, retry the batch; like on HTTP its ids aren't reported). Id 0 is invalid and never
+// new. Producers may pipeline batches; acks come back in order.
+const (
+	tcpFrameBatch = 0x01
+	tcpFrameAck   = 0x81
+	tcpFrameError = 0xff
+
+	tcpStatusOK          = 0
+	tcpStatusUnavailable = 1
+	tcpStatusFailed      = 2
+)
+
+// tcpIngest serves the TCP ingest protocol for trusted internal producers. It skips HTTP
+// parsing, the tenant and API key handling and the JSON codec; ids go straight to the batch
+// accept path, so the window, its breakdowns and the grace period see them like batch ids.
+type tcpIngest struct {
+	addr     string
+	allowed  []netip.Prefix
+	maxBatch int
+	// idleTimeout closes connections that send nothing for that long; 0 keeps them open.
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newTCPIngest(addr string, allowed []netip.Prefix, maxBatch int, idleTimeout time.Duration) *tcpIngest {
+	return &tcpIngest{addr: addr, allowed: allowed, maxBatch: maxBatch, idleTimeout: idleTimeout, conns: map[net.Conn]bool{}}
+}
+
+// run accepts connections until shutdown, then lets every connection finish the batch it is
+// on and closes it.
+func (s *tcpIngest) run(runCtx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving TCP ingest on %s\n", ln.Addr())
+	return s.serve(runCtx, ln)
+}
+
+func (s *tcpIngest) serve(runCtx context.Context, ln net.Listener) error {
+	go func() {
+		<-runCtx.Done()
+		ln.Close()
+		s.mu.Lock()
+		for c := range s.conns {
+			// Unblocks the read of the next frame; a batch being handled still gets its ack
+			c.SetReadDeadline(time.Now())
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if runCtx.Err() != nil {
+				break
+			}
+			log.Printf("Error accepting TCP ingest connection: %v\n", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if len(s.allowed) > 0 {
+			if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err != nil || !containsAddr(s.allowed, ap.Addr()) {
+				tcpIngestConnections.WithLabelValues("refused").Inc()
+				c.Close()
+				continue
+			}
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		tcpIngestConnections.WithLabelValues("accepted").Inc()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(runCtx, c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// handle serves one producer connection until it closes, errs or the server shuts down.
+func (s *tcpIngest) handle(runCtx context.Context, c net.Conn) {
+	r := bufio.NewReaderSize(c, 64<<10)
+	w := bufio.NewWriterSize(c, 16<<10)
+	// A batch frame is at most a varint per id plus its header
+	maxFrame := s.maxBatch*binary.MaxVarintLen64 + 32
+	var payload, ack []byte
+	for {
+		if s.idleTimeout > 0 && runCtx.Err() == nil {
+			c.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && runCtx.Err() == nil {
+				log.Printf("TCP ingest connection from %s closed: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+		if size == 0 || size > uint64(maxFrame) {
+			s.fail(w, 0, fmt.Sprintf("frame of %d bytes, at most %d allowed", size, maxFrame))
+			return
+		}
+		if cap(payload) < int(size) {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+
+		seq, ids, err := decodeBatchFrame(payload, s.maxBatch)
+		if err != nil {
+			tcpIngestFrames.WithLabelValues("invalid").Inc()
+			s.fail(w, seq, err.Error())
+			return
+		}
+		status, added := s.accept(runCtx, ids)
+		ack = appendAckFrame(ack[:0], seq, status, added)
+		if _, err := w.Write(ack); err != nil {
+			return
+		}
+		// Acks of pipelined batches go out together once the producer's input is drained
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// accept records a batch the way the batch endpoint's middleware and handler would.
+func (s *tcpIngest) accept(runCtx context.Context, ids []uint64) (byte, []bool) {
+	scaling.countRequest()
+	if replicator != nil && !coordinator.IsLeader() {
+		tcpIngestFrames.WithLabelValues("unavailable").Inc()
+		return tcpStatusUnavailable, nil
+	}
+	if a := resources; a.maxDedupeMemory > 0 && a.dedupeMemory.Load() > a.maxDedupeMemory {
+		a.rejectedDedupeMemory.Add(1)
+		resourceCapRejections.WithLabelValues("dedupe_memory_bytes").Inc()
+		tcpIngestFrames.WithLabelValues("unavailable").Inc()
+		return tcpStatusUnavailable, nil
+	}
+	if keyspace.refusing() != "" {
+		resourceCapRejections.WithLabelValues("redis_keyspace").Inc()
+		tcpIngestFrames.WithLabelValues("unavailable").Inc()
+		return tcpStatusUnavailable, nil
+	}
+
+	gen := acceptGrace.begin()
+	defer gen.done()
+	arrived := time.Now()
+	reqCtx := context.WithoutCancel(runCtx)
+	if budget := getEnvDuration("REQUEST_BUDGET", 0); budget > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, budget)
+		defer cancel()
+	}
+
+	ins := make([]dedupeInput, len(ids))
+	for i, id := range ids {
+		// Ids past the int range are invalid like 0, which acceptStatuses skips
+		if id <= math.MaxInt {
+			ins[i] = dedupeInput{id: int(id), arrived: arrived}
+		}
+	}
+	statuses, err := acceptStatuses(reqCtx, ins)
+	if err != nil {
+		tcpIngestFrames.WithLabelValues("failed").Inc()
+		return tcpStatusFailed, make([]bool, len(ids))
+	}
+	added := make([]bool, len(ids))
+	for i, status := range statuses {
+		added[i] = status == statusAccepted
+	}
+	tcpIngestFrames.WithLabelValues("ok").Inc()
+	tcpIngestIDs.Add(float64(len(ids)))
+	return tcpStatusOK, added
+}
+
+// fail sends an error frame; the connection is closed after it.
+func (s *tcpIngest) fail(w *bufio.Writer, seq uint64, message string) {
+	body := binary.AppendUvarint([]byte{tcpFrameError}, seq)
+	body = append(body, message...)
+	w.Write(binary.AppendUvarint(nil, uint64(len(body))))
+	w.Write(body)
+	w.Flush()
+}
+
+// decodeBatchFrame parses a batch payload, returning its sequence number even when the rest
+// is malformed so the error frame can name it.
+func decodeBatchFrame(payload []byte, maxBatch int) (uint64, []uint64, error) {
+	if payload[0] != tcpFrameBatch {
+		return 0, nil, fmt.Errorf("unknown frame type 0x%02x", payload[0])
+	}
+	b := payload[1:]
+	seq, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errors.New("malformed sequence number")
+	}
+	b = b[n:]
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return seq, nil, errors.New("malformed id count")
+	}
+	if count > uint64(maxBatch) {
+		return seq, nil, fmt.Errorf("batch of %d ids, at most %d allowed", count, maxBatch)
+	}
+	b = b[n:]
+	ids := make([]uint64, count)
+	for i := range ids {
+		if ids[i], n = binary.Uvarint(b); n <= 0 {
+			return seq, nil, fmt.Errorf("malformed id %d", i)
+		}
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		return seq, nil, fmt.Errorf("%d bytes after the last id", len(b))
+	}
+	return seq, ids, nil
+}
+
+// appendAckFrame appends the length-prefixed ack of a batch to dst.
+func appendAckFrame(dst []byte, seq uint64, status byte, added []bool) []byte {
+	var body [2*binary.MaxVarintLen64 + 2]byte
+	header := binary.AppendUvarint(append(body[:0], tcpFrameAck), seq)
+	header = append(header, status)
+	header = binary.AppendUvarint(header, uint64(len(added)))
+	bitmap := (len(added) + 7) / 8
+
+	dst = binary.AppendUvarint(dst, uint64(len(header)+bitmap))
+	dst = append(dst, header...)
+	start := len(dst)
+	dst = append(dst, make([]byte, bitmap)...)
+	for i, ok := range added {
+		if ok {
+			dst[start+i/8] |= 1 << (i % 8)
+		}
+	}
+	return dst
+}
+
+// appendBatchFrame appends the length-prefixed batch frame of ids to dst; producers in Go
+// can use it as the reference encoder.
+func appendBatchFrame(dst []byte, seq uint64, ids []uint64) []byte {
+	body := binary.AppendUvarint([]byte{tcpFrameBatch}, seq)
+	body = binary.AppendUvarint(body, uint64(len(ids)))
+	for _, id := range ids {
+		body = binary.AppendUvarint(body, id)
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(body)))
+	return append(dst, body...)
+}
+
+// readAckFrame reads the next frame from the server: an ack, or an error frame as an error.
+func readAckFrame(r *bufio.Reader) (seq uint64, status byte, added []bool, err error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if len(payload) == 0 {
+		return 0, 0, nil, errors.New("empty frame")
+	}
+	kind, b := payload[0], payload[1:]
+	seq, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, nil, errors.New("malformed sequence number")
+	}
+	b = b[n:]
+	switch kind {
+	case tcpFrameError:
+		return seq, 0, nil, fmt.Errorf("server error on batch %d: %s", seq, b)
+	case tcpFrameAck:
+	default:
+		return seq, 0, nil, fmt.Errorf("unknown frame type 0x%02x", kind)
+	}
+	if len(b) == 0 {
+		return seq, 0, nil, errors.New("ack without status")
+	}
+	status, b = b[0], b[1:]
+	count, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) != (count+7)/8 {
+		return seq, status, nil, errors.New("malformed ack bitmap")
+	}
+	b = b[n:]
+	added = make([]bool, count)
+	for i := range added {
+		added[i] = b[i/8]&(1<<(i%8)) != 0
+	}
+	return seq, status, added, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/client"
+)
+
+// startTCPIngest serves TCP ingest on a local port until the test ends.
+func startTCPIngest(t *testing.T, allowed []netip.Prefix, maxBatch int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- newTCPIngest(ln.Addr().String(), allowed, maxBatch, 0).serve(runCtx, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func TestTCPIngestAcks(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	conn, err := net.Dial("tcp", startTCPIngest(t, nil, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Two pipelined batches are acked in order; 0 and a repeated id are never new
+	frames := appendBatchFrame(nil, 1, []uint64{1, 2, 1, 0})
+	frames = appendBatchFrame(frames, 2, []uint64{2, 3})
+	if _, err := conn.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, want := range []struct {
+		seq   uint64
+		added string
+	}{{1, "[true true false false]"}, {2, "[false true]"}} {
+		seq, status, added, err := readAckFrame(r)
+		if err != nil || seq != want.seq || status != tcpStatusOK || fmt.Sprint(added) != want.added {
+			t.Errorf("got ack %d, status %d, %v, %v, want batch %d acked %s", seq, status, added, err, want.seq, want.added)
+		}
+	}
+	if err := expectCount(h.Client, 3); err != nil {
+		t.Error(err)
+	}
+
+	// A batch over the limit gets an error frame naming it, and the connection is closed
+	conn.Write(appendBatchFrame(nil, 3, make([]uint64, 11)))
+	if _, _, _, err := readAckFrame(r); err == nil || !strings.Contains(err.Error(), "batch 3") {
+		t.Errorf("got %v for an oversized batch, want an error frame for batch 3", err)
+	}
+	if _, _, _, err := readAckFrame(r); err != io.EOF {
+		t.Errorf("got %v after the error frame, want the connection closed", err)
+	}
+}
+
+func TestTCPIngestRefusesOutsideCIDRs(t *testing.T) {
+	addr := startTCPIngest(t, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, 10)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(appendBatchFrame(nil, 1, []uint64{1}))
+	if _, _, _, err := readAckFrame(bufio.NewReader(conn)); err == nil {
+		t.Error("a producer outside INGEST_TCP_ALLOWED_CIDRS got an ack")
+	}
+}
+
+// BenchmarkIngest sends the same batches through the v2 batch endpoint and through TCP ingest
+// against the in-memory roaring backend. Producers run in the benchmark process and are part of
+// the cost on both paths, so the figures compare the two paths rather than predict a
+// deployment's; -cpu sets the producers and GOMAXPROCS.
+func BenchmarkIngest(b *testing.B) {
+	const batchSize = 1000
+	coordinator = localCoordinator{}
+	dedupeKey, _ = parseKeyStrategy("id")
+	tenants, tenantWindows = nil, nil
+	dedup, _ = newRoaringDeduplicator("", 0, 0)
+	dedupeBackend = "roaring"
+	backendSwitch = nil
+	notifications = newNotifier(1, 10, 1, 10, time.Second)
+	registerRoutes()
+	// Per-batch logs would end up in the figures
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(newHandler())
+	defer server.Close()
+	c := client.New(server.URL, client.WithRetries(0, 0), client.WithHTTPClient(&http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ingest := newTCPIngest(ln.Addr().String(), nil, batchSize, 0)
+	go ingest.serve(ctx, ln)
+	defer ln.Close()
+
+	// Every batch holds new ids, so both paths do the same dedupe work
+	var next atomic.Int64
+	batch := func(ids []int) []int {
+		start := int(next.Add(batchSize)) - batchSize + 1
+		ids = ids[:0]
+		for id := start; id < start+batchSize; id++ {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	run := func(b *testing.B, producer func() (func(ids []int) error, func())) {
+		dedup.Flush(ctx)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			send, done := producer()
+			defer done()
+			var ids []int
+			for pb.Next() {
+				ids = batch(ids)
+				if err := send(ids); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "ids/s")
+	}
+
+	b.Run("http-batch", func(b *testing.B) {
+		run(b, func() (func([]int) error, func()) {
+			return func(ids []int) error {
+				results, err := c.AcceptBatch(ctx, ids)
+				if err == nil && len(results) != len(ids) {
+					err = fmt.Errorf("%d results for %d ids", len(results), len(ids))
+				}
+				return err
+			}, func() {}
+		})
+	})
+	b.Run("tcp", func(b *testing.B) {
+		run(b, func() (func([]int) error, func()) {
+			return tcpProducer(ln.Addr().String())
+		})
+	})
+}
+
+// tcpProducer opens a connection and sends a batch at a time over it, waiting for each ack.
+func tcpProducer(addr string) (func(ids []int) error, func()) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return func([]int) error { return err }, func() {}
+	}
+	r := bufio.NewReaderSize(conn, 16<<10)
+	var frame []byte
+	var wire []uint64
+	var seq uint64
+	return func(ids []int) error {
+		seq++
+		wire = wire[:0]
+		for _, id := range ids {
+			wire = append(wire, uint64(id))
+		}
+		frame = appendBatchFrame(frame[:0], seq, wire)
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+		got, status, added, err := readAckFrame(r)
+		switch {
+		case err != nil:
+			return err
+		case got != seq || status != tcpStatusOK || len(added) != len(ids):
+			return fmt.Errorf("unexpected ack of batch %d: seq %d, status %d, %d ids", seq, got, status, len(added))
+		}
+		return nil
+	}, func() { conn.Close() }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestIntegrationWindow runs one window through the redis backend and the kafka sink.
+func TestIntegrationWindow(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	windowEnd := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+
+	t.Run("redis backend stores a new id", func(t *testing.T) {
+		status, err := h.AcceptAs("acme", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != statusAccepted || !h.Redis.Exists(redisIDPrefix+"1") {
+			t.Fatalf("got %s, key stored: %t", status, h.Redis.Exists(redisIDPrefix+"1"))
+		}
+	})
+	t.Run("redis backend reports a duplicate id", func(t *testing.T) {
+		status, err := h.AcceptAs("acme", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != statusDuplicate {
+			t.Fatalf("got %s", status)
+		}
+	})
+	t.Run("redis backend pipelines a batch", func(t *testing.T) {
+		results, err := h.Client.AcceptBatch(ctx, []int{2, 3, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 3 || results[0].Duplicate || results[1].Duplicate || !results[2].Duplicate {
+			t.Fatalf("unexpected results %+v", results)
+		}
+	})
+	t.Run("stats count the redis window", func(t *testing.T) {
+		if err := expectCount(h.Client, 3); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("window report and tenant message reach Kafka", func(t *testing.T) {
+		report, tenantMessages, err := h.CloseWindow(windowEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.UniqueRequestCount != 3 || report.Tenants["acme"] != 1 {
+			t.Fatalf("unexpected report %+v", report)
+		}
+		if len(tenantMessages) != 1 || tenantMessages[0].Tenant != "acme" || tenantMessages[0].UniqueRequestCount != 1 {
+			t.Fatalf("unexpected tenant messages %+v", tenantMessages)
+		}
+	})
+	t.Run("flush empties the redis window", func(t *testing.T) {
+		if keys := h.Redis.Keys(); len(keys) != 0 {
+			t.Fatalf("keys left after the flush: %v", keys)
+		}
+		if err := expectCount(h.Client, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
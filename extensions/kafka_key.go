@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// messageKeyStrategy picks the Kafka key of a message: a window or rollup report when tenant is
+// empty, otherwise that report's message for tenant. Kafka partitions and compacts by key.
+type messageKeyStrategy func(report windowReport, tenant string) []byte
+
+// parseMessageKeyStrategy parses KAFKA_KEY: tenant (default; tenant messages are keyed by
+// tenant id, reports by their window start), constant, window_start or instance. The writers
+// hash keys onto partitions, so constant puts every message on one.
+func parseMessageKeyStrategy(spec, constant string) (messageKeyStrategy, error) {
+	switch spec {
+	case "", "tenant":
+		return func(report windowReport, tenant string) []byte {
+			if tenant != "" {
+				return []byte(tenant)
+			}
+			return []byte(windowStart(report))
+		}, nil
+	case "constant":
+		return func(windowReport, string) []byte {
+			return []byte(constant)
+		}, nil
+	case "window_start":
+		return func(report windowReport, _ string) []byte {
+			return []byte(windowStart(report))
+		}, nil
+	case "instance":
+		return func(report windowReport, _ string) []byte {
+			return []byte(report.InstanceID)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown Kafka key strategy %q", spec)
+}
+
+// windowStart identifies the window of a report by its start, prefixed with the period for
+// rollups so that an hour doesn't share its key with its first minute.
+func windowStart(report windowReport) string {
+	if report.Period != "" {
+		return report.Period + "/" + report.PeriodStart
+	}
+	end, err := time.Parse(time.RFC3339, report.Timestamp)
+	if err != nil {
+		return report.Timestamp
+	}
+	return end.Add(-time.Minute).Format(time.RFC3339)
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDefaultKafkaKeySpreadsReports(t *testing.T) {
+	key, err := parseMessageKeyStrategy("tenant", "unique-id-count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := windowReport{Timestamp: "2026-10-14T12:01:00Z"}
+	second := windowReport{Timestamp: "2026-10-14T12:02:00Z"}
+	if got := string(key(first, "")); got != "2026-10-14T12:00:00Z" {
+		t.Errorf("got report key %s, want the window start", got)
+	}
+	if string(key(first, "")) == string(key(second, "")) {
+		t.Error("two windows share a key, and so a partition")
+	}
+	if got := string(key(first, "acme")); got != "acme" {
+		t.Errorf("got tenant key %s, want acme", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// tenantReport is the per-tenant message published next to the window report.
+type tenantReport struct {
+	Tenant             string `json:"tenant"`
+	UniqueRequestCount int    `json:"unique_request_count"`
+	Timestamp          string `json:"timestamp"`
+	Version            string `json:"version"`
+	GitSHA             string `json:"git_sha"`
+	InstanceID         string `json:"instance_id"`
+	Backend            string `json:"backend"`
+	// Window is set for tenants reporting on their own window, e.g. "10s".
+	Window string `json:"window,omitempty"`
+}
+
+// initTenantKafka returns the writer for per-tenant messages. It has no fixed topic so every
+// message can name its tenant's topic, and hashes keys so a tenant always lands on the same
+// partition of a shared topic.
+func initTenantKafka() *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(getEnv("KAFKA_BROKER", "")),
+		Balancer:               &kafka.Hash{},
+		AllowAutoTopicCreation: true,
+		Compression:            kafkaCompression,
+	}
+}
+
+// publishTenantCounts sends one message per tenant of the window, routed by the tenant's
+// configured topic; tenants without one share the report topic. Under the default KAFKA_KEY
+// they are keyed by tenant id.
+func publishTenantCounts(ctx context.Context, report windowReport) error {
+	if len(report.Tenants) == 0 {
+		return nil
+	}
+
+	messages := make([]kafka.Message, 0, len(report.Tenants))
+	for id, count := range report.Tenants {
+		m, err := tenantMessage(ctx, report, tenantReport{
+			Tenant:             id,
+			UniqueRequestCount: count,
+			Timestamp:          report.Timestamp,
+			Version:            report.Version,
+			GitSHA:             report.GitSHA,
+			InstanceID:         report.InstanceID,
+			Backend:            report.Backend,
+		})
+		if err != nil {
+			return err
+		}
+		messages = append(messages, m)
+	}
+	return writeTenantMessages(ctx, messages)
+}
+
+// tenantMessage encodes the tenant message of report, on the tenant's topic.
+func tenantMessage(ctx context.Context, report windowReport, t tenantReport) (kafka.Message, error) {
+	topic := getEnv("KAFKA_TOPIC", "")
+	if tenants != nil {
+		if stored, err := tenants.Get(ctx, t.Tenant); err == nil && stored.KafkaTopic != "" {
+			topic = stored.KafkaTopic
+		}
+	}
+	value, err := kafkaFormat.Tenant(t)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{Topic: topic, Key: kafkaKey(report, t.Tenant), Value: value}, nil
+}
+
+func writeTenantMessages(ctx context.Context, messages []kafka.Message) error {
+	if dryRun {
+		for _, m := range messages {
+			skipDryRun("kafka", "topic %s, key %s: %s", m.Topic, m.Key, printablePayload(kafkaFormat, m.Value))
+		}
+		return nil
+	}
+
+	resources.kafkaWrites.Add(1)
+	defer resources.kafkaWrites.Add(-1)
+	if err := tenantWriter.WriteMessages(ctx, messages...); err != nil {
+		return err
+	}
+	log.Printf("Published %d tenant counts to Kafka\n", len(messages))
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/abhishek818/verve-technical-challenge/harness"
+	"github.com/segmentio/kafka-go"
+)
+
+// failingKafka fails its first write.
+type failingKafka struct {
+	*harness.Kafka
+	failed bool
+}
+
+func (k *failingKafka) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if !k.failed {
+		k.failed = true
+		return errors.New("broker down")
+	}
+	return k.Kafka.WriteMessages(ctx, msgs...)
+}
+
+func TestKafkaSinkRetryKeepsReportOnce(t *testing.T) {
+	reports, tenantCounts := &harness.Kafka{Topic: "reports"}, &failingKafka{Kafka: &harness.Kafka{Topic: "tenants"}}
+	oldReports, oldTenants := kafkaWriter, tenantWriter
+	kafkaWriter, tenantWriter = reports, tenantCounts
+	kafkaKey, _ = parseMessageKeyStrategy("tenant", "unique-id-count")
+	kafkaFormat = jsonPayload{}
+	// Only an outbox retries, so only with one are windows tracked
+	reportOutbox = &outbox{}
+	defer func() { kafkaWriter, tenantWriter, reportOutbox = oldReports, oldTenants, nil }()
+
+	s := &kafkaSink{}
+	report := windowReport{Timestamp: "2026-10-14T12:00:00Z", Tenants: map[string]int{"acme": 3}}
+	if err := s.Publish(context.Background(), report); err == nil {
+		t.Fatal("the failed tenant counts didn't fail the publish")
+	}
+	if err := s.Publish(context.Background(), report); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reports.Messages("reports")); n != 1 {
+		t.Errorf("got %d window reports after the retry, want 1", n)
+	}
+	if n := len(tenantCounts.Messages("tenants")); n != 1 {
+		t.Errorf("got %d tenant counts, want 1", n)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("still tracking %v once delivered", s.pending)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// topicSpec is the expected shape of the report topic. Empty config values are left to the
+// broker defaults and aren't checked for drift.
+type topicSpec struct {
+	name              string
+	partitions        int
+	replicationFactor int
+	configs           map[string]string
+}
+
+func topicSpecFromEnv(name string) topicSpec {
+	spec := topicSpec{
+		name:              name,
+		partitions:        getEnvInt("KAFKA_TOPIC_PARTITIONS", 1),
+		replicationFactor: getEnvInt("KAFKA_TOPIC_REPLICATION_FACTOR", 1),
+		configs:           map[string]string{},
+	}
+	for config, env := range map[string]string{
+		"retention.ms":        "KAFKA_TOPIC_RETENTION_MS",
+		"cleanup.policy":      "KAFKA_TOPIC_CLEANUP_POLICY",
+		"min.insync.replicas": "KAFKA_TOPIC_MIN_INSYNC_REPLICAS",
+	} {
+		if value := getEnv(env, ""); value != "" {
+			spec.configs[config] = value
+		}
+	}
+	return spec
+}
+
+func createKafkaTopic(spec topicSpec, broker string) {
+	err := waitForKafka(broker, 10, 5*time.Second)
+	if err != nil {
+		log.Fatalf("Kafka is not ready: %v", err)
+	}
+
+	topic := kafka.TopicConfig{
+		Topic:             spec.name,
+		NumPartitions:     spec.partitions,
+		ReplicationFactor: spec.replicationFactor,
+	}
+	for name, value := range spec.configs {
+		topic.ConfigEntries = append(topic.ConfigEntries, kafka.ConfigEntry{ConfigName: name, ConfigValue: value})
+	}
+
+	// An existing topic is not an error. Right after startup the broker may still be electing a controller, so retry a few times
+	const attempts = 5
+	for attempt := 1; ; attempt++ {
+		err = createTopic(broker, topic)
+		switch {
+		case err == nil:
+			log.Printf("Kafka topic %s created successfully", spec.name)
+			return
+		case attempt == attempts:
+			log.Printf("Failed to create Kafka topic %s: %v", spec.name, err)
+			return
+		}
+		log.Printf("Failed to create Kafka topic %s (attempt %d/%d): %v", spec.name, attempt, attempts, err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func createTopic(broker string, topic kafka.TopicConfig) error {
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.CreateTopics(topic)
+}
+
+// checkTopicConfig compares the configured topic settings with the broker's, so a topic that
+// was created earlier, or changed by hand, doesn't silently keep different settings.
+func checkTopicConfig(spec topicSpec, broker string) {
+	if len(spec.configs) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(spec.configs))
+	for name := range spec.configs {
+		names = append(names, name)
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	client := &kafka.Client{Addr: kafka.TCP(broker)}
+	resp, err := client.DescribeConfigs(reqCtx, &kafka.DescribeConfigsRequest{
+		Resources: []kafka.DescribeConfigRequestResource{{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: spec.name,
+			ConfigNames:  names,
+		}},
+	})
+	if err != nil {
+		log.Printf("Failed to describe Kafka topic %s: %v", spec.name, err)
+		return
+	}
+
+	actual := map[string]string{}
+	for _, resource := range resp.Resources {
+		if resource.Error != nil {
+			log.Printf("Failed to describe Kafka topic %s: %v", spec.name, resource.Error)
+			return
+		}
+		for _, entry := range resource.ConfigEntries {
+			actual[entry.ConfigName] = entry.ConfigValue
+		}
+	}
+
+	for name, want := range spec.configs {
+		if got := actual[name]; got != want {
+			log.Printf("Warning: Kafka topic %s has %s=%q, expected %q", spec.name, name, got, want)
+			topicConfigDrift.WithLabelValues(name).Set(1)
+		} else {
+			topicConfigDrift.WithLabelValues(name).Set(0)
+		}
+	}
+}
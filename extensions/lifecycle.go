@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// component is a long running part of the service owned by the lifecycle manager.
+type component struct {
+	name string
+	// run blocks until ctx is cancelled or the component fails.
+	run func(ctx context.Context) error
+	// stop optionally asks the component to finish gracefully before its context is cancelled.
+	stop func(ctx context.Context) error
+}
+
+// lifecycle starts components in the order they were added and stops them in reverse order,
+// so e.g. the HTTP server stops taking requests before the workers and publishers it feeds.
+// The first component to fail, or SIGINT/SIGTERM, shuts everything down.
+type lifecycle struct {
+	components      []component
+	shutdownTimeout time.Duration
+}
+
+func newLifecycle(shutdownTimeout time.Duration) *lifecycle {
+	return &lifecycle{shutdownTimeout: shutdownTimeout}
+}
+
+func (l *lifecycle) add(name string, run func(ctx context.Context) error, stop func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, run: run, stop: stop})
+}
+
+func (l *lifecycle) run(parent context.Context) error {
+	ctx, stopSignals := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	g, gctx := errgroup.WithContext(ctx)
+	cancels := make([]context.CancelFunc, len(l.components))
+	done := make([]chan struct{}, len(l.components))
+
+	for i, c := range l.components {
+		// Every component gets its own context so shutdown can cancel them one at a time
+		cctx, cancel := context.WithCancel(context.Background())
+		cancels[i], done[i] = cancel, make(chan struct{})
+
+		log.Printf("Starting %s", c.name)
+		g.Go(func() error {
+			defer close(done[i])
+			resources.components.Add(1)
+			defer resources.components.Add(-1)
+			if err := c.run(cctx); err != nil && !errors.Is(err, context.Canceled) {
+				return fmt.Errorf("%s: %w", c.name, err)
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		<-gctx.Done()
+		log.Printf("Shutting down...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout)
+		defer cancel()
+
+		for i := len(l.components) - 1; i >= 0; i-- {
+			c := l.components[i]
+			log.Printf("Stopping %s", c.name)
+			if c.stop != nil {
+				if err := c.stop(shutdownCtx); err != nil {
+					log.Printf("Failed to stop %s gracefully: %v", c.name, err)
+				}
+			}
+			cancels[i]()
+
+			select {
+			case <-done[i]:
+			case <-shutdownCtx.Done():
+				log.Printf("Timed out waiting for %s to stop", c.name)
+			}
+		}
+		return nil
+	})
+
+	return g.Wait()
+}
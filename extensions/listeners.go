@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listener is one HTTP server run by the lifecycle manager.
+type listener struct {
+	// role is "public" for the API, or "internal" for operational endpoints only.
+	role   string
+	server *http.Server
+	// h3 replaces server for an HTTP/3 listener, which serves over QUIC on a UDP address.
+	h3 *http3.Server
+	// maxConns limits the concurrent connections; 0 is unlimited.
+	maxConns int
+}
+
+func (l listener) name() string {
+	if l.h3 != nil {
+		return l.role + " http3 server " + l.h3.Addr
+	}
+	return l.role + " http server " + l.server.Addr
+}
+
+func (l listener) shutdown(shutdownCtx context.Context) error {
+	if l.h3 != nil {
+		return l.h3.Shutdown(shutdownCtx)
+	}
+	return l.server.Shutdown(shutdownCtx)
+}
+
+// serve listens on the server's address and serves until the server is shut down.
+func (l listener) serve() error {
+	if l.h3 != nil {
+		if l.maxConns == 0 {
+			return l.h3.ListenAndServe()
+		}
+		ln, err := quic.ListenAddrEarly(l.h3.Addr, l.h3.TLSConfig, l.h3.QUICConfig)
+		if err != nil {
+			return err
+		}
+		return l.h3.ServeListener(newQUICLimitListener(ln, l.h3.Addr, l.maxConns))
+	}
+	ln, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return err
+	}
+	if l.maxConns > 0 {
+		ln = newLimitListener(ln, l.server.Addr, l.maxConns)
+	}
+	return l.server.Serve(ln)
+}
+
+// newListeners creates a public server for every address of LISTEN_ADDR and, when
+// INTERNAL_ADDR is set, an internal server for the admin, ops and debug routes.
+// MAX_CONNECTIONS only limits the public listeners, so metrics can still be scraped from the
+// internal one while the public ones are at their limit.
+//
+// HTTP3_ADDR adds public HTTP/3 listeners on UDP addresses, with the TLS certificate QUIC
+// requires, and the public TCP listeners advertise all of them in an Alt-Svc header.
+// MAX_CONNECTIONS limits each of them like a TCP listener; HTTP_IDLE_TIMEOUT is its idle timeout.
+func newListeners() ([]listener, error) {
+	maxConns := getEnvInt("MAX_CONNECTIONS", 0)
+	idleTimeout := getEnvDuration("HTTP_IDLE_TIMEOUT", 0)
+	keepAlives := getEnvBool("HTTP_KEEPALIVES", true)
+
+	seen := map[string]bool{}
+	var listeners []listener
+	add := func(role, addr string, handler http.Handler) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid %s listen address %q: %w", role, addr, err)
+		}
+		if seen[addr] {
+			return fmt.Errorf("listen address %q is configured twice", addr)
+		}
+		seen[addr] = true
+		server := &http.Server{
+			Addr:        addr,
+			Handler:     handler,
+			IdleTimeout: idleTimeout,
+			ConnState:   newConnTracker(addr).connState,
+		}
+		server.SetKeepAlivesEnabled(keepAlives)
+		l := listener{role: role, server: server}
+		if role == "public" {
+			l.maxConns = maxConns
+		}
+		listeners = append(listeners, l)
+		return nil
+	}
+
+	public := newHandler()
+	h3, err := newHTTP3Servers(getEnv("HTTP3_ADDR", ""), getEnv("HTTP3_CERT_FILE", ""), getEnv("HTTP3_KEY_FILE", ""), public, idleTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tcpPublic := public
+	if len(h3) > 0 {
+		tcpPublic = advertiseHTTP3(h3, public)
+	}
+	for _, addr := range strings.Split(getEnv("LISTEN_ADDR", ":8080"), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if err := add("public", addr, tcpPublic); err != nil {
+			return nil, err
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("LISTEN_ADDR doesn't contain an address")
+	}
+	for _, server := range h3 {
+		listeners = append(listeners, listener{role: "public", h3: server, maxConns: maxConns})
+	}
+
+	if addr := getEnv("INTERNAL_ADDR", ""); addr != "" {
+		if err := add("internal", addr, newInternalHandler()); err != nil {
+			return nil, err
+		}
+		if host, _, _ := net.SplitHostPort(addr); !isLoopback(host) && getEnv("INTERNAL_TOKEN", "") == "" {
+			log.Printf("Warning: internal listener %s is not bound to loopback and INTERNAL_TOKEN is not set", addr)
+		}
+	}
+	return listeners, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newHTTP3Servers creates an HTTP/3 server serving handler for every UDP address of spec, which
+// may repeat the ports of the TCP listeners. QUIC can't run without TLS, so the certificate and
+// key are required.
+func newHTTP3Servers(spec, certFile, keyFile string, handler http.Handler, idleTimeout time.Duration) ([]*http3.Server, error) {
+	seen := map[string]bool{}
+	var addrs []string
+	for _, addr := range strings.Split(spec, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid HTTP3_ADDR address %q: %w", addr, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("HTTP3_ADDR address %q is configured twice", addr)
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("HTTP3_ADDR needs HTTP3_CERT_FILE and HTTP3_KEY_FILE, QUIC always uses TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP3_CERT_FILE: %w", err)
+	}
+
+	var servers []*http3.Server
+	for _, addr := range addrs {
+		servers = append(servers, &http3.Server{
+			Addr:       addr,
+			Handler:    handler,
+			TLSConfig:  http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+			QUICConfig: &quic.Config{MaxIdleTimeout: idleTimeout},
+		})
+	}
+	return servers, nil
+}
+
+// advertiseHTTP3 sets an Alt-Svc header pointing clients at every server that is listening.
+func advertiseHTTP3(servers []*http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alts []string
+		for _, server := range servers {
+			header := http.Header{}
+			// Servers on the same port advertise the same alternative
+			if server.SetQUICHeaders(header) == nil && !slices.Contains(alts, header.Get("Alt-Svc")) {
+				alts = append(alts, header.Get("Alt-Svc"))
+			}
+		}
+		if len(alts) > 0 {
+			w.Header().Set("Alt-Svc", strings.Join(alts, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestAdvertiseEveryHTTP3Listener(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+
+	var servers []*http3.Server
+	for range 2 {
+		ln, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, nil)
+		if err != nil {
+			t.Skipf("no UDP: %v", err)
+		}
+		server := &http3.Server{TLSConfig: tlsConfig}
+		go server.ServeListener(ln)
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	handler := advertiseHTTP3(servers, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	// The servers register their listeners as they start serving
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		alt := rec.Header().Get("Alt-Svc")
+		if strings.Count(alt, "h3=") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got Alt-Svc %q, want both listeners", alt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
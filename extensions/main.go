@@ -3,25 +3,71 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 )
 
+// kafkaMessageWriter is what the publishers need of a *kafka.Writer, so tests can swap in an
+// in-memory one.
+type kafkaMessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
 var (
-	ctx         = context.Background()
-	redisDB     *redis.Client
-	kafkaWriter *kafka.Writer
+	ctx           = context.Background()
+	redisDB       *redis.Client
+	kafkaWriter   kafkaMessageWriter
+	kafkaKey      messageKeyStrategy
+	kafkaFormat   payloadSerializer
+	dedup         Deduplicator
+	coordinator   Coordinator
+	notifications *notifier
+	buckets       *idBuckets
+	metadata      *metadataTracker
+	reconciler    *windowReconciler
+	rollups       *rollupTracker
+	dedupeKey     keyStrategy
+	dedupeBackend string
+	audit         *auditLog
+	tenants       tenantStore
+	tenantCounts  = newTenantCounter()
+	tenantWriter  kafkaMessageWriter
+	sinks         []Sink
+	reportOutbox  *outbox
+	history       historyStore
+	replicas      *redisReplicaSet
+	notifyFormat  *notifyFormats
+	notifyCounts  = newCountCache(0)
+	statsCounts   = newCountCache(0)
+	replicator    *windowReplicator
+	idHash        *idHasher
+	contracts     *contractTracker
 )
 
 func initRedis() *redis.Client {
+	rdb, err := connectRedis()
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	return rdb
+}
+
+// connectRedis is initRedis for callers that can recover from Redis being down, like a
+// backend switch.
+func connectRedis() (*redis.Client, error) {
 	redisHost := os.Getenv("REDIS_HOST")
 	redisPort := os.Getenv("REDIS_PORT")
 
@@ -29,24 +75,29 @@ func initRedis() *redis.Client {
 		Addr:     redisHost + ":" + redisPort,
 		Password: "",
 		DB:       0,
+		// Let request deadlines (REQUEST_BUDGET) bound Redis calls
+		ContextTimeoutEnabled: true,
 	})
 
 	// Test connection
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		rdb.Close()
+		return nil, err
 	}
 
-	return rdb
+	return rdb, nil
 }
 
 func initKafka() *kafka.Writer {
-	kafkaBroker := os.Getenv("KAFKA_BROKER")
-	kafkaTopic := os.Getenv("KAFKA_TOPIC")
+	kafkaBroker := getEnv("KAFKA_BROKER", "")
+	kafkaTopic := getEnv("KAFKA_TOPIC", "")
 
+	// Keys are hashed so that KAFKA_KEY decides the partition
 	writer := &kafka.Writer{
-		Addr:     kafka.TCP(kafkaBroker),
-		Topic:    kafkaTopic,
-		Balancer: &kafka.LeastBytes{},
+		Addr:        kafka.TCP(kafkaBroker),
+		Topic:       kafkaTopic,
+		Balancer:    &kafka.Hash{},
+		Compression: kafkaCompression,
 	}
 
 	return writer
@@ -68,163 +119,937 @@ func waitForKafka(broker string, retries int, delay time.Duration) error {
 	return fmt.Errorf("could not connect to Kafka at %s after %d retries", broker, retries)
 }
 
-func createKafkaTopic(topic string, broker string) {
-	err := waitForKafka(broker, 10, 5*time.Second)
-	if err != nil {
-		log.Fatalf("Kafka is not ready: %v", err)
-	}
-
-	conn, err := kafka.Dial("tcp", broker)
-	if err != nil {
-		log.Fatalf("Failed to connect to Kafka broker: %v", err)
-	}
-	defer conn.Close()
-
-	// Create topic
-	err = conn.CreateTopics(kafka.TopicConfig{
-		Topic:             topic,
-		NumPartitions:     1,
-		ReplicationFactor: 1,
-	})
-	if err != nil {
-		log.Printf("Failed to create Kafka topic %s: %v", topic, err)
-	} else {
-		log.Printf("Kafka topic %s created successfully", topic)
-	}
+// windowReport is published for every finished window.
+type windowReport struct {
+	UniqueRequestCount int                       `json:"unique_request_count"`
+	Timestamp          string                    `json:"timestamp"`
+	Version            string                    `json:"version"`
+	GitSHA             string                    `json:"git_sha"`
+	InstanceID         string                    `json:"instance_id"`
+	Backend            string                    `json:"backend"`
+	Buckets            map[string]int            `json:"buckets,omitempty"`
+	Dimensions         map[string]map[string]int `json:"dimensions,omitempty"`
+	Tenants            map[string]int            `json:"tenants,omitempty"`
+	Reconciliation     *reconciliation           `json:"reconciliation,omitempty"`
+	// Period is set on hour and day rollups, whose counts are HyperLogLog estimates.
+	Period      string `json:"period,omitempty"`
+	PeriodStart string `json:"period_start,omitempty"`
+	Approximate bool   `json:"approximate,omitempty"`
+	// Overflowed is set on windows with more unique ids than WINDOW_MAX_UNIQUE, which are also
+	// approximate when they switched to approximate counting.
+	Overflowed bool `json:"overflowed,omitempty"`
+	// Compacted is set on history reports summed from finer ones by the history compactor.
+	Compacted bool `json:"compacted,omitempty"`
+	// Duplicates and TopDuplicates, the most repeated dedupe keys and how often they repeated,
+	// are this instance's and only kept for the file sink.
+	Duplicates    int            `json:"duplicates,omitempty"`
+	TopDuplicates map[string]int `json:"top_duplicates,omitempty"`
+	// Regions and MissingRegions are set on the global windows of an aggregator: the count of
+	// every region that reported the window and the AGGREGATE_REGIONS that didn't in time.
+	Regions        map[string]int `json:"regions,omitempty"`
+	MissingRegions []string       `json:"missing_regions,omitempty"`
+	// Trend is only set on subscription notifications, with NOTIFY_TREND.
+	Trend *windowTrend `json:"trend,omitempty"`
+	// SketchDigest is the SHA-256 of the window's HyperLogLog registers, set on minute windows
+	// with the region or history sink; the verify checksum covers it.
+	SketchDigest string `json:"sketch_digest,omitempty"`
 }
 
 // Publish unique ID count to Kafka
-func publishToKafka(count int) {
-	payload := map[string]interface{}{
-		"unique_request_count": count,
-		"timestamp":            time.Now().Format(time.RFC3339),
-	}
-	message, err := json.Marshal(payload)
+func publishToKafka(ctx context.Context, report windowReport) error {
+	message, err := kafkaFormat.Report(report)
 	if err != nil {
-		log.Printf("Failed to marshal Kafka message: %v\n", err)
-		return
+		return fmt.Errorf("marshal Kafka message: %w", err)
+	}
+
+	key := kafkaKey(report, "")
+	if skipDryRun("kafka", "key %s: %s", key, printablePayload(kafkaFormat, message)) {
+		return nil
 	}
 
 	// Write message to Kafka
+	resources.kafkaWrites.Add(1)
+	defer resources.kafkaWrites.Add(-1)
 	err = kafkaWriter.WriteMessages(ctx, kafka.Message{
-		Key:   []byte("unique-id-count"),
+		Key:   key,
 		Value: message,
 	})
 	if err != nil {
-		log.Printf("Failed to write message to Kafka: %v\n", err)
-	} else {
-		log.Printf("Published to Kafka: %s\n", string(message))
+		return err
 	}
+	log.Printf("Published to Kafka: %s\n", printablePayload(kafkaFormat, message))
+	return nil
 }
 
-// Periodically fetch unique ID counts and send to Kafka
-func logAndNotifyUniqueRequests() {
+// windowsAligned reports whether the service window closes on the minute. In privacy mode the
+// dedupe salt changes on the minute, so windows have to end on it too; with the region sink they
+// do so that every region's windows end in the same minute. Otherwise they tick from startup.
+func windowsAligned() bool {
+	return idHash != nil || hasSink(sinks, "region")
+}
+
+// Periodically fetch unique ID counts and send them to the configured sinks
+func logAndNotifyUniqueRequests(runCtx context.Context) error {
+	clock := newWindowClock(time.Now(), time.Minute, getEnvDuration("CLOCK_SKEW_TOLERANCE", time.Second))
+	aligned := windowsAligned()
+	if aligned {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case now := <-time.After(untilMinute(time.Now())):
+			reportWindow(clock.boundary(now))
+		}
+	}
+
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		// Count unique requests in Redis
-		keys, err := redisDB.Keys(ctx, "*").Result()
-		if err != nil {
-			log.Printf("Error fetching keys from Redis: %v\n", err)
-			continue
+	realigning := false
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case now := <-ticker.C:
+			reportWindow(clock.boundary(now))
+			// After a jump the monotonic ticks no longer fall on the wall-clock minute the salts
+			// rotate at, so the next tick is put back on it
+			switch {
+			case aligned && clock.skewed:
+				ticker.Reset(untilMinute(time.Now()))
+				realigning = true
+			case realigning:
+				ticker.Reset(time.Minute)
+				realigning = false
+			}
 		}
+	}
+}
 
-		count := len(keys)
+// reportWindow closes the window ending at now and publishes its report.
+func reportWindow(now time.Time) {
+	start := startedAt
+	if opened := windowOpened.Swap(now.UnixNano()); opened != 0 {
+		start = time.Unix(0, opened)
+	}
+	// Let the requests that arrived before now finish. Other instances' requests can't be
+	// waited for, so with a coordinator the whole grace period is held
+	_, single := coordinator.(localCoordinator)
+	acceptGrace.close(getEnvDuration("WINDOW_GRACE", 0), !single)
+	// A switch requested through the admin API happens here, so the closing window is
+	// flushed from the new backend with the old one's ids drained into it
+	if backendSwitch != nil {
+		backendSwitch.atBoundary(ctx)
+	}
 
-		publishToKafka(count)
+	// Breakdowns are kept per instance, so every instance starts a new window for them
+	report := windowReport{
+		Timestamp:  now.Format(time.RFC3339),
+		Version:    currentBuild().Version,
+		GitSHA:     currentBuild().GitSHA,
+		InstanceID: instanceID(),
+		Backend:    activeBackend(),
+	}
+	if buckets != nil {
+		report.Buckets = buckets.flush()
+	}
+	if metadata != nil {
+		report.Dimensions = metadata.flush()
+	}
+	report.Tenants = tenantCounts.flush()
+	dups := duplicates.flush()
+	report.Duplicates, report.TopDuplicates = dups.Total, dups.TopKeys
+	duplicateReports.enqueue(report.Timestamp, dups)
+	if rollups != nil {
+		rollups.tick(ctx, now, coordinator.IsLeader())
+	}
+	windowSketches.rotate(ctx, report.Timestamp)
+	idSets.rotate(start, report.Timestamp)
 
-		// Clean up old keys
-		for _, key := range keys {
-			redisDB.Del(ctx, key)
+	// Only the leader reports, so replicas sharing a backend don't publish a window twice. The
+	// others read the windows it published for their trends; this one is there by the next
+	// boundary
+	if !coordinator.IsLeader() {
+		// The leader may flush a shared backend a little before or after this, a count read in
+		// between is at most one cache ttl stale
+		notifyCounts.invalidate()
+		statsCounts.invalidate()
+		if _, shared := history.(*redisHistory); shared {
+			if err := trends.catchUp(ctx, history, now); err != nil {
+				log.Printf("Error loading the window history for the notification trend: %v\n", err)
+			}
+		}
+		return
+	}
+
+	// Count unique requests and start a new window
+	count, err := dedup.Flush(ctx)
+	notifyCounts.invalidate()
+	statsCounts.invalidate()
+	if err != nil {
+		log.Printf("Error flushing unique ids: %v\n", err)
+		return
+	}
+	replicator.replicate(replicateFlush, "")
+	keyspace.afterFlush()
+	audit.record(auditEntry{
+		Action:  "window.flush",
+		Actor:   "instance " + instanceID(),
+		Details: map[string]interface{}{"window": report.Timestamp, "unique_request_count": count},
+	})
+
+	report.UniqueRequestCount = count
+	if overflow := windowCap.lastWindow(); overflow.overflowed {
+		report.Overflowed, report.Approximate = true, overflow.approximate
+	}
+	if reconciler != nil {
+		if report.Reconciliation, err = reconciler.collect(ctx, count); err != nil {
+			log.Printf("Error reconciling window contributions: %v\n", err)
 		}
 	}
+	report.SketchDigest = windowSketches.digest(ctx, report.Timestamp)
+	publishReport(report)
+	notifySubscribers(report)
 }
 
 // Send unique request count to an endpoint
 func sendCountToEndpoint(endpoint string, count int) {
-	payload := map[string]interface{}{
-		"unique_request_count": count,
-		"timestamp":            time.Now().Format(time.RFC3339),
-	}
-	jsonData, err := json.Marshal(payload)
+	build := currentBuild()
+	postNotification(endpoint, notifyFormat.forEndpoint(endpoint), nil, windowReport{
+		UniqueRequestCount: count,
+		Timestamp:          time.Now().Format(time.RFC3339),
+		Version:            build.Version,
+		GitSHA:             build.GitSHA,
+		InstanceID:         instanceID(),
+		Backend:            activeBackend(),
+	})
+}
+
+// postNotification sends report to endpoint with the extra header, returning the status code
+// it answered with, or 0 when it wasn't sent.
+func postNotification(endpoint string, format payloadSerializer, header http.Header, report windowReport) int {
+	payload, err := format.Report(report)
 	if err != nil {
-		log.Printf("Failed to marshal JSON payload: %v\n", err)
-		return
+		log.Printf("Failed to marshal %s payload: %v\n", format.Name(), err)
+		return 0
 	}
 
-	// Send the POST request
-	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonData))
+	if skipDryRun("endpoint", "%s %s", endpoint, printablePayload(format, payload)) {
+		return 0
+	}
+
+	// Send the POST request, hedged for critical hosts
+	var resp *http.Response
+	if host, ok := notifyHedge.hedged(endpoint); ok {
+		resp, err = notifyHedge.post(host, endpoint, format.ContentType(), header, payload)
+	} else {
+		resp, err = postWithHeader(endpoint, format.ContentType(), header, payload)
+	}
 	if err != nil {
 		log.Printf("Error sending request to endpoint %s: %v\n", endpoint, err)
-		return
+		return 0
 	}
 	defer resp.Body.Close()
 
 	log.Printf("Sent count to endpoint %s, status code: %d\n", endpoint, resp.StatusCode)
+	if contracts != nil {
+		contracts.observe(endpoint, resp)
+	}
+	return resp.StatusCode
 }
 
-func isUniqueID(id int) bool {
-	key := strconv.Itoa(id)
-	result, err := redisDB.SetNX(ctx, key, true, 1*time.Minute).Result()
+// postWithHeader is notifyClient.Post with extra request headers, e.g. a subscription's auth.
+func postWithHeader(endpoint, contentType string, header http.Header, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
 	if err != nil {
-		log.Printf("Error checking ID in Redis: %v\n", err)
-		return false
+		return nil, err
 	}
-	return result
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	return notifyClient.Do(req)
 }
 
-func acceptHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure it's a GET request
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is supported", http.StatusMethodNotAllowed)
-		return
+// isUniqueID reports whether in is new in the current window. An id that couldn't be checked is
+// not unique; the error is returned so that a blown request budget can be told apart.
+func isUniqueID(reqCtx context.Context, in dedupeInput) (bool, error) {
+	if w := tenantWindows.lookup(in.tenant); w != nil {
+		return w.add(reqCtx, in)
+	}
+	key := storedKey(in)
+	start := time.Now()
+	result, err := dedup.Add(reqCtx, key)
+	scaling.observeDedupe(time.Since(start))
+	if err != nil {
+		log.Printf("Error checking ID in dedupe store: %v\n", err)
+		return false, err
+	}
+	if result {
+		replicator.replicate(replicateAdd, key)
+		recordUnique(in, key)
+		countUnique(reqCtx, 1)
+	} else {
+		duplicates.record(key, in.tenant)
 	}
+	return result, nil
+}
 
+// recordUnique adds a new id, stored as key, to the per-instance breakdowns of the window.
+func recordUnique(in dedupeInput, key string) {
+	if buckets != nil {
+		buckets.record(in.id)
+	}
+	if metadata != nil {
+		metadata.record(key, in.metadata)
+	}
+	if reconciler != nil {
+		reconciler.record()
+	}
+	if in.tenant != "" {
+		tenantCounts.record(in.tenant)
+	}
+	if rollups != nil {
+		rollups.record(dedupeKey(in))
+	}
+	windowSketches.record(dedupeKey(in))
+	if idSets != nil {
+		idSets.record(storedKey(in))
+	}
+}
+
+func acceptHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
-	idParam := query.Get("id")
+	idParam, _ := extractID(r)
 	endpoint := query.Get("endpoint")
 
-	id, err := strconv.Atoi(idParam)
+	id, err := idNormalize.parseID(idParam)
 	if err != nil || id <= 0 {
 		http.Error(w, "Invalid or missing 'id' parameter", http.StatusBadRequest)
 		return
 	}
+	if endpoint != "" && !endpointParam {
+		http.Error(w, "The 'endpoint' parameter is disabled, register a subscription through the admin API instead", http.StatusBadRequest)
+		return
+	}
+
+	// Metadata dimensions are passed as plain query parameters, e.g. &source=web
+	var meta map[string]string
+	if metadata != nil {
+		meta = map[string]string{}
+		for _, dim := range metadata.dimensions {
+			if value := query.Get(dim); value != "" {
+				meta[dim] = value
+			}
+		}
+		if err := validateMetadata(meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	in := newDedupeInput(r, id, endpoint, meta)
+	traffic.record([]dedupeInput{in})
+	unique, err := isUniqueID(r.Context(), in)
+	if budgetExceeded(r, err) {
+		writeBudgetExceeded(w, r)
+		return
+	}
+	shardHints.set(w, in)
+	status := statusAccepted
+	if !unique {
+		if err == nil {
+			duplicateHook.record(r, in)
+		}
+		status = statusDuplicate
+	}
 
-	if !isUniqueID(id) {
+	// Internal callers get the v2 JSON answer with the window metadata
+	if details := callers.details(r); details != nil {
+		writeJSON(w, http.StatusOK, acceptV2Response{ID: id, Status: status, acceptDetails: details})
+	} else if !unique {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok (duplicate), retry with different id"))
-		return
+	} else {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+	if unique && endpoint != "" {
+		notifyEndpoint(endpoint)
+	}
+}
 
-	if endpoint != "" {
-		keys, _ := redisDB.Keys(ctx, "*").Result()
-		count := len(keys)
+// Send the current unique count to endpoint in the background
+func notifyEndpoint(endpoint string) {
+	count, _ := notifyCounts.get(ctx)
 
-		go sendCountToEndpoint(endpoint, count)
-	}
+	notifications.enqueue(endpoint, count)
 }
 
 func main() {
-	redisDB = initRedis()
-	defer redisDB.Close()
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelftest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mock-endpoint" {
+		os.Exit(runMockEndpoint(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-redis" {
+		os.Exit(runMigrateRedis(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "record" {
+		rest, err := prepareRecord(os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		os.Args = append(os.Args[:1], rest...)
+	}
+	validateOnly := flag.Bool("validate-only", false, "validate the configuration and probe dependencies, then exit (non-zero on problems)")
+	dryRunFlag := flag.Bool("dry-run", false, "compute and log Kafka messages, sink writes and endpoint notifications without sending them")
+	flag.Parse()
+	dryRun = *dryRunFlag
+
+	build := currentBuild()
+	log.Printf("verve %s (git %s, built %s, %s)", build.Version, build.GitSHA, build.BuildTime, build.GoVersion)
+	tuneRuntime()
 
-	kafkaWriter = initKafka()
-	defer kafkaWriter.Close()
+	// --validate-only runs before any connection is made, so it only sees environment variables
+	if *validateOnly {
+		report := validateStartup()
+		report.print()
+		if report.failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	createKafkaTopic("unique-id-count", os.Getenv("KAFKA_BROKER"))
+	coordinatorKind := getEnv("COORDINATOR", "none")
+	if coordinatorKind == "redis" {
+		redisDB = initRedis()
+		defer redisDB.Close()
+	}
+
+	var err error
+	coordinator, err = newCoordinator(coordinatorKind)
+	if err != nil {
+		log.Fatalf("Failed to initialize coordinator: %v", err)
+	}
+	defer coordinator.Close()
+
+	clusterConfig, err = coordinator.Config(ctx)
+	if err != nil {
+		log.Printf("Failed to load cluster configuration: %v", err)
+	}
+	validateStartup().print()
+	if dryRun = dryRun || getEnvBool("DRY_RUN", false); dryRun {
+		log.Printf("Dry run: window reports and notifications are logged, not sent\n")
+	}
+
+	dedupeKey, err = parseKeyStrategy(getEnv("DEDUPE_KEY", "id"))
+	if err != nil {
+		log.Fatalf("Invalid dedupe key strategy: %v", err)
+	}
+	extractID, err = parseIDSource(getEnv("ID_SOURCE", "query:id"))
+	if err != nil {
+		log.Fatalf("Invalid id source: %v", err)
+	}
+	if idNormalize, err = parseIDNormalize(getEnv("ID_NORMALIZE", "")); err != nil {
+		log.Fatalf("Invalid id normalization: %v", err)
+	}
+	if cuckooHash, err = newIDHash(getEnv("CUCKOO_HASH", "fnv")); err != nil {
+		log.Fatalf("Invalid cuckoo hash: %v", err)
+	}
+	if rollupHash, err = newIDHash(getEnv("ROLLUP_HASH", "xxhash")); err != nil {
+		log.Fatalf("Invalid rollup hash: %v", err)
+	}
 
-	go logAndNotifyUniqueRequests()
+	backend := getEnv("DEDUPE_BACKEND", "redis")
+	dedupeBackend = backend
+	attributeLogs()
+	if backend == "roaring" && getEnv("DEDUPE_KEY", "id") != "id" {
+		log.Fatalf("The roaring dedupe backend only supports DEDUPE_KEY=id")
+	}
+	switch mode := getEnv("PRIVACY_MODE", "off"); mode {
+	case "off":
+	case "hash":
+		if backend == "roaring" {
+			log.Fatalf("The roaring dedupe backend stores numeric ids and can't be used with PRIVACY_MODE=hash")
+		}
+		secret := getEnv("PRIVACY_SECRET", "")
+		if secret == "" && coordinatorKind != "none" {
+			log.Fatalf("PRIVACY_MODE=hash with several instances requires a shared PRIVACY_SECRET")
+		}
+		idHash = newIDHasher(secret)
+		log.Printf("Privacy mode: dedupe keys are stored as salted SHA-256 hashes, salt rotated every minute")
+	default:
+		log.Fatalf("Unknown privacy mode %q", mode)
+	}
+	if backend == "redis" && redisDB == nil && getEnv("REDIS_SHARDS", "") == "" {
+		redisDB = initRedis()
+		defer redisDB.Close()
+	}
+	if addrs := getEnv("REDIS_REPLICAS", ""); addrs != "" {
+		replicas = newRedisReplicaSet(strings.Split(addrs, ","))
+		if replicas != nil {
+			defer replicas.Close()
+		}
+	}
+	if coordinatorKind != "none" && !sharedBackends[backend] {
+		log.Printf("Warning: %s dedupe backend is local to this instance, only the leader's ids will be reported", backend)
+	}
 
-	http.HandleFunc("/api/verve/accept", acceptHandler)
+	dedup, err = newDeduplicator(backend)
+	if err != nil {
+		log.Fatalf("Failed to initialize dedupe backend: %v", err)
+	}
+	maxKeys, maxMemory := getEnvInt("REDIS_MAX_KEYS", 0), getEnvInt("REDIS_MAX_MEMORY_MB", 0)
+	if interval := getEnvDuration("REDIS_KEYSPACE_INTERVAL", 30*time.Second); backend == "redis" && interval > 0 && (maxKeys > 0 || maxMemory > 0) {
+		keyspace = newKeyspaceGuard(dedup.(*redisDeduplicator), interval, maxKeys, uint64(maxMemory)<<20)
+	}
+	backendSwitch = newSwitchingDeduplicator(dedup, backend)
+	dedup = backendSwitch
+	if canary := getEnv("CANARY_BACKEND", ""); canary != "" {
+		percent := getEnvInt("CANARY_PERCENT", 1)
+		switch {
+		case canary == backend:
+			log.Fatalf("CANARY_BACKEND must differ from DEDUPE_BACKEND, both are %s", backend)
+		case percent < 0 || percent > 100:
+			log.Fatalf("CANARY_PERCENT must be between 0 and 100")
+		case canary == "roaring" && (getEnv("DEDUPE_KEY", "id") != "id" || idHash != nil):
+			log.Fatalf("The roaring canary backend only supports DEDUPE_KEY=id without PRIVACY_MODE")
+		}
+		if canary == "redis" && redisDB == nil && getEnv("REDIS_SHARDS", "") == "" {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		secondary, err := newDeduplicator(canary)
+		if err != nil {
+			log.Fatalf("Failed to initialize canary dedupe backend: %v", err)
+		}
+		dedup = newCanaryDeduplicator(dedup, secondary, percent)
+		log.Printf("Answering %d%% of ids from the %s canary dedupe backend", percent, canary)
+	}
+	if limit := getEnvInt("WINDOW_MAX_UNIQUE", 0); limit > 0 {
+		approximate, err := parseWindowOverflow(getEnv("WINDOW_OVERFLOW", "report"))
+		if err != nil {
+			log.Fatalf("Invalid WINDOW_OVERFLOW: %v", err)
+		}
+		if approximate && sharedBackends[backend] {
+			log.Fatalf("WINDOW_OVERFLOW=approximate protects the memory of in-process backends, %s is shared", backend)
+		}
+		windowCap = newWindowCapDeduplicator(dedup, limit, approximate)
+		dedup = windowCap
+	}
+	if closer, ok := dedup.(io.Closer); ok {
+		defer closer.Close()
+	}
+	log.Printf("Using %s dedupe backend", backend)
+
+	if getEnvBool("STANDBY", false) {
+		if coordinatorKind == "none" {
+			log.Fatalf("STANDBY needs a COORDINATOR to tell the leader from the standbys")
+		}
+		if sharedBackends[backend] {
+			log.Printf("Warning: %s dedupe backend is already shared, STANDBY only adds replication traffic", backend)
+		}
+		if redisDB == nil {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		replicator = newWindowReplicator(redisDB, getEnv("STANDBY_STREAM", "verve:window:replication"), getEnvInt("STANDBY_QUEUE_SIZE", 10000))
+	}
+
+	if getEnvBool("RECONCILE", false) {
+		if redisDB == nil {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		reconciler = newWindowReconciler(redisDB, getEnvDuration("RECONCILE_INTERVAL", 5*time.Second))
+	}
+
+	sinkSpec := getEnv("SINKS", "kafka")
+	needsRedis := strings.Contains(sinkSpec, "redis_stream") ||
+		(strings.Contains(sinkSpec, "history") && getEnv("HISTORY_STORE", "bolt") == "redis")
+	if needsRedis && redisDB == nil {
+		redisDB = initRedis()
+		defer redisDB.Close()
+	}
+	sinks, err = newSinks(sinkSpec)
+	if err != nil {
+		log.Fatalf("Invalid sink configuration: %v", err)
+	}
+	if closer, ok := history.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if hasSink(sinks, "kafka") {
+		kafkaKey, err = parseMessageKeyStrategy(getEnv("KAFKA_KEY", "tenant"), getEnv("KAFKA_KEY_CONSTANT", "unique-id-count"))
+		if err != nil {
+			log.Fatalf("Invalid Kafka key strategy: %v", err)
+		}
+		if kafkaFormat, err = newPayloadSerializer(getEnv("KAFKA_FORMAT", "json")); err != nil {
+			log.Fatalf("Invalid Kafka payload format: %v", err)
+		}
+		if kafkaCompression, err = parseKafkaCompression(getEnv("KAFKA_COMPRESSION", "none")); err != nil {
+			log.Fatalf("Invalid Kafka compression: %v", err)
+		}
+		kafkaWriter = initKafka()
+		tenantWriter = initTenantKafka()
+
+		// Replicas starting together would otherwise all race to create the topic. A dry run
+		// leaves the broker alone apart from reading the topic config
+		spec := topicSpecFromEnv("unique-id-count")
+		if !dryRun {
+			unlock, err := coordinator.Lock(ctx, "kafka-topic")
+			if err != nil {
+				log.Fatalf("Failed to acquire Kafka topic lock: %v", err)
+			}
+			createKafkaTopic(spec, getEnv("KAFKA_BROKER", ""))
+			unlock()
+		}
+		checkTopicConfig(spec, getEnv("KAFKA_BROKER", ""))
+	}
+
+	if path := getEnv("OUTBOX_PATH", ""); path != "" {
+		reportOutbox, err = newOutbox(path, sinks, getEnvDuration("OUTBOX_RETRY_INTERVAL", 10*time.Second))
+		if err != nil {
+			log.Fatalf("Failed to open outbox: %v", err)
+		}
+		defer reportOutbox.Close()
+	}
+
+	rollups, err = newRollupTracker(getEnv("ROLLUPS", ""), redisDB, getEnvDuration("ROLLUP_GRACE", 2*time.Minute))
+	if err != nil {
+		log.Fatalf("Invalid rollup configuration: %v", err)
+	}
+
+	buckets, err = newIDBuckets(getEnv("ID_BUCKET_RANGES", ""), getEnvInt("ID_HASH_BUCKETS", 0))
+	if err != nil {
+		log.Fatalf("Invalid id bucket configuration: %v", err)
+	}
+
+	if dims := parseDimensions(getEnv("METADATA_DIMENSIONS", "")); dims != nil {
+		metadata = newMetadataTracker(dims)
+	}
+
+	audit, err = newAuditLog(getEnv("AUDIT_LOG_PATH", "audit.log"), getEnv("AUDIT_LOG_KEY", ""), getEnvInt("AUDIT_AUTH_FAILURES_PER_MINUTE", 60))
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.Close()
+	// Only the names of the settings are audited, their values may be secrets
+	audit.record(auditEntry{
+		Action:  "config.load",
+		Actor:   "instance " + instanceID(),
+		Details: map[string]interface{}{"coordinator": coordinatorKind, "cluster_settings": sortedKeys(clusterConfig)},
+	})
+
+	if kind := getEnv("TENANT_STORE", ""); kind != "" {
+		if kind == "redis" && redisDB == nil {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		tenants, err = newTenantStore(kind)
+		if err != nil {
+			log.Fatalf("Failed to initialize tenant store: %v", err)
+		}
+		if closer, ok := tenants.(io.Closer); ok {
+			defer closer.Close()
+		}
+		quotas = newTenantQuotas(getEnvDuration("TENANT_QUOTA_REFRESH", 30*time.Second))
+	}
+	if getEnvBool("TENANT_WINDOWS", false) {
+		if tenants == nil {
+			log.Fatalf("TENANT_WINDOWS reads the tenants' windows from the TENANT_STORE, set one")
+		}
+		tenantWindows = newTenantWindowSet(getEnvDuration("TENANT_WINDOW_REFRESH", 30*time.Second))
+	}
+	if kind := getEnv("SUBSCRIPTION_STORE", ""); kind != "" {
+		if kind == "redis" && redisDB == nil {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		subscriptions, err = newSubscriptionStore(kind)
+		if err != nil {
+			log.Fatalf("Failed to initialize subscription store: %v", err)
+		}
+		if closer, ok := subscriptions.(io.Closer); ok {
+			defer closer.Close()
+		}
+		if key := getEnv("SUBSCRIPTION_SECRET_KEY", ""); key != "" {
+			if subscriptionSealer, err = newSecretSealer(key); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		subscriptions = sealedSubscriptions{store: subscriptions, sealer: subscriptionSealer}
+	}
+	endpointParam = getEnvBool("NOTIFY_ENDPOINT_PARAM", false)
+
+	if getEnvBool("REPLAY_PROTECTION", false) {
+		if tenants == nil {
+			log.Fatalf("REPLAY_PROTECTION signs requests with API keys and needs a TENANT_STORE")
+		}
+		kind := getEnv("REPLAY_NONCE_STORE", "memory")
+		if kind == "redis" && redisDB == nil {
+			redisDB = initRedis()
+			defer redisDB.Close()
+		}
+		nonces, err := newNonceStore(kind)
+		if err != nil {
+			log.Fatalf("Failed to initialize nonce store: %v", err)
+		}
+		replayGuard = newReplayProtection(getEnvDuration("REPLAY_MAX_SKEW", 5*time.Minute), nonces)
+	}
+
+	contract, err := newResponseContract(getEnv("NOTIFY_EXPECT_STATUS", ""), getEnv("NOTIFY_EXPECT_FIELDS", ""))
+	if err != nil {
+		log.Fatalf("Invalid notification contract: %v", err)
+	}
+	if contract != nil {
+		contracts = newContractTracker(contract)
+	}
+	notifyCounts = newCountCache(getEnvDuration("NOTIFY_COUNT_TTL", time.Second))
+	notifyFormat, err = parseNotifyFormats(getEnv("NOTIFY_FORMAT", "json"), getEnv("NOTIFY_HOST_FORMATS", ""))
+	if err != nil {
+		log.Fatalf("Invalid notification payload format: %v", err)
+	}
+	if getEnvBool("NOTIFY_TREND", false) {
+		n := getEnvInt("NOTIFY_TREND_WINDOWS", 5)
+		if n < 1 {
+			log.Fatalf("NOTIFY_TREND_WINDOWS must be at least 1")
+		}
+		trends = newWindowTrends(n)
+	}
+	notifyHedge, err = parseNotifyHedge(getEnv("NOTIFY_HEDGE_HOSTS", ""), getEnvInt("NOTIFY_HEDGE_PERCENTILE", 95), getEnvDuration("NOTIFY_HEDGE_MIN_DELAY", 50*time.Millisecond))
+	if err != nil {
+		log.Fatalf("Invalid notification hedging: %v", err)
+	}
+	statsCounts = newCountCache(getEnvDuration("STATS_CACHE_TTL", time.Second))
+	notifications = newNotifier(
+		getEnvInt("NOTIFY_WORKERS", 8),
+		getEnvInt("NOTIFY_QUEUE_SIZE", 1000),
+		getEnvInt("NOTIFY_MAX_PER_HOST", 2),
+		getEnvInt("NOTIFY_HOST_QUEUE_SIZE", 100),
+		getEnvDuration("NOTIFY_TIMEOUT", 10*time.Second),
+	)
+	if hook := getEnv("DUPLICATE_WEBHOOK_URL", ""); hook != "" {
+		interval := getEnvDuration("DUPLICATE_WEBHOOK_INTERVAL", 5*time.Second)
+		if interval <= 0 {
+			log.Fatalf("DUPLICATE_WEBHOOK_INTERVAL must be positive")
+		}
+		duplicateHook = newDuplicateWebhook(hook,
+			getEnvInt("DUPLICATE_WEBHOOK_BATCH", 100),
+			getEnvInt("DUPLICATE_WEBHOOK_QUEUE_SIZE", 10000),
+			interval,
+			getEnvDuration("NOTIFY_TIMEOUT", 10*time.Second),
+		)
+	}
+	if topic, url := getEnv("DUPLICATE_REPORT_TOPIC", ""), getEnv("DUPLICATE_REPORT_URL", ""); topic != "" || url != "" {
+		if topic != "" && getEnv("KAFKA_BROKER", "") == "" {
+			log.Fatalf("DUPLICATE_REPORT_TOPIC requires KAFKA_BROKER")
+		}
+		duplicateReports = newDuplicateReporter(topic, url, getEnvDuration("NOTIFY_TIMEOUT", 10*time.Second))
+		if duplicates == nil {
+			duplicates = newDuplicateTracker(getEnvInt("REPORT_TOP_K", 10))
+		}
+	}
+	if bucket := getEnv("ID_SET_BUCKET", ""); bucket != "" {
+		if idSets, err = newIDSetExporter(ctx, bucket, getEnv("ID_SET_PREFIX", "verve/id-sets/"), getEnv("ID_SET_ENDPOINT", ""), getEnv("ID_SET_FORMAT", "roaring")); err != nil {
+			log.Fatalf("Invalid ID set export: %v", err)
+		}
+	}
+
+	httpSpec := getEnv("HTTP_MIDDLEWARE", defaultHTTPMiddleware)
+	if httpChain, err = parseHTTPChain(httpSpec); err != nil {
+		log.Fatalf("Invalid HTTP_MIDDLEWARE: %v", err)
+	}
+	apiSpec := getEnv("API_MIDDLEWARE", defaultAPIMiddleware)
+	if apiChain, err = parseAPIChain(apiSpec); err != nil {
+		log.Fatalf("Invalid API_MIDDLEWARE: %v", err)
+	}
+	if err := requireAPIAuth(apiSpec, getEnv("TENANT_STORE", "")); err != nil {
+		log.Fatalf("Invalid API_MIDDLEWARE: %v", err)
+	}
+	if realIP, err = parseRealIP(getEnv("TRUSTED_PROXIES", ""), getEnv("REAL_IP_HEADERS", "X-Forwarded-For,X-Real-IP,Forwarded")); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	if adminAllowed, err = parseCIDRList(getEnv("ADMIN_ALLOWED_CIDRS", "")); err != nil {
+		log.Fatalf("Invalid ADMIN_ALLOWED_CIDRS: %v", err)
+	}
+	if callers, err = newCallerClassifier(getEnv("INTERNAL_CIDRS", ""), getEnv("INTERNAL_API_KEY_IDS", ""), getEnv("VERBOSE_RESPONSES", "internal")); err != nil {
+		log.Fatalf("Invalid caller classes: %v", err)
+	}
+	if policies, err = loadPolicies(getEnv("POLICY_FILE", "")); err != nil {
+		log.Fatalf("Invalid POLICY_FILE: %v", err)
+	}
+	if shardHints, err = parseShardHints(getEnv("SHARD_HINT_PEERS", ""), getEnv("SHARD_HINT_SELF", "")); err != nil {
+		log.Fatalf("Invalid SHARD_HINT_PEERS: %v", err)
+	}
+	if rps := getEnvInt("RATE_LIMIT_RPS", 0); rps > 0 {
+		if names, _ := parseLayerNames(httpSpec, httpLayers); !slices.Contains(names, "rate_limit") {
+			log.Fatalf("RATE_LIMIT_RPS is set but the rate_limit layer isn't in HTTP_MIDDLEWARE")
+		}
+		rateLimiter = newClientRateLimiter(float64(rps), getEnvInt("RATE_LIMIT_BURST", 2*rps), getEnvInt("RATE_LIMIT_SOFT_PERCENT", 20))
+	}
+	if threshold := getEnvDuration("SLO_LATENCY", 0); threshold > 0 {
+		target, err := parseSLOTarget(getEnv("SLO_TARGET", "99"))
+		if err != nil {
+			log.Fatalf("Invalid SLO_TARGET: %v", err)
+		}
+		latencySLO = newSLOTracker(threshold, target)
+	}
+	registerRoutes()
+
+	listeners, err := newListeners()
+	if err != nil {
+		log.Fatalf("Invalid listener configuration: %v", err)
+	}
+
+	weights, err := parseScalingWeights(getEnv("SCALING_WEIGHTS", "rps=0.5,inflight=0.3,dedupe_latency=0.2"))
+	if err != nil {
+		log.Fatalf("Invalid SCALING_WEIGHTS: %v", err)
+	}
+	scaling = newScalingSignal(scalingTargets{
+		rps:           float64(getEnvInt("SCALING_TARGET_RPS", 2000)),
+		inflight:      float64(getEnvInt("SCALING_TARGET_INFLIGHT", 200)),
+		dedupeLatency: getEnvDuration("SCALING_TARGET_DEDUPE_LATENCY", 5*time.Millisecond),
+	}, weights)
+	resources = newResourceAccounting(
+		getEnvInt("MAX_INFLIGHT_REQUESTS", 0),
+		getEnvInt("MAX_GOROUTINES", 0),
+		uint64(getEnvInt("DEDUPE_MEMORY_LIMIT_MB", 0))<<20,
+	)
+
+	lc := newLifecycle(getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+	if kafkaWriter != nil {
+		lc.add("kafka publisher", func(runCtx context.Context) error {
+			<-runCtx.Done()
+			tenantWriter.Close()
+			return kafkaWriter.Close()
+		}, nil)
+	}
+	if hasSink(sinks, "region") {
+		regionWriter = initRegionKafka()
+		lc.add("region publisher", func(runCtx context.Context) error {
+			<-runCtx.Done()
+			return regionWriter.Close()
+		}, nil)
+	}
+	if reportOutbox != nil {
+		lc.add("outbox", reportOutbox.run, nil)
+	}
+	if runner, ok := dedup.(backgroundRunner); ok {
+		lc.add("dedupe backend", runner.Run, nil)
+	}
+	if path := getEnv("RECORD_PATH", ""); path != "" {
+		// Replay needs the raw ids, which privacy mode keeps off disk
+		if idHash != nil {
+			log.Fatalf("RECORD_PATH writes raw ids and can't be used with PRIVACY_MODE")
+		}
+		sample, err := strconv.ParseFloat(getEnv("RECORD_SAMPLE", "1"), 64)
+		if err != nil {
+			log.Fatalf("Invalid RECORD_SAMPLE: %v", err)
+		}
+		if traffic, err = newTrafficRecorder(path, sample, int64(getEnvInt("RECORD_MAX_MB", 0))<<20); err != nil {
+			log.Fatalf("Failed to start traffic recording: %v", err)
+		}
+		log.Printf("Recording accept traffic to %s (sample %v)\n", path, sample)
+		lc.add("traffic recorder", traffic.run, nil)
+	}
+	lc.add("resource accounting", resources.run, nil)
+	if keyspace != nil {
+		lc.add("redis keyspace guard", keyspace.run, nil)
+	}
+	lc.add("scaling signal", scaling.run, nil)
+	if addr := getEnv("INGEST_TCP_ADDR", ""); addr != "" {
+		allowed, err := parseCIDRList(getEnv("INGEST_TCP_ALLOWED_CIDRS", ""))
+		if err != nil {
+			log.Fatalf("Invalid INGEST_TCP_ALLOWED_CIDRS: %v", err)
+		}
+		// The protocol has no API key, so the network is its only authentication
+		if len(allowed) == 0 {
+			log.Fatalf("INGEST_TCP_ADDR requires INGEST_TCP_ALLOWED_CIDRS")
+		}
+		ingest := newTCPIngest(addr, allowed, getEnvInt("BATCH_MAX_IDS", 1000), getEnvDuration("INGEST_TCP_IDLE_TIMEOUT", 5*time.Minute))
+		lc.add("tcp ingest "+addr, ingest.run, nil)
+	}
+	if latencySLO != nil {
+		lc.add("slo tracker", latencySLO.run, nil)
+	}
+	if uploadURL := getEnv("PROFILING_UPLOAD_URL", ""); uploadURL != "" {
+		p := newProfiler(uploadURL,
+			getEnv("PROFILING_APP_NAME", "verve"),
+			getEnvDuration("PROFILING_INTERVAL", 1*time.Minute),
+			getEnvDuration("PROFILING_CPU_DURATION", 10*time.Second),
+		)
+		lc.add("profiler", p.run, nil)
+	}
+	if history != nil && getEnvBool("HISTORY_DOWNSAMPLE", false) {
+		interval := getEnvDuration("HISTORY_COMPACT_INTERVAL", time.Hour)
+		if interval <= 0 {
+			log.Fatalf("HISTORY_COMPACT_INTERVAL must be positive")
+		}
+		compactor := newHistoryCompactor(history,
+			getEnvDuration("HISTORY_MINUTE_RETENTION", 7*24*time.Hour),
+			getEnvDuration("HISTORY_HOUR_RETENTION", 90*24*time.Hour),
+			interval,
+		)
+		lc.add("history compactor", compactor.run, nil)
+	}
+	if reconciler != nil {
+		lc.add("window reconciler", reconciler.run, nil)
+	}
+	if replicator != nil {
+		lc.add("window replication", replicator.run, nil)
+	}
+	lc.add("notification workers", notifications.run, nil)
+	if duplicateHook != nil {
+		lc.add("duplicate webhook", duplicateHook.run, nil)
+	}
+	if duplicateReports != nil {
+		lc.add("duplicate reports", duplicateReports.run, nil)
+	}
+	if idSets != nil {
+		lc.add("id set exports", idSets.run, nil)
+	}
+	if interval := getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second); interval > 0 {
+		lc.add("heartbeat", newHeartbeater(interval, getEnv("HEARTBEAT_TOPIC", "")).run, nil)
+	}
+	if spec := getEnv("AGGREGATE_REGIONS", ""); spec != "" {
+		regions, err := parseRegions(spec)
+		if err != nil {
+			log.Fatalf("Invalid AGGREGATE_REGIONS: %v", err)
+		}
+		// An aggregator's windows are the regions'; its own would only ever be empty
+		agg := newRegionAggregator(initRegionReader(), regions, getEnvDuration("AGGREGATE_WAIT", 2*time.Minute))
+		lc.add("region aggregator", agg.run, nil)
+	} else {
+		lc.add("window reporter", logAndNotifyUniqueRequests, nil)
+	}
+	if quotas != nil {
+		lc.add("tenant quotas", quotas.run, nil)
+	}
+	if tenantWindows != nil {
+		lc.add("tenant windows", tenantWindows.run, nil)
+	}
+	lc.add("leader election", func(runCtx context.Context) error {
+		coordinator.Campaign(runCtx)
+		return nil
+	}, nil)
+	for _, l := range listeners {
+		lc.add(l.name(), func(context.Context) error {
+			log.Printf("Starting %s...\n", l.name())
+			if err := l.serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		}, l.shutdown)
+	}
 
-	// Start the server
-	port := ":8080"
-	log.Printf("Starting server on %s...\n", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	if err := lc.run(ctx); err != nil {
+		log.Fatalf("Server stopped: %v", err)
 	}
+	log.Printf("Server stopped")
 }
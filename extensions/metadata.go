@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	maxMetadataKeys     = 8
+	maxMetadataValueLen = 64
+)
+
+var errInvalidMetadata = errors.New("metadata may hold at most 8 keys with values of up to 64 characters")
+
+// validateMetadata enforces that metadata stays a small blob.
+func validateMetadata(meta map[string]string) error {
+	if len(meta) > maxMetadataKeys {
+		return errInvalidMetadata
+	}
+	for key, value := range meta {
+		if len(key) > maxMetadataValueLen || len(value) > maxMetadataValueLen {
+			return errInvalidMetadata
+		}
+	}
+	return nil
+}
+
+// metadataTracker keeps the metadata of every unique id of the current window and aggregates it
+// into unique counts per dimension value, e.g. {"source": {"web": 10, "app": 3}}. An id is
+// attributed to the metadata it carried when it was first seen in the window. Ids are tracked
+// by dedupe key, so the same id of two tenants counts for both.
+type metadataTracker struct {
+	dimensions []string
+
+	mu     sync.Mutex
+	ids    map[string]map[string]string
+	counts map[string]map[string]int
+}
+
+func newMetadataTracker(dimensions []string) *metadataTracker {
+	t := &metadataTracker{dimensions: dimensions}
+	t.reset()
+	return t
+}
+
+// parseDimensions parses the METADATA_DIMENSIONS list, returning nil when it is empty.
+func parseDimensions(spec string) []string {
+	var dims []string
+	for _, dim := range strings.Split(spec, ",") {
+		if dim = strings.TrimSpace(dim); dim != "" {
+			dims = append(dims, dim)
+		}
+	}
+	return dims
+}
+
+func (t *metadataTracker) reset() {
+	t.ids = map[string]map[string]string{}
+	t.counts = make(map[string]map[string]int, len(t.dimensions))
+	for _, dim := range t.dimensions {
+		t.counts[dim] = map[string]int{}
+	}
+}
+
+// record stores the tracked dimensions of meta for the unique id stored as key.
+func (t *metadataTracker) record(key string, meta map[string]string) {
+	kept := map[string]string{}
+	for _, dim := range t.dimensions {
+		if value := meta[dim]; value != "" {
+			kept[dim] = value
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids[key] = kept
+	for dim, value := range kept {
+		t.counts[dim][value]++
+	}
+}
+
+// retract removes the contribution of the id stored as key after it was retracted from the
+// window.
+func (t *metadataTracker) retract(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for dim, value := range t.ids[key] {
+		if t.counts[dim][value]--; t.counts[dim][value] <= 0 {
+			delete(t.counts[dim], value)
+		}
+	}
+	delete(t.ids, key)
+}
+
+// flush returns the per-dimension counts of the finished window and starts a new one.
+func (t *metadataTracker) flush() map[string]map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := t.counts
+	t.reset()
+	return counts
+}
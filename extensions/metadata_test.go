@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestMetadataTrackedByDedupeKey(t *testing.T) {
+	dedupeKey, _ = parseKeyStrategy("id_tenant")
+	defer func() { dedupeKey, _ = parseKeyStrategy("id") }()
+	tr := newMetadataTracker([]string{"source"})
+
+	acme := dedupeInput{id: 1, tenant: "acme"}
+	other := dedupeInput{id: 1, tenant: "other"}
+	tr.record(storedKey(acme), map[string]string{"source": "web"})
+	tr.record(storedKey(other), map[string]string{"source": "app"})
+	// Retracting one tenant's id leaves the other tenant's id of the same number counted
+	tr.retract(storedKey(acme))
+	counts := tr.flush()
+	if counts["source"]["web"] != 0 || counts["source"]["app"] != 1 {
+		t.Errorf("got %v, want only other's app id", counts)
+	}
+}
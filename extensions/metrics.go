@@ -0,0 +1,321 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served at /metrics.
+var (
+	auditFailuresSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_audit_auth_failures_suppressed_total",
+		Help: "Failed authentications left out of the audit log over AUDIT_AUTH_FAILURES_PER_MINUTE.",
+	})
+	outboxDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_outbox_dropped_total",
+		Help: "Window reports the outbox gave up on, per sink, because the sink refused them for good.",
+	}, []string{"sink"})
+	panicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_http_panics_total",
+		Help: "Number of HTTP handler panics recovered.",
+	})
+	topicConfigDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_kafka_topic_config_drift",
+		Help: "1 if the report topic's config differs from the configured value, per config name.",
+	}, []string{"config"})
+	windowDiscrepancy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_window_count_discrepancy",
+		Help: "Shared dedupe count of the last window minus the sum of the per-instance contributions.",
+	})
+	notifyContractViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_notification_contract_violations_total",
+		Help: "Notification responses that didn't match NOTIFY_EXPECT_STATUS/NOTIFY_EXPECT_FIELDS, per host and reason.",
+	}, []string{"host", "reason"})
+	notifyHedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_notification_hedges_total",
+		Help: "Hedged notification requests sent, and those that answered before the original (won), per host.",
+	}, []string{"host", "result"})
+	subscriptionNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_subscription_notifications_total",
+		Help: "Window notifications of subscriptions by result: sent, rejected (non-2xx answer), failed, dropped (queue full) or filtered (skipped by the subscription's filters).",
+	}, []string{"result"})
+	openConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_http_connections",
+		Help: "Open HTTP connections per listener and state (new, active, idle).",
+	}, []string{"listener", "state"})
+	connectionsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_http_connections_accepted_total",
+		Help: "HTTP connections accepted per listener.",
+	}, []string{"listener"})
+	connectionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_http_connections_closed_total",
+		Help: "HTTP connections closed per listener.",
+	}, []string{"listener"})
+	connectionRequests = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "verve_http_connection_requests",
+		Help:    "Requests served per HTTP connection, observed when it closes.",
+		Buckets: []float64{1, 2, 5, 10, 50, 100, 1000, 10000, 100000},
+	})
+	connectionLifetime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "verve_http_connection_duration_seconds",
+		Help:    "Lifetime of HTTP connections, observed when they close.",
+		Buckets: []float64{0.01, 0.1, 1, 10, 60, 300, 1800, 3600},
+	})
+	connectionLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_http_connection_limit",
+		Help: "MAX_CONNECTIONS of a listener.",
+	}, []string{"listener"})
+	connectionLimitReached = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_http_connection_limit_reached_total",
+		Help: "Times a listener stopped accepting because it was at MAX_CONNECTIONS.",
+	}, []string{"listener"})
+	replicaReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_redis_replica_reads_total",
+		Help: "Read-only Redis commands served by a replica, or by the primary after a replica failed.",
+	}, []string{"served_by"})
+	budgetExceededTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_http_budget_exceeded_total",
+		Help: "Requests answered with 503 because they exceeded REQUEST_BUDGET, per path.",
+	}, []string{"path"})
+	dryRunSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_dry_run_skipped_total",
+		Help: "Messages that DRY_RUN logged instead of sending, per target (kafka, graphite, redis_stream, endpoint, heartbeat).",
+	}, []string{"target"})
+	windowGraceStragglers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_window_grace_stragglers_total",
+		Help: "Accept requests still in flight when WINDOW_GRACE ran out, which may count in the next window.",
+	})
+	heartbeatTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_heartbeat_timestamp_seconds",
+		Help: "Unix time of this instance's last heartbeat.",
+	})
+	uptimeSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_uptime_seconds",
+		Help: "Seconds since this instance started, as of its last heartbeat.",
+	})
+	lastWindowPublished = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_last_window_published_timestamp_seconds",
+		Help: "Unix time of the last window this instance published.",
+	})
+	healthCheck = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_health",
+		Help: "1 if the check (dedupe, sinks, notifications) passed at the last heartbeat, 0 otherwise.",
+	}, []string{"check"})
+	roaringSpills = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_roaring_spills_total",
+		Help: "Times the roaring window outgrew ROARING_MEMORY_BUDGET_MB and was spilled to disk.",
+	})
+	spilledIDs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_roaring_spilled_ids",
+		Help: "Ids of the current roaring window held on disk.",
+	})
+	replicationDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_replication_dropped_total",
+		Help: "Window changes not replicated to standbys because the replication queue was full.",
+	})
+	replicationApplied = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_replication_applied_total",
+		Help: "Replicated window changes applied by this standby.",
+	})
+	resourceInUse = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_resource_in_use",
+		Help: "What a subsystem holds right now, sampled every second.",
+	}, []string{"resource"})
+	resourceCap = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_resource_cap",
+		Help: "Configured cap of a resource; 0 is unlimited.",
+	}, []string{"resource"})
+	resourceCapRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_resource_cap_rejections_total",
+		Help: "Requests turned away because a resource cap was reached.",
+	}, []string{"resource"})
+	replayRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_replay_rejections_total",
+		Help: "API key requests rejected by replay protection, by reason.",
+	}, []string{"reason"})
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_rate_limited_total",
+		Help: "Requests answered with a 429 by the rate_limit middleware.",
+	})
+	sloRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_slo_requests_total",
+		Help: "API requests counted against the latency SLO, good when answered within SLO_LATENCY without a 5xx.",
+	}, []string{"result"})
+	sloBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_slo_burn_rate",
+		Help: "How fast the latency SLO's error budget is spent over the window; 1 spends exactly the budget.",
+	}, []string{"window"})
+	sloBudgetRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_slo_error_budget_remaining",
+		Help: "Share of the latency SLO's error budget left over the window, negative once overspent.",
+	}, []string{"window"})
+	rateLimitWarnings = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_rate_limit_warnings_total",
+		Help: "Clients warned that they are close to their rate limit, at most once a minute each.",
+	})
+	historyCompacted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_history_compacted_reports_total",
+		Help: "History reports replaced by coarser ones by the history compactor, by period.",
+	}, []string{"period"})
+	duplicateWebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_duplicate_webhook_events_total",
+		Help: "Duplicate submissions passed to DUPLICATE_WEBHOOK_URL, by result (sent, failed, dropped).",
+	}, []string{"result"})
+	canaryAddLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "verve_canary_add_duration_seconds",
+		Help:    "Latency of dedupe adds with a canary backend, by backend role (primary, canary, and their _batch adds).",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.5},
+	}, []string{"backend"})
+	canaryDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_canary_decisions_total",
+		Help: "Decisions on canaried ids: match, canary_unique or canary_duplicate where the canary disagreed with the primary, canary_error.",
+	}, []string{"result"})
+	canaryWindowCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_canary_window_count",
+		Help: "Unique count of the last window on the primary backend and on the canary, which only sees the canary slice.",
+	}, []string{"backend"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "verve_http_request_duration_seconds",
+		Help:    "Duration of public API requests per method, route and status, with trace id exemplars.",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 10},
+	}, []string{"method", "route", "code"})
+	uniqueIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_unique_ids_total",
+		Help: "Ids counted as new in their window by this instance, with trace id exemplars.",
+	})
+	windowOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_window_overflows_total",
+		Help: "Windows with more unique ids than WINDOW_MAX_UNIQUE.",
+	})
+	windowOverflowing = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_window_overflowing",
+		Help: "1 while the current window has more unique ids than WINDOW_MAX_UNIQUE.",
+	})
+	backendSwitches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_dedupe_backend_switches_total",
+		Help: "Dedupe backend switches at a window boundary, by result: switched or failed.",
+	}, []string{"from", "to", "result"})
+	backendSwitchDrained = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_dedupe_backend_switch_drained_ids_total",
+		Help: "Ids drained from the old dedupe backend into the new one by backend switches.",
+	})
+	scalingLoad = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_scaling_load",
+		Help: "Weighted load of this replica against its SCALING_TARGET_* values, 1 at target; the autoscaling signal.",
+	})
+	scalingInput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_scaling_input",
+		Help: "Smoothed inputs of verve_scaling_load: rps, inflight requests and dedupe_latency in seconds.",
+	}, []string{"input"})
+	tcpIngestFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_tcp_ingest_frames_total",
+		Help: "Batch frames received over TCP ingest, by result: ok, unavailable, failed or invalid.",
+	}, []string{"result"})
+	tcpIngestIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_tcp_ingest_ids_total",
+		Help: "Ids checked through TCP ingest.",
+	})
+	tcpIngestConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_tcp_ingest_connections_total",
+		Help: "TCP ingest connections, by result: accepted, or refused by INGEST_TCP_ALLOWED_CIDRS.",
+	}, []string{"result"})
+	policyEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_policy_evaluations_total",
+		Help: "POLICY_FILE rules checked against requests they apply to, by rule and result: allowed, denied or error.",
+	}, []string{"rule", "result"})
+	shardHintMisrouted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_shard_hint_misrouted_ids_total",
+		Help: "Ids received by an instance other than the SHARD_HINT_PEERS owner the Shard-Hint names.",
+	})
+	aggregatedRegions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_aggregator_region_windows_total",
+		Help: "Region windows read by the aggregator, by result: received, late (after the global window was published) or malformed.",
+	}, []string{"result"})
+	aggregatedWindows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_aggregator_windows_total",
+		Help: "Global windows published by the aggregator: complete, or partial when AGGREGATE_REGIONS were missing.",
+	}, []string{"result"})
+	recordedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_traffic_recorded_requests_total",
+		Help: "Accept requests written to the traffic recording (RECORD_PATH).",
+	})
+	recordedIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_traffic_recorded_ids_total",
+		Help: "Ids written to the traffic recording, after RECORD_SAMPLE.",
+	})
+	clockSkewEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_clock_skew_events_total",
+		Help: "Wall clock jumps between window boundaries beyond CLOCK_SKEW_TOLERANCE (forward, backward), and windows closed late by a pause (late).",
+	}, []string{"kind"})
+	clockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_clock_skew_seconds",
+		Help: "How far the wall clock moved on its own over the last window, relative to the monotonic clock.",
+	})
+	windowBoundariesAdjusted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_window_boundaries_adjusted_total",
+		Help: "Window boundaries moved past the previous one because the wall clock put them at or before it.",
+	})
+	tenantWindowCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_tenant_windows",
+		Help: "Tenants reporting on a window of their own (TENANT_WINDOWS).",
+	})
+	tenantWindowReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_tenant_window_reports_total",
+		Help: "Tenant windows closed by the leader, by result: published, logged (no Kafka sink) or failed.",
+	}, []string{"result"})
+	tenantQuotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_tenant_quota_rejections_total",
+		Help: "Accept requests answered 429 because their tenant reached its quota for the window, by tenant.",
+	}, []string{"tenant"})
+	keyspaceKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "verve_redis_keyspace_keys",
+		Help: "Keys this service holds in Redis at the last keyspace sample, by kind: ids, tenant_windows or other.",
+	}, []string{"kind"})
+	keyspaceMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_redis_keyspace_memory_bytes",
+		Help: "Estimated Redis memory of the keys this service holds, from MEMORY USAGE of a sample of them.",
+	})
+	keyspaceSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_redis_keyspace_samples_total",
+		Help: "Redis keyspace samples, by result: ok or failed.",
+	}, []string{"result"})
+	keyspaceSampleSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "verve_redis_keyspace_sample_seconds",
+		Help:    "Time a Redis keyspace sample took to scan the service's keys.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	keyspaceTripped = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "verve_redis_keyspace_limit_reached",
+		Help: "1 while the keyspace is at REDIS_MAX_KEYS or REDIS_MAX_MEMORY_MB and new ids are refused.",
+	})
+	keyspaceTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_redis_keyspace_limit_trips_total",
+		Help: "Times the Redis keyspace reached its limits.",
+	})
+	duplicateReportsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_duplicate_reports_total",
+		Help: "Window duplicate reports, by destination (kafka, url, queue) and result (sent, failed, dropped).",
+	}, []string{"destination", "result"})
+	callerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_accept_callers_total",
+		Help: "Accept requests by caller class (internal, external).",
+	}, []string{"class"})
+	idSetExports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "verve_id_set_exports_total",
+		Help: "Window ID set exports, by result (uploaded, failed, dropped).",
+	}, []string{"result"})
+	idSetExportBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "verve_id_set_export_bytes_total",
+		Help: "Bytes of window ID sets uploaded to object storage.",
+	})
+	acceptWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "verve_http_accept_wait_seconds",
+		Help:    "Time Accept waited for a free connection slot while at MAX_CONNECTIONS.",
+		Buckets: []float64{0, 0.001, 0.01, 0.1, 0.5, 1, 5},
+	}, []string{"listener"})
+)
+
+// metricsHandler serves OpenMetrics to scrapers asking for it, the only format carrying exemplars.
+var metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
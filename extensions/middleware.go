@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// requestIDMiddleware tags every request with the caller's X-Request-ID, or a generated one,
+// and echoes it in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoveryMiddleware turns a handler panic into a 500 response instead of taking down the process.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// ErrAbortHandler is the documented way to abort a response, let net/http handle it
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			panicsTotal.Inc()
+			log.Printf("Panic serving %s %s (request_id=%s): %v\n%s", r.Method, r.URL.Path, requestID(r), err, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address a request came from, used to tell clients apart in rate limits,
+// allowlists and logs. Behind TRUSTED_PROXIES it is the client they forwarded the request for.
+func clientIP(r *http.Request) string {
+	if addr := realIP.resolve(r); addr.IsValid() {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type traceKey struct{}
+
+// traceContext is the W3C trace context of a request.
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+// sampled reports whether the caller records this trace.
+func (tc traceContext) sampled() bool {
+	flags, err := hex.DecodeString(tc.flags)
+	return err == nil && len(flags) == 1 && flags[0]&1 == 1
+}
+
+// tracingMiddleware continues the caller's W3C traceparent, or starts a trace, with a new span
+// for this request, and returns it in the traceparent response header so callers can find the
+// request in the logs. Traces it starts aren't sampled, the service exports no spans.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			tc = traceContext{traceID: randomHex(16), flags: "00"}
+		}
+		tc.spanID = randomHex(8)
+
+		w.Header().Set("traceparent", "00-"+tc.traceID+"-"+tc.spanID+"-"+tc.flags)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceKey{}, tc)))
+	})
+}
+
+// parseTraceparent parses a version 00 traceparent header.
+func parseTraceparent(header string) (traceContext, bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceContext{}, false
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return traceContext{}, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: parts[1], spanID: parts[2], flags: parts[3]}, true
+}
+
+// traceID is the trace a request belongs to, empty without the tracing layer.
+func traceID(r *http.Request) string {
+	tc, _ := r.Context().Value(traceKey{}).(traceContext)
+	return tc.traceID
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// accessLogMiddleware logs one line per request once it has been answered.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %s %d %dB %v request_id=%s trace_id=%s\n",
+			clientIP(r), r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start).Round(time.Microsecond), requestID(r), traceID(r))
+	})
+}
+
+// corsMiddleware lets browsers on CORS_ALLOWED_ORIGINS (comma separated, or *) call the API,
+// answering preflight requests itself.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, Deprecation, Sunset, Link, ETag, traceparent, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Shard-Hint")
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Request-ID, X-Tenant-ID, X-Key-ID, X-Timestamp, X-Nonce, X-Signature, traceparent")
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(getEnvDuration("CORS_MAX_AGE", 10*time.Minute).Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func corsAllowed(origin string) bool {
+	for _, allowed := range strings.Split(getEnv("CORS_ALLOWED_ORIGINS", ""), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
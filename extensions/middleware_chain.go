@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// httpLayers are the layers HTTP_MIDDLEWARE wraps around every public request, outermost
+// first. The internal listener keeps a fixed request_id,recovery chain.
+var httpLayers = map[string]func(http.Handler) http.Handler{
+	"request_id": requestIDMiddleware,
+	"recovery":   recoveryMiddleware,
+	"tracing":    tracingMiddleware,
+	"access_log": accessLogMiddleware,
+	"cors":       corsMiddleware,
+	"rate_limit": rateLimitMiddleware,
+}
+
+// apiLayers are the layers API_MIDDLEWARE wraps around the v1 and v2 routes, outermost first.
+// Admin authentication isn't one of them, it can't be configured away.
+var apiLayers = map[string]middleware{
+	"standby":       standbyGate,
+	"resource_caps": resourceCaps,
+	"auth":          tenantFromAPIKey,
+	"replay":        replayCheck,
+}
+
+const (
+	defaultHTTPMiddleware = "request_id,recovery"
+	defaultAPIMiddleware  = "standby,resource_caps,auth,replay"
+)
+
+// The configured chains; main parses them before the routes are registered.
+var (
+	httpChain, _ = parseHTTPChain(defaultHTTPMiddleware)
+	apiChain, _  = parseAPIChain(defaultAPIMiddleware)
+)
+
+// parseLayerNames splits a middleware list, rejecting unknown and repeated layers. The empty
+// list, or "none", disables every layer.
+func parseLayerNames[V any](spec string, layers map[string]V) ([]string, error) {
+	if strings.TrimSpace(spec) == "none" {
+		return nil, nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := layers[name]; !ok {
+			return nil, fmt.Errorf("unknown middleware %q, expected one of %s", name, strings.Join(sortedKeys(layers), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q is listed twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func parseHTTPChain(spec string) ([]func(http.Handler) http.Handler, error) {
+	names, err := parseLayerNames(spec, httpLayers)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]func(http.Handler) http.Handler, len(names))
+	for i, name := range names {
+		chain[i] = httpLayers[name]
+	}
+	return chain, nil
+}
+
+// parseAPIChain also keeps replay inside auth, as replayCheck relies on the key being valid.
+func parseAPIChain(spec string) ([]middleware, error) {
+	names, err := parseLayerNames(spec, apiLayers)
+	if err != nil {
+		return nil, err
+	}
+	if replay, auth := slices.Index(names, "replay"), slices.Index(names, "auth"); replay >= 0 && (auth < 0 || auth > replay) {
+		return nil, fmt.Errorf("middleware replay must come after auth")
+	}
+	chain := make([]middleware, len(names))
+	for i, name := range names {
+		chain[i] = apiLayers[name]
+	}
+	return chain, nil
+}
+
+// requireAPIAuth rejects an API chain that leaves out auth while a tenant store holds API
+// keys: requests would carry whatever X-Tenant-ID they send.
+func requireAPIAuth(spec, tenantStore string) error {
+	names, err := parseLayerNames(spec, apiLayers)
+	if err != nil {
+		return err
+	}
+	if tenantStore != "" && !slices.Contains(names, "auth") {
+		return fmt.Errorf("the auth layer is needed to check the API keys of TENANT_STORE=%s", tenantStore)
+	}
+	return nil
+}
+
+// wrapHTTPChain wraps h in httpChain, the first layer outermost.
+func wrapHTTPChain(h http.Handler) http.Handler {
+	for i := len(httpChain) - 1; i >= 0; i-- {
+		h = httpChain[i](h)
+	}
+	return h
+}
+
+func layerList(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
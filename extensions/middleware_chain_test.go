@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseAPIChainReplayAfterAuth(t *testing.T) {
+	if _, err := parseAPIChain("replay,auth"); err == nil {
+		t.Error("replay ahead of auth was accepted")
+	}
+	if _, err := parseAPIChain("standby,replay"); err == nil {
+		t.Error("replay without auth was accepted")
+	}
+	if _, err := parseAPIChain("standby,auth,replay"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireAPIAuthWithTenantStore(t *testing.T) {
+	if err := requireAPIAuth("standby,resource_caps", "redis"); err == nil {
+		t.Error("a chain without auth was accepted with a tenant store")
+	}
+	if err := requireAPIAuth("standby,resource_caps", ""); err != nil {
+		t.Errorf("a chain without auth was rejected without a tenant store: %v", err)
+	}
+	if err := requireAPIAuth(defaultAPIMiddleware, "redis"); err != nil {
+		t.Error(err)
+	}
+}
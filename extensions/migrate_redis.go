@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// legacyMigration counts what `verve migrate-redis` found.
+type legacyMigration struct {
+	prefix     string
+	scanned    int
+	migrated   int
+	present    int
+	stragglers int
+	converted  int
+	deleted    int
+}
+
+// runMigrateRedis runs `verve migrate-redis` and returns the exit code. Before dedupe keys were
+// namespaced under verve:id:, every id was its own SETNX key, -legacy-prefix followed by the id,
+// holding "1" for a minute. An upgrade would leave those behind and start the in-progress window
+// from zero, so this copies every legacy id key into the current layout: with REDIS_LAYOUT=set the
+// ids go into the window's SETs, together with the verve:id: keys of the key-per-id layout;
+// otherwise each becomes a verve:id: key with its remaining TTL. Legacy keys without a TTL never
+// expire and belong to no window; -cleanup deletes them together with the migrated keys. Redis
+// may be shared with other applications, so -cleanup needs -legacy-prefix to be given, even as
+// ” for unprefixed keys on a Redis of this service's own, and only ever deletes keys that are
+// the prefix followed by a positive integer holding "1".
+func runMigrateRedis(args []string) int {
+	flags := flag.NewFlagSet("migrate-redis", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be migrated and deleted")
+	cleanup := flags.Bool("cleanup", false, "delete migrated legacy keys and legacy keys without a TTL; needs -legacy-prefix")
+	prefix := flags.String("legacy-prefix", "", "the prefix of legacy id keys, followed by the id")
+	batch := flags.Int("batch", 1000, "keys scanned and migrated per round trip")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	prefixGiven := false
+	flags.Visit(func(f *flag.Flag) { prefixGiven = prefixGiven || f.Name == "legacy-prefix" })
+	if *cleanup && !prefixGiven {
+		log.Printf("-cleanup deletes keys, so it needs the legacy key prefix: pass -legacy-prefix, '' for unprefixed ids")
+		return 2
+	}
+	if backend := getEnv("DEDUPE_BACKEND", "redis"); backend != "redis" {
+		log.Printf("migrate-redis migrates into the redis dedupe backend, DEDUPE_BACKEND is %s", backend)
+		return 2
+	}
+
+	var err error
+	if dedupeKey, err = parseKeyStrategy(getEnv("DEDUPE_KEY", "id")); err != nil {
+		log.Printf("Invalid dedupe key strategy: %v", err)
+		return 2
+	}
+	if getEnv("PRIVACY_MODE", "off") == "hash" {
+		secret := getEnv("PRIVACY_SECRET", "")
+		if secret == "" {
+			log.Printf("PRIVACY_MODE=hash needs the servers' PRIVACY_SECRET to store keys they recognise")
+			return 2
+		}
+		idHash = newIDHasher(secret)
+	}
+
+	// Legacy keys live on REDIS_HOST; the migrated ones go wherever the backend shards them
+	redisDB = initRedis()
+	defer redisDB.Close()
+	d, err := newDeduplicator("redis")
+	if err != nil {
+		log.Printf("Failed to initialize redis dedupe backend: %v", err)
+		return 1
+	}
+	target := d.(*redisDeduplicator)
+
+	m := &legacyMigration{prefix: *prefix}
+	iter := redisDB.Scan(ctx, 0, *prefix+"*", int64(*batch)).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		m.scanned++
+		if m.legacyIDKey(iter.Val()) {
+			keys = append(keys, iter.Val())
+		}
+		if len(keys) >= *batch {
+			if err := m.migrate(ctx, target, keys, *dryRun, *cleanup); err != nil {
+				log.Printf("Migration failed: %v", err)
+				return 1
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Failed to scan Redis: %v", err)
+		return 1
+	}
+	if err := m.migrate(ctx, target, keys, *dryRun, *cleanup); err != nil {
+		log.Printf("Migration failed: %v", err)
+		return 1
+	}
+	if target.sets > 0 {
+		if err := m.convertIDKeys(ctx, target, *batch, *dryRun, *cleanup); err != nil {
+			log.Printf("Converting verve:id: keys failed: %v", err)
+			return 1
+		}
+	}
+
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+	log.Printf("%s %d legacy id keys (%d already present) of %d keys scanned, %d verve:id: keys into sets; %d without a TTL, %d keys deleted",
+		verb, m.migrated, m.present, m.scanned, m.converted, m.stragglers, m.deleted)
+	return 0
+}
+
+// legacyIDKey reports whether key looks like a legacy id key: the legacy API only accepted
+// positive integer ids and used them after the prefix verbatim.
+func (m *legacyMigration) legacyIDKey(key string) bool {
+	rest, ok := strings.CutPrefix(key, m.prefix)
+	id, err := strconv.ParseInt(rest, 10, 64)
+	return ok && err == nil && id > 0 && strconv.FormatInt(id, 10) == rest
+}
+
+func (m *legacyMigration) migrate(ctx context.Context, target *redisDeduplicator, keys []string, dryRun, cleanup bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Read value and TTL in one round trip; anything but "1" isn't one of our keys
+	values := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			values[i] = pipe.Get(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	var migrate, remove []string
+	var migrateTTLs []time.Duration
+	for i, key := range keys {
+		if values[i].Val() != "1" {
+			continue
+		}
+		switch ttl := ttls[i].Val(); {
+		case ttl > 0:
+			migrate, migrateTTLs = append(migrate, key), append(migrateTTLs, ttl)
+			if cleanup {
+				remove = append(remove, key)
+			}
+		case ttl == -1:
+			m.stragglers++
+			if cleanup {
+				remove = append(remove, key)
+			}
+		}
+	}
+	if dryRun {
+		m.migrated += len(migrate)
+		m.deleted += len(remove)
+		return nil
+	}
+
+	added := make([]bool, len(migrate))
+	if target.sets > 0 {
+		// The SETs expire as a whole, so the ids stay for the window's TTL
+		stored := make([]string, len(migrate))
+		for i, key := range migrate {
+			id, _ := strconv.Atoi(strings.TrimPrefix(key, m.prefix))
+			stored[i] = storedKey(dedupeInput{id: id})
+		}
+		if added, err = target.AddBatch(ctx, stored); err != nil {
+			return err
+		}
+	} else {
+		cmds := make([]*redis.BoolCmd, len(migrate))
+		_, err = target.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range migrate {
+				id, _ := strconv.Atoi(strings.TrimPrefix(key, m.prefix))
+				cmds[i] = pipe.SetNX(ctx, redisIDPrefix+storedKey(dedupeInput{id: id}), true, migrateTTLs[i])
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			added[i] = cmd.Val()
+		}
+	}
+	for _, ok := range added {
+		if ok {
+			m.migrated++
+		} else {
+			m.present++
+		}
+	}
+
+	if len(remove) > 0 {
+		deleted, err := redisDB.Del(ctx, remove...).Result()
+		if err != nil {
+			return err
+		}
+		m.deleted += int(deleted)
+	}
+	return nil
+}
+
+// convertIDKeys moves the verve:id: keys of the key-per-id layout into the SETs of
+// REDIS_LAYOUT=set; -cleanup deletes them once they are in.
+func (m *legacyMigration) convertIDKeys(ctx context.Context, target *redisDeduplicator, batch int, dryRun, cleanup bool) error {
+	var mu sync.Mutex
+	return target.forEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		var keys []string
+		convert := func() error {
+			defer func() { keys = keys[:0] }()
+			if len(keys) == 0 || dryRun {
+				mu.Lock()
+				m.converted += len(keys)
+				mu.Unlock()
+				return nil
+			}
+			ids := make([]string, len(keys))
+			for i, key := range keys {
+				ids[i] = strings.TrimPrefix(key, redisIDPrefix)
+			}
+			if _, err := target.AddBatch(ctx, ids); err != nil {
+				return err
+			}
+			var deleted int64
+			if cleanup {
+				var err error
+				if deleted, err = client.Del(ctx, keys...).Result(); err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			m.converted += len(keys)
+			m.deleted += int(deleted)
+			mu.Unlock()
+			return nil
+		}
+		iter := client.Scan(ctx, 0, redisIDPrefix+"*", int64(batch)).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) >= batch {
+				if err := convert(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		return convert()
+	})
+}
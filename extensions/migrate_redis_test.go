@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMigrateRedisCleanup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	t.Setenv("REDIS_HOST", host)
+	t.Setenv("REDIS_PORT", port)
+	t.Setenv("REDIS_LAYOUT", "set")
+	defer func() { dedupeKey, _ = parseKeyStrategy("id") }()
+
+	mr.Set("legacy:7", "1")
+	mr.Set("legacy:8", "1")
+	mr.SetTTL("legacy:7", 30*time.Second)
+	mr.SetTTL("legacy:8", 30*time.Second)
+	mr.Set("legacy:9x", "1")
+	mr.Set("42", "1")
+	mr.Set(redisIDPrefix+"5", "1")
+
+	// Deleting needs the prefix, so other applications' keys aren't taken for legacy ids
+	if code := runMigrateRedis([]string{"-cleanup"}); code != 2 {
+		t.Fatalf("got exit code %d for -cleanup without -legacy-prefix, want 2", code)
+	}
+	if code := runMigrateRedis([]string{"-cleanup", "-legacy-prefix", "legacy:"}); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	for _, key := range []string{"legacy:7", "legacy:8", redisIDPrefix + "5"} {
+		if mr.Exists(key) {
+			t.Errorf("%s wasn't cleaned up", key)
+		}
+	}
+	for _, key := range []string{"legacy:9x", "42"} {
+		if !mr.Exists(key) {
+			t.Errorf("%s, not a legacy id key, was deleted", key)
+		}
+	}
+	members := map[string]bool{}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, redisSetPrefix) {
+			ids, _ := mr.Members(key)
+			for _, id := range ids {
+				members[id] = true
+			}
+		}
+	}
+	if len(members) != 3 || !members["7"] || !members["8"] || !members["5"] {
+		t.Errorf("got set members %v, want 5, 7 and 8", members)
+	}
+}
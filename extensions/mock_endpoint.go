@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// mockEndpoint receives count notifications like a real endpoint would, checks that every one
+// is a well-formed notification, and can answer some of them with failures or delays.
+type mockEndpoint struct {
+	failRate   float64
+	failStatus int
+	delay      time.Duration
+	response   []byte
+
+	mu    sync.Mutex
+	stats mockEndpointStats
+}
+
+type mockEndpointStats struct {
+	Received int `json:"received"`
+	Invalid  int `json:"invalid"`
+	Failed   int `json:"failed"`
+	// LastCount is the unique_request_count of the last valid notification.
+	LastCount int    `json:"last_count"`
+	LastFrom  string `json:"last_from,omitempty"`
+}
+
+// runMockEndpoint serves `verve mock-endpoint` until SIGINT/SIGTERM and returns the exit code.
+func runMockEndpoint(args []string) int {
+	flags := flag.NewFlagSet("mock-endpoint", flag.ContinueOnError)
+	addr := flags.String("addr", ":9000", "address to listen on")
+	failRate := flags.Float64("fail-rate", 0, "fraction of notifications answered with -fail-status, 0 to 1")
+	failStatus := flags.Int("fail-status", http.StatusServiceUnavailable, "status code of injected failures")
+	delay := flags.Duration("delay", 0, "delay before every response, e.g. to exceed NOTIFY_TIMEOUT")
+	response := flags.String("response", `{"received": true}`, "JSON body of successful responses")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *failRate < 0 || *failRate > 1 {
+		log.Printf("-fail-rate must be between 0 and 1")
+		return 2
+	}
+	if !json.Valid([]byte(*response)) {
+		log.Printf("-response must be valid JSON")
+		return 2
+	}
+
+	m := &mockEndpoint{failRate: *failRate, failStatus: *failStatus, delay: *delay, response: []byte(*response)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", m.receive)
+	mux.HandleFunc("GET /stats", m.statsHandler)
+	server := &http.Server{Addr: *addr, Handler: mux}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Mock endpoint listening on %s (POST notifications to any path, GET /stats)", *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Mock endpoint failed: %v", err)
+		return 1
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log.Printf("Mock endpoint stopped: %d notifications, %d invalid, %d failed on purpose", m.stats.Received, m.stats.Invalid, m.stats.Failed)
+	return 0
+}
+
+func (m *mockEndpoint) receive(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	note, err := validateNotification(r, body)
+
+	m.mu.Lock()
+	m.stats.Received++
+	if err != nil {
+		m.stats.Invalid++
+	} else {
+		m.stats.LastCount, m.stats.LastFrom = *note.UniqueRequestCount, note.InstanceID
+	}
+	fail := err == nil && m.failRate > 0 && rand.Float64() < m.failRate
+	if fail {
+		m.stats.Failed++
+	}
+	m.mu.Unlock()
+
+	if m.delay > 0 {
+		time.Sleep(m.delay)
+	}
+	switch {
+	case err != nil:
+		log.Printf("INVALID notification on %s from %s: %v: %s", r.URL.Path, r.RemoteAddr, err, body)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case fail:
+		log.Printf("FAIL    count %d from %s (injected %d)", *note.UniqueRequestCount, note.InstanceID, m.failStatus)
+		http.Error(w, "Injected failure", m.failStatus)
+	default:
+		log.Printf("ok      count %d from %s at %s", *note.UniqueRequestCount, note.InstanceID, note.Timestamp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m.response)
+	}
+}
+
+func (m *mockEndpoint) statsHandler(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	stats := m.stats
+	m.mu.Unlock()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// receivedNotification is the part of a notification the mock endpoint checks; the count is a
+// pointer so that a missing one can be told from zero.
+type receivedNotification struct {
+	UniqueRequestCount *int   `json:"unique_request_count"`
+	Timestamp          string `json:"timestamp"`
+	InstanceID         string `json:"instance_id"`
+}
+
+// validateNotification checks body against what sendCountToEndpoint sends, in any of the
+// payload formats. The number and statsd formats carry neither timestamp nor instance.
+func validateNotification(r *http.Request, body []byte) (receivedNotification, error) {
+	var note receivedNotification
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var err error
+	switch ct {
+	case jsonPayload{}.ContentType():
+		if err := json.Unmarshal(body, &note); err != nil {
+			return note, fmt.Errorf("malformed JSON: %v", err)
+		}
+	case protobufPayload{}.ContentType():
+		err = decodeProtobufNotification(body, &note)
+	case avroPayload{}.ContentType():
+		err = decodeAvroNotification(body, &note)
+	case numberPayload{}.ContentType():
+		// The number and statsd formats share text/plain
+		err = decodeTextNotification(body, &note)
+	default:
+		return note, fmt.Errorf("content type %q, expected one of the payload formats' (%s)", ct, strings.Join(payloadContentTypes(), ", "))
+	}
+	if err != nil {
+		return note, err
+	}
+	if note.UniqueRequestCount == nil || *note.UniqueRequestCount < 0 {
+		return note, errors.New("missing or negative unique_request_count")
+	}
+	if ct == (jsonPayload{}).ContentType() || note.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339, note.Timestamp); err != nil {
+			return note, fmt.Errorf("timestamp %q is not RFC 3339", note.Timestamp)
+		}
+	}
+	return note, nil
+}
+
+func payloadContentTypes() []string {
+	seen := map[string]bool{}
+	for _, s := range payloadSerializers {
+		seen[s.ContentType()] = true
+	}
+	return sortedKeys(seen)
+}
+
+// decodeProtobufNotification reads the count, timestamp and instance of a CountMessage.
+func decodeProtobufNotification(b []byte, note *receivedNotification) error {
+	count := 0
+	note.UniqueRequestCount = &count
+	for len(b) > 0 {
+		field, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("malformed protobuf: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case field == 1 && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return fmt.Errorf("malformed protobuf: %v", protowire.ParseError(m))
+			}
+			count, n = int(int64(v)), m
+		case (field == 2 || field == 5) && typ == protowire.BytesType:
+			v, m := protowire.ConsumeString(b)
+			if m < 0 {
+				return fmt.Errorf("malformed protobuf: %v", protowire.ParseError(m))
+			}
+			if field == 2 {
+				note.Timestamp = v
+			} else {
+				note.InstanceID = v
+			}
+			n = m
+		default:
+			if n = protowire.ConsumeFieldValue(field, typ, b); n < 0 {
+				return fmt.Errorf("malformed protobuf: %v", protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// decodeAvroNotification reads the leading fields of avroCountSchema, up to the instance.
+func decodeAvroNotification(b []byte, note *receivedNotification) error {
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return errors.New("malformed Avro: no unique_request_count")
+	}
+	count := int(protowire.DecodeZigZag(v))
+	note.UniqueRequestCount = &count
+	b = b[n:]
+	var fields [4]string
+	for i := range fields {
+		length, n := protowire.ConsumeVarint(b)
+		size := protowire.DecodeZigZag(length)
+		if n < 0 || size < 0 || int64(len(b)-n) < size {
+			return errors.New("malformed Avro: truncated string")
+		}
+		fields[i], b = string(b[n:n+int(size)]), b[n+int(size):]
+	}
+	// timestamp, version, git_sha, instance_id
+	note.Timestamp, note.InstanceID = fields[0], fields[3]
+	return nil
+}
+
+// decodeTextNotification reads a plain number, or the unique_request_count gauge of statsd lines.
+func decodeTextNotification(b []byte, note *receivedNotification) error {
+	text := strings.TrimSpace(string(b))
+	if count, err := strconv.Atoi(text); err == nil {
+		note.UniqueRequestCount = &count
+		return nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSuffix(line, "|g"), ":")
+		if ok && strings.HasSuffix(name, ".unique_request_count") && !strings.Contains(name, ".tenants.") {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("malformed statsd gauge %q", line)
+			}
+			note.UniqueRequestCount = &count
+			return nil
+		}
+	}
+	return errors.New("neither a number nor statsd lines with a unique_request_count gauge")
+}
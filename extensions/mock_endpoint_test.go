@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMockEndpointAcceptsEveryFormat(t *testing.T) {
+	report := windowReport{UniqueRequestCount: 42, Timestamp: "2026-10-14T07:00:00Z", InstanceID: "i-1"}
+	for name, s := range payloadSerializers {
+		payload, err := s.Report(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/hook", bytes.NewReader(payload))
+		r.Header.Set("Content-Type", s.ContentType())
+		note, err := validateNotification(r, payload)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if *note.UniqueRequestCount != 42 {
+			t.Errorf("%s: got count %d, want 42", name, *note.UniqueRequestCount)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/hook", nil)
+	r.Header.Set("Content-Type", "application/xml")
+	if _, err := validateNotification(r, []byte("<count/>")); err == nil {
+		t.Error("accepted an unknown content type")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notifyClient sends endpoint notifications; newNotifier replaces it with a client whose
+// connection pool is limited per host.
+var notifyClient = http.DefaultClient
+
+type notification struct {
+	endpoint string
+	count    int
+	// subscription is set on window notifications of a subscription, which send report
+	// instead of the current count.
+	subscription *subscription
+	report       windowReport
+}
+
+// notifier delivers endpoint notifications from a bounded queue with a fixed pool of workers,
+// instead of one detached goroutine per request.
+type notifier struct {
+	queue   chan notification
+	workers int
+	hosts   *hostLimiter
+	// busy counts the workers sending a notification right now.
+	busy atomic.Int64
+}
+
+func newNotifier(workers, queueSize, maxPerHost, hostQueueSize int, timeout time.Duration) *notifier {
+	notifyClient = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxConnsPerHost:     maxPerHost,
+			MaxIdleConnsPerHost: maxPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return &notifier{
+		queue:   make(chan notification, queueSize),
+		workers: workers,
+		hosts:   newHostLimiter(maxPerHost, hostQueueSize),
+	}
+}
+
+// enqueue schedules a notification, dropping it if the queue is full.
+func (n *notifier) enqueue(endpoint string, count int) {
+	n.enqueueNote(notification{endpoint: endpoint, count: count})
+}
+
+func (n *notifier) enqueueNote(note notification) bool {
+	select {
+	case n.queue <- note:
+		return true
+	default:
+		log.Printf("Notification queue full, dropping notification to %s\n", note.endpoint)
+		return false
+	}
+}
+
+// run delivers notifications until ctx is cancelled, then drains what is already queued.
+func (n *notifier) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < n.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case note := <-n.queue:
+					n.deliver(note)
+				case <-ctx.Done():
+					n.drain()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (n *notifier) drain() {
+	for {
+		select {
+		case note := <-n.queue:
+			n.deliver(note)
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends note unless its host is already at its concurrency limit, in which case the note
+// is parked for the host and sent by the worker that frees the next slot. Workers therefore never
+// wait on a slow host while notifications to other hosts are queued.
+func (n *notifier) deliver(note notification) {
+	host := notificationHost(note.endpoint)
+	if !n.hosts.acquire(host, note) {
+		return
+	}
+	n.busy.Add(1)
+	defer n.busy.Add(-1)
+	for ok := true; ok; note, ok = n.hosts.release(host) {
+		if note.subscription != nil {
+			sendToSubscription(note.subscription, note.report)
+		} else {
+			sendCountToEndpoint(note.endpoint, note.count)
+		}
+	}
+}
+
+func notificationHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
+
+// hostLimiter bounds the in-flight notifications per destination host.
+type hostLimiter struct {
+	limit     int
+	queueSize int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+	pending  map[string][]notification
+}
+
+func newHostLimiter(limit, queueSize int) *hostLimiter {
+	return &hostLimiter{
+		limit:     limit,
+		queueSize: queueSize,
+		inFlight:  map[string]int{},
+		pending:   map[string][]notification{},
+	}
+}
+
+// acquire takes a slot for host and reports whether the caller should send note now. Otherwise
+// note was parked, or dropped when the host's backlog is full.
+func (l *hostLimiter) acquire(host string, note notification) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[host] < l.limit {
+		l.inFlight[host]++
+		return true
+	}
+	if len(l.pending[host]) >= l.queueSize {
+		log.Printf("Too many pending notifications to %s, dropping notification\n", host)
+		return false
+	}
+	l.pending[host] = append(l.pending[host], note)
+	return false
+}
+
+// parked returns how many notifications wait for a host slot.
+func (l *hostLimiter) parked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, notes := range l.pending {
+		n += len(notes)
+	}
+	return n
+}
+
+// release hands the caller the next parked notification for host, keeping its slot, or frees
+// the slot when nothing is parked.
+func (l *hostLimiter) release(host string) (notification, bool) {
+	if l.limit <= 0 {
+		return notification{}, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if parked := l.pending[host]; len(parked) > 0 {
+		note := parked[0]
+		if len(parked) == 1 {
+			delete(l.pending, host)
+		} else {
+			l.pending[host] = parked[1:]
+		}
+		return note, true
+	}
+	if l.inFlight[host]--; l.inFlight[host] <= 0 {
+		delete(l.inFlight, host)
+	}
+	return notification{}, false
+}
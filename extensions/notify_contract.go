@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedEndpoints bounds the per-endpoint contract state, since endpoints come from callers.
+const maxTrackedEndpoints = 1000
+
+// responseContract is what a notification endpoint is expected to answer.
+type responseContract struct {
+	// statuses holds exact codes (200) and classes (2 for "2xx").
+	statuses map[int]bool
+	classes  map[int]bool
+	// fields must be present at the top level of a JSON response body.
+	fields []string
+}
+
+// newResponseContract parses NOTIFY_EXPECT_STATUS (e.g. "2xx" or "200,202") and
+// NOTIFY_EXPECT_FIELDS (e.g. "received"), returning nil when neither is set.
+func newResponseContract(statusSpec, fieldSpec string) (*responseContract, error) {
+	c := &responseContract{statuses: map[int]bool{}, classes: map[int]bool{}}
+	for _, s := range strings.Split(statusSpec, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s == "" {
+			continue
+		}
+		if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+			c.classes[int(s[0]-'0')] = true
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid expected status %q", s)
+		}
+		c.statuses[code] = true
+	}
+	for _, f := range strings.Split(fieldSpec, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			c.fields = append(c.fields, f)
+		}
+	}
+	if len(c.statuses) == 0 && len(c.classes) == 0 && len(c.fields) == 0 {
+		return nil, nil
+	}
+	// Only checking fields still implies a successful response
+	if len(c.statuses) == 0 && len(c.classes) == 0 {
+		c.classes[2] = true
+	}
+	return c, nil
+}
+
+// check returns the reason resp violates the contract, or "" when it doesn't. It reads the body
+// only when fields are expected.
+func (c *responseContract) check(resp *http.Response) (reason, detail string) {
+	if !c.statuses[resp.StatusCode] && !c.classes[resp.StatusCode/100] {
+		return "status", fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	if len(c.fields) == 0 {
+		return "", ""
+	}
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return "invalid_body", "response is not a JSON object"
+	}
+	for _, f := range c.fields {
+		if _, ok := body[f]; !ok {
+			return "missing_field", fmt.Sprintf("response has no %q field", f)
+		}
+	}
+	return "", ""
+}
+
+// endpointContract is the contract state of a single notification endpoint.
+type endpointContract struct {
+	Endpoint      string    `json:"endpoint"`
+	Checked       int       `json:"checked"`
+	Violations    int       `json:"violations"`
+	Consecutive   int       `json:"consecutive_violations"`
+	LastStatus    int       `json:"last_status"`
+	LastViolation string    `json:"last_violation,omitempty"`
+	LastCheckedAt time.Time `json:"last_checked_at"`
+}
+
+// contractTracker records the contract checks per endpoint, for the metrics and the admin API.
+type contractTracker struct {
+	contract *responseContract
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointContract
+}
+
+func newContractTracker(contract *responseContract) *contractTracker {
+	return &contractTracker{contract: contract, endpoints: map[string]*endpointContract{}}
+}
+
+// observe checks a notification response. An endpoint's violations are logged when they start
+// and when the endpoint recovers, rather than on every notification.
+func (t *contractTracker) observe(endpoint string, resp *http.Response) {
+	reason, detail := t.contract.check(resp)
+	if reason != "" {
+		notifyContractViolations.WithLabelValues(notificationHost(endpoint), reason).Inc()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.endpoints[endpoint]
+	if !ok {
+		if len(t.endpoints) >= maxTrackedEndpoints {
+			return
+		}
+		state = &endpointContract{Endpoint: endpoint}
+		t.endpoints[endpoint] = state
+	}
+	state.Checked++
+	state.LastStatus = resp.StatusCode
+	state.LastCheckedAt = time.Now().UTC()
+	if reason == "" {
+		if state.Consecutive > 0 {
+			log.Printf("Endpoint %s meets the notification contract again after %d violations\n", endpoint, state.Consecutive)
+		}
+		state.Consecutive = 0
+		return
+	}
+	state.Violations++
+	state.Consecutive++
+	state.LastViolation = detail
+	if state.Consecutive == 1 {
+		log.Printf("Endpoint %s violates the notification contract: %s\n", endpoint, detail)
+	}
+}
+
+// snapshot lists the tracked endpoints, those currently violating the contract first.
+func (t *contractTracker) snapshot() []endpointContract {
+	t.mu.Lock()
+	list := make([]endpointContract, 0, len(t.endpoints))
+	for _, state := range t.endpoints {
+		list = append(list, *state)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Consecutive != list[j].Consecutive {
+			return list[i].Consecutive > list[j].Consecutive
+		}
+		return list[i].Endpoint < list[j].Endpoint
+	})
+	return list
+}
+
+type contractsResponse struct {
+	Endpoints []endpointContract `json:"endpoints"`
+}
+
+// List the notification endpoints and their contract violations
+func notificationContractsHandler(w http.ResponseWriter, r *http.Request) {
+	if contracts == nil {
+		writeErrorV2(w, http.StatusNotImplemented, "contracts_disabled", "Notification contract checks are disabled, set NOTIFY_EXPECT_STATUS or NOTIFY_EXPECT_FIELDS to enable them")
+		return
+	}
+	writeJSON(w, http.StatusOK, contractsResponse{Endpoints: contracts.snapshot()})
+}
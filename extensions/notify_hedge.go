@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyHedge is set with NOTIFY_HEDGE_HOSTS.
+var notifyHedge *notifyHedger
+
+const (
+	// hedgeSamples is how many recent latencies per host the hedge delay is estimated from.
+	hedgeSamples = 128
+	// hedgeMinSamples latencies have to be seen before a host's requests are hedged.
+	hedgeMinSamples = 20
+)
+
+// notifyHedger hedges notifications to critical hosts: when a request hasn't answered within
+// the host's recent NOTIFY_HEDGE_PERCENTILE latency, a second one is sent, the first response
+// wins and the other request is cancelled. Endpoints may therefore see a notification twice, so
+// only hosts that tolerate that should be listed.
+type notifyHedger struct {
+	hosts      map[string]bool
+	percentile int
+	minDelay   time.Duration
+
+	mu        sync.Mutex
+	latencies map[string]*latencyRing
+}
+
+// parseNotifyHedge parses NOTIFY_HEDGE_HOSTS, a comma separated list of hosts (host or
+// host:port, "*" for every host). It returns nil when the list is empty.
+func parseNotifyHedge(hostSpec string, percentile int, minDelay time.Duration) (*notifyHedger, error) {
+	if percentile < 50 || percentile > 99 {
+		return nil, fmt.Errorf("hedge percentile must be between 50 and 99, got %d", percentile)
+	}
+	if minDelay < 0 {
+		return nil, fmt.Errorf("minimum hedge delay must not be negative")
+	}
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(hostSpec, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if strings.Contains(host, "/") {
+			return nil, fmt.Errorf("invalid hedge host %q, expected host or host:port", host)
+		}
+		hosts[host] = true
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	return &notifyHedger{hosts: hosts, percentile: percentile, minDelay: minDelay, latencies: map[string]*latencyRing{}}, nil
+}
+
+// hedged reports whether notifications to endpoint are hedged, and the host their latencies
+// are tracked under.
+func (h *notifyHedger) hedged(endpoint string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	return u.Host, h.hosts["*"] || h.hosts[u.Host] || h.hosts[u.Hostname()]
+}
+
+// delay is how long a request to host is given before it is hedged; false until enough
+// latencies were seen to estimate one.
+func (h *notifyHedger) delay(host string) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring, ok := h.latencies[host]
+	if !ok {
+		return 0, false
+	}
+	d, ok := ring.percentile(h.percentile)
+	return max(d, h.minDelay), ok
+}
+
+func (h *notifyHedger) observe(host string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring, ok := h.latencies[host]
+	if !ok {
+		ring = &latencyRing{}
+		h.latencies[host] = ring
+	}
+	ring.add(d)
+}
+
+type hedgeAttempt struct {
+	index   int
+	resp    *http.Response
+	err     error
+	elapsed time.Duration
+}
+
+// post sends the notification, hedging it once the host's delay passes. An attempt that fails
+// doesn't trigger the hedge; hedging cuts the tail latency, retrying is left to the endpoint.
+func (h *notifyHedger) post(host, endpoint, contentType string, header http.Header, payload []byte) (*http.Response, error) {
+	delay, ok := h.delay(host)
+	if !ok {
+		start := time.Now()
+		resp, err := postWithHeader(endpoint, contentType, header, payload)
+		h.observe(host, time.Since(start))
+		return resp, err
+	}
+
+	results := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	launch := func() {
+		attemptCtx, cancel := context.WithCancel(context.Background())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			req, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, endpoint, bytes.NewReader(payload))
+			if err != nil {
+				results <- hedgeAttempt{index: index, err: err}
+				return
+			}
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			req.Header.Set("Content-Type", contentType)
+			resp, err := notifyClient.Do(req)
+			results <- hedgeAttempt{index: index, resp: resp, err: err, elapsed: time.Since(start)}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var lastErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 {
+				launch()
+				pending++
+				notifyHedges.WithLabelValues(host, "sent").Inc()
+			}
+		case a := <-results:
+			pending--
+			h.observe(host, a.elapsed)
+			if a.err != nil {
+				lastErr = a.err
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != a.index {
+					cancel()
+				}
+			}
+			if a.index == 1 {
+				notifyHedges.WithLabelValues(host, "won").Inc()
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			a.resp.Body = cancelOnClose{ReadCloser: a.resp.Body, cancel: cancels[a.index]}
+			return a.resp, nil
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, lastErr
+}
+
+// cancelOnClose releases the winning attempt's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// latencyRing keeps the last hedgeSamples latencies of a host.
+type latencyRing struct {
+	samples [hedgeSamples]time.Duration
+	n       int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.samples[r.n%hedgeSamples] = d
+	r.n++
+}
+
+func (r *latencyRing) percentile(p int) (time.Duration, bool) {
+	n := min(r.n, hedgeSamples)
+	if n < hedgeMinSamples {
+		return 0, false
+	}
+	sorted := slices.Clone(r.samples[:n])
+	slices.Sort(sorted)
+	return sorted[(n*p+99)/100-1], true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// primedHedger hedges every host once a request took longer than delay.
+func primedHedger(t *testing.T, host string, delay time.Duration) *notifyHedger {
+	t.Helper()
+	h, err := parseNotifyHedge("*", 95, delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(host, delay)
+	}
+	return h
+}
+
+func TestNotifyHedgeSlowFirstResponse(t *testing.T) {
+	var requests atomic.Int32
+	firstCancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices a cancelled request once its body was read
+		io.Copy(io.Discard, r.Body)
+		if requests.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+				close(firstCancelled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		io.WriteString(w, "hedge")
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	h := primedHedger(t, host, 10*time.Millisecond)
+	won := testutil.ToFloat64(notifyHedges.WithLabelValues(host, "won"))
+
+	resp, err := h.post(host, srv.URL, "application/json", nil, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hedge" {
+		t.Errorf("got %q, want the hedged request's response", body)
+	}
+	if got := testutil.ToFloat64(notifyHedges.WithLabelValues(host, "won")) - won; got != 1 {
+		t.Errorf("%v hedges won, want 1", got)
+	}
+	select {
+	case <-firstCancelled:
+	case <-time.After(time.Second):
+		t.Error("the slow first request wasn't cancelled")
+	}
+}
+
+// trackedBody tells when it is closed.
+type trackedBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (b *trackedBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+// hedgeTransport answers the first request once release is closed, whether or not it was
+// cancelled meanwhile, and every later one right away.
+type hedgeTransport struct {
+	requests atomic.Int32
+	release  chan struct{}
+	first    *trackedBody
+}
+
+func (tr *hedgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := io.NopCloser(strings.NewReader("hedge"))
+	if tr.requests.Add(1) == 1 {
+		<-tr.release
+		body = tr.first
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: body, Request: r}, nil
+}
+
+func TestNotifyHedgeClosesLosingBody(t *testing.T) {
+	tr := &hedgeTransport{release: make(chan struct{}), first: &trackedBody{Reader: strings.NewReader("first"), closed: make(chan struct{})}}
+	old := notifyClient
+	notifyClient = &http.Client{Transport: tr}
+	defer func() { notifyClient = old }()
+	endpoint := "http://hooks.example.com/notify"
+	u, _ := url.Parse(endpoint)
+	h := primedHedger(t, u.Host, 10*time.Millisecond)
+
+	resp, err := h.post(u.Host, endpoint, "application/json", nil, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hedge" {
+		t.Errorf("got %q, want the hedged request's response", body)
+	}
+	resp.Body.Close()
+
+	close(tr.release)
+	select {
+	case <-tr.first.closed:
+	case <-time.After(time.Second):
+		t.Error("the losing response's body wasn't closed")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// trends keeps the counts of the last windows for the trend context of notifications; nil
+// without NOTIFY_TREND.
+var trends *windowTrends
+
+// windowTrend compares a notification's count with the windows before it, so receivers can
+// spot a drop without storing counts themselves.
+type windowTrend struct {
+	PreviousCount int `json:"previous_count"`
+	// Delta is the count minus PreviousCount.
+	Delta         int     `json:"delta"`
+	MovingAverage float64 `json:"moving_average"`
+	// Windows is how many windows MovingAverage is over, fewer than NOTIFY_TREND_WINDOWS until
+	// that many windows were seen.
+	Windows int `json:"windows"`
+}
+
+// windowTrends is a ring of the last closed windows, kept with their tenant counts so
+// subscriptions filtered by tenant get the trend of their tenants. The reporting leader feeds it
+// the windows it reports; the other instances catch up from a shared (redis) history, so a new
+// leader's trend carries on after a failover.
+type windowTrends struct {
+	size int
+
+	mu      sync.Mutex
+	windows []trendWindow
+}
+
+type trendWindow struct {
+	timestamp string
+	count     int
+	tenants   map[string]int
+}
+
+func newWindowTrends(size int) *windowTrends {
+	return &windowTrends{size: size}
+}
+
+// observe adds a closed window; rollups and windows already seen are ignored.
+func (t *windowTrends) observe(report windowReport) {
+	if t == nil || report.Period != "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(t.windows); n > 0 && report.Timestamp <= t.windows[n-1].timestamp {
+		return
+	}
+	t.windows = append(t.windows, trendWindow{timestamp: report.Timestamp, count: report.UniqueRequestCount, tenants: report.Tenants})
+	// One more than the average is over, for the windows before the newest one
+	if len(t.windows) > t.size+1 {
+		t.windows = t.windows[1:]
+	}
+}
+
+// catchUp observes the windows store holds that this instance hasn't seen, from the last ones
+// the ring can hold up to now.
+func (t *windowTrends) catchUp(ctx context.Context, store historyStore, now time.Time) error {
+	if t == nil || store == nil {
+		return nil
+	}
+	from := now.Add(-time.Duration(t.size+2) * time.Minute)
+	return store.Scan(ctx, from, now.Add(time.Second), func(report windowReport) error {
+		t.observe(report)
+		return nil
+	})
+}
+
+// trend compares count with the windows ending before the given timestamp, or with all of them
+// for an empty one, the open window. With tenants, the windows count only those tenants. It is
+// nil before there is a window to compare with.
+func (t *windowTrends) trend(count int, before string, tenants []string) *windowTrend {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var counts []int
+	for _, w := range t.windows {
+		if before != "" && w.timestamp >= before {
+			break
+		}
+		n := w.count
+		if len(tenants) > 0 {
+			n = 0
+			for _, tenant := range tenants {
+				n += w.tenants[tenant]
+			}
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	if len(counts) > t.size {
+		counts = counts[len(counts)-t.size:]
+	}
+
+	sum := 0
+	for _, n := range counts {
+		sum += n
+	}
+	previous := counts[len(counts)-1]
+	return &windowTrend{
+		PreviousCount: previous,
+		Delta:         count - previous,
+		MovingAverage: float64(sum) / float64(len(counts)),
+		Windows:       len(counts),
+	}
+}
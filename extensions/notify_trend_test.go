@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWindowTrendsCatchUp(t *testing.T) {
+	store, err := newBoltHistory(filepath.Join(t.TempDir(), "history.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	for i, count := range []int{100, 120, 90} {
+		ts := now.Add(time.Duration(i-2) * time.Minute).Format(time.RFC3339)
+		if err := store.Append(context.Background(), windowReport{Timestamp: ts, UniqueRequestCount: count}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Append(context.Background(), windowReport{Timestamp: now.Format(time.RFC3339), Period: "hour", UniqueRequestCount: 310})
+
+	trends := newWindowTrends(2)
+	if err := trends.catchUp(context.Background(), store, now); err != nil {
+		t.Fatal(err)
+	}
+	// Catching up again doesn't observe the same windows twice
+	trends.catchUp(context.Background(), store, now)
+	got := trends.trend(80, "", nil)
+	if got == nil || got.PreviousCount != 90 || got.Windows != 2 || got.MovingAverage != 105 {
+		t.Errorf("got trend %+v, want previous 90 over 2 windows averaging 105", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var outboxBucket = []byte("outbox")
+
+// outboxEntry is a window report together with the sinks that acknowledged it.
+type outboxEntry struct {
+	Report    windowReport    `json:"report"`
+	Delivered map[string]bool `json:"delivered"`
+}
+
+// outbox makes window publishing at-least-once: a report is first committed to a local bbolt
+// file and only removed once every sink acknowledged it, so reports survive sink outages and
+// crashes and are retried in window order.
+type outbox struct {
+	db       *bolt.DB
+	sinks    []Sink
+	interval time.Duration
+
+	// mu guards delivering and again, which serialize delivery between the reporter and the
+	// retry loop without holding a lock while sinks publish
+	mu         sync.Mutex
+	delivering bool
+	// again is set when a delivery was asked for while one ran; that one then goes once more.
+	again bool
+}
+
+func newOutbox(path string, sinks []Sink, interval time.Duration) (*outbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &outbox{db: db, sinks: sinks, interval: interval}, nil
+}
+
+// add durably stores a report and then tries to deliver everything pending.
+func (o *outbox) add(ctx context.Context, report windowReport) error {
+	value, err := json.Marshal(outboxEntry{Report: report, Delivered: map[string]bool{}})
+	if err != nil {
+		return err
+	}
+
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// Big endian sequence keys keep bolt's iteration in window order
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	o.deliver(ctx)
+	return nil
+}
+
+// deliver hands every pending report to the sinks that haven't acknowledged it yet. While a
+// delivery runs, another call leaves the reports to it, so a slow sink holds up neither the
+// reporter nor the retry loop.
+func (o *outbox) deliver(ctx context.Context) {
+	o.mu.Lock()
+	if o.delivering {
+		o.again = true
+		o.mu.Unlock()
+		return
+	}
+	o.delivering = true
+	o.mu.Unlock()
+
+	for {
+		o.deliverPending(ctx)
+		o.mu.Lock()
+		again := o.again
+		o.again, o.delivering = false, again
+		o.mu.Unlock()
+		if !again {
+			return
+		}
+	}
+}
+
+// deliverPending copies the pending entries out of the outbox and publishes them.
+func (o *outbox) deliverPending(ctx context.Context) {
+	type pending struct {
+		key   []byte
+		entry outboxEntry
+	}
+	var entries []pending
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				log.Printf("Skipping unreadable outbox entry %x: %v\n", k, err)
+				return nil
+			}
+			entries = append(entries, pending{key: append([]byte(nil), k...), entry: entry})
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to read outbox: %v\n", err)
+		return
+	}
+
+	for _, p := range entries {
+		done := true
+		for _, s := range o.sinks {
+			if p.entry.Delivered[s.Name()] {
+				continue
+			}
+			err := publishTo(ctx, s, p.entry.Report)
+			if errors.As(err, &permanentError{}) {
+				log.Printf("The %s sink refused window %s, not retrying: %v\n", s.Name(), p.entry.Report.Timestamp, err)
+				outboxDropped.WithLabelValues(s.Name()).Inc()
+				err = nil
+			}
+			if err != nil {
+				log.Printf("Failed to publish window %s to %s sink, will retry: %v\n", p.entry.Report.Timestamp, s.Name(), err)
+				done = false
+				continue
+			}
+			p.entry.Delivered[s.Name()] = true
+		}
+
+		if err := o.ack(p.key, p.entry, done); err != nil {
+			log.Printf("Failed to update outbox: %v\n", err)
+			return
+		}
+	}
+}
+
+// ack records the sinks that acknowledged an entry and removes it once all of them have.
+func (o *outbox) ack(key []byte, entry outboxEntry, done bool) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if done {
+			return b.Delete(key)
+		}
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+// run retries pending reports every interval, including those left over from a previous run.
+func (o *outbox) run(runCtx context.Context) error {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	o.deliver(ctx)
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+			o.deliver(ctx)
+		}
+	}
+}
+
+// pending returns how many reports are waiting for a sink to acknowledge them.
+func (o *outbox) pending() int {
+	n := 0
+	o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(outboxBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func (o *outbox) Close() error {
+	return o.db.Close()
+}
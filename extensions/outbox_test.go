@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingSink holds its first publish until release is closed.
+type blockingSink struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	published []string
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+func (s *blockingSink) Publish(_ context.Context, report windowReport) error {
+	s.mu.Lock()
+	first := len(s.published) == 0
+	s.published = append(s.published, report.Timestamp)
+	s.mu.Unlock()
+	if first {
+		close(s.started)
+		<-s.release
+	}
+	return nil
+}
+
+func TestOutboxPublishesOutsideLock(t *testing.T) {
+	sink := &blockingSink{started: make(chan struct{}), release: make(chan struct{})}
+	o, err := newOutbox(filepath.Join(t.TempDir(), "outbox.db"), []Sink{sink}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() { done <- o.add(ctx, windowReport{Timestamp: "2026-10-14T12:00:00Z"}) }()
+	<-sink.started
+
+	// The next window's report is stored while the first still publishes, and left to it
+	added := make(chan error)
+	go func() { added <- o.add(ctx, windowReport{Timestamp: "2026-10-14T12:01:00Z"}) }()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("add waited for another delivery's publish")
+	}
+	close(sink.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := o.pending(); n != 0 {
+		t.Errorf("got %d reports pending, want both delivered", n)
+	}
+	if len(sink.published) != 2 {
+		t.Errorf("got published %v, want each report once", sink.published)
+	}
+}
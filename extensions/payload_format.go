@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// payloadSerializer encodes the count messages this service sends: window reports, the
+// per-tenant messages next to them and endpoint notifications, which are reports without the
+// breakdowns.
+type payloadSerializer interface {
+	Name() string
+	// ContentType is sent to HTTP consumers.
+	ContentType() string
+	Report(report windowReport) ([]byte, error)
+	Tenant(report tenantReport) ([]byte, error)
+}
+
+// payloadSerializers are the payload formats sinks and endpoints can be configured with
+// (KAFKA_FORMAT, REDIS_STREAM_FORMAT, NOTIFY_FORMAT, NOTIFY_HOST_FORMATS).
+var payloadSerializers = map[string]payloadSerializer{
+	"json":     jsonPayload{},
+	"protobuf": protobufPayload{},
+	"avro":     avroPayload{},
+	"number":   numberPayload{},
+	"statsd":   statsdPayload{},
+}
+
+func newPayloadSerializer(name string) (payloadSerializer, error) {
+	s, ok := payloadSerializers[strings.TrimSpace(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload format %q, expected one of %s", name, strings.Join(sortedKeys(payloadSerializers), ", "))
+	}
+	return s, nil
+}
+
+// printablePayload is payload for logs, or its size when it is binary.
+func printablePayload(s payloadSerializer, payload []byte) string {
+	switch s.(type) {
+	case protobufPayload, avroPayload:
+		return fmt.Sprintf("<%d bytes of %s>", len(payload), s.Name())
+	}
+	return string(payload)
+}
+
+// notifyFormats picks the payload format of an endpoint notification by the endpoint's host,
+// falling back to NOTIFY_FORMAT.
+type notifyFormats struct {
+	fallback payloadSerializer
+	byHost   map[string]payloadSerializer
+}
+
+// parseNotifyFormats parses NOTIFY_FORMAT and NOTIFY_HOST_FORMATS, a comma separated list of
+// host=format, e.g. hooks.example.com=statsd,metrics.example.com:8443=number.
+func parseNotifyFormats(fallback, hostSpec string) (*notifyFormats, error) {
+	s, err := newPayloadSerializer(fallback)
+	if err != nil {
+		return nil, err
+	}
+	formats := &notifyFormats{fallback: s, byHost: map[string]payloadSerializer{}}
+	for _, entry := range strings.Split(hostSpec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		host, name, ok := strings.Cut(entry, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid host format %q, expected host=format", entry)
+		}
+		if formats.byHost[host], err = newPayloadSerializer(name); err != nil {
+			return nil, err
+		}
+	}
+	return formats, nil
+}
+
+func (f *notifyFormats) forEndpoint(endpoint string) payloadSerializer {
+	if f == nil {
+		return jsonPayload{}
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		if s, ok := f.byHost[u.Host]; ok {
+			return s
+		}
+		if s, ok := f.byHost[u.Hostname()]; ok {
+			return s
+		}
+	}
+	return f.fallback
+}
+
+// jsonPayload is the default format, and the only one carrying the reconciliation.
+type jsonPayload struct{}
+
+func (jsonPayload) Name() string        { return "json" }
+func (jsonPayload) ContentType() string { return "application/json" }
+
+func (jsonPayload) Report(report windowReport) ([]byte, error) { return json.Marshal(report) }
+func (jsonPayload) Tenant(report tenantReport) ([]byte, error) { return json.Marshal(report) }
+
+// numberPayload is just the count, for consumers that only want the number.
+type numberPayload struct{}
+
+func (numberPayload) Name() string        { return "number" }
+func (numberPayload) ContentType() string { return "text/plain" }
+
+func (numberPayload) Report(report windowReport) ([]byte, error) {
+	return []byte(strconv.Itoa(report.UniqueRequestCount)), nil
+}
+
+func (numberPayload) Tenant(report tenantReport) ([]byte, error) {
+	return []byte(strconv.Itoa(report.UniqueRequestCount)), nil
+}
+
+// statsdPayload writes gauges in the statsd line protocol ("<name>:<value>|g"), one line per
+// count, under STATSD_PREFIX. Names follow the graphite sink's.
+type statsdPayload struct{}
+
+func (statsdPayload) Name() string        { return "statsd" }
+func (statsdPayload) ContentType() string { return "text/plain" }
+
+func (statsdPayload) Report(report windowReport) ([]byte, error) {
+	var b strings.Builder
+	gauge := func(value int, name ...string) {
+		for i := range name {
+			name[i] = graphiteComponent(name[i])
+		}
+		fmt.Fprintf(&b, "%s.%s:%d|g\n", getEnv("STATSD_PREFIX", "verve"), strings.Join(name, "."), value)
+	}
+	if report.Period != "" {
+		gauge(report.UniqueRequestCount, "rollup", report.Period, "unique_request_count")
+		return []byte(b.String()), nil
+	}
+	gauge(report.UniqueRequestCount, "unique_request_count")
+	for _, name := range sortedKeys(report.Buckets) {
+		gauge(report.Buckets[name], "buckets", name)
+	}
+	for _, dim := range sortedKeys(report.Dimensions) {
+		for _, value := range sortedKeys(report.Dimensions[dim]) {
+			gauge(report.Dimensions[dim][value], "dimensions", dim, value)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+func (statsdPayload) Tenant(report tenantReport) ([]byte, error) {
+	line := fmt.Sprintf("%s.tenants.%s.unique_request_count:%d|g\n", getEnv("STATSD_PREFIX", "verve"), graphiteComponent(report.Tenant), report.UniqueRequestCount)
+	return []byte(line), nil
+}
+
+// protobufPayload encodes the CountMessage below; tenant messages set tenant instead of the
+// breakdowns. Maps are written in key order so equal reports encode to equal bytes.
+//
+//	message CountMessage {
+//	  int64 unique_request_count = 1;
+//	  string timestamp = 2;
+//	  string version = 3;
+//	  string git_sha = 4;
+//	  string instance_id = 5;
+//	  string backend = 6;
+//	  map<string, int64> buckets = 7;
+//	  repeated Dimension dimensions = 8;
+//	  map<string, int64> tenants = 9;
+//	  string period = 10;
+//	  string period_start = 11;
+//	  bool approximate = 12;
+//	  string tenant = 13;
+//	  bool overflowed = 14;
+//	  int64 duplicates = 15;
+//	  map<string, int64> top_duplicates = 16;
+//	  map<string, int64> regions = 17;
+//	  repeated string missing_regions = 18;
+//	  string window = 19;
+//	  Trend trend = 20;
+//	  string sketch_digest = 21;
+//	}
+//	message Dimension {
+//	  string name = 1;
+//	  map<string, int64> values = 2;
+//	}
+//	message Trend {
+//	  int64 previous_count = 1;
+//	  int64 delta = 2;
+//	  double moving_average = 3;
+//	  int64 windows = 4;
+//	}
+type protobufPayload struct{}
+
+func (protobufPayload) Name() string        { return "protobuf" }
+func (protobufPayload) ContentType() string { return "application/x-protobuf" }
+
+func (protobufPayload) Report(report windowReport) ([]byte, error) {
+	b := protobufHeader(nil, report.UniqueRequestCount, report.Timestamp, report.Version, report.GitSHA, report.InstanceID, report.Backend)
+	b = protobufCounts(b, 7, report.Buckets)
+	for _, dim := range sortedKeys(report.Dimensions) {
+		var d []byte
+		d = protobufString(d, 1, dim)
+		d = protobufCounts(d, 2, report.Dimensions[dim])
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, d)
+	}
+	b = protobufCounts(b, 9, report.Tenants)
+	b = protobufString(b, 10, report.Period)
+	b = protobufString(b, 11, report.PeriodStart)
+	if report.Approximate {
+		b = protowire.AppendTag(b, 12, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if report.Overflowed {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if report.Duplicates != 0 {
+		b = protowire.AppendTag(b, 15, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(report.Duplicates))
+	}
+	b = protobufCounts(b, 16, report.TopDuplicates)
+	b = protobufCounts(b, 17, report.Regions)
+	for _, region := range report.MissingRegions {
+		b = protobufString(b, 18, region)
+	}
+	if t := report.Trend; t != nil {
+		var m []byte
+		for field, v := range []int{t.PreviousCount, t.Delta} {
+			m = protowire.AppendTag(m, protowire.Number(field+1), protowire.VarintType)
+			m = protowire.AppendVarint(m, uint64(int64(v)))
+		}
+		m = protowire.AppendTag(m, 3, protowire.Fixed64Type)
+		m = protowire.AppendFixed64(m, math.Float64bits(t.MovingAverage))
+		m = protowire.AppendTag(m, 4, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(t.Windows))
+		b = protowire.AppendTag(b, 20, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return protobufString(b, 21, report.SketchDigest), nil
+}
+
+func (protobufPayload) Tenant(report tenantReport) ([]byte, error) {
+	b := protobufHeader(nil, report.UniqueRequestCount, report.Timestamp, report.Version, report.GitSHA, report.InstanceID, report.Backend)
+	b = protobufString(b, 13, report.Tenant)
+	return protobufString(b, 19, report.Window), nil
+}
+
+func protobufHeader(b []byte, count int, timestamp, version, gitSHA, instance, backend string) []byte {
+	if count != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(count))
+	}
+	b = protobufString(b, 2, timestamp)
+	b = protobufString(b, 3, version)
+	b = protobufString(b, 4, gitSHA)
+	b = protobufString(b, 5, instance)
+	return protobufString(b, 6, backend)
+}
+
+// protobufString appends a string field, leaving it out when empty like proto3 does.
+func protobufString(b []byte, field protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// protobufCounts appends a map<string, int64> field, one entry message per key.
+func protobufCounts(b []byte, field protowire.Number, counts map[string]int) []byte {
+	for _, key := range sortedKeys(counts) {
+		var entry []byte
+		entry = protobufString(entry, 1, key)
+		entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(counts[key]))
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// avroCountSchema is the schema of avroPayload messages, which are plain Avro binary records
+// without a container file or schema registry header.
+const avroCountSchema = `{"type": "record", "name": "CountMessage", "namespace": "verve", "fields": [
+  {"name": "unique_request_count", "type": "long"},
+  {"name": "timestamp", "type": "string"},
+  {"name": "version", "type": "string"},
+  {"name": "git_sha", "type": "string"},
+  {"name": "instance_id", "type": "string"},
+  {"name": "backend", "type": "string"},
+  {"name": "tenant", "type": "string"},
+  {"name": "period", "type": "string"},
+  {"name": "period_start", "type": "string"},
+  {"name": "approximate", "type": "boolean"},
+  {"name": "buckets", "type": {"type": "map", "values": "long"}},
+  {"name": "dimensions", "type": {"type": "map", "values": {"type": "map", "values": "long"}}},
+  {"name": "tenants", "type": {"type": "map", "values": "long"}}
+]}`
+
+// avroPayload encodes avroCountSchema; tenant messages set tenant and leave the maps empty.
+type avroPayload struct{}
+
+func (avroPayload) Name() string        { return "avro" }
+func (avroPayload) ContentType() string { return "avro/binary" }
+
+func (avroPayload) Report(report windowReport) ([]byte, error) {
+	var b []byte
+	b = avroLong(b, int64(report.UniqueRequestCount))
+	for _, s := range []string{report.Timestamp, report.Version, report.GitSHA, report.InstanceID, report.Backend, "", report.Period, report.PeriodStart} {
+		b = avroString(b, s)
+	}
+	b = avroBool(b, report.Approximate)
+	b = avroCounts(b, report.Buckets)
+	if len(report.Dimensions) > 0 {
+		b = avroLong(b, int64(len(report.Dimensions)))
+		for _, dim := range sortedKeys(report.Dimensions) {
+			b = avroString(b, dim)
+			b = avroCounts(b, report.Dimensions[dim])
+		}
+	}
+	b = avroLong(b, 0)
+	return avroCounts(b, report.Tenants), nil
+}
+
+func (avroPayload) Tenant(report tenantReport) ([]byte, error) {
+	var b []byte
+	b = avroLong(b, int64(report.UniqueRequestCount))
+	for _, s := range []string{report.Timestamp, report.Version, report.GitSHA, report.InstanceID, report.Backend, report.Tenant, "", ""} {
+		b = avroString(b, s)
+	}
+	b = avroBool(b, false)
+	for i := 0; i < 3; i++ {
+		b = avroLong(b, 0)
+	}
+	return b, nil
+}
+
+func avroLong(b []byte, v int64) []byte {
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+}
+
+func avroString(b []byte, s string) []byte {
+	return append(avroLong(b, int64(len(s))), s...)
+}
+
+func avroBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// avroCounts appends a map of longs as a single block followed by the end marker.
+func avroCounts(b []byte, counts map[string]int) []byte {
+	if len(counts) > 0 {
+		b = avroLong(b, int64(len(counts)))
+		for _, key := range sortedKeys(counts) {
+			b = avroString(b, key)
+			b = avroLong(b, int64(counts[key]))
+		}
+	}
+	return avroLong(b, 0)
+}
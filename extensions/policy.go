@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// policies are the rules of POLICY_FILE; nil without one.
+var policies *policySet
+
+// policyFile is the format of POLICY_FILE:
+//
+//	{"rules": [{
+//	  "name": "partner-x-range",
+//	  "when": "tenant == 'partner-x'",
+//	  "require": "ids.all(id, id >= 1000000 && id < 2000000)",
+//	  "message": "partner-x may only submit ids from 1000000 to 1999999"
+//	}]}
+//
+// Rules are CEL expressions over the request (policyVariables). A request is denied by the
+// first rule whose "when" holds (a missing "when" always does) and whose "require" doesn't.
+// Rules guard the HTTP API only; TCP ingest has neither a tenant nor a key to judge and is
+// restricted by INGEST_TCP_ALLOWED_CIDRS instead.
+type policyFile struct {
+	Rules []policyRuleSpec `json:"rules"`
+}
+
+type policyRuleSpec struct {
+	Name    string `json:"name"`
+	When    string `json:"when,omitempty"`
+	Require string `json:"require"`
+	// Message is returned to denied callers; without it they are told the rule's name.
+	Message string `json:"message,omitempty"`
+}
+
+// policyVariables are what rules can refer to: the caller's API key id (as shown by the admin
+// API, "" without a key), its tenant, whether the tenant came from a key the tenant store knows,
+// its client address (after TRUSTED_PROXIES), the request method and path, and the ids it
+// submits (empty on the stats, export and verify routes).
+//
+// Without authenticated, tenant and key_id are only what the caller claims: X-Tenant-ID is taken
+// as sent without a tenant store, and a caller may send no key at all. Rules about a tenant hold
+// only for callers that can't drop or swap it, so either require a key for everyone, e.g.
+// {"name": "keys", "require": "authenticated"}, or make the tenant rule's "when" true for
+// unauthenticated callers too.
+var policyVariables = []cel.EnvOption{
+	cel.Variable("key_id", cel.StringType),
+	cel.Variable("authenticated", cel.BoolType),
+	cel.Variable("tenant", cel.StringType),
+	cel.Variable("ip", cel.StringType),
+	cel.Variable("method", cel.StringType),
+	cel.Variable("path", cel.StringType),
+	cel.Variable("ids", cel.ListType(cel.IntType)),
+	// in_cidr(ip, "10.0.0.0/8") reports whether an address is in a range
+	cel.Function("in_cidr", cel.Overload("in_cidr_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+		cel.BinaryBinding(func(ip, cidr ref.Val) ref.Val {
+			addr, err := netip.ParseAddr(ip.Value().(string))
+			if err != nil {
+				return types.False
+			}
+			prefix, err := netip.ParsePrefix(cidr.Value().(string))
+			if err != nil {
+				return types.NewErr("invalid CIDR %q", cidr.Value())
+			}
+			return types.Bool(prefix.Contains(addr.Unmap()))
+		}))),
+}
+
+type policySet struct {
+	rules []policyRule
+}
+
+type policyRule struct {
+	name    string
+	message string
+	when    cel.Program // nil when the rule always applies
+	require cel.Program
+}
+
+// loadPolicies compiles the rules of POLICY_FILE, returning nil without a file.
+func loadPolicies(path string) (*policySet, error) {
+	if path == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file policyFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return compilePolicies(file)
+}
+
+func compilePolicies(file policyFile) (*policySet, error) {
+	env, err := cel.NewEnv(policyVariables...)
+	if err != nil {
+		return nil, err
+	}
+	set := &policySet{}
+	seen := map[string]bool{}
+	for i, spec := range file.Rules {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("rule %q is defined twice", spec.Name)
+		}
+		seen[spec.Name] = true
+		if spec.Require == "" {
+			return nil, fmt.Errorf("rule %q has no require expression", spec.Name)
+		}
+
+		rule := policyRule{name: spec.Name, message: spec.Message}
+		if rule.message == "" {
+			rule.message = fmt.Sprintf("Denied by policy %q", spec.Name)
+		}
+		if spec.When != "" {
+			if rule.when, err = compilePolicyExpr(env, spec.When); err != nil {
+				return nil, fmt.Errorf("rule %q: when: %w", spec.Name, err)
+			}
+		}
+		if rule.require, err = compilePolicyExpr(env, spec.Require); err != nil {
+			return nil, fmt.Errorf("rule %q: require: %w", spec.Name, err)
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+// compilePolicyExpr type checks a boolean expression, so typos fail at startup rather than on
+// the first request.
+func compilePolicyExpr(env *cel.Env, expr string) (cel.Program, error) {
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("%q is a %s, not a bool", expr, ast.OutputType())
+	}
+	return env.Program(ast, cel.EvalOptions(cel.OptOptimize))
+}
+
+// evaluate returns the rule denying a request with vars, or nil. A rule that fails to
+// evaluate denies too: a policy that can't be checked isn't met.
+func (s *policySet) evaluate(vars map[string]interface{}) *policyRule {
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if rule.when != nil {
+			applies, err := evalPolicyExpr(rule.when, vars)
+			if err != nil {
+				log.Printf("Error evaluating policy %q: %v\n", rule.name, err)
+				policyEvaluations.WithLabelValues(rule.name, "error").Inc()
+				return rule
+			}
+			if !applies {
+				continue
+			}
+		}
+		met, err := evalPolicyExpr(rule.require, vars)
+		switch {
+		case err != nil:
+			log.Printf("Error evaluating policy %q: %v\n", rule.name, err)
+			policyEvaluations.WithLabelValues(rule.name, "error").Inc()
+			return rule
+		case !met:
+			policyEvaluations.WithLabelValues(rule.name, "denied").Inc()
+			return rule
+		}
+		policyEvaluations.WithLabelValues(rule.name, "allowed").Inc()
+	}
+	return nil
+}
+
+func evalPolicyExpr(prg cel.Program, vars map[string]interface{}) (bool, error) {
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	met, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluated to %v, not a bool", out.Value())
+	}
+	return met, nil
+}
+
+// policyCheck answers requests a POLICY_FILE rule denies with a 403. It runs in the route's
+// middleware, after the API layers resolved the tenant and after batch bodies are
+// decompressed, so it sees the ids the handler will.
+func policyCheck(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if policies == nil {
+			next(w, r)
+			return
+		}
+		var apiKeyID string
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			apiKeyID = keyID(hashAPIKey(key))
+		}
+		authenticated, _ := r.Context().Value(authenticatedKey{}).(bool)
+		var ids interface{}
+		vars := map[string]interface{}{
+			"key_id":        apiKeyID,
+			"authenticated": authenticated,
+			"tenant":        r.Header.Get("X-Tenant-ID"),
+			"ip":            clientIP(r),
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			// Bound lazily, so rules that don't look at the ids don't read the body. A body that
+			// can't be read fails the rules that do, which deny the request
+			"ids": func() interface{} {
+				if ids == nil {
+					if list, err := policyIDs(r); err != nil {
+						ids = types.WrapErr(err)
+					} else {
+						ids = list
+					}
+				}
+				return ids
+			},
+		}
+		rule := policies.evaluate(vars)
+		if rule == nil {
+			next(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			writeErrorV2(w, http.StatusForbidden, "policy_denied", rule.message)
+			return
+		}
+		http.Error(w, rule.message, http.StatusForbidden)
+	}
+}
+
+// policyIDs reads the ids a request submits the way its handler will, within the same body
+// limit, putting the body back for it. Ids the handler would reject are left out and a body
+// past the limit gives none; the handler answers for them. A body the handler would get but
+// that isn't JSON is an error.
+func policyIDs(r *http.Request) ([]int64, error) {
+	if r.URL.Path == "/api/verve/accept" {
+		raw, _ := extractID(r)
+		if id, err := idNormalize.parseID(raw); err == nil && id > 0 {
+			return []int64{int64(id)}, nil
+		}
+		return []int64{}, nil
+	}
+	limit := acceptBodyLimit(r.URL.Path)
+	if limit == 0 || r.Body == nil {
+		return []int64{}, nil
+	}
+
+	var req struct {
+		ID  jsonID   `json:"id"`
+		IDs []jsonID `json:"ids"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	// The handler also gets whatever is past the limit, to reject the body as too large
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return []int64{}, nil
+	}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+	ids := make([]int64, 0, len(req.IDs)+1)
+	if req.ID > 0 {
+		ids = append(ids, int64(req.ID))
+	}
+	for _, id := range req.IDs {
+		if id > 0 {
+			ids = append(ids, int64(id))
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	set, err := compilePolicies(policyFile{Rules: []policyRuleSpec{
+		{Name: "keys", When: "path == '/api/v2/verve/accept'", Require: "authenticated"},
+		{Name: "range", Require: "ids.all(id, id < 100)"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies = set
+	defer func() { policies = nil }()
+	handler := policyCheck(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"ids in range", "/api/v2/verve/accept/batch", `{"ids": [1, 99]}`, http.StatusNoContent},
+		{"id out of range", "/api/v2/verve/accept/batch", `{"ids": [1, 100]}`, http.StatusForbidden},
+		{"body that isn't JSON", "/api/v2/verve/accept/batch", `{"ids": [1, 100`, http.StatusForbidden},
+		{"unauthenticated", "/api/v2/verve/accept", `{"id": 1}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
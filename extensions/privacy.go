@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// idHasher replaces dedupe keys with salted SHA-256 hashes (PRIVACY_MODE=hash), so raw ids never
+// reach Redis or any other dedupe store. The salt changes every minute: it is an HMAC of the
+// minute under PRIVACY_SECRET, so all instances sharing the secret agree on it without talking
+// to each other, and a hash can't be linked to the same id in another window.
+type idHasher struct {
+	secret []byte
+
+	mu     sync.Mutex
+	minute int64
+	salt   []byte
+}
+
+// newIDHasher uses secret, or a random one when it is empty; a random secret only suits a single
+// instance, since other instances would hash the same id differently.
+func newIDHasher(secret string) *idHasher {
+	h := &idHasher{secret: []byte(secret)}
+	if secret == "" {
+		h.secret = make([]byte, 32)
+		rand.Read(h.secret)
+	}
+	return h
+}
+
+func (h *idHasher) saltFor(t time.Time) []byte {
+	minute := t.Unix() / 60
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.salt != nil && minute == h.minute {
+		return h.salt
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	binary.Write(mac, binary.BigEndian, minute)
+	// Requests of a closing window still hash with its salt; only a later minute replaces it
+	if h.salt == nil || minute > h.minute {
+		h.minute, h.salt = minute, mac.Sum(nil)
+		return h.salt
+	}
+	return mac.Sum(nil)
+}
+
+// hash returns the first 128 bits of SHA-256(salt || key) with the salt of minute at, hex
+// encoded.
+func (h *idHasher) hash(key string, at time.Time) string {
+	sum := sha256.New()
+	sum.Write(h.saltFor(at))
+	sum.Write([]byte(key))
+	return hex.EncodeToString(sum.Sum(nil)[:16])
+}
+
+// storedKey is the key a request is deduplicated under in the dedupe backend: its dedupe key,
+// hashed in privacy mode with the salt of the minute the request arrived in, so one that is
+// still in flight after the boundary hashes like the rest of the closing window. Rollups use
+// the unhashed key, since their sketches span windows and only keep register maxima, never the
+// keys.
+func storedKey(in dedupeInput) string {
+	key := dedupeKey(in)
+	if idHash != nil {
+		at := in.arrived
+		if at.IsZero() {
+			at = time.Now()
+		}
+		return idHash.hash(key, at)
+	}
+	return key
+}
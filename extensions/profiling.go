@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profiler periodically captures CPU and heap profiles and uploads them to a Pyroscope compatible
+// /ingest endpoint, so production hotspots are visible without manual pprof sessions.
+type profiler struct {
+	uploadURL   string
+	appName     string
+	interval    time.Duration
+	cpuDuration time.Duration
+	client      *http.Client
+}
+
+func newProfiler(uploadURL, appName string, interval, cpuDuration time.Duration) *profiler {
+	return &profiler{
+		uploadURL:   strings.TrimRight(uploadURL, "/"),
+		appName:     appName,
+		interval:    interval,
+		cpuDuration: cpuDuration,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *profiler) run(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.collect(ctx); err != nil {
+			log.Printf("Failed to upload profiles: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *profiler) collect(ctx context.Context) error {
+	from := time.Now()
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(p.cpuDuration):
+	}
+	pprof.StopCPUProfile()
+	until := time.Now()
+
+	if err := p.upload("cpu", cpu.Bytes(), from, until); err != nil {
+		return err
+	}
+
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return err
+	}
+	return p.upload("alloc_space", heap.Bytes(), from, until)
+}
+
+func (p *profiler) upload(profileType string, profile []byte, from, until time.Time) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(profile); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("name", fmt.Sprintf("%s.%s{instance=%s,version=%s}", p.appName, profileType, instanceID(), currentBuild().Version))
+	query.Set("from", strconv.FormatInt(from.Unix(), 10))
+	query.Set("until", strconv.FormatInt(until.Unix(), 10))
+	query.Set("format", "pprof")
+	query.Set("spyName", "gospy")
+
+	resp, err := p.client.Post(p.uploadURL+"/ingest?"+query.Encode(), form.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("profile upload returned status %d", resp.StatusCode)
+	}
+	return nil
+}
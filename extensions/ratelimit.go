@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is set with RATE_LIMIT_RPS; main refuses the setting without the rate_limit
+// layer in HTTP_MIDDLEWARE.
+var rateLimiter *clientRateLimiter
+
+// clientRateLimiter keeps a token bucket per client: RATE_LIMIT_RPS tokens a second, up to
+// RATE_LIMIT_BURST. A client is its API key once the key was validated, and its address
+// before that and without one, so made-up keys don't each get a fresh bucket.
+// Below RATE_LIMIT_SOFT_PERCENT of the burst left a client is warned, once a minute, before
+// its requests start failing.
+type clientRateLimiter struct {
+	rate  float64
+	burst float64
+	soft  float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	checks  int
+	// keys are the ids of the API keys tenantFromAPIKey resolved to a tenant.
+	keys map[string]bool
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	warned time.Time
+}
+
+// rateLimitState is what a request learns about its client's bucket.
+type rateLimitState struct {
+	allowed   bool
+	remaining int
+	// reset is how long until the bucket is full again.
+	reset time.Duration
+	// retry is how long a rejected client has to wait for the next token.
+	retry time.Duration
+	// warn is set on the first request of a minute that finds the client under the soft limit.
+	warn bool
+}
+
+func newClientRateLimiter(rps float64, burst, softPercent int) *clientRateLimiter {
+	l := &clientRateLimiter{rate: rps, burst: float64(max(burst, 1)), buckets: map[string]*tokenBucket{}, keys: map[string]bool{}}
+	l.soft = l.burst * float64(softPercent) / 100
+	return l
+}
+
+// allow takes a token from client's bucket if there is one.
+func (l *clientRateLimiter) allow(client string, now time.Time) rateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Full buckets are the same as no bucket, drop them now and then
+	if l.checks++; l.checks%4096 == 0 {
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	var state rateLimitState
+	if b.tokens >= 1 {
+		b.tokens--
+		state.allowed = true
+	} else {
+		state.retry = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	state.remaining = int(b.tokens)
+	state.reset = time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second))
+	if state.allowed && b.tokens < l.soft && now.Sub(b.warned) >= time.Minute {
+		b.warned = now
+		state.warn = true
+	}
+	return state
+}
+
+// validated lets requests with the key id be limited as that key from now on.
+func (l *clientRateLimiter) validated(id string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys[id] = true
+}
+
+// rateLimitClient names the client a request is limited as. Keys are hashed so that they
+// don't sit in memory in the clear.
+func (l *clientRateLimiter) rateLimitClient(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		id := keyID(hashAPIKey(key))
+		l.mu.Lock()
+		known := l.keys[id]
+		l.mu.Unlock()
+		if known {
+			return "key:" + id
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// rateLimitMiddleware tells clients how much of their rate is left in X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset (seconds until the bucket is full), and answers
+// those over it with a 429.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := rateLimiter.rateLimitClient(r)
+		state := rateLimiter.allow(client, time.Now())
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(int(rateLimiter.burst)))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(state.remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(state.reset.Seconds()))))
+		if state.warn {
+			rateLimitWarnings.Inc()
+			log.Printf("Client %s is close to its rate limit, %d of %d requests left (request_id=%s)\n", client, state.remaining, int(rateLimiter.burst), requestID(r))
+		}
+		if state.allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rateLimited.Inc()
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(state.retry.Seconds()))))
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			writeErrorV2(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, slow down")
+			return
+		}
+		http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimitUnvalidatedKeys(t *testing.T) {
+	l := newClientRateLimiter(1, 1, 0)
+	r := httptest.NewRequest(http.MethodPost, "/api/v2/verve/accept", nil)
+	r.Header.Set("X-API-Key", "made-up")
+	if client := l.rateLimitClient(r); !strings.HasPrefix(client, "ip:") {
+		t.Errorf("got client %s for an unvalidated key, want its address", client)
+	}
+	l.validated(keyID(hashAPIKey("made-up")))
+	if client := l.rateLimitClient(r); !strings.HasPrefix(client, "key:") {
+		t.Errorf("got client %s for a validated key, want the key", client)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// realIP is set with TRUSTED_PROXIES; without it clientIP is the peer address.
+var realIP *realIPResolver
+
+// realIPResolver finds the client behind trusted proxies, like the challenge's load balancer.
+// A forwarding header is only believed when the peer is a trusted proxy, and is read from the
+// right: every hop that is a trusted proxy is skipped, and the first one that isn't is the
+// client. Addresses further left were written by whoever sent the request and can be forged.
+type realIPResolver struct {
+	trusted []netip.Prefix
+	// headers are tried in order; the first one present with a usable address wins.
+	headers []string
+}
+
+// realIPHeaders are the headers REAL_IP_HEADERS can list.
+var realIPHeaders = []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"}
+
+// parseRealIP parses TRUSTED_PROXIES, comma separated CIDRs or addresses, and REAL_IP_HEADERS,
+// the headers to read the client from in order of precedence. It returns nil without proxies.
+func parseRealIP(proxySpec, headerSpec string) (*realIPResolver, error) {
+	trusted, err := parseCIDRList(proxySpec)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	var headers []string
+	for _, h := range strings.Split(headerSpec, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		known := false
+		for _, name := range realIPHeaders {
+			if strings.EqualFold(h, name) {
+				headers, known = append(headers, name), true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown real IP header %q, expected %s", h, strings.Join(realIPHeaders, ", "))
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, nil
+	}
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("TRUSTED_PROXIES needs at least one header in REAL_IP_HEADERS")
+	}
+	return &realIPResolver{trusted: trusted, headers: headers}, nil
+}
+
+// parseCIDRList parses a comma separated list of CIDRs; a plain address is a single host.
+func parseCIDRList(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether addr is in one of prefixes.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client address of r, falling back to the peer when it isn't a trusted
+// proxy or no header names the client.
+func (res *realIPResolver) resolve(r *http.Request) netip.Addr {
+	peer := peerAddr(r)
+	if res == nil || !peer.IsValid() || !containsAddr(res.trusted, peer) {
+		return peer
+	}
+	for _, name := range res.headers {
+		var hops []netip.Addr
+		switch name {
+		case "X-Forwarded-For":
+			hops = forwardedForHops(r.Header.Values(name))
+		case "X-Real-IP":
+			if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(name))); err == nil {
+				hops = []netip.Addr{addr}
+			}
+		case "Forwarded":
+			hops = forwardedHops(r.Header.Values(name))
+		}
+		if len(hops) == 0 {
+			continue
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !containsAddr(res.trusted, hops[i]) {
+				return hops[i].Unmap()
+			}
+		}
+		// Every hop is a proxy of ours; the leftmost is the closest to the client we know
+		return hops[0].Unmap()
+	}
+	return peer
+}
+
+// peerAddr is the address of the connection's other end.
+func peerAddr(r *http.Request) netip.Addr {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return ap.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return addr.Unmap()
+}
+
+// forwardedForHops parses X-Forwarded-For headers, client first. A malformed entry makes the
+// whole chain unusable, since the hops to its right can no longer be told from forged ones.
+func forwardedForHops(values []string) []netip.Addr {
+	var hops []netip.Addr
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			addr, ok := parseHop(strings.TrimSpace(hop))
+			if !ok {
+				return nil
+			}
+			hops = append(hops, addr)
+		}
+	}
+	return hops
+}
+
+// forwardedHops parses the for= parameters of RFC 7239 Forwarded headers, client first.
+// Obfuscated identifiers like for=_hidden or for=unknown make the chain unusable.
+func forwardedHops(values []string) []netip.Addr {
+	var hops []netip.Addr
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				addr, ok := parseHop(strings.Trim(strings.TrimSpace(value), `"`))
+				if !ok {
+					return nil
+				}
+				hops = append(hops, addr)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address that may carry a port or, for IPv6, brackets.
+func parseHop(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, true
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	return addr, err == nil
+}
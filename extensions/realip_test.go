@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIPResolve(t *testing.T) {
+	res, err := parseRealIP("10.0.0.0/8, 192.0.2.1", "X-Forwarded-For,Forwarded,X-Real-IP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, peer, header, value, want string
+	}{
+		{name: "untrusted peer", peer: "203.0.113.9:1234", header: "X-Forwarded-For", value: "198.51.100.1", want: "203.0.113.9"},
+		{name: "rightmost untrusted hop", peer: "10.0.0.1:1234", header: "X-Forwarded-For", value: "6.6.6.6, 198.51.100.1, 10.0.0.2", want: "198.51.100.1"},
+		{name: "every hop trusted", peer: "10.0.0.1:1234", header: "X-Forwarded-For", value: "10.0.0.3, 10.0.0.2", want: "10.0.0.3"},
+		{name: "malformed chain", peer: "10.0.0.1:1234", header: "X-Forwarded-For", value: "198.51.100.1, nonsense", want: "10.0.0.1"},
+		{name: "forwarded with port", peer: "192.0.2.1:1234", header: "Forwarded", value: `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`, want: "2001:db8::1"},
+		{name: "obfuscated forwarded", peer: "192.0.2.1:1234", header: "Forwarded", value: "for=_hidden", want: "192.0.2.1"},
+		{name: "x-real-ip", peer: "10.0.0.1:1234", header: "X-Real-IP", value: " 198.51.100.7 ", want: "198.51.100.7"},
+		{name: "no header", peer: "10.0.0.1:1234", want: "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if got := res.resolve(r).String(); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRealIPHeaderPrecedence(t *testing.T) {
+	res, err := parseRealIP("10.0.0.1", "x-real-ip,X-Forwarded-For")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+	if got := res.resolve(r).String(); got != "198.51.100.2" {
+		t.Errorf("got %s, want the X-Real-IP listed first", got)
+	}
+}
+
+func TestParseRealIP(t *testing.T) {
+	if res, err := parseRealIP("", "X-Forwarded-For"); res != nil || err != nil {
+		t.Errorf("got %v, %v without TRUSTED_PROXIES, want no resolver", res, err)
+	}
+	for _, tc := range [][2]string{{"10.0.0.0/33", "X-Forwarded-For"}, {"10.0.0.1", "X-Client-IP"}, {"10.0.0.1", ""}} {
+		if _, err := parseRealIP(tc[0], tc[1]); err == nil {
+			t.Errorf("TRUSTED_PROXIES=%q REAL_IP_HEADERS=%q was accepted", tc[0], tc[1])
+		}
+	}
+}
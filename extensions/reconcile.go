@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// reconcileKey holds the contribution of every instance to the current window.
+const reconcileKey = "verve:window:contributions"
+
+// reconciliation compares what the replicas accepted with what the shared backend counted.
+type reconciliation struct {
+	Total     int            `json:"total"`
+	Instances map[string]int `json:"instances"`
+	// Discrepancy is the shared dedupe count minus the sum of the instance contributions.
+	Discrepancy int `json:"discrepancy"`
+}
+
+// windowReconciler periodically adds the ids this instance accepted as unique to a Redis hash
+// shared by all replicas; the leader reads and resets the hash when it reports the window.
+type windowReconciler struct {
+	client   *redis.Client
+	instance string
+	interval time.Duration
+
+	pending atomic.Int64
+}
+
+func newWindowReconciler(client *redis.Client, interval time.Duration) *windowReconciler {
+	return &windowReconciler{client: client, instance: instanceID(), interval: interval}
+}
+
+// record counts an id this instance accepted as unique.
+func (r *windowReconciler) record() {
+	r.pending.Add(1)
+}
+
+// retract takes back an id retracted through this instance.
+func (r *windowReconciler) retract() {
+	r.pending.Add(-1)
+}
+
+// push adds the contribution gathered since the last push to the shared hash.
+func (r *windowReconciler) push(ctx context.Context) error {
+	delta := r.pending.Swap(0)
+	if delta == 0 {
+		return nil
+	}
+	if err := r.client.HIncrBy(ctx, reconcileKey, r.instance, delta).Err(); err != nil {
+		// Keep the contribution for the next push
+		r.pending.Add(delta)
+		return err
+	}
+	return nil
+}
+
+// run pushes this instance's contribution every interval until ctx is done.
+func (r *windowReconciler) run(runCtx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.push(ctx); err != nil {
+				log.Printf("Failed to push window contribution: %v\n", err)
+			}
+		}
+	}
+}
+
+// collect is called by the leader when it closes a window: it reads and resets all
+// contributions and compares their sum with the count of the shared backend.
+func (r *windowReconciler) collect(ctx context.Context, count int) (*reconciliation, error) {
+	if err := r.push(ctx); err != nil {
+		return nil, err
+	}
+
+	var all *redis.MapStringStringCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		all = pipe.HGetAll(ctx, reconcileKey)
+		pipe.Del(ctx, reconcileKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &reconciliation{Instances: map[string]int{}}
+	for instance, value := range all.Val() {
+		n, _ := strconv.Atoi(value)
+		rec.Instances[instance] = n
+		rec.Total += n
+	}
+	rec.Discrepancy = count - rec.Total
+	windowDiscrepancy.Set(float64(rec.Discrepancy))
+	if rec.Discrepancy != 0 {
+		log.Printf("Window count %d differs from the sum of instance contributions %d\n", count, rec.Total)
+	}
+	return rec, nil
+}
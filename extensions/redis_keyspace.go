@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyspacePrefix covers every key this service writes to Redis.
+const redisKeyspacePrefix = "verve:"
+
+// keyspace watches what this service holds in Redis; nil unless the dedupe backend is redis,
+// REDIS_KEYSPACE_INTERVAL isn't 0 and REDIS_MAX_KEYS or REDIS_MAX_MEMORY_MB is set.
+var keyspace *keyspaceGuard
+
+// keyspaceGuard samples the service's share of a Redis that may be shared with others: how many
+// keys it holds under verve:, split into window ids, tenant window ids and the rest, and their
+// estimated memory. Once REDIS_MAX_KEYS or REDIS_MAX_MEMORY_MB is reached the guard trips and
+// accepting requests answer 503 until a sample finds the keyspace under its limits again. The
+// guard resamples right after every flush, so a window only opens if the flush made room. After
+// a switch away from redis it stops scanning and lets ids through until switched back.
+type keyspaceGuard struct {
+	dedup     *redisDeduplicator
+	interval  time.Duration
+	maxKeys   int64
+	maxMemory uint64
+
+	// sampling serialises samples, which the ticker and window flushes both start.
+	sampling sync.Mutex
+	keys     atomic.Int64
+	memory   atomic.Uint64
+	tripped  atomic.Bool
+	// reason is why the guard tripped, for the 503s.
+	reason   atomic.Value
+	rejected atomic.Int64
+}
+
+// keyspaceSampleSize is how many keys of each kind per shard get a MEMORY USAGE call; the memory
+// of the rest is estimated from the average of their kind, as a window's id keys and the sets
+// and sketches among the other keys differ by orders of magnitude.
+const keyspaceSampleSize = 64
+
+func newKeyspaceGuard(dedup *redisDeduplicator, interval time.Duration, maxKeys int, maxMemory uint64) *keyspaceGuard {
+	resourceCap.WithLabelValues("redis_keys").Set(float64(maxKeys))
+	resourceCap.WithLabelValues("redis_memory_bytes").Set(float64(maxMemory))
+	g := &keyspaceGuard{dedup: dedup, interval: interval, maxKeys: int64(maxKeys), maxMemory: maxMemory}
+	g.reason.Store("")
+	return g
+}
+
+func (g *keyspaceGuard) run(runCtx context.Context) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.sample(runCtx)
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// redis is the redis backend the guard samples, nil once the admin API switched to another one.
+func (g *keyspaceGuard) redis() *redisDeduplicator {
+	if backendSwitch == nil {
+		return g.dedup
+	}
+	backendSwitch.mu.RLock()
+	defer backendSwitch.mu.RUnlock()
+	dedup, _ := backendSwitch.current.(*redisDeduplicator)
+	return dedup
+}
+
+// afterFlush resamples once a window was flushed, deciding whether the next one may open.
+func (g *keyspaceGuard) afterFlush() {
+	if g != nil {
+		g.sample(ctx)
+	}
+}
+
+func (g *keyspaceGuard) sample(sampleCtx context.Context) {
+	g.sampling.Lock()
+	defer g.sampling.Unlock()
+	start := time.Now()
+	var mu sync.Mutex
+	counts := map[string]int64{"ids": 0, "tenant_windows": 0, "other": 0}
+	var memory float64
+	dedup := g.redis()
+	if dedup == nil {
+		// Switched away from redis, so there is nothing of ours there to guard
+		g.reason.Store("")
+		g.trip(false, 0, 0, "")
+		return
+	}
+	err := dedup.forEachShard(sampleCtx, func(shardCtx context.Context, client *redis.Client) error {
+		shard, sampled, sampledBytes := map[string]int64{}, map[string]int64{}, map[string]int64{}
+		iter := client.Scan(shardCtx, 0, redisKeyspacePrefix+"*", 1000).Iterator()
+		for iter.Next(shardCtx) {
+			key := iter.Val()
+			kind := "other"
+			switch {
+			case strings.HasPrefix(key, redisIDPrefix), strings.HasPrefix(key, redisSetPrefix+"id:"):
+				kind = "ids"
+			case strings.HasPrefix(key, "verve:window:"), strings.HasPrefix(key, redisSetPrefix+"window:"):
+				kind = "tenant_windows"
+			}
+			shard[kind]++
+			if sampled[kind] < keyspaceSampleSize {
+				sampled[kind]++
+				sampledBytes[kind] += keyMemory(shardCtx, client, key)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for kind, n := range shard {
+			counts[kind] += n
+			memory += float64(sampledBytes[kind]) / float64(sampled[kind]) * float64(n)
+		}
+		return nil
+	})
+	keyspaceSampleSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		// An unknown keyspace trips nothing and releases nothing
+		log.Printf("Failed to sample the Redis keyspace: %v\n", err)
+		keyspaceSamples.WithLabelValues("failed").Inc()
+		return
+	}
+	keyspaceSamples.WithLabelValues("ok").Inc()
+
+	var keys int64
+	for kind, n := range counts {
+		keyspaceKeys.WithLabelValues(kind).Set(float64(n))
+		keys += n
+	}
+	g.keys.Store(keys)
+	g.memory.Store(uint64(memory))
+	keyspaceMemory.Set(memory)
+	resourceInUse.WithLabelValues("redis_keys").Set(float64(keys))
+	resourceInUse.WithLabelValues("redis_memory_bytes").Set(memory)
+
+	var reason string
+	switch {
+	case g.maxKeys > 0 && keys >= g.maxKeys:
+		reason = fmt.Sprintf("The service holds %d Redis keys, REDIS_MAX_KEYS is %d", keys, g.maxKeys)
+	case g.maxMemory > 0 && uint64(memory) >= g.maxMemory:
+		reason = fmt.Sprintf("The service holds about %d MiB in Redis, REDIS_MAX_MEMORY_MB is %d", uint64(memory)>>20, g.maxMemory>>20)
+	}
+	g.reason.Store(reason)
+	g.trip(reason != "", keys, uint64(memory), reason)
+}
+
+// trip records a change of the guard's state, alerting when it trips.
+func (g *keyspaceGuard) trip(tripped bool, keys int64, memory uint64, reason string) {
+	if g.tripped.Swap(tripped) == tripped {
+		return
+	}
+	details := map[string]interface{}{"keys": keys, "memory_bytes": memory, "max_keys": g.maxKeys, "max_memory_bytes": g.maxMemory}
+	if tripped {
+		keyspaceTripped.Set(1)
+		keyspaceTrips.Inc()
+		log.Printf("Redis keyspace limit reached, refusing new ids: %s\n", reason)
+		audit.record(auditEntry{Action: "redis.keyspace_limit", Actor: "instance " + instanceID(), Details: details})
+		return
+	}
+	keyspaceTripped.Set(0)
+	log.Printf("Redis keyspace back under its limits (%d keys, about %d MiB), accepting ids again\n", keys, memory>>20)
+	audit.record(auditEntry{Action: "redis.keyspace_recovered", Actor: "instance " + instanceID(), Details: details})
+}
+
+// keyMemory is the MEMORY USAGE of key, or an estimate of a small string key where the
+// command isn't available.
+func keyMemory(ctx context.Context, client *redis.Client, key string) int64 {
+	if n, err := client.MemoryUsage(ctx, key).Result(); err == nil {
+		return n
+	}
+	return int64(56 + len(key))
+}
+
+// refusing returns why ids are refused, empty while they are accepted.
+func (g *keyspaceGuard) refusing() string {
+	if g == nil || !g.tripped.Load() {
+		return ""
+	}
+	g.rejected.Add(1)
+	return g.reason.Load().(string)
+}
+
+type keyspaceUsage struct {
+	Keys        int64  `json:"keys"`
+	MaxKeys     int64  `json:"max_keys,omitempty"`
+	MemoryBytes uint64 `json:"memory_bytes"`
+	MaxMemory   uint64 `json:"max_memory_bytes,omitempty"`
+	Tripped     bool   `json:"tripped"`
+	Rejected    int64  `json:"rejected"`
+}
+
+func (g *keyspaceGuard) usage() *keyspaceUsage {
+	if g == nil {
+		return nil
+	}
+	return &keyspaceUsage{
+		Keys:        g.keys.Load(),
+		MaxKeys:     g.maxKeys,
+		MemoryBytes: g.memory.Load(),
+		MaxMemory:   g.maxMemory,
+		Tripped:     g.tripped.Load(),
+		Rejected:    g.rejected.Load(),
+	}
+}
+
+// redisKeyspaceCap turns requests that add ids away with a 503 while the keyspace guard is
+// tripped, so a growing window can't take down a shared Redis.
+func redisKeyspaceCap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason := keyspace.refusing(); reason != "" {
+			writeCapReached(w, r, "redis_keyspace", reason)
+			return
+		}
+		next(w, r)
+	}
+}
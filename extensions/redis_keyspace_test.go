@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKeyspaceGuardSample(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	d := &redisDeduplicator{client: client, ttl: time.Minute}
+	backendSwitch = newSwitchingDeduplicator(d, "redis")
+	defer func() { backendSwitch = nil }()
+	for i := 0; i < 200; i++ {
+		mr.Set(fmt.Sprintf("%s%03d", redisIDPrefix, i), "1")
+	}
+	other := "verve:" + strings.Repeat("x", 1000)
+	mr.Set(other, "1")
+
+	g := newKeyspaceGuard(d, time.Minute, 150, 0)
+	g.sample(context.Background())
+	// miniredis has no MEMORY USAGE, so every key weighs its estimate. Sampled by kind, the
+	// long key's weight isn't averaged into the ids
+	want := uint64(200*keyMemory(context.Background(), client, redisIDPrefix+"000") + keyMemory(context.Background(), client, other))
+	if got := g.memory.Load(); got != want {
+		t.Errorf("got memory %d, want %d", got, want)
+	}
+	if g.keys.Load() != 201 || g.refusing() == "" {
+		t.Errorf("got %d keys, tripped %v, want 201 keys over the limit", g.keys.Load(), g.tripped.Load())
+	}
+
+	// After switching away from redis the keyspace isn't scanned and ids go through
+	backendSwitch = newSwitchingDeduplicator(newCuckooDeduplicator(100), "cuckoo")
+	mr.Set(redisIDPrefix+"new", "1")
+	g.sample(context.Background())
+	if g.refusing() != "" || g.keys.Load() != 201 {
+		t.Errorf("got tripped %v with %d keys after the switch, want released and not rescanned", g.tripped.Load(), g.keys.Load())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisReplicaSet spreads read-only commands (counts, history scans) over the Redis replicas of
+// REDIS_REPLICAS round-robin, so that they don't compete with the SETNX writes on the primary.
+// Replicas lag the primary slightly, so counts read from them may miss the latest ids.
+type redisReplicaSet struct {
+	clients []*redis.Client
+	next    atomic.Uint64
+}
+
+// newRedisReplicaSet connects to the replicas, returning nil when addrs is empty. A replica that
+// is down at startup is kept; reads fall back to the primary until it is back.
+func newRedisReplicaSet(addrs []string) *redisReplicaSet {
+	s := &redisReplicaSet{}
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		client := redis.NewClient(&redis.Options{Addr: addr, ContextTimeoutEnabled: true})
+		if err := client.Ping(ctx).Err(); err != nil {
+			log.Printf("Warning: Redis replica %s is unreachable: %v\n", addr, err)
+		}
+		s.clients = append(s.clients, client)
+	}
+	if len(s.clients) == 0 {
+		return nil
+	}
+	return s
+}
+
+// read runs fn against the next replica, or against primary when there are no replicas or the
+// replica fails. Errors of the caller's own context aren't retried.
+func (s *redisReplicaSet) read(ctx context.Context, primary *redis.Client, fn func(client *redis.Client) error) error {
+	if s == nil {
+		return fn(primary)
+	}
+	replica := s.clients[s.next.Add(1)%uint64(len(s.clients))]
+	err := fn(replica)
+	if err == nil {
+		replicaReads.WithLabelValues("replica").Inc()
+		return nil
+	}
+	if ctx.Err() != nil || errors.Is(err, redis.Nil) {
+		return err
+	}
+	log.Printf("Redis replica %s failed, reading from the primary: %v\n", replica.Options().Addr, err)
+	replicaReads.WithLabelValues("primary_fallback").Inc()
+	return fn(primary)
+}
+
+func (s *redisReplicaSet) Close() error {
+	var errs []error
+	for _, client := range s.clients {
+		errs = append(errs, client.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Multi-region aggregation: every region runs its own deployment with the "region" sink, which
+// publishes the region's count of each window together with a HyperLogLog sketch of the
+// window's dedupe keys to REGION_TOPIC. An aggregator (AGGREGATE_REGIONS) consumes the topic,
+// merges the sketches of a window and publishes the global count through its own sinks. An id
+// seen in several regions is counted once, which summing the regional counts can't do.
+
+// windowSketches sketches the current window for the region sink and the sketch digest of
+// reports kept in the history; nil without either.
+var windowSketches *windowSketcher
+
+// regionWriter publishes the region sink's messages; it has its own topic, REGION_TOPIC.
+var regionWriter kafkaMessageWriter
+
+// regionSketchKeep is how many closed windows' sketches an instance keeps for the region sink,
+// which may only publish a window after the outbox retried it for a while.
+const regionSketchKeep = 60
+
+// regionSketchTTL is how long replicas' shared sketches are kept in Redis.
+const regionSketchTTL = time.Hour
+
+// regionReport is the message the region sink publishes per window.
+type regionReport struct {
+	Region             string `json:"region"`
+	Timestamp          string `json:"timestamp"`
+	UniqueRequestCount int    `json:"unique_request_count"`
+	// Sketch holds the registers of the window's HyperLogLog sketch, base64 in JSON. It is
+	// missing when no sketch of the window was kept any more.
+	Sketch     []byte `json:"sketch,omitempty"`
+	Version    string `json:"version"`
+	GitSHA     string `json:"git_sha"`
+	InstanceID string `json:"instance_id"`
+}
+
+// windowSketcher sketches the keys that were unique in the current window on this instance.
+// With Redis every instance shares the sketch of a window when it closes, like rollups do, so
+// the reporting leader can merge the ids its replicas accepted.
+type windowSketcher struct {
+	instance string
+
+	mu      sync.Mutex
+	current *hyperLogLog
+	// closed holds this instance's sketches of the last windows by timestamp.
+	closed map[string]*hyperLogLog
+}
+
+func newWindowSketcher() *windowSketcher {
+	return &windowSketcher{instance: instanceID(), current: &hyperLogLog{}, closed: map[string]*hyperLogLog{}}
+}
+
+func (s *windowSketcher) record(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.current.add(key)
+	s.mu.Unlock()
+}
+
+func regionSketchKey(timestamp string) string {
+	return "verve:region:sketch:" + timestamp
+}
+
+// rotate closes the current sketch as the window ending at timestamp and shares it.
+func (s *windowSketcher) rotate(ctx context.Context, timestamp string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	closed := s.current
+	s.current = &hyperLogLog{}
+	s.closed[timestamp] = closed
+	if len(s.closed) > regionSketchKeep {
+		stamps := sortedKeys(s.closed)
+		for _, stamp := range stamps[:len(stamps)-regionSketchKeep] {
+			delete(s.closed, stamp)
+		}
+	}
+	s.mu.Unlock()
+
+	if redisDB == nil {
+		return
+	}
+	_, err := redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, regionSketchKey(timestamp), s.instance, closed.bytes())
+		pipe.Expire(ctx, regionSketchKey(timestamp), regionSketchTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to share the window sketch: %v\n", err)
+	}
+}
+
+// merged returns the sketch of a window over every instance, or nil when none is kept.
+func (s *windowSketcher) merged(ctx context.Context, timestamp string) *hyperLogLog {
+	var merged *hyperLogLog
+	s.mu.Lock()
+	if own, ok := s.closed[timestamp]; ok {
+		snapshot := *own
+		merged = &snapshot
+	}
+	s.mu.Unlock()
+
+	if redisDB == nil {
+		return merged
+	}
+	all, err := redisDB.HGetAll(ctx, regionSketchKey(timestamp)).Result()
+	if err != nil {
+		log.Printf("Failed to read the window sketches, publishing this instance's only: %v\n", err)
+	}
+	for instance, value := range all {
+		h, ok := hyperLogLogFromBytes([]byte(value))
+		if !ok {
+			log.Printf("Ignoring malformed window sketch of %s\n", instance)
+			continue
+		}
+		if merged == nil {
+			merged = h
+			continue
+		}
+		merged.merge(h)
+	}
+	return merged
+}
+
+// digest is the "sha256:" hex digest of the merged sketch of a window, "" when none is kept.
+// Replicas that haven't shared their sketch of the window yet aren't in it.
+func (s *windowSketcher) digest(ctx context.Context, timestamp string) string {
+	if s == nil {
+		return ""
+	}
+	merged := s.merged(ctx, timestamp)
+	if merged == nil {
+		return ""
+	}
+	sum := sha256.Sum256(merged.bytes())
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// regionSink publishes this region's minute windows for the aggregator. Hour and day rollups
+// aren't published; the aggregator's own ROLLUPS can't be built from them either, they are
+// regional.
+type regionSink struct {
+	region string
+	// wait gives replicas time to share their sketch of the window before it is read.
+	wait time.Duration
+}
+
+func (s *regionSink) Name() string { return "region" }
+
+func (s *regionSink) Publish(ctx context.Context, report windowReport) error {
+	if report.Period != "" {
+		return nil
+	}
+	if end, err := time.Parse(time.RFC3339, report.Timestamp); err == nil && redisDB != nil {
+		if d := time.Until(end.Add(s.wait)); d > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d):
+			}
+		}
+	}
+
+	message := regionReport{
+		Region:             s.region,
+		Timestamp:          report.Timestamp,
+		UniqueRequestCount: report.UniqueRequestCount,
+		Version:            report.Version,
+		GitSHA:             report.GitSHA,
+		InstanceID:         report.InstanceID,
+	}
+	if merged := windowSketches.merged(ctx, report.Timestamp); merged != nil {
+		message.Sketch = merged.bytes()
+	} else {
+		log.Printf("No sketch of the window ending %s is kept, publishing its count only\n", report.Timestamp)
+	}
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if skipDryRun("region", "topic %s, region %s, window %s: %d unique ids", regionTopic(), s.region, report.Timestamp, report.UniqueRequestCount) {
+		return nil
+	}
+
+	resources.kafkaWrites.Add(1)
+	defer resources.kafkaWrites.Add(-1)
+	// Keyed by window, so all regions' messages of a window land on the same partition and
+	// aggregators sharing the consumer group each get whole windows
+	return regionWriter.WriteMessages(ctx, kafka.Message{Key: []byte(regionWindow(report.Timestamp)), Value: value})
+}
+
+func regionTopic() string {
+	return getEnv("REGION_TOPIC", "verve-region-windows")
+}
+
+// initRegionKafka returns the writer of the region sink.
+func initRegionKafka() *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(getEnv("KAFKA_BROKER", "")),
+		Topic:                  regionTopic(),
+		Balancer:               &kafka.Hash{},
+		AllowAutoTopicCreation: true,
+		Compression:            kafkaCompression,
+	}
+}
+
+// parseRegions parses AGGREGATE_REGIONS, the comma separated regions a global window waits for.
+func parseRegions(spec string) ([]string, error) {
+	var regions []string
+	seen := map[string]bool{}
+	for _, region := range strings.Split(spec, ",") {
+		if region = strings.TrimSpace(region); region == "" {
+			continue
+		}
+		if seen[region] {
+			return nil, fmt.Errorf("region %q is listed twice", region)
+		}
+		seen[region] = true
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// kafkaMessageReader is the part of kafka.Reader the aggregator uses.
+type kafkaMessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// regionAggregator merges the regions' windows into global ones. A window is published once
+// every region reported it, or wait after it ended with the regions that did; it then carries
+// "missing_regions". Offsets are committed once a window is published, so a restarted
+// aggregator publishes the windows it was waiting for again, at least once.
+type regionAggregator struct {
+	reader  kafkaMessageReader
+	regions []string
+	wait    time.Duration
+
+	pending map[string]*pendingWindow
+	// published remembers recent windows, so a region reporting after the window was published
+	// is logged instead of starting the window over.
+	published map[string]time.Time
+	// uncommitted are the messages of published windows whose offsets can't be committed yet,
+	// since an earlier message on their partition still belongs to a pending window.
+	uncommitted []kafka.Message
+}
+
+type pendingWindow struct {
+	reports  map[string]regionReport
+	messages []kafka.Message
+}
+
+func newRegionAggregator(reader kafkaMessageReader, regions []string, wait time.Duration) *regionAggregator {
+	return &regionAggregator{reader: reader, regions: regions, wait: wait, pending: map[string]*pendingWindow{}, published: map[string]time.Time{}}
+}
+
+// initRegionReader joins the aggregators' consumer group on REGION_TOPIC.
+func initRegionReader() *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers: strings.Split(getEnv("KAFKA_BROKER", ""), ","),
+		GroupID: getEnv("AGGREGATE_GROUP", "verve-aggregator"),
+		Topic:   regionTopic(),
+	})
+}
+
+func (a *regionAggregator) run(runCtx context.Context) error {
+	defer a.reader.Close()
+	for runCtx.Err() == nil {
+		// Fetch with a short deadline, so windows missing a region are published on time
+		fetchCtx, cancel := context.WithTimeout(runCtx, time.Second)
+		m, err := a.reader.FetchMessage(fetchCtx)
+		cancel()
+		switch {
+		case err == nil:
+			a.add(m)
+		case errors.Is(err, context.DeadlineExceeded) || runCtx.Err() != nil:
+		default:
+			log.Printf("Error reading region windows: %v\n", err)
+			select {
+			case <-runCtx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+		a.publishDue(runCtx, time.Now())
+	}
+	return nil
+}
+
+// add files a region's message under its window.
+func (a *regionAggregator) add(m kafka.Message) {
+	var report regionReport
+	if err := json.Unmarshal(m.Value, &report); err != nil || report.Region == "" || report.Timestamp == "" {
+		log.Printf("Ignoring malformed region window at offset %d: %v\n", m.Offset, err)
+		aggregatedRegions.WithLabelValues("malformed").Inc()
+		a.uncommitted = append(a.uncommitted, m)
+		return
+	}
+	window := regionWindow(report.Timestamp)
+	if _, done := a.published[window]; done {
+		log.Printf("Region %s reported the window ending %s after it was published\n", report.Region, report.Timestamp)
+		aggregatedRegions.WithLabelValues("late").Inc()
+		a.uncommitted = append(a.uncommitted, m)
+		return
+	}
+	w, ok := a.pending[window]
+	if !ok {
+		w = &pendingWindow{reports: map[string]regionReport{}}
+		a.pending[window] = w
+	}
+	// A region publishing a window twice, e.g. from its outbox, replaces its first report
+	w.reports[report.Region] = report
+	w.messages = append(w.messages, m)
+	aggregatedRegions.WithLabelValues("received").Inc()
+}
+
+// regionWindow is the global window a region's window ending at timestamp belongs to: the
+// minute it ended in. Regions tick on their own clocks, so their timestamps of a window differ
+// by the milliseconds their ticks are apart, which the second resolution of timestamps doesn't
+// always hide.
+func regionWindow(timestamp string) string {
+	end, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return end.UTC().Truncate(time.Minute).Format(time.RFC3339)
+}
+
+// publishDue publishes the windows every region reported and those waited for long enough.
+func (a *regionAggregator) publishDue(ctx context.Context, now time.Time) {
+	for _, timestamp := range sortedKeys(a.pending) {
+		w := a.pending[timestamp]
+		complete := true
+		for _, region := range a.regions {
+			if _, ok := w.reports[region]; !ok {
+				complete = false
+			}
+		}
+		end, err := time.Parse(time.RFC3339, timestamp)
+		if !complete && err == nil && now.Before(end.Add(a.wait)) {
+			continue
+		}
+		report := a.globalReport(timestamp, w)
+		publishReport(report)
+		notifySubscribers(report)
+		delete(a.pending, timestamp)
+		a.published[timestamp] = now
+		a.uncommitted = append(a.uncommitted, w.messages...)
+	}
+	for timestamp, at := range a.published {
+		if now.Sub(at) > time.Hour {
+			delete(a.published, timestamp)
+		}
+	}
+	a.commit(ctx)
+}
+
+// globalReport merges the regions' sketches of a window. The estimate is kept between the
+// largest regional count, which it can't be below, and their sum, which it can't exceed.
+func (a *regionAggregator) globalReport(timestamp string, w *pendingWindow) windowReport {
+	merged := &hyperLogLog{}
+	counts := make(map[string]int, len(w.reports))
+	largest, sum := 0, 0
+	for region, report := range w.reports {
+		counts[region] = report.UniqueRequestCount
+		largest = max(largest, report.UniqueRequestCount)
+		sum += report.UniqueRequestCount
+		if h, ok := hyperLogLogFromBytes(report.Sketch); ok {
+			merged.merge(h)
+		} else {
+			log.Printf("Region %s sent no usable sketch of the window ending %s\n", region, timestamp)
+		}
+	}
+	count := min(max(merged.estimate(), largest), sum)
+
+	var missing []string
+	for _, region := range a.regions {
+		if _, ok := w.reports[region]; !ok {
+			missing = append(missing, region)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Publishing the window ending %s without regions %s\n", timestamp, strings.Join(missing, ", "))
+		aggregatedWindows.WithLabelValues("partial").Inc()
+	} else {
+		aggregatedWindows.WithLabelValues("complete").Inc()
+	}
+	log.Printf("Global window %s: ~%d unique ids from %d regions\n", timestamp, count, len(w.reports))
+
+	build := currentBuild()
+	return windowReport{
+		UniqueRequestCount: count,
+		Timestamp:          timestamp,
+		Version:            build.Version,
+		GitSHA:             build.GitSHA,
+		InstanceID:         instanceID(),
+		Backend:            activeBackend(),
+		Approximate:        true,
+		Regions:            counts,
+		MissingRegions:     missing,
+	}
+}
+
+// commit commits the offsets of published windows up to the first message of a pending one
+// on each partition; committing further would skip that window after a restart.
+func (a *regionAggregator) commit(ctx context.Context) {
+	if len(a.uncommitted) == 0 {
+		return
+	}
+	firstPending := map[int]int64{}
+	for _, w := range a.pending {
+		for _, m := range w.messages {
+			if first, ok := firstPending[m.Partition]; !ok || m.Offset < first {
+				firstPending[m.Partition] = m.Offset
+			}
+		}
+	}
+	sort.Slice(a.uncommitted, func(i, j int) bool { return a.uncommitted[i].Offset < a.uncommitted[j].Offset })
+	var ready, held []kafka.Message
+	for _, m := range a.uncommitted {
+		if first, ok := firstPending[m.Partition]; ok && m.Offset > first {
+			held = append(held, m)
+			continue
+		}
+		ready = append(ready, m)
+	}
+	if len(ready) == 0 {
+		return
+	}
+	if err := a.reader.CommitMessages(ctx, ready...); err != nil {
+		log.Printf("Failed to commit region window offsets: %v\n", err)
+		return
+	}
+	a.uncommitted = held
+}
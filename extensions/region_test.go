@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestRegionAggregatorBucketsByMinute(t *testing.T) {
+	a := newRegionAggregator(nil, []string{"eu-west", "us-east"}, time.Minute)
+	for i, r := range []regionReport{
+		{Region: "eu-west", Timestamp: "2026-10-14T07:01:00Z", UniqueRequestCount: 3},
+		{Region: "us-east", Timestamp: "2026-10-14T07:01:01Z", UniqueRequestCount: 4},
+	} {
+		value, _ := json.Marshal(r)
+		a.add(kafka.Message{Offset: int64(i), Value: value})
+	}
+	w, ok := a.pending["2026-10-14T07:01:00Z"]
+	if len(a.pending) != 1 || !ok || len(w.reports) != 2 {
+		t.Fatalf("got pending windows %v, want both regions under 2026-10-14T07:01:00Z", sortedKeys(a.pending))
+	}
+	if got := regionWindow("2026-10-14T07:01:59Z"); got != "2026-10-14T07:01:00Z" {
+		t.Errorf("regionWindow: got %s", got)
+	}
+}
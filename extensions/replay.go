@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replayGuard is set with REPLAY_PROTECTION: requests authenticated by an API key must then be
+// signed, and are rejected when stale or when their nonce was seen before.
+var replayGuard *replayProtection
+
+// nonceStore remembers the nonces of signed requests.
+type nonceStore interface {
+	// Seen records nonce for ttl and reports whether it was already recorded.
+	Seen(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+func newNonceStore(kind string) (nonceStore, error) {
+	switch kind {
+	case "memory":
+		return &memoryNonceStore{expires: map[string]time.Time{}}, nil
+	case "redis":
+		if redisDB == nil {
+			return nil, fmt.Errorf("redis nonce store requires a Redis connection")
+		}
+		return &redisNonceStore{client: redisDB}, nil
+	default:
+		return nil, fmt.Errorf("unknown nonce store %q", kind)
+	}
+}
+
+// memoryNonceStore only protects a single instance; replicas need the redis store.
+type memoryNonceStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	inserts int
+}
+
+func (s *memoryNonceStore) Seen(_ context.Context, nonce string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.inserts++; s.inserts%1024 == 0 {
+		for n, expires := range s.expires {
+			if now.After(expires) {
+				delete(s.expires, n)
+			}
+		}
+	}
+	if expires, ok := s.expires[nonce]; ok && now.Before(expires) {
+		return true, nil
+	}
+	s.expires[nonce] = now.Add(ttl)
+	return false, nil
+}
+
+type redisNonceStore struct {
+	client *redis.Client
+}
+
+func (s *redisNonceStore) Seen(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	fresh, err := s.client.SetNX(ctx, "verve:nonce:"+nonce, 1, ttl).Result()
+	return !fresh, err
+}
+
+// replayProtection verifies the X-Key-ID, X-Timestamp, X-Nonce and X-Signature headers of
+// requests with an X-API-Key. X-Key-ID is the key id of the API key, and the signature is the
+// hex HMAC-SHA256, keyed with that key's signing secret, of
+//
+//	<timestamp>\n<nonce>\n<method>\n<path and query>\n<hex SHA-256 of the body>
+//
+// with the timestamp in Unix seconds. The secret is handed out with the key and never sent, so
+// a captured API key alone can't sign. Requests more than maxSkew away from the server's clock
+// are stale; nonces are remembered for twice that, which covers every timestamp still accepted.
+type replayProtection struct {
+	maxSkew time.Duration
+	nonces  nonceStore
+}
+
+func newReplayProtection(maxSkew time.Duration, nonces nonceStore) *replayProtection {
+	return &replayProtection{maxSkew: maxSkew, nonces: nonces}
+}
+
+// signRequest computes the signature a partner sends for a request.
+func signRequest(secret, timestamp, nonce, method, uri string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", timestamp, nonce, method, uri, hex.EncodeToString(bodySum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks r and reports the error code and message to reject it with, if any. The body
+// is read and put back for the handler.
+func (p *replayProtection) verify(r *http.Request, key string) (code, message string) {
+	id, timestamp, nonce, signature := r.Header.Get("X-Key-ID"), r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce"), r.Header.Get("X-Signature")
+	if id == "" || timestamp == "" || nonce == "" || signature == "" {
+		return "signature_required", "Requests with an API key must carry X-Key-ID, X-Timestamp, X-Nonce and X-Signature"
+	}
+	if id != keyID(hashAPIKey(key)) {
+		return "invalid_signature", "X-Key-ID must be the key id of X-API-Key"
+	}
+	if len(nonce) < 8 || len(nonce) > 128 {
+		return "invalid_signature", "X-Nonce must be 8 to 128 characters"
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid_signature", "X-Timestamp must be Unix seconds"
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > p.maxSkew || skew < -p.maxSkew {
+		return "stale_request", fmt.Sprintf("X-Timestamp is %v away from the server's clock, at most %v is accepted", skew.Round(time.Second), p.maxSkew)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		limit := int64(getEnvInt("BATCH_MAX_IDS", 1000))*24 + 2048
+		body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return "invalid_signature", "Failed to read the request body"
+		}
+		if int64(len(body)) > limit {
+			return "body_too_large", fmt.Sprintf("Signed bodies are at most %d bytes", limit)
+		}
+	}
+
+	// tenantFromAPIKey put the key's tenant in X-Tenant-ID
+	t, err := tenants.Get(r.Context(), r.Header.Get("X-Tenant-ID"))
+	if err != nil {
+		return "signing_secret_unavailable", "Failed to look up the signing secret"
+	}
+	secret := t.SigningSecrets[id]
+	if secret == "" {
+		return "signing_secret_missing", "The API key has no signing secret, create a new key to sign requests"
+	}
+	expected := signRequest(secret, timestamp, nonce, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return "invalid_signature", "X-Signature doesn't match the request"
+	}
+
+	// Checked last, so that unsigned junk can't use up nonces of real requests
+	seen, err := p.nonces.Seen(r.Context(), id+":"+nonce, 2*p.maxSkew)
+	if err != nil {
+		return "nonce_store_unavailable", "Failed to check the request nonce"
+	}
+	if seen {
+		return "replayed_request", "This X-Nonce was already used"
+	}
+	return "", ""
+}
+
+// replayCheck rejects API key requests that fail replayGuard. It runs after tenantFromAPIKey,
+// so the key is known to be valid.
+func replayCheck(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if replayGuard == nil || key == "" {
+			next(w, r)
+			return
+		}
+		code, message := replayGuard.verify(r, key)
+		if code == "" {
+			next(w, r)
+			return
+		}
+
+		replayRejections.WithLabelValues(code).Inc()
+		status := http.StatusUnauthorized
+		switch code {
+		case "nonce_store_unavailable", "signing_secret_unavailable":
+			status = http.StatusServiceUnavailable
+		case "body_too_large":
+			status = http.StatusRequestEntityTooLarge
+		default:
+			auditAuthFailure(r, "signature")
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			writeErrorV2(w, status, code, message)
+			return
+		}
+		http.Error(w, message, status)
+	}
+}
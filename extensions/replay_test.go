@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTenantStore serves one tenant.
+type fakeTenantStore struct{ t tenant }
+
+func (s fakeTenantStore) List(context.Context) ([]tenant, error) { return []tenant{s.t}, nil }
+func (s fakeTenantStore) Get(_ context.Context, id string) (tenant, error) {
+	if id != s.t.ID {
+		return tenant{}, errTenantNotFound
+	}
+	return s.t, nil
+}
+func (s fakeTenantStore) Put(context.Context, tenant) error { return nil }
+func (s fakeTenantStore) Update(_ context.Context, id string, change func(*tenant) error) (tenant, error) {
+	t, err := s.Get(context.Background(), id)
+	if err != nil {
+		return tenant{}, err
+	}
+	return t, change(&t)
+}
+func (s fakeTenantStore) Delete(context.Context, string) error { return nil }
+func (s fakeTenantStore) TenantForKey(_ context.Context, hash string) (string, error) {
+	for _, h := range s.t.KeyHashes {
+		if h == hash {
+			return s.t.ID, nil
+		}
+	}
+	return "", errTenantNotFound
+}
+
+func TestReplayCheck(t *testing.T) {
+	key, hash := newAPIKey()
+	id, secret := keyID(hash), newSigningSecret()
+	tenants = fakeTenantStore{t: tenant{ID: "acme", KeyHashes: []string{hash}, SigningSecrets: map[string]string{id: secret}}}
+	nonces, _ := newNonceStore("memory")
+	replayGuard = newReplayProtection(time.Minute, nonces)
+	defer func() { tenants, replayGuard = nil, nil }()
+	handler := tenantFromAPIKey(replayCheck(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }))
+
+	const path = "/api/v2/verve/accept"
+	send := func(signWith, nonce, body string) int {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", key)
+		r.Header.Set("X-Key-ID", id)
+		r.Header.Set("X-Timestamp", timestamp)
+		r.Header.Set("X-Nonce", nonce)
+		r.Header.Set("X-Signature", signRequest(signWith, timestamp, nonce, http.MethodPost, path, []byte(body)))
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec.Code
+	}
+
+	if got := send(secret, "nonce-0001", `{"id": 1}`); got != http.StatusNoContent {
+		t.Errorf("signed with the secret: got %d, want %d", got, http.StatusNoContent)
+	}
+	if got := send(secret, "nonce-0001", `{"id": 1}`); got != http.StatusUnauthorized {
+		t.Errorf("replayed nonce: got %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := send(key, "nonce-0002", `{"id": 1}`); got != http.StatusUnauthorized {
+		t.Errorf("signed with the API key: got %d, want %d", got, http.StatusUnauthorized)
+	}
+	large := `{"ids": [` + strings.Repeat("1,", getEnvInt("BATCH_MAX_IDS", 1000)*24) + `1]}`
+	if got := send(secret, "nonce-0003", large); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: got %d, want %d", got, http.StatusRequestEntityTooLarge)
+	}
+}
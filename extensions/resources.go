@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resources is the resource accounting of this instance; main replaces it with one holding
+// the configured caps.
+var resources = newResourceAccounting(0, 0, 0)
+
+// resourceAccounting tracks what the subsystems hold right now and enforces the caps on the
+// public API: MAX_INFLIGHT_REQUESTS, MAX_GOROUTINES and DEDUPE_MEMORY_LIMIT_MB. A zero cap is
+// unlimited.
+type resourceAccounting struct {
+	maxRequests     int64
+	maxGoroutines   int
+	maxDedupeMemory uint64
+
+	requests    atomic.Int64
+	kafkaWrites atomic.Int64
+	components  atomic.Int64
+	// dedupeMemory is sampled by run, since estimating it can walk the whole window.
+	dedupeMemory atomic.Uint64
+
+	rejectedRequests     atomic.Int64
+	rejectedGoroutines   atomic.Int64
+	rejectedDedupeMemory atomic.Int64
+}
+
+func newResourceAccounting(maxRequests, maxGoroutines int, maxDedupeMemory uint64) *resourceAccounting {
+	resourceCap.WithLabelValues("api_requests").Set(float64(maxRequests))
+	resourceCap.WithLabelValues("goroutines").Set(float64(maxGoroutines))
+	resourceCap.WithLabelValues("dedupe_memory_bytes").Set(float64(maxDedupeMemory))
+	return &resourceAccounting{maxRequests: int64(maxRequests), maxGoroutines: maxGoroutines, maxDedupeMemory: maxDedupeMemory}
+}
+
+// run samples the dedupe memory estimate and the resource gauges every second.
+func (a *resourceAccounting) run(runCtx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		a.sample()
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *resourceAccounting) sample() {
+	if reporter, ok := dedup.(MemoryReporter); ok {
+		a.dedupeMemory.Store(reporter.MemoryBytes())
+	}
+	report := a.report()
+	resourceInUse.WithLabelValues("api_requests").Set(float64(report.Requests.InUse))
+	resourceInUse.WithLabelValues("goroutines").Set(float64(report.Goroutines.Total))
+	resourceInUse.WithLabelValues("dedupe_memory_bytes").Set(float64(a.dedupeMemory.Load()))
+	resourceInUse.WithLabelValues("kafka_writes").Set(float64(report.Kafka.WritesInFlight))
+	resourceInUse.WithLabelValues("outbox_pending").Set(float64(report.Kafka.OutboxPending))
+	resourceInUse.WithLabelValues("notification_workers_busy").Set(float64(report.Notifications.Busy))
+	resourceInUse.WithLabelValues("notification_queue").Set(float64(report.Notifications.QueueDepth))
+}
+
+type resourceReport struct {
+	Goroutines    goroutineUsage    `json:"goroutines"`
+	Requests      resourceUsage     `json:"api_requests"`
+	Notifications notificationUsage `json:"notifications"`
+	Kafka         kafkaUsage        `json:"kafka"`
+	Dedupe        dedupeUsage       `json:"dedupe"`
+	// Redis is the keyspace guard's last sample, with the redis backend.
+	Redis *keyspaceUsage `json:"redis,omitempty"`
+}
+
+type resourceUsage struct {
+	InUse    int64 `json:"in_use"`
+	Cap      int64 `json:"cap,omitempty"`
+	Rejected int64 `json:"rejected"`
+}
+
+type goroutineUsage struct {
+	Total    int   `json:"total"`
+	Cap      int   `json:"cap,omitempty"`
+	Rejected int64 `json:"rejected"`
+	// Pools counts the goroutines of the pools this service runs; "other" is the rest, such as
+	// connection handling and client libraries.
+	Pools map[string]int `json:"pools"`
+}
+
+type notificationUsage struct {
+	Workers       int   `json:"workers"`
+	Busy          int64 `json:"busy"`
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	// Parked are notifications waiting for a host at NOTIFY_MAX_PER_HOST.
+	Parked int `json:"parked"`
+}
+
+type kafkaUsage struct {
+	WritesInFlight int64 `json:"writes_in_flight"`
+	// OutboxPending are reports waiting in the outbox for a sink to acknowledge them.
+	OutboxPending int `json:"outbox_pending"`
+}
+
+type dedupeUsage struct {
+	Backend string `json:"backend"`
+	// MemoryBytes is only reported by backends that keep the window in this process.
+	MemoryBytes *uint64 `json:"memory_bytes,omitempty"`
+	Cap         uint64  `json:"cap_bytes,omitempty"`
+	Rejected    int64   `json:"rejected"`
+}
+
+func (a *resourceAccounting) report() resourceReport {
+	report := resourceReport{
+		Goroutines: goroutineUsage{Total: runtime.NumGoroutine(), Cap: a.maxGoroutines, Rejected: a.rejectedGoroutines.Load()},
+		Requests:   resourceUsage{InUse: a.requests.Load(), Cap: a.maxRequests, Rejected: a.rejectedRequests.Load()},
+		Kafka:      kafkaUsage{WritesInFlight: a.kafkaWrites.Load()},
+		Dedupe:     dedupeUsage{Backend: activeBackend(), Cap: a.maxDedupeMemory, Rejected: a.rejectedDedupeMemory.Load()},
+		Redis:      keyspace.usage(),
+	}
+	if n := notifications; n != nil {
+		report.Notifications = notificationUsage{
+			Workers:       n.workers,
+			Busy:          n.busy.Load(),
+			QueueDepth:    len(n.queue),
+			QueueCapacity: cap(n.queue),
+			Parked:        n.hosts.parked(),
+		}
+	}
+	if reportOutbox != nil {
+		report.Kafka.OutboxPending = reportOutbox.pending()
+	}
+	if _, ok := dedup.(MemoryReporter); ok {
+		memory := a.dedupeMemory.Load()
+		report.Dedupe.MemoryBytes = &memory
+	}
+
+	pools := map[string]int{
+		"api_requests":         int(report.Requests.InUse),
+		"notification_workers": report.Notifications.Workers,
+		"components":           int(a.components.Load()),
+	}
+	other := report.Goroutines.Total
+	for _, n := range pools {
+		other -= n
+	}
+	pools["other"] = max(other, 0)
+	report.Goroutines.Pools = pools
+	return report
+}
+
+// Report what every subsystem holds right now against its cap
+func resourcesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, resources.report())
+}
+
+// resourceCaps counts the public API requests in flight, and turns new ones away with a 503
+// while MAX_INFLIGHT_REQUESTS or MAX_GOROUTINES is reached.
+func resourceCaps(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := resources
+		inUse := a.requests.Add(1)
+		defer a.requests.Add(-1)
+		if a.maxRequests > 0 && inUse > a.maxRequests {
+			a.rejectedRequests.Add(1)
+			writeCapReached(w, r, "api_requests", fmt.Sprintf("Too many requests in flight, MAX_INFLIGHT_REQUESTS is %d", a.maxRequests))
+			return
+		}
+		if n := runtime.NumGoroutine(); a.maxGoroutines > 0 && n > a.maxGoroutines {
+			a.rejectedGoroutines.Add(1)
+			writeCapReached(w, r, "goroutines", fmt.Sprintf("%d goroutines running, MAX_GOROUTINES is %d", n, a.maxGoroutines))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// dedupeMemoryCap turns requests that add ids away with a 503 while the dedupe window is over
+// DEDUPE_MEMORY_LIMIT_MB, rather than growing until the container is killed.
+func dedupeMemoryCap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := resources
+		if memory := a.dedupeMemory.Load(); a.maxDedupeMemory > 0 && memory > a.maxDedupeMemory {
+			a.rejectedDedupeMemory.Add(1)
+			writeCapReached(w, r, "dedupe_memory_bytes", fmt.Sprintf("The dedupe window takes up %d MiB, DEDUPE_MEMORY_LIMIT_MB is %d", memory>>20, a.maxDedupeMemory>>20))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeCapReached(w http.ResponseWriter, r *http.Request, resource, message string) {
+	resourceCapRejections.WithLabelValues(resource).Inc()
+	w.Header().Set("Retry-After", "1")
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeErrorV2(w, http.StatusServiceUnavailable, "resource_exhausted", message)
+		return
+	}
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
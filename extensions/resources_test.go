@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResourceCapsInflight(t *testing.T) {
+	old := resources
+	resources = newResourceAccounting(1, 0, 0)
+	defer func() { resources = old }()
+
+	var inner *httptest.ResponseRecorder
+	handler := resourceCaps(func(w http.ResponseWriter, r *http.Request) {
+		// A second request while this one is in flight is over MAX_INFLIGHT_REQUESTS
+		if inner == nil {
+			inner = httptest.NewRecorder()
+			resourceCaps(func(http.ResponseWriter, *http.Request) {})(inner, httptest.NewRequest("POST", "/api/v2/verve/accept", nil))
+			if report := resources.report(); report.Requests.InUse != 1 {
+				t.Errorf("%d requests in use, want 1", report.Requests.InUse)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/v2/verve/accept", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d for the request under the cap, want 200", w.Code)
+	}
+	if inner.Code != http.StatusServiceUnavailable || inner.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d, Retry-After %q over the cap, want 503 with a Retry-After", inner.Code, inner.Header().Get("Retry-After"))
+	}
+	if report := resources.report(); report.Requests.InUse != 0 || report.Requests.Rejected != 1 {
+		t.Errorf("got %+v after both requests, want none in use and 1 rejected", report.Requests)
+	}
+}
+
+func TestDedupeMemoryCap(t *testing.T) {
+	old := resources
+	resources = newResourceAccounting(0, 0, 1<<20)
+	defer func() { resources = old }()
+	handler := dedupeMemoryCap(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/verve/accept?id=1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d under DEDUPE_MEMORY_LIMIT_MB, want 200", w.Code)
+	}
+
+	resources.dedupeMemory.Store(2 << 20)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/verve/accept?id=1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d over DEDUPE_MEMORY_LIMIT_MB, want 503", w.Code)
+	}
+	if report := resources.report(); report.Dedupe.Rejected != 1 {
+		t.Errorf("got %d dedupe memory rejections, want 1", report.Dedupe.Rejected)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rollupPeriod is a reporting period longer than the minute window.
+type rollupPeriod struct {
+	name  string
+	start func(t time.Time) time.Time
+	end   func(start time.Time) time.Time
+}
+
+var rollupPeriods = map[string]rollupPeriod{
+	"hour": {
+		name:  "hour",
+		start: func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+		end:   func(start time.Time) time.Time { return start.Add(time.Hour) },
+	},
+	"day": {
+		name: "day",
+		start: func(t time.Time) time.Time {
+			y, m, d := t.UTC().Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		},
+		end: func(start time.Time) time.Time { return start.AddDate(0, 0, 1) },
+	},
+}
+
+type rollupKey struct {
+	period string
+	start  time.Time
+}
+
+// rollupTracker keeps a HyperLogLog sketch per open hour and day. Unique totals can't be
+// summed from minute counts (an id may come back every minute), but sketches of the same period
+// merge, so with Redis every replica shares its sketches and the leader merges them.
+type rollupTracker struct {
+	periods  []rollupPeriod
+	client   *redis.Client
+	instance string
+	grace    time.Duration
+
+	mu   sync.Mutex
+	open map[rollupKey]*hyperLogLog
+}
+
+// newRollupTracker parses ROLLUPS, e.g. "hour,day", returning nil when it is empty. Without a
+// Redis client the rollups only cover the ids accepted by the reporting instance.
+func newRollupTracker(spec string, client *redis.Client, grace time.Duration) (*rollupTracker, error) {
+	t := &rollupTracker{client: client, instance: instanceID(), grace: grace, open: map[rollupKey]*hyperLogLog{}}
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		period, ok := rollupPeriods[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rollup period %q", name)
+		}
+		t.periods = append(t.periods, period)
+	}
+	if len(t.periods) == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// sketch returns the sketch of the period containing now; the caller holds mu.
+func (t *rollupTracker) sketch(period rollupPeriod, now time.Time) *hyperLogLog {
+	key := rollupKey{period: period.name, start: period.start(now)}
+	h, ok := t.open[key]
+	if !ok {
+		h = &hyperLogLog{}
+		t.open[key] = h
+	}
+	return h
+}
+
+// record adds a key that was unique in its minute window. A key that is new for the hour is
+// new for its minute too, so only unique-in-window keys need to reach the sketches.
+func (t *rollupTracker) record(key string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, period := range t.periods {
+		t.sketch(period, now).add(key)
+	}
+}
+
+func rollupRedisKey(key rollupKey) string {
+	return fmt.Sprintf("verve:rollup:%s:%d", key.period, key.start.Unix())
+}
+
+// tick runs with every window: it shares this instance's sketches and closes the periods that
+// ended more than the grace period ago, publishing them when this instance is the leader.
+// The grace period gives replicas a window to push their last sketch of a period.
+func (t *rollupTracker) tick(ctx context.Context, now time.Time, leader bool) {
+	t.mu.Lock()
+	// Make sure the current periods exist so that an idle period is still reported as 0
+	for _, period := range t.periods {
+		t.sketch(period, now)
+	}
+	sketches := make(map[rollupKey]*hyperLogLog, len(t.open))
+	var closed []rollupKey
+	for key, h := range t.open {
+		snapshot := *h
+		sketches[key] = &snapshot
+		if !rollupPeriods[key.period].end(key.start).Add(t.grace).After(now) {
+			closed = append(closed, key)
+			delete(t.open, key)
+		}
+	}
+	t.mu.Unlock()
+
+	if t.client != nil {
+		_, err := t.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for key, h := range sketches {
+				pipe.HSet(ctx, rollupRedisKey(key), t.instance, h.bytes())
+				pipe.Expire(ctx, rollupRedisKey(key), 48*time.Hour)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to share rollup sketches: %v\n", err)
+		}
+	}
+
+	if !leader {
+		return
+	}
+	for _, key := range closed {
+		t.publish(ctx, key, sketches[key])
+	}
+}
+
+func (t *rollupTracker) publish(ctx context.Context, key rollupKey, merged *hyperLogLog) {
+	if t.client != nil {
+		all, err := t.client.HGetAll(ctx, rollupRedisKey(key)).Result()
+		if err != nil {
+			log.Printf("Failed to read rollup sketches, reporting this instance only: %v\n", err)
+		}
+		for instance, value := range all {
+			if h, ok := hyperLogLogFromBytes([]byte(value)); ok {
+				merged.merge(h)
+			} else {
+				log.Printf("Ignoring malformed rollup sketch of %s\n", instance)
+			}
+		}
+	}
+
+	end := rollupPeriods[key.period].end(key.start)
+	report := windowReport{
+		UniqueRequestCount: merged.estimate(),
+		Timestamp:          end.Format(time.RFC3339),
+		Version:            currentBuild().Version,
+		GitSHA:             currentBuild().GitSHA,
+		InstanceID:         instanceID(),
+		Backend:            activeBackend(),
+		Period:             key.period,
+		PeriodStart:        key.start.Format(time.RFC3339),
+		Approximate:        true,
+	}
+	log.Printf("Rollup %s %s - %s: ~%d unique ids\n", key.period, report.PeriodStart, report.Timestamp, report.UniqueRequestCount)
+	publishReport(report)
+}
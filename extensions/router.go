@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// middleware wraps a route's handler, e.g. requireAdmin.
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// router registers routes on a ServeMux with method patterns ("GET /api/v2/verve/stats"), so
+// handlers don't check r.Method themselves. A request with another method for a known path gets
+// a 405 with an Allow header, in the error format of the API version the path belongs to.
+type router struct {
+	mux *http.ServeMux
+	// allowed holds the registered methods per path.
+	allowed map[string][]string
+}
+
+func newRouter() *router {
+	return &router{mux: http.NewServeMux(), allowed: map[string][]string{}}
+}
+
+// handle registers r wrapped in its own middleware and then in mw, so mw runs first. A route
+// without a method matches every method.
+func (rt *router) handle(r route, mw ...middleware) {
+	handler := r.handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+
+	if r.method == "" {
+		rt.mux.HandleFunc(r.path, handler)
+		return
+	}
+	rt.mux.HandleFunc(r.method+" "+r.path, handler)
+	if _, ok := rt.allowed[r.path]; !ok {
+		path := r.path
+		rt.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			methodNotAllowed(w, req, rt.allowed[path])
+		})
+	}
+	rt.allowed[r.path] = append(rt.allowed[r.path], r.method)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, methods []string) {
+	var allow []string
+	for _, m := range methods {
+		allow = append(allow, m)
+		if m == http.MethodGet {
+			allow = append(allow, http.MethodHead)
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+
+	message := "Only " + joinMethods(methods) + " supported"
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeErrorV2(w, http.StatusMethodNotAllowed, "method_not_allowed", message)
+		return
+	}
+	http.Error(w, message, http.StatusMethodNotAllowed)
+}
+
+// joinMethods formats methods like "GET, PUT and DELETE methods are".
+func joinMethods(methods []string) string {
+	if len(methods) == 1 {
+		return methods[0] + " method is"
+	}
+	return strings.Join(methods[:len(methods)-1], ", ") + " and " + methods[len(methods)-1] + " methods are"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+type route struct {
+	// method is matched by the router; empty matches every method.
+	method  string
+	path    string
+	handler http.HandlerFunc
+	// middleware wraps handler, outermost first.
+	middleware []middleware
+	// successor is the replacement of a deprecated route, advertised in its response headers.
+	successor string
+	// streaming routes take as long as their response is big, so they are left out of the
+	// latency SLO.
+	streaming bool
+}
+
+// budgeted routes run under REQUEST_BUDGET. The export streams for as long as it takes.
+// Every public API route is checked against POLICY_FILE first.
+var budgeted = []middleware{policyCheck, requestBudget}
+
+var streamed = []middleware{policyCheck}
+
+// accepting routes add ids to the window, which waits for them when it closes (WINDOW_GRACE),
+// and stop while the window is over DEDUPE_MEMORY_LIMIT_MB or the Redis keyspace limits, or
+// for a tenant over its quota.
+var accepting = []middleware{policyCheck, dedupeMemoryCap, redisKeyspaceCap, tenantQuotaCap, inWindow, requestBudget}
+
+// acceptingBatches also take bodies compressed with zstd or gzip, which large backfills send.
+var acceptingBatches = append([]middleware{decompressBody}, accepting...)
+
+// v1Routes are kept for existing callers but are deprecated in favour of v2.
+var v1Routes = []route{
+	{method: http.MethodGet, path: "/api/verve/accept", handler: acceptHandler, middleware: accepting, successor: "/api/v2/verve/accept"},
+	// POST takes the id from a JSON body with ID_SOURCE=json:<path>
+	{method: http.MethodPost, path: "/api/verve/accept", handler: acceptHandler, middleware: accepting, successor: "/api/v2/verve/accept"},
+	{method: http.MethodPost, path: "/api/verve/accept/batch", handler: acceptBatchHandler, middleware: acceptingBatches, successor: "/api/v2/verve/accept/batch"},
+	{method: http.MethodGet, path: "/api/verve/stats", handler: statsHandler, middleware: budgeted, successor: "/api/v2/verve/stats"},
+	{method: http.MethodGet, path: "/api/verve/export", handler: exportHandler, middleware: streamed, successor: "/api/v2/verve/export", streaming: true},
+}
+
+var v2Routes = []route{
+	{method: http.MethodPost, path: "/api/v2/verve/accept", handler: acceptV2Handler, middleware: accepting},
+	{method: http.MethodPost, path: "/api/v2/verve/accept/batch", handler: acceptBatchV2Handler, middleware: acceptingBatches},
+	{method: http.MethodGet, path: "/api/v2/verve/stats", handler: statsV2Handler, middleware: budgeted},
+	{method: http.MethodGet, path: "/api/v2/verve/export", handler: exportHandler, middleware: streamed, streaming: true},
+	{method: http.MethodGet, path: "/api/v2/verve/verify", handler: verifyHandler, middleware: budgeted},
+}
+
+var tenantMiddleware = []middleware{requireTenants}
+
+var subscriptionMiddleware = []middleware{requireSubscriptions}
+
+// leaderOnly routes change the window, which a warm standby (STANDBY) only takes from the leader.
+var leaderOnly = []middleware{standbyGate}
+
+// adminRoutes require the admin token.
+var adminRoutes = []route{
+	{method: http.MethodPost, path: "/api/v2/admin/retract", handler: retractHandler, middleware: leaderOnly},
+	{method: http.MethodPost, path: "/api/v2/admin/purge", handler: purgeHandler, middleware: leaderOnly},
+	{method: http.MethodGet, path: "/api/v2/admin/audit", handler: auditHandler},
+	{method: http.MethodGet, path: "/api/v2/admin/resources", handler: resourcesHandler},
+	{method: http.MethodGet, path: "/api/v2/admin/backend", handler: backendStatusHandler},
+	{method: http.MethodPost, path: "/api/v2/admin/backend", handler: switchBackendHandler},
+	{method: http.MethodDelete, path: "/api/v2/admin/backend", handler: cancelBackendSwitchHandler},
+	{method: http.MethodGet, path: "/api/v2/admin/tenants", handler: listTenantsHandler, middleware: tenantMiddleware},
+	{method: http.MethodPost, path: "/api/v2/admin/tenants", handler: createTenantHandler, middleware: tenantMiddleware},
+	{method: http.MethodGet, path: "/api/v2/admin/tenants/{tenant}", handler: getTenantHandler, middleware: tenantMiddleware},
+	{method: http.MethodPut, path: "/api/v2/admin/tenants/{tenant}", handler: updateTenantHandler, middleware: tenantMiddleware},
+	{method: http.MethodDelete, path: "/api/v2/admin/tenants/{tenant}", handler: deleteTenantHandler, middleware: tenantMiddleware},
+	{method: http.MethodPost, path: "/api/v2/admin/tenants/{tenant}/keys", handler: tenantKeysHandler, middleware: tenantMiddleware},
+	{method: http.MethodDelete, path: "/api/v2/admin/tenants/{tenant}/keys/{key}", handler: tenantKeyHandler, middleware: tenantMiddleware},
+	{method: http.MethodGet, path: "/api/v2/admin/subscriptions", handler: listSubscriptionsHandler, middleware: subscriptionMiddleware},
+	{method: http.MethodPost, path: "/api/v2/admin/subscriptions", handler: createSubscriptionHandler, middleware: subscriptionMiddleware},
+	{method: http.MethodGet, path: "/api/v2/admin/subscriptions/{subscription}", handler: getSubscriptionHandler, middleware: subscriptionMiddleware},
+	{method: http.MethodPut, path: "/api/v2/admin/subscriptions/{subscription}", handler: updateSubscriptionHandler, middleware: subscriptionMiddleware},
+	{method: http.MethodDelete, path: "/api/v2/admin/subscriptions/{subscription}", handler: deleteSubscriptionHandler, middleware: subscriptionMiddleware},
+	{method: http.MethodGet, path: "/api/v2/admin/notifications/contracts", handler: notificationContractsHandler},
+}
+
+// opsRoutes serve operational endpoints rather than the public API.
+var opsRoutes = []route{
+	{method: http.MethodGet, path: "/metrics", handler: metricsHandler.ServeHTTP},
+	{method: http.MethodGet, path: "/version", handler: versionHandler},
+	{method: http.MethodGet, path: "/slo", handler: sloHandler},
+	{method: http.MethodGet, path: "/scaling-hint", handler: scalingHintHandler},
+}
+
+// debugRoutes expose pprof; they are only served by the internal listener.
+var debugRoutes = []route{
+	{path: "/debug/pprof/", handler: pprof.Index},
+	{path: "/debug/pprof/cmdline", handler: pprof.Cmdline},
+	{path: "/debug/pprof/profile", handler: pprof.Profile},
+	{path: "/debug/pprof/symbol", handler: pprof.Symbol},
+	{path: "/debug/pprof/trace", handler: pprof.Trace},
+}
+
+// publicRouter serves the public listeners. It doesn't use http.DefaultServeMux, which
+// net/http/pprof registers its handlers on.
+var publicRouter = newRouter()
+
+// registerRoutes sets up the public routes. With an internal listener (INTERNAL_ADDR) the admin
+// and ops routes are only served there.
+func registerRoutes() {
+	publicRouter = newRouter()
+	for _, routes := range [][]route{v1Routes, v2Routes} {
+		for _, r := range routes {
+			chain := apiChain
+			if r.successor != "" {
+				chain = append([]middleware{deprecated(r.successor)}, chain...)
+			}
+			// Outermost, so requests turned away by the chain are timed and count too
+			if !r.streaming {
+				chain = append([]middleware{sloTracked}, chain...)
+			}
+			chain = append([]middleware{instrumented(r.path)}, chain...)
+			publicRouter.handle(r, chain...)
+		}
+	}
+	if getEnv("INTERNAL_ADDR", "") != "" {
+		return
+	}
+	for _, r := range adminRoutes {
+		publicRouter.handle(r, requireAdmin)
+	}
+	for _, r := range opsRoutes {
+		publicRouter.handle(r)
+	}
+}
+
+// newHandler wraps the registered routes in the middleware every request goes through
+// (HTTP_MIDDLEWARE).
+func newHandler() http.Handler {
+	return wrapHTTPChain(publicRouter)
+}
+
+// newInternalHandler serves the admin, ops and debug routes for a listener bound to a
+// loopback or internal interface. It skips the public API's tenant and deprecation handling;
+// ops and debug routes require INTERNAL_TOKEN when it is set, admin routes keep ADMIN_TOKEN.
+func newInternalHandler() http.Handler {
+	rt := newRouter()
+	for _, r := range adminRoutes {
+		rt.handle(r, requireAdmin)
+	}
+	for _, routes := range [][]route{opsRoutes, debugRoutes} {
+		for _, r := range routes {
+			rt.handle(r, requireInternal)
+		}
+	}
+	return requestIDMiddleware(recoveryMiddleware(rt))
+}
+
+// deprecated marks responses of a route as deprecated (RFC 8594 style headers) and points
+// callers at its successor.
+func deprecated(successor string) middleware {
+	sunset := getEnv("V1_SUNSET", "")
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+			next(w, r)
+		}
+	}
+}
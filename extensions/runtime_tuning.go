@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+
+	"github.com/KimMachineGun/automemlimit/memlimit"
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+// tuneRuntime sizes GOMAXPROCS to the container's CPU quota and GOMEMLIMIT to its cgroup memory
+// limit, so the Go runtime doesn't schedule more threads than the quota allows (and gets
+// throttled) or let the heap grow until the container is OOM-killed. GOMAXPROCS and GOMEMLIMIT
+// set in the environment win; AUTOMEMLIMIT sets the share of the memory limit (default 0.9,
+// "off" disables it).
+func tuneRuntime() {
+	if _, err := maxprocs.Set(maxprocs.Logger(func(format string, args ...interface{}) {})); err != nil {
+		log.Printf("Failed to set GOMAXPROCS from CPU quota: %v", err)
+	}
+
+	limit, err := memlimit.Set()
+	if err != nil {
+		log.Printf("Failed to set GOMEMLIMIT from cgroup memory limit: %v", err)
+	}
+
+	log.Printf("Runtime: GOMAXPROCS=%d (%d CPUs visible), GOMEMLIMIT=%s", runtime.GOMAXPROCS(0), runtime.NumCPU(), formatMemLimit(limit))
+}
+
+func formatMemLimit(limit int64) string {
+	if limit <= 0 || limit == math.MaxInt64 {
+		return "none"
+	}
+	return formatBytes(limit)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
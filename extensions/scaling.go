@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scaling is the autoscaling signal; main replaces it with the configured one.
+var scaling = newScalingSignal(scalingTargets{rps: 2000, inflight: 200, dedupeLatency: 5 * time.Millisecond}, defaultScalingWeights)
+
+// scalingInputs are the signals the load is combined from, in SCALING_WEIGHTS order.
+var scalingInputs = []string{"rps", "inflight", "dedupe_latency"}
+
+var defaultScalingWeights = map[string]float64{"rps": 0.5, "inflight": 0.3, "dedupe_latency": 0.2}
+
+// scalingSmoothing is the weight of the newest second in the smoothed inputs; the rest is the
+// running average, so a single slow second doesn't add a replica but a burst shows within a
+// few seconds.
+const scalingSmoothing = 0.3
+
+// scalingTargets are the per-replica values at which an input is at 100% of its share.
+type scalingTargets struct {
+	rps           float64
+	inflight      float64
+	dedupeLatency time.Duration
+}
+
+// scalingSignal combines this instance's request rate, requests in flight and dedupe latency
+// into one load figure for KEDA and the HPA: each input is divided by its per-replica target
+// (SCALING_TARGET_*) and the ratios are averaged with SCALING_WEIGHTS. 1 means the replica is
+// at its target; the autoscaler's usual formula, replicas * average load / 1, then tracks
+// bursts without a rule per input.
+type scalingSignal struct {
+	targets scalingTargets
+	weights map[string]float64
+
+	requests      atomic.Int64
+	dedupeNanos   atomic.Int64
+	dedupeSamples atomic.Int64
+
+	mu   sync.Mutex
+	last scalingHint
+	// smoothed holds the smoothed inputs; seen is false until the first sample.
+	smoothed map[string]float64
+	seen     bool
+}
+
+type scalingHint struct {
+	Load    float64            `json:"load"`
+	Inputs  map[string]float64 `json:"inputs"`
+	Targets map[string]float64 `json:"targets"`
+	Weights map[string]float64 `json:"weights"`
+	At      time.Time          `json:"at"`
+}
+
+// parseScalingWeights parses SCALING_WEIGHTS, e.g. "rps=0.5,inflight=0.3,dedupe_latency=0.2".
+// Inputs left out weigh 0; the weights don't have to add up to 1.
+func parseScalingWeights(spec string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	total := 0.0
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		known := false
+		for _, input := range scalingInputs {
+			known = known || input == name
+		}
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid scaling weight %q, expected <input>=<weight> with input one of %s", pair, strings.Join(scalingInputs, ", "))
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || w < 0 || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid scaling weight %q, expected a non-negative number", pair)
+		}
+		weights[name] = w
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one scaling weight must be positive")
+	}
+	return weights, nil
+}
+
+func newScalingSignal(targets scalingTargets, weights map[string]float64) *scalingSignal {
+	return &scalingSignal{targets: targets, weights: weights, smoothed: map[string]float64{}}
+}
+
+// countRequest counts a public API request towards the request rate.
+func (s *scalingSignal) countRequest() {
+	s.requests.Add(1)
+}
+
+// observeDedupe records how long a call to the dedupe backend took.
+func (s *scalingSignal) observeDedupe(d time.Duration) {
+	s.dedupeNanos.Add(int64(d))
+	s.dedupeSamples.Add(1)
+}
+
+// run samples the inputs every second and exports the load as verve_scaling_load.
+func (s *scalingSignal) run(runCtx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case now := <-ticker.C:
+			s.sample(now.Sub(last), now)
+			last = now
+		}
+	}
+}
+
+func (s *scalingSignal) sample(elapsed time.Duration, now time.Time) {
+	raw := map[string]float64{
+		"rps":      float64(s.requests.Swap(0)) / elapsed.Seconds(),
+		"inflight": float64(resources.requests.Load()),
+	}
+	nanos, samples := s.dedupeNanos.Swap(0), s.dedupeSamples.Swap(0)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A second without dedupe calls keeps the latency it had, rather than reading as instant
+	raw["dedupe_latency"] = s.smoothed["dedupe_latency"]
+	if samples > 0 {
+		raw["dedupe_latency"] = time.Duration(nanos / samples).Seconds()
+	}
+	for _, input := range scalingInputs {
+		if s.seen {
+			s.smoothed[input] += scalingSmoothing * (raw[input] - s.smoothed[input])
+		} else {
+			s.smoothed[input] = raw[input]
+		}
+	}
+	s.seen = true
+
+	targets := map[string]float64{"rps": s.targets.rps, "inflight": s.targets.inflight, "dedupe_latency": s.targets.dedupeLatency.Seconds()}
+	inputs := make(map[string]float64, len(scalingInputs))
+	load, total := 0.0, 0.0
+	for _, input := range scalingInputs {
+		inputs[input] = s.smoothed[input]
+		scalingInput.WithLabelValues(input).Set(s.smoothed[input])
+		if w := s.weights[input]; w > 0 && targets[input] > 0 {
+			load += w * s.smoothed[input] / targets[input]
+			total += w
+		}
+	}
+	if total > 0 {
+		load /= total
+	}
+	scalingLoad.Set(load)
+	s.last = scalingHint{Load: math.Round(load*1000) / 1000, Inputs: inputs, Targets: targets, Weights: s.weights, At: now.UTC()}
+}
+
+func (s *scalingSignal) hint() scalingHint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Serve the scaling load for KEDA's metrics-api scaler (valueLocation: load) or an external
+// metrics adapter
+func scalingHintHandler(w http.ResponseWriter, r *http.Request) {
+	if !getEnvBool("SCALING_HINT", false) {
+		http.Error(w, "The scaling hint is disabled, set SCALING_HINT=true", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, scaling.hint())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/client"
+)
+
+// captureSink keeps published reports in memory for the self-test.
+type captureSink struct {
+	reports []windowReport
+}
+
+func (s *captureSink) Name() string { return "selftest" }
+
+func (s *captureSink) Publish(ctx context.Context, report windowReport) error {
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+// selfCheck is one step of a self-test; steps run in order and share state.
+type selfCheck struct {
+	name string
+	run  func() error
+}
+
+// runSelftest serves the API from in-memory backends, runs a scripted sequence of requests
+// through one window and checks the reported count. It returns the process exit code, so
+// `verve selftest` can gate container health checks and releases. TestSelftest runs the same
+// checks under go test.
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	checks, done := newSelftest()
+	defer done()
+	return runChecks(checks)
+}
+
+// newSelftest wires the package state to in-memory dependencies and returns the checks, and
+// the function that stops their server.
+func newSelftest() ([]selfCheck, func()) {
+	sink := &captureSink{}
+	coordinator = localCoordinator{}
+	dedupeKey, _ = parseKeyStrategy("id")
+	dedup, _ = newRoaringDeduplicator("", 0, 0)
+	dedupeBackend, backendSwitch = "roaring", nil
+	tenants, tenantWindows = nil, nil
+	sinks = []Sink{sink}
+	notifications = newNotifier(1, 10, 1, 10, time.Second)
+	registerRoutes()
+
+	server := httptest.NewServer(newHandler())
+	c := client.New(server.URL, client.WithRetries(0, 0))
+
+	// The window is closed explicitly with a fake clock instead of waiting for the ticker
+	windowEnd := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+
+	checks := []selfCheck{
+		{"v1 accepts a new id", func() error {
+			return expectV1(server.URL+"/api/verve/accept?id=1", http.StatusOK, "ok")
+		}},
+		{"v1 reports a duplicate id", func() error {
+			return expectV1(server.URL+"/api/verve/accept?id=1", http.StatusOK, "ok (duplicate), retry with different id")
+		}},
+		{"v1 rejects an invalid id", func() error {
+			return expectV1(server.URL+"/api/verve/accept?id=abc", http.StatusBadRequest, "Invalid or missing 'id' parameter\n")
+		}},
+		{"v2 accepts a new id", func() error {
+			result, err := c.Accept(ctx, 2)
+			if err == nil && result.Duplicate {
+				err = fmt.Errorf("id 2 reported as duplicate")
+			}
+			return err
+		}},
+		{"v2 batch sorts accepted, duplicate and invalid ids", func() error {
+			results, err := c.AcceptBatch(ctx, []int{3, 2, -1})
+			if err != nil {
+				return err
+			}
+			if len(results) != 3 || results[0].Duplicate || results[0].Invalid || !results[1].Duplicate || !results[2].Invalid {
+				return fmt.Errorf("unexpected results %+v", results)
+			}
+			return nil
+		}},
+		{"stats count the window", func() error {
+			return expectCount(c, 3)
+		}},
+		{"window report carries the count", func() error {
+			reportWindow(windowEnd)
+			if len(sink.reports) != 1 {
+				return fmt.Errorf("expected 1 report, got %d", len(sink.reports))
+			}
+			report := sink.reports[0]
+			if report.UniqueRequestCount != 3 || report.Timestamp != windowEnd.Format(time.RFC3339) {
+				return fmt.Errorf("unexpected report %+v", report)
+			}
+			return nil
+		}},
+		{"next window starts empty", func() error {
+			return expectCount(c, 0)
+		}},
+		{"ids are unique again in the next window", func() error {
+			return expectV1(server.URL+"/api/verve/accept?id=1", http.StatusOK, "ok")
+		}},
+	}
+	return checks, server.Close
+}
+
+// runChecks runs checks in order, logging each, and returns the exit code.
+func runChecks(checks []selfCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			log.Printf("FAIL %s: %v", check.name, err)
+			failed++
+			continue
+		}
+		log.Printf("ok   %s", check.name)
+	}
+	if failed > 0 {
+		log.Printf("selftest failed: %d of %d checks", failed, len(checks))
+		return 1
+	}
+	log.Printf("selftest passed: %d checks", len(checks))
+	return 0
+}
+
+func expectV1(url string, status int, body string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != status || strings.TrimSpace(string(got)) != strings.TrimSpace(body) {
+		return fmt.Errorf("got %d %q, expected %d %q", resp.StatusCode, got, status, body)
+	}
+	return nil
+}
+
+func expectCount(c *client.Client, want int) error {
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if stats.UniqueRequestCount != want {
+		return fmt.Errorf("got count %d, expected %d", stats.UniqueRequestCount, want)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSelftest(t *testing.T) {
+	checks, done := newSelftest()
+	defer done()
+	for _, check := range checks {
+		// Checks share the server's state, so a failed one fails the ones after it
+		if !t.Run(check.name, func(t *testing.T) {
+			if err := check.run(); err != nil {
+				t.Fatal(err)
+			}
+		}) {
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// shardHints is set with SHARD_HINT_PEERS; without it responses carry no Shard-Hint.
+var shardHints *shardHinter
+
+// shardHinter names the instance an id belongs to, for load balancers and clients that route
+// on it (e.g. Envoy's ring hash on the Shard-Hint of the previous response, or a client keeping
+// a connection per peer). With the in-process backends every instance only deduplicates what it
+// receives, so sending an id to its owner every time is what makes it unique across replicas;
+// with Redis it keeps a key's traffic on one instance's connections.
+type shardHinter struct {
+	peers []string
+	// self is this instance's name among peers, "" when it isn't one of them.
+	self string
+}
+
+// parseShardHints parses SHARD_HINT_PEERS, the comma separated names of all instances as the
+// load balancer knows them, and SHARD_HINT_SELF, this instance's (by default the hostname,
+// the pod name on Kubernetes). It returns nil without peers.
+func parseShardHints(peerSpec, self string) (*shardHinter, error) {
+	var peers []string
+	seen := map[string]bool{}
+	for _, peer := range strings.Split(peerSpec, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		if seen[peer] {
+			return nil, fmt.Errorf("peer %q is listed twice", peer)
+		}
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	if self == "" {
+		self, _ = os.Hostname()
+	}
+	h := &shardHinter{peers: peers}
+	if seen[self] {
+		h.self = self
+	}
+	return h, nil
+}
+
+// owner is the peer key belongs to by rendezvous hashing: the peer with the highest hash of
+// peer and key. Adding or removing a peer only moves the keys it gains or loses.
+func (h *shardHinter) owner(key string) string {
+	var best string
+	var bestScore uint64
+	for _, peer := range h.peers {
+		if score := xxhash.Sum64String(peer + "\x00" + key); best == "" || score > bestScore {
+			best, bestScore = peer, score
+		}
+	}
+	return best
+}
+
+// set adds the Shard-Hint header for the ids of a request: the owner they share, or none when
+// a batch spans several owners and has to be split to be routed. Ids that reached an instance
+// other than their owner are counted, showing whether routing follows the hints.
+func (h *shardHinter) set(w http.ResponseWriter, ins ...dedupeInput) {
+	if h == nil {
+		return
+	}
+	var hint string
+	mixed := false
+	misrouted := 0
+	for _, in := range ins {
+		if in.id <= 0 {
+			continue
+		}
+		owner := h.owner(dedupeKey(in))
+		if h.self != "" && owner != h.self {
+			misrouted++
+		}
+		if hint == "" {
+			hint = owner
+		}
+		mixed = mixed || owner != hint
+	}
+	if misrouted > 0 {
+		shardHintMisrouted.Add(float64(misrouted))
+	}
+	if hint != "" && !mixed {
+		w.Header().Set("Shard-Hint", hint)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShardHintOwnerStable(t *testing.T) {
+	three, _ := parseShardHints("a,b,c", "a")
+	four, _ := parseShardHints("a,b,c,d", "a")
+	moved := 0
+	for id := 0; id < 1000; id++ {
+		key := fmt.Sprint(id)
+		before, after := three.owner(key), four.owner(key)
+		if before != after {
+			moved++
+			if after != "d" {
+				t.Fatalf("id %d moved from %s to %s when d was added", id, before, after)
+			}
+		}
+	}
+	// About a quarter of the ids move to the new peer, and nothing else moves
+	if moved < 150 || moved > 350 {
+		t.Errorf("%d of 1000 ids moved to the added peer, want about 250", moved)
+	}
+}
+
+func TestShardHintHeader(t *testing.T) {
+	old := dedupeKey
+	dedupeKey, _ = parseKeyStrategy("id")
+	defer func() { dedupeKey = old }()
+	h, err := parseShardHints("a, b", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownedBy := map[string][]dedupeInput{}
+	for id := 1; len(ownedBy["a"]) < 2 || len(ownedBy["b"]) < 1; id++ {
+		in := dedupeInput{id: id}
+		ownedBy[h.owner(dedupeKey(in))] = append(ownedBy[h.owner(dedupeKey(in))], in)
+	}
+	misrouted := testutil.ToFloat64(shardHintMisrouted)
+
+	w := httptest.NewRecorder()
+	h.set(w, ownedBy["a"][:2]...)
+	if got := w.Header().Get("Shard-Hint"); got != "a" {
+		t.Errorf("got Shard-Hint %q for ids owned by a, want a", got)
+	}
+	w = httptest.NewRecorder()
+	h.set(w, ownedBy["a"][0], ownedBy["b"][0])
+	if got := w.Header().Get("Shard-Hint"); got != "" {
+		t.Errorf("got Shard-Hint %q for a batch spanning two owners, want none", got)
+	}
+	if got := testutil.ToFloat64(shardHintMisrouted) - misrouted; got != 1 {
+		t.Errorf("%v ids counted as misrouted, want the one owned by b", got)
+	}
+}
+
+func TestParseShardHints(t *testing.T) {
+	if h, err := parseShardHints("", "a"); h != nil || err != nil {
+		t.Errorf("got %v, %v without peers, want no hints", h, err)
+	}
+	if _, err := parseShardHints("a,b,a", "a"); err == nil {
+		t.Error("a repeated peer was accepted")
+	}
+	if h, _ := parseShardHints("a,b", "c"); h.self != "" {
+		t.Errorf("an instance outside the peers is %q, want none", h.self)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives the report of every finished window.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, report windowReport) error
+}
+
+// permanentError is a sink refusing a report in a way retrying can't fix, like a receiver
+// rejecting the payload; the outbox gives up on the report for that sink.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// newSinks builds the comma separated list of sinks configured in SINKS.
+func newSinks(spec string) ([]Sink, error) {
+	var sinks []Sink
+	for _, kind := range strings.Split(spec, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case "":
+		case "kafka":
+			sinks = append(sinks, &kafkaSink{})
+		case "graphite":
+			addr := getEnv("GRAPHITE_ADDR", "")
+			if addr == "" {
+				return nil, fmt.Errorf("graphite sink requires GRAPHITE_ADDR")
+			}
+			sinks = append(sinks, newGraphiteSink(addr, getEnv("GRAPHITE_PATH_TEMPLATE", "verve.{metric}")))
+		case "redis_stream":
+			if redisDB == nil {
+				return nil, fmt.Errorf("redis_stream sink requires a Redis connection")
+			}
+			format, err := newPayloadSerializer(getEnv("REDIS_STREAM_FORMAT", "json"))
+			if err != nil {
+				return nil, fmt.Errorf("redis_stream sink: %w", err)
+			}
+			sinks = append(sinks, &redisStreamSink{
+				client: redisDB,
+				stream: getEnv("REDIS_STREAM_KEY", "verve:unique-id-count"),
+				maxLen: int64(getEnvInt("REDIS_STREAM_MAXLEN", 10000)),
+				format: format,
+			})
+		case "remote_write":
+			url := getEnv("REMOTE_WRITE_URL", "")
+			if url == "" {
+				return nil, fmt.Errorf("remote_write sink requires REMOTE_WRITE_URL")
+			}
+			sinks = append(sinks, newRemoteWriteSink(url,
+				getEnv("REMOTE_WRITE_JOB", "verve"),
+				getEnv("REMOTE_WRITE_BEARER_TOKEN", ""),
+				getEnv("REMOTE_WRITE_TENANT", ""),
+				getEnvDuration("REMOTE_WRITE_TIMEOUT", 10*time.Second),
+			))
+		case "file":
+			dir := getEnv("REPORT_DIR", "")
+			if dir == "" {
+				return nil, fmt.Errorf("file sink requires REPORT_DIR")
+			}
+			sink, err := newReportFileSink(dir, getEnvInt("REPORT_KEEP", 0))
+			if err != nil {
+				return nil, fmt.Errorf("file sink: %w", err)
+			}
+			// The files carry the full report, so the window's duplicates are counted for them
+			duplicates = newDuplicateTracker(getEnvInt("REPORT_TOP_K", 10))
+			sinks = append(sinks, sink)
+		case "region":
+			region := getEnv("REGION", "")
+			if region == "" || getEnv("KAFKA_BROKER", "") == "" {
+				return nil, fmt.Errorf("region sink requires REGION and KAFKA_BROKER")
+			}
+			if windowSketches == nil {
+				windowSketches = newWindowSketcher()
+			}
+			sinks = append(sinks, &regionSink{region: region, wait: getEnvDuration("REGION_SKETCH_WAIT", 2*time.Second)})
+		case "history":
+			store, err := newHistoryStore(getEnv("HISTORY_STORE", "bolt"), historyRetention())
+			if err != nil {
+				return nil, err
+			}
+			history = store
+			// The verify endpoint answers with the digest of each window's sketch
+			if windowSketches == nil {
+				windowSketches = newWindowSketcher()
+			}
+			sinks = append(sinks, historySink{store: store})
+		default:
+			return nil, fmt.Errorf("unknown sink %q", kind)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sink configured")
+	}
+	return sinks, nil
+}
+
+// hasSink reports whether a sink of the given kind is configured.
+func hasSink(sinks []Sink, name string) bool {
+	for _, s := range sinks {
+		if s.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// publishReport hands a window report to every sink; a failing sink doesn't stop the others.
+// With an outbox the report is stored first and failed sinks are retried.
+func publishReport(report windowReport) {
+	if reportOutbox != nil {
+		err := reportOutbox.add(ctx, report)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to store window in outbox, publishing directly: %v\n", err)
+	}
+	for _, s := range sinks {
+		if err := publishTo(ctx, s, report); err != nil {
+			log.Printf("Failed to publish window to %s sink: %v\n", s.Name(), err)
+		}
+	}
+}
+
+type kafkaSink struct {
+	mu sync.Mutex
+	// pending holds the windows whose report went out but whose tenant counts didn't, by
+	// period and timestamp, so the outbox's retry doesn't send the report again.
+	pending map[string]bool
+}
+
+func (*kafkaSink) Name() string { return "kafka" }
+
+func (s *kafkaSink) Publish(ctx context.Context, report windowReport) error {
+	window := report.Period + "@" + report.Timestamp
+	s.mu.Lock()
+	sent := s.pending[window]
+	s.mu.Unlock()
+	if !sent {
+		if err := publishToKafka(ctx, report); err != nil {
+			return err
+		}
+	}
+	err := publishTenantCounts(ctx, report)
+
+	// Only the outbox retries, so without one nothing would take a window out again
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil:
+		delete(s.pending, window)
+	case reportOutbox != nil:
+		if s.pending == nil {
+			s.pending = map[string]bool{}
+		}
+		s.pending[window] = true
+	}
+	return err
+}
+
+// historyRetention is how long the history keeps reports; downsampled history keeps its daily
+// reports forever unless HISTORY_RETENTION says otherwise.
+func historyRetention() time.Duration {
+	if getEnvBool("HISTORY_DOWNSAMPLE", false) {
+		return getEnvDuration("HISTORY_RETENTION", 0)
+	}
+	return getEnvDuration("HISTORY_RETENTION", 7*24*time.Hour)
+}
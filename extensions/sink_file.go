@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportFileSink writes every window report to a file of its own in dir, for batch jobs that
+// pick reports up from a directory. A file is written under a temporary name, fsynced and
+// renamed into place, and the directory is fsynced after the rename, so a reader listing
+// *.json only ever sees complete reports, also after a crash.
+type reportFileSink struct {
+	dir string
+	// keep is how many report files are kept; older ones are removed. 0 keeps every file.
+	keep int
+}
+
+func newReportFileSink(dir string, keep int) (*reportFileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &reportFileSink{dir: dir, keep: keep}, nil
+}
+
+func (s *reportFileSink) Name() string { return "file" }
+
+// reportFileName names the file of a report by its period and the end of its window in UTC,
+// e.g. window-20240101T120000Z.json, so the files sort by time.
+func reportFileName(report windowReport) string {
+	kind := report.Period
+	if kind == "" {
+		kind = "window"
+	}
+	stamp := strings.NewReplacer(":", "", "-", "").Replace(report.Timestamp)
+	if t, err := time.Parse(time.RFC3339, report.Timestamp); err == nil {
+		stamp = t.UTC().Format("20060102T150405Z")
+	}
+	return kind + "-" + stamp + ".json"
+}
+
+func (s *reportFileSink) Publish(ctx context.Context, report windowReport) error {
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := reportFileName(report)
+	if skipDryRun("file", "%s: %s", filepath.Join(s.dir, name), body) {
+		return nil
+	}
+
+	// The temporary file starts with a dot so it doesn't match *.json
+	tmp, err := os.CreateTemp(s.dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(body, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return fmt.Errorf("sync report directory: %w", err)
+	}
+	// The report is in place, so a failed cleanup mustn't have the outbox write it again
+	if err := s.rotate(); err != nil {
+		log.Printf("Failed to remove old report files from %s: %v\n", s.dir, err)
+	}
+	return nil
+}
+
+// rotate removes the oldest report files beyond s.keep.
+func (s *reportFileSink) rotate() error {
+	if s.keep <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil || len(files) <= s.keep {
+		return err
+	}
+	// Names sort by time within a period; older windows go first across periods too
+	sort.Slice(files, func(i, j int) bool {
+		return reportFileTime(files[i]) < reportFileTime(files[j])
+	})
+	for _, f := range files[:len(files)-s.keep] {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportFileTime is the timestamp part of a report file name.
+func reportFileTime(path string) string {
+	_, stamp, _ := strings.Cut(filepath.Base(path), "-")
+	return stamp
+}
+
+// syncDir fsyncs a directory, making the renames into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportFileRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newReportFileSink(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty directory named like an old report can't be removed by rotate
+	stuck := filepath.Join(dir, "window-20000101T000000Z.json")
+	if err := os.MkdirAll(filepath.Join(stuck, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report := windowReport{Timestamp: "2026-10-14T12:00:00Z"}
+	if err := s.Publish(context.Background(), report); err != nil {
+		t.Errorf("got %v for a report that was written, want the failed rotation only logged", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, reportFileName(report))); err != nil {
+		t.Errorf("the report isn't in place: %v", err)
+	}
+}
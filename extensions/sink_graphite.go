@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// graphiteSink writes window counts to Carbon using the plaintext protocol
+// ("<path> <value> <timestamp>\n"), one short-lived TCP connection per window.
+type graphiteSink struct {
+	addr     string
+	template string
+}
+
+// newGraphiteSink takes a path template like "verve.{instance}.{metric}"; {metric} expands to
+// unique_request_count, buckets.<bucket> or dimensions.<dimension>.<value>.
+func newGraphiteSink(addr, template string) *graphiteSink {
+	if !strings.Contains(template, "{metric}") {
+		template += ".{metric}"
+	}
+	return &graphiteSink{addr: addr, template: template}
+}
+
+func (g *graphiteSink) Name() string { return "graphite" }
+
+// graphiteComponent keeps the dots and whitespace of ids and metadata values out of the path.
+func graphiteComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+func (g *graphiteSink) path(metric ...string) string {
+	for i := range metric {
+		metric[i] = graphiteComponent(metric[i])
+	}
+	return strings.NewReplacer(
+		"{metric}", strings.Join(metric, "."),
+		"{instance}", graphiteComponent(instanceID()),
+	).Replace(g.template)
+}
+
+func (g *graphiteSink) Publish(ctx context.Context, report windowReport) error {
+	ts := time.Now()
+	if parsed, err := time.Parse(time.RFC3339, report.Timestamp); err == nil {
+		ts = parsed
+	}
+
+	var buf bytes.Buffer
+	line := func(path string, value int) {
+		fmt.Fprintf(&buf, "%s %d %d\n", path, value, ts.Unix())
+	}
+	if report.Period != "" {
+		line(g.path("rollup", report.Period, "unique_request_count"), report.UniqueRequestCount)
+		return g.write(ctx, buf.Bytes())
+	}
+	line(g.path("unique_request_count"), report.UniqueRequestCount)
+	for _, name := range sortedKeys(report.Buckets) {
+		line(g.path("buckets", name), report.Buckets[name])
+	}
+	for _, dim := range sortedKeys(report.Dimensions) {
+		for _, value := range sortedKeys(report.Dimensions[dim]) {
+			line(g.path("dimensions", dim, value), report.Dimensions[dim][value])
+		}
+	}
+
+	return g.write(ctx, buf.Bytes())
+}
+
+func (g *graphiteSink) write(ctx context.Context, lines []byte) error {
+	if skipDryRun("graphite", "%s", bytes.TrimSpace(lines)) {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", g.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(lines)
+	return err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
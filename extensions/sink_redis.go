@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStreamSink appends window reports to a Redis Stream, a lightweight alternative to Kafka
+// for deployments that already run Redis. The stream is capped at roughly maxLen entries.
+type redisStreamSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+	format payloadSerializer
+}
+
+func (s *redisStreamSink) Name() string { return "redis_stream" }
+
+func (s *redisStreamSink) Publish(ctx context.Context, report windowReport) error {
+	message, err := s.format.Report(report)
+	if err != nil {
+		return err
+	}
+
+	if skipDryRun("redis_stream", "%s %s", s.stream, printablePayload(s.format, message)) {
+		return nil
+	}
+
+	// The count and timestamp are duplicated as plain fields so XRANGE output is readable
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"unique_request_count": report.UniqueRequestCount,
+			"timestamp":            report.Timestamp,
+			"report":               message,
+		},
+	}).Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSink pushes window counts to a Prometheus remote-write receiver (Mimir, Thanos
+// Receive, Prometheus with --web.enable-remote-write-receiver), for environments that don't
+// scrape. Every report becomes one sample per series, stamped with the report's time:
+//
+//	verve_unique_request_count{period="minute|hour|day"}
+//	verve_unique_request_count_by_id_bucket{id_bucket}
+//	verve_unique_request_count_by_dimension{dimension, value}
+//	verve_unique_request_count_by_tenant{tenant}
+//
+// all with job (REMOTE_WRITE_JOB) and backend; instance is left out so that replicas taking
+// over the leadership continue the same series.
+type remoteWriteSink struct {
+	url    string
+	job    string
+	token  string
+	tenant string
+	client *http.Client
+}
+
+func newRemoteWriteSink(url, job, token, tenant string, timeout time.Duration) *remoteWriteSink {
+	return &remoteWriteSink{url: url, job: job, token: token, tenant: tenant, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *remoteWriteSink) Name() string { return "remote_write" }
+
+type remoteWriteSeries struct {
+	labels map[string]string
+	value  int
+}
+
+func (s *remoteWriteSink) series(report windowReport) []remoteWriteSeries {
+	base := func(name string, labels ...string) map[string]string {
+		m := map[string]string{"__name__": name, "job": s.job, "backend": report.Backend}
+		for i := 0; i+1 < len(labels); i += 2 {
+			m[labels[i]] = labels[i+1]
+		}
+		return m
+	}
+	period := report.Period
+	if period == "" {
+		period = "minute"
+	}
+	series := []remoteWriteSeries{{labels: base("verve_unique_request_count", "period", period), value: report.UniqueRequestCount}}
+	for _, name := range sortedKeys(report.Buckets) {
+		series = append(series, remoteWriteSeries{labels: base("verve_unique_request_count_by_id_bucket", "id_bucket", name), value: report.Buckets[name]})
+	}
+	for _, dim := range sortedKeys(report.Dimensions) {
+		for _, value := range sortedKeys(report.Dimensions[dim]) {
+			series = append(series, remoteWriteSeries{labels: base("verve_unique_request_count_by_dimension", "dimension", dim, "value", value), value: report.Dimensions[dim][value]})
+		}
+	}
+	for _, tenant := range sortedKeys(report.Tenants) {
+		series = append(series, remoteWriteSeries{labels: base("verve_unique_request_count_by_tenant", "tenant", tenant), value: report.Tenants[tenant]})
+	}
+	return series
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest by hand, like the protobuf payload:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// Receivers require the labels of a series sorted by name.
+func encodeWriteRequest(series []remoteWriteSeries, at time.Time) []byte {
+	var b []byte
+	for _, s := range series {
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var ts []byte
+		for _, name := range names {
+			var label []byte
+			label = protobufString(label, 1, name)
+			label = protobufString(label, 2, s.labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(float64(s.value)))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(at.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+func (s *remoteWriteSink) Publish(ctx context.Context, report windowReport) error {
+	series := s.series(report)
+	if skipDryRun("remote_write", "%d series to %s", len(series), s.url) {
+		return nil
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(series, reportTime(report)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "verve/"+currentBuild().Version)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if s.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenant)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("remote write answered %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		// The receiver rejected the samples themselves, sending them again gets the same answer
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteWritePermanentErrors(t *testing.T) {
+	for status, permanent := range map[int]bool{400: true, 404: true, 429: false, 503: false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		s := &remoteWriteSink{url: server.URL, client: server.Client()}
+		err := s.Publish(context.Background(), windowReport{Timestamp: "2026-10-14T07:00:00Z"})
+		server.Close()
+		if err == nil || errors.As(err, &permanentError{}) != permanent {
+			t.Errorf("got %v for %d, want permanent %v", err, status, permanent)
+		}
+	}
+}
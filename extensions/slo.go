@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencySLO is set with SLO_LATENCY: the share of API requests, SLO_TARGET, that should be
+// answered within it.
+var latencySLO *sloTracker
+
+// sloWindows are the compliance windows /slo and the burn rate gauges report.
+var sloWindows = []struct {
+	name   string
+	length time.Duration
+}{{"1h", time.Hour}, {"6h", 6 * time.Hour}, {"24h", 24 * time.Hour}}
+
+// sloTracker counts good and bad requests per minute over the longest window. A request is
+// good when it was answered within the latency threshold without a 5xx; 4xx are the caller's
+// error and don't burn the budget.
+type sloTracker struct {
+	threshold time.Duration
+	// target is the objective as a fraction, e.g. 0.99.
+	target float64
+
+	mu      sync.Mutex
+	minutes [24 * 60]sloMinute
+}
+
+type sloMinute struct {
+	// start is the Unix minute the counts belong to; older counts in the slot are stale.
+	start int64
+	total int64
+	bad   int64
+}
+
+func newSLOTracker(threshold time.Duration, target float64) *sloTracker {
+	return &sloTracker{threshold: threshold, target: target}
+}
+
+// parseSLOTarget parses SLO_TARGET, a percentage such as 99 or 99.9.
+func parseSLOTarget(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || percent <= 0 || percent >= 100 {
+		return 0, fmt.Errorf("SLO target %q must be a percentage between 0 and 100, e.g. 99.9", s)
+	}
+	return percent / 100, nil
+}
+
+func (t *sloTracker) record(now time.Time, latency time.Duration, status int) {
+	good := latency <= t.threshold && status < 500
+	outcome := "good"
+	if !good {
+		outcome = "bad"
+	}
+	sloRequests.WithLabelValues(outcome).Inc()
+
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := &t.minutes[minute%int64(len(t.minutes))]
+	if slot.start != minute {
+		*slot = sloMinute{start: minute}
+	}
+	slot.total++
+	if !good {
+		slot.bad++
+	}
+}
+
+type sloWindowReport struct {
+	Window   string `json:"window"`
+	Requests int64  `json:"requests"`
+	Bad      int64  `json:"bad"`
+	// Compliance is the share of good requests; 1 without requests.
+	Compliance float64 `json:"compliance"`
+	// BurnRate is how fast the error budget is spent: 1 uses it up exactly over the window.
+	BurnRate float64 `json:"burn_rate"`
+	// BudgetRemaining is the share of the window's error budget left, negative once overspent.
+	BudgetRemaining float64 `json:"error_budget_remaining"`
+	Met             bool    `json:"met"`
+}
+
+func (t *sloTracker) window(name string, length time.Duration, now time.Time) sloWindowReport {
+	from := now.Add(-length).Unix() / 60
+	report := sloWindowReport{Window: name}
+	t.mu.Lock()
+	for _, m := range t.minutes {
+		if m.start > from && m.start <= now.Unix()/60 {
+			report.Requests += m.total
+			report.Bad += m.bad
+		}
+	}
+	t.mu.Unlock()
+
+	report.Compliance, report.BudgetRemaining = 1, 1
+	if report.Requests > 0 {
+		badShare := float64(report.Bad) / float64(report.Requests)
+		report.Compliance = 1 - badShare
+		report.BurnRate = badShare / (1 - t.target)
+		report.BudgetRemaining = 1 - report.BurnRate
+	}
+	report.Met = report.Compliance >= t.target
+	return report
+}
+
+// run keeps the burn rate gauges current.
+func (t *sloTracker) run(runCtx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, w := range sloWindows {
+			report := t.window(w.name, w.length, now)
+			sloBurnRate.WithLabelValues(w.name).Set(report.BurnRate)
+			sloBudgetRemaining.WithLabelValues(w.name).Set(report.BudgetRemaining)
+		}
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sloTracked records the latency and status of API requests against latencySLO.
+func sloTracked(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := latencySLO
+		if t == nil {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		t.record(time.Now(), time.Since(start), rec.status)
+	}
+}
+
+// Summarize compliance with the latency SLO over the last 1h, 6h and 24h
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	t := latencySLO
+	if t == nil {
+		http.Error(w, "No latency SLO is configured, set SLO_LATENCY", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	windows := make([]sloWindowReport, len(sloWindows))
+	for i, sw := range sloWindows {
+		windows[i] = t.window(sw.name, sw.length, now)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"objective": fmt.Sprintf("%g%% of API requests within %v without a 5xx", t.target*100, t.threshold),
+		"latency":   t.threshold.String(),
+		"target":    t.target,
+		"windows":   windows,
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSLORecord(t *testing.T) {
+	tr := newSLOTracker(100*time.Millisecond, 0.99)
+	good, bad := testutil.ToFloat64(sloRequests.WithLabelValues("good")), testutil.ToFloat64(sloRequests.WithLabelValues("bad"))
+	now := time.Now()
+	tr.record(now, 10*time.Millisecond, http.StatusOK)
+	tr.record(now, time.Second, http.StatusOK)
+	tr.record(now, 10*time.Millisecond, http.StatusServiceUnavailable)
+
+	if got := testutil.ToFloat64(sloRequests.WithLabelValues("good")) - good; got != 1 {
+		t.Errorf("got %v good requests, want 1", got)
+	}
+	if got := testutil.ToFloat64(sloRequests.WithLabelValues("bad")) - bad; got != 2 {
+		t.Errorf("got %v bad requests, want the slow one and the 503", got)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { tr.record(now, time.Millisecond, http.StatusOK) }); allocs > 0 {
+		t.Errorf("record allocates %v times per request", allocs)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Replication stream operations.
+const (
+	replicateAdd    = "add"
+	replicateRemove = "remove"
+	replicateFlush  = "flush"
+)
+
+type replicationOp struct {
+	op  string
+	key string
+	// tenant names the tenant window changed, empty for the service window.
+	tenant string
+}
+
+// windowReplicator runs warm standby (STANDBY): the leader appends every change to its local
+// dedupe window to a Redis stream, and every other instance tails the stream into its own
+// backend without serving traffic. When the leader dies mid-window, the instance that wins the
+// election already holds the window, applies what it hasn't read yet and takes over.
+// The stream is trimmed at every flush, so it only ever holds the current window.
+type windowReplicator struct {
+	client *redis.Client
+	stream string
+	queue  chan replicationOp
+	// lastID is the last stream entry applied or written by this instance.
+	lastID string
+}
+
+func newWindowReplicator(client *redis.Client, stream string, queueSize int) *windowReplicator {
+	return &windowReplicator{client: client, stream: stream, queue: make(chan replicationOp, queueSize), lastID: "0"}
+}
+
+// replicate queues a change of the leader's window; a full queue drops it rather than slow
+// the request down, and the standby then undercounts.
+func (s *windowReplicator) replicate(op, key string) {
+	s.replicateTenant("", op, key)
+}
+
+// replicateTenant is replicate for the window of tenant. Standbys close their copies of
+// tenant windows on their own tickers, so only adds need replicating.
+func (s *windowReplicator) replicateTenant(tenant, op, key string) {
+	if s == nil || !coordinator.IsLeader() {
+		return
+	}
+	select {
+	case s.queue <- replicationOp{op: op, key: key, tenant: tenant}:
+	default:
+		replicationDropped.Inc()
+	}
+}
+
+// run tails the stream while this instance is a standby and writes the queue to it while it is
+// the leader. Becoming leader first applies the rest of the stream, so that nothing the old
+// leader replicated is lost.
+func (s *windowReplicator) run(runCtx context.Context) error {
+	standby := true
+	for runCtx.Err() == nil {
+		if !coordinator.IsLeader() {
+			if !standby {
+				s.discardQueue()
+				standby = true
+			}
+			if err := s.tail(runCtx, time.Second); err != nil && runCtx.Err() == nil {
+				log.Printf("Failed to tail window replication stream: %v\n", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		if standby {
+			start := time.Now()
+			if err := s.tail(runCtx, -1); err != nil && runCtx.Err() == nil {
+				log.Printf("Failed to catch up on window replication stream: %v\n", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			log.Printf("Leading with the replicated window after %v of catching up\n", time.Since(start))
+			standby = false
+		}
+		select {
+		case <-runCtx.Done():
+		case op := <-s.queue:
+			s.write(runCtx, op)
+		}
+	}
+	return nil
+}
+
+// discardQueue drops the changes queued while this instance was still the leader; its
+// successor never saw them in the window.
+func (s *windowReplicator) discardQueue() {
+	for {
+		select {
+		case <-s.queue:
+		default:
+			return
+		}
+	}
+}
+
+// tail applies new stream entries to the local window, waiting up to block for them; a negative
+// block reads what is there without waiting.
+func (s *windowReplicator) tail(runCtx context.Context, block time.Duration) error {
+	for {
+		args := &redis.XReadArgs{Streams: []string{s.stream, s.lastID}, Count: 1000, Block: block}
+		streams, err := s.client.XRead(runCtx, args).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				s.apply(runCtx, msg.Values)
+				s.lastID = msg.ID
+			}
+		}
+		if block >= 0 {
+			return nil
+		}
+	}
+}
+
+func (s *windowReplicator) apply(runCtx context.Context, values map[string]interface{}) {
+	key, _ := values["key"].(string)
+	var err error
+	if tenant, _ := values["tenant"].(string); tenant != "" {
+		// A tenant whose window this standby hasn't started yet is counted from its first tick
+		if w := tenantWindows.lookup(tenant); w != nil && values["op"] == replicateAdd {
+			if _, err = w.dedup.Add(runCtx, key); err != nil {
+				log.Printf("Failed to apply replicated add to the window of tenant %s: %v\n", tenant, err)
+				return
+			}
+			replicationApplied.Inc()
+		}
+		return
+	}
+	switch values["op"] {
+	case replicateAdd:
+		_, err = dedup.Add(runCtx, key)
+	case replicateRemove:
+		if remover, ok := dedup.(Remover); ok {
+			_, err = remover.Remove(runCtx, key)
+		}
+	case replicateFlush:
+		_, err = dedup.Flush(runCtx)
+	}
+	if err != nil {
+		log.Printf("Failed to apply replicated %v: %v\n", values["op"], err)
+		return
+	}
+	replicationApplied.Inc()
+}
+
+// write appends op and whatever else is queued to the stream in one pipeline, and trims the
+// stream up to a flush so that it starts with the current window.
+func (s *windowReplicator) write(runCtx context.Context, first replicationOp) {
+	ops := []replicationOp{first}
+collect:
+	for len(ops) < 1000 {
+		select {
+		case op := <-s.queue:
+			ops = append(ops, op)
+		default:
+			break collect
+		}
+	}
+
+	cmds := make([]*redis.StringCmd, len(ops))
+	_, err := s.client.Pipelined(runCtx, func(pipe redis.Pipeliner) error {
+		for i, op := range ops {
+			values := map[string]interface{}{"op": op.op, "key": op.key}
+			if op.tenant != "" {
+				values["tenant"] = op.tenant
+			}
+			cmds[i] = pipe.XAdd(runCtx, &redis.XAddArgs{Stream: s.stream, Values: values})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to replicate %d window changes: %v\n", len(ops), err)
+		return
+	}
+	for i, op := range ops {
+		s.lastID = cmds[i].Val()
+		if op.op == replicateFlush {
+			if err := s.client.XTrimMinID(runCtx, s.stream, s.lastID).Err(); err != nil {
+				log.Printf("Failed to trim window replication stream: %v\n", err)
+			}
+		}
+	}
+}
+
+// standbyGate answers 503 while this instance is a warm standby, so that load balancer health
+// checks keep traffic on the leader.
+func standbyGate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if replicator == nil || coordinator.IsLeader() {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		const message = "This instance is a standby, send requests to the leader"
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			writeErrorV2(w, http.StatusServiceUnavailable, "standby", message)
+			return
+		}
+		http.Error(w, message, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestReplicateTenantWindow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	dedupeKey, _ = parseKeyStrategy("id")
+	leader := newWindowReplicator(client, "verve:window:replication", 10)
+	replicator = leader
+	defer func() { replicator, tenantWindows = nil, nil }()
+	ctx := context.Background()
+
+	window := func() *tenantWindow {
+		tenantWindows = newTenantWindowSet(time.Minute)
+		w := &tenantWindow{tenant: "acme", interval: 5 * time.Minute, dedup: newCuckooDeduplicator(1024)}
+		tenantWindows.windows["acme"] = w
+		return w
+	}
+	if added, _ := window().add(ctx, dedupeInput{id: 1, tenant: "acme"}); !added {
+		t.Fatal("first add wasn't new")
+	}
+	leader.write(ctx, <-leader.queue)
+
+	// A standby applies the add to its own copy of the tenant's window
+	w := window()
+	if err := newWindowReplicator(client, leader.stream, 10).tail(ctx, -1); err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := w.dedup.Add(ctx, storedKey(dedupeInput{id: 1, tenant: "acme"})); added {
+		t.Error("the standby's tenant window doesn't hold the replicated id")
+	}
+}
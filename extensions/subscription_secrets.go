@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// subscriptionSealer encrypts the auth secrets of subscriptions in their store; nil without
+// SUBSCRIPTION_SECRET_KEY, which leaves subscriptions without auth.
+var subscriptionSealer *secretSealer
+
+// sealedPrefix marks a sealed secret, followed by the base64 of the nonce and the ciphertext.
+const sealedPrefix = "sealed:v1:"
+
+var errSecretKeyMissing = errors.New("a subscription secret is sealed, but SUBSCRIPTION_SECRET_KEY isn't set")
+
+// secretSealer seals secrets with AES-256-GCM, bound to the id of what they belong to, so a
+// sealed value copied to another subscription doesn't open.
+type secretSealer struct {
+	aead cipher.AEAD
+}
+
+func newSecretSealer(key string) (*secretSealer, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("SUBSCRIPTION_SECRET_KEY must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretSealer{aead: aead}, nil
+}
+
+func (s *secretSealer) seal(secret, id string) string {
+	if secret == "" {
+		return ""
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(secret), []byte(id)))
+}
+
+// open returns the secret sealed in value. Values without the prefix were stored before
+// secrets were sealed and are returned as they are.
+func (s *secretSealer) open(value, id string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	if s == nil {
+		return "", errSecretKeyMissing
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(raw) < s.aead.NonceSize() {
+		return "", fmt.Errorf("malformed sealed secret")
+	}
+	n := s.aead.NonceSize()
+	secret, err := s.aead.Open(nil, raw[:n], raw[n:], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("failed to open a sealed secret, was SUBSCRIPTION_SECRET_KEY changed? %w", err)
+	}
+	return string(secret), nil
+}
+
+// sealedSubscriptions seals the auth secrets of the subscriptions it puts into store and opens
+// them again on the way out, so the store never holds them in the clear.
+type sealedSubscriptions struct {
+	store  subscriptionStore
+	sealer *secretSealer
+}
+
+// List leaves out the subscriptions whose secrets don't open, so the others are still listed and
+// notified; those can be deleted by id.
+func (s sealedSubscriptions) List(ctx context.Context) ([]subscription, error) {
+	list, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opened := list[:0]
+	for _, sub := range list {
+		if err := s.openAuth(&sub); err != nil {
+			log.Printf("Leaving out subscription %s: %v\n", sub.ID, err)
+			continue
+		}
+		opened = append(opened, sub)
+	}
+	return opened, nil
+}
+
+func (s sealedSubscriptions) Get(ctx context.Context, id string) (subscription, error) {
+	sub, err := s.store.Get(ctx, id)
+	if err != nil {
+		return sub, err
+	}
+	return sub, s.openAuth(&sub)
+}
+
+func (s sealedSubscriptions) Put(ctx context.Context, sub subscription) error {
+	if a := sub.Auth; a != nil {
+		if s.sealer == nil {
+			return fmt.Errorf("subscription auth needs SUBSCRIPTION_SECRET_KEY")
+		}
+		sealed := *a
+		sealed.Token = s.sealer.seal(a.Token, sub.ID)
+		sealed.Password = s.sealer.seal(a.Password, sub.ID)
+		sealed.Value = s.sealer.seal(a.Value, sub.ID)
+		sub.Auth = &sealed
+	}
+	return s.store.Put(ctx, sub)
+}
+
+func (s sealedSubscriptions) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, id)
+}
+
+func (s sealedSubscriptions) openAuth(sub *subscription) error {
+	a := sub.Auth
+	if a == nil {
+		return nil
+	}
+	var err error
+	for _, secret := range []*string{&a.Token, &a.Password, &a.Value} {
+		if *secret, err = s.sealer.open(*secret, sub.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
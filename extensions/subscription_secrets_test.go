@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// mapSubscriptionStore keeps subscriptions as JSON, like the stores do.
+type mapSubscriptionStore map[string][]byte
+
+func (m mapSubscriptionStore) List(ctx context.Context) ([]subscription, error) {
+	var list []subscription
+	for id := range m {
+		s, _ := m.Get(ctx, id)
+		list = append(list, s)
+	}
+	return list, nil
+}
+func (m mapSubscriptionStore) Get(_ context.Context, id string) (subscription, error) {
+	var s subscription
+	if m[id] == nil {
+		return s, errSubscriptionNotFound
+	}
+	return s, json.Unmarshal(m[id], &s)
+}
+func (m mapSubscriptionStore) Put(_ context.Context, s subscription) error {
+	m[s.ID], _ = json.Marshal(s)
+	return nil
+}
+func (m mapSubscriptionStore) Delete(_ context.Context, id string) error {
+	delete(m, id)
+	return nil
+}
+
+func TestSealedSubscriptions(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	sealer, err := newSecretSealer(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := mapSubscriptionStore{}
+	store := sealedSubscriptions{store: inner, sealer: sealer}
+	ctx := context.Background()
+
+	sub := subscription{ID: "sub_1", URL: "https://example.com/hook", Auth: &subscriptionAuth{Type: "bearer", Token: "s3cret-token"}}
+	if err := store.Put(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(inner["sub_1"]), "s3cret-token") {
+		t.Fatalf("the store holds the token in the clear: %s", inner["sub_1"])
+	}
+	if sub.Auth.Token != "s3cret-token" {
+		t.Errorf("Put changed the caller's subscription to %q", sub.Auth.Token)
+	}
+	got, err := store.Get(ctx, "sub_1")
+	if err != nil || got.Auth.Token != "s3cret-token" {
+		t.Errorf("got token %q, %v, want s3cret-token", got.Auth.Token, err)
+	}
+
+	// A sealed secret copied to another subscription doesn't open
+	inner["sub_2"] = []byte(strings.Replace(string(inner["sub_1"]), "sub_1", "sub_2", 1))
+	if _, err := store.Get(ctx, "sub_2"); err == nil {
+		t.Error("opened a secret sealed for another subscription")
+	}
+	delete(inner, "sub_2")
+
+	// Secrets stored before sealing are read as they are, and need the key once sealed
+	inner.Put(ctx, subscription{ID: "sub_3", Auth: &subscriptionAuth{Type: "header", Header: "X-Token", Value: "plain"}})
+	if got, err := store.Get(ctx, "sub_3"); err != nil || got.Auth.Value != "plain" {
+		t.Errorf("got value %q, %v for a secret stored in the clear, want plain", got.Auth.Value, err)
+	}
+	if list, err := (sealedSubscriptions{store: inner}).List(ctx); err != nil || len(list) != 1 || list[0].ID != "sub_3" {
+		t.Errorf("got %v, %v without the key, want only the subscription stored in the clear", list, err)
+	}
+}
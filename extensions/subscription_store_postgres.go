@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresSubscriptionStore keeps subscriptions as JSONB documents.
+type postgresSubscriptionStore struct {
+	pool *pgxpool.Pool
+}
+
+func newPostgresSubscriptionStore(ctx context.Context, dsn string) (*postgresSubscriptionStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS verve_subscriptions (
+		id TEXT PRIMARY KEY,
+		doc JSONB NOT NULL
+	)`)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create postgres subscription table: %w", err)
+	}
+	return &postgresSubscriptionStore{pool: pool}, nil
+}
+
+func (s *postgresSubscriptionStore) List(ctx context.Context) ([]subscription, error) {
+	rows, err := s.pool.Query(ctx, `SELECT doc FROM verve_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []subscription{}
+	for rows.Next() {
+		var sub subscription
+		if err := rows.Scan(&sub); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *postgresSubscriptionStore) Get(ctx context.Context, id string) (subscription, error) {
+	var sub subscription
+	err := s.pool.QueryRow(ctx, `SELECT doc FROM verve_subscriptions WHERE id = $1`, id).Scan(&sub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return subscription{}, errSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (s *postgresSubscriptionStore) Put(ctx context.Context, sub subscription) error {
+	doc, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `INSERT INTO verve_subscriptions (id, doc) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET doc = EXCLUDED.doc`, sub.ID, doc)
+	return err
+}
+
+func (s *postgresSubscriptionStore) Delete(ctx context.Context, id string) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM verve_subscriptions WHERE id = $1`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errSubscriptionNotFound
+	}
+	return err
+}
+
+func (s *postgresSubscriptionStore) Close() error {
+	s.pool.Close()
+	return nil
+}
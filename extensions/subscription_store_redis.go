@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisSubscriptionsKey = "verve:subscriptions"
+
+// redisSubscriptionStore keeps every subscription as a JSON field of one hash.
+type redisSubscriptionStore struct {
+	client *redis.Client
+}
+
+func (s *redisSubscriptionStore) List(ctx context.Context) ([]subscription, error) {
+	all, err := s.client.HGetAll(ctx, redisSubscriptionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]subscription, 0, len(all))
+	for _, value := range all {
+		var sub subscription
+		if err := json.Unmarshal([]byte(value), &sub); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+func (s *redisSubscriptionStore) Get(ctx context.Context, id string) (subscription, error) {
+	value, err := s.client.HGet(ctx, redisSubscriptionsKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return subscription{}, errSubscriptionNotFound
+	}
+	if err != nil {
+		return subscription{}, err
+	}
+
+	var sub subscription
+	err = json.Unmarshal([]byte(value), &sub)
+	return sub, err
+}
+
+func (s *redisSubscriptionStore) Put(ctx context.Context, sub subscription) error {
+	value, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, redisSubscriptionsKey, sub.ID, value).Err()
+}
+
+func (s *redisSubscriptionStore) Delete(ctx context.Context, id string) error {
+	removed, err := s.client.HDel(ctx, redisSubscriptionsKey, id).Result()
+	if err == nil && removed == 0 {
+		return errSubscriptionNotFound
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+// subscriptions are the endpoints notified of every window; nil without SUBSCRIPTION_STORE.
+var subscriptions subscriptionStore
+
+// endpointParam is NOTIFY_ENDPOINT_PARAM: whether accept requests may still name an endpoint to
+// notify of the current count, which subscriptions replace. It is off unless turned on.
+var endpointParam = false
+
+// subscription is an endpoint notified of every window, managed through the admin API instead
+// of being passed with each accept request.
+type subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Auth is sent with every notification; nil sends none.
+	Auth *subscriptionAuth `json:"auth,omitempty"`
+	// Format is the payload format; empty uses NOTIFY_FORMAT and NOTIFY_HOST_FORMATS.
+	Format  string              `json:"format,omitempty"`
+	Filters subscriptionFilters `json:"filters,omitempty"`
+	// Paused subscriptions are kept but not notified.
+	Paused    bool      `json:"paused,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// subscriptionAuth is how notifications authenticate: a bearer token, basic auth or a header of
+// the subscriber's choosing.
+type subscriptionAuth struct {
+	Type     string `json:"type"`
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Header   string `json:"header,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+// subscriptionFilters pick the windows a subscription is notified of.
+type subscriptionFilters struct {
+	// Tenants restricts the count to the ids these tenants sent in the window.
+	Tenants []string `json:"tenants,omitempty"`
+	// MinCount skips windows with a lower count.
+	MinCount int `json:"min_count,omitempty"`
+}
+
+func (s subscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'url' must be an absolute http or https URL")
+	}
+	if s.Format != "" {
+		if _, err := newPayloadSerializer(s.Format); err != nil {
+			return fmt.Errorf("'format': %v", err)
+		}
+	}
+	if a := s.Auth; a != nil {
+		switch {
+		case subscriptionSealer == nil:
+			return fmt.Errorf("'auth' needs SUBSCRIPTION_SECRET_KEY, secrets are only stored encrypted")
+		case a.Type == "bearer" && a.Token == "":
+			return fmt.Errorf("bearer 'auth' requires a 'token'")
+		case a.Type == "basic" && a.Username == "":
+			return fmt.Errorf("basic 'auth' requires a 'username'")
+		case a.Type == "header" && (a.Header == "" || strings.ContainsAny(a.Header, " :\r\n") || a.Value == ""):
+			return fmt.Errorf("header 'auth' requires a 'header' and a 'value'")
+		case a.Type != "bearer" && a.Type != "basic" && a.Type != "header":
+			return fmt.Errorf("'auth.type' must be bearer, basic or header")
+		}
+	}
+	if len(s.Filters.Tenants) > 0 && !tenantCountsComplete() {
+		return fmt.Errorf("'filters.tenants' needs COORDINATOR=none, the leader's tenant counts only hold the ids it accepted itself")
+	}
+	for _, t := range s.Filters.Tenants {
+		if !tenantIDPattern.MatchString(t) {
+			return fmt.Errorf("'filters.tenants' must be tenant ids")
+		}
+	}
+	if s.Filters.MinCount < 0 {
+		return fmt.Errorf("'filters.min_count' must not be negative")
+	}
+	return nil
+}
+
+// tenantCountsComplete tells whether a window report's tenant counts cover every id of the
+// window: they are kept per instance, so only without a coordinator.
+func tenantCountsComplete() bool {
+	_, single := coordinator.(localCoordinator)
+	return single || coordinator == nil
+}
+
+// header returns the headers authenticating a notification.
+func (a *subscriptionAuth) header() http.Header {
+	if a == nil {
+		return nil
+	}
+	header := http.Header{}
+	switch a.Type {
+	case "bearer":
+		header.Set("Authorization", "Bearer "+a.Token)
+	case "basic":
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(a.Username, a.Password)
+	case "header":
+		header.Set(a.Header, a.Value)
+	}
+	return header
+}
+
+// notification returns what the subscription is sent for a window report, like an endpoint
+// notification without the breakdowns, and false when its filters skip the window.
+func (s subscription) notification(report windowReport) (windowReport, bool) {
+	note := windowReport{
+		UniqueRequestCount: report.UniqueRequestCount,
+		Timestamp:          report.Timestamp,
+		Version:            report.Version,
+		GitSHA:             report.GitSHA,
+		InstanceID:         report.InstanceID,
+		Backend:            report.Backend,
+		Approximate:        report.Approximate,
+	}
+	if len(s.Filters.Tenants) > 0 {
+		note.UniqueRequestCount = 0
+		note.Tenants = map[string]int{}
+		for _, t := range s.Filters.Tenants {
+			note.UniqueRequestCount += report.Tenants[t]
+			note.Tenants[t] = report.Tenants[t]
+		}
+	}
+	return note, note.UniqueRequestCount >= s.Filters.MinCount
+}
+
+// subscriptionStore persists subscriptions, so they survive restarts and are shared by replicas.
+type subscriptionStore interface {
+	List(ctx context.Context) ([]subscription, error)
+	// Get returns errSubscriptionNotFound for unknown subscriptions.
+	Get(ctx context.Context, id string) (subscription, error)
+	// Put creates or replaces a subscription.
+	Put(ctx context.Context, s subscription) error
+	Delete(ctx context.Context, id string) error
+}
+
+func newSubscriptionStore(kind string) (subscriptionStore, error) {
+	switch kind {
+	case "redis":
+		if redisDB == nil {
+			return nil, fmt.Errorf("redis subscription store requires a Redis connection")
+		}
+		return &redisSubscriptionStore{client: redisDB}, nil
+	case "postgres":
+		return newPostgresSubscriptionStore(ctx, getEnv("POSTGRES_DSN", ""))
+	default:
+		return nil, fmt.Errorf("unknown subscription store %q", kind)
+	}
+}
+
+func newSubscriptionID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return "sub_" + hex.EncodeToString(buf)
+}
+
+// notifySubscribers queues a window's notification for every active subscription. The
+// reporting leader calls it once per window, so replicas don't notify subscribers twice, and
+// it is also where the window is added to the trends.
+func notifySubscribers(report windowReport) {
+	trends.observe(report)
+	if subscriptions == nil || report.Period != "" {
+		return
+	}
+	listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	list, err := subscriptions.List(listCtx)
+	if err != nil {
+		log.Printf("Failed to list subscriptions, not notifying them of the window ending %s: %v\n", report.Timestamp, err)
+		return
+	}
+	for i := range list {
+		s := &list[i]
+		if s.Paused {
+			continue
+		}
+		// Filters stored before a coordinator was configured would undercount
+		if len(s.Filters.Tenants) > 0 && !tenantCountsComplete() {
+			subscriptionNotifications.WithLabelValues("filtered").Inc()
+			continue
+		}
+		note, ok := s.notification(report)
+		if !ok {
+			subscriptionNotifications.WithLabelValues("filtered").Inc()
+			continue
+		}
+		note.Trend = trends.trend(note.UniqueRequestCount, report.Timestamp, s.Filters.Tenants)
+		if !notifications.enqueueNote(notification{endpoint: s.URL, subscription: s, report: note}) {
+			subscriptionNotifications.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+func sendToSubscription(s *subscription, report windowReport) {
+	format := notifyFormat.forEndpoint(s.URL)
+	if s.Format != "" {
+		format, _ = newPayloadSerializer(s.Format)
+	}
+	switch status := postNotification(s.URL, format, s.Auth.header(), report); {
+	case dryRun:
+	case status == 0:
+		subscriptionNotifications.WithLabelValues("failed").Inc()
+	case status >= 300:
+		subscriptionNotifications.WithLabelValues("rejected").Inc()
+	default:
+		subscriptionNotifications.WithLabelValues("sent").Inc()
+	}
+}
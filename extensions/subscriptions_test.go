@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEndpointParamOffByDefault(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	accept := func(body string) int {
+		resp, err := http.Post(h.Server.URL+"/api/v2/verve/accept", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := accept(`{"id": 1, "endpoint": "http://127.0.0.1:1/hook"}`); code != http.StatusBadRequest {
+		t.Errorf("got %d for an endpoint by default, want 400", code)
+	}
+	endpointParam = true
+	defer func() { endpointParam = false }()
+	if code := accept(`{"id": 1, "endpoint": "http://127.0.0.1:1/hook"}`); code != http.StatusOK {
+		t.Errorf("got %d for an endpoint with NOTIFY_ENDPOINT_PARAM=true, want 200", code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotas enforces the tenants' quotas; nil without TENANT_STORE.
+var quotas *tenantQuotas
+
+// tenantQuotas keeps the quotas of the tenant store, refreshed every refresh and right away
+// when the admin API changes one here, and turns a tenant's accepts away once this instance
+// counted its quota of new ids in the tenant's current window. Counts are kept per instance
+// like the tenant breakdown, so across n replicas a tenant gets up to n times its quota.
+type tenantQuotas struct {
+	refresh time.Duration
+
+	mu     sync.RWMutex
+	quotas map[string]int
+}
+
+func newTenantQuotas(refresh time.Duration) *tenantQuotas {
+	return &tenantQuotas{refresh: refresh, quotas: map[string]int{}}
+}
+
+func (q *tenantQuotas) run(runCtx context.Context) error {
+	ticker := time.NewTicker(q.refresh)
+	defer ticker.Stop()
+	for {
+		q.load(runCtx)
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// load replaces the quotas with the tenant store's; a failed read keeps the ones loaded before.
+func (q *tenantQuotas) load(runCtx context.Context) {
+	listCtx, cancel := context.WithTimeout(runCtx, 5*time.Second)
+	defer cancel()
+	list, err := tenants.List(listCtx)
+	if err != nil {
+		log.Printf("Failed to list tenants, keeping their quotas as they are: %v\n", err)
+		return
+	}
+	loaded := map[string]int{}
+	for _, t := range list {
+		if t.Quota > 0 {
+			loaded[t.ID] = t.Quota
+		}
+	}
+	q.mu.Lock()
+	q.quotas = loaded
+	q.mu.Unlock()
+}
+
+// set takes a tenant's quota changed through the admin API, 0 for none or a deleted tenant.
+func (q *tenantQuotas) set(tenant string, quota int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if quota > 0 {
+		q.quotas[tenant] = quota
+	} else {
+		delete(q.quotas, tenant)
+	}
+}
+
+// exceeded returns the quota of tenant when its window already holds that many new ids, 0
+// while the tenant may add more.
+func (q *tenantQuotas) exceeded(tenant string) int {
+	if q == nil || tenant == "" {
+		return 0
+	}
+	q.mu.RLock()
+	quota := q.quotas[tenant]
+	q.mu.RUnlock()
+	if quota <= 0 {
+		return 0
+	}
+	used := tenantCounts.count(tenant)
+	if w := tenantWindows.lookup(tenant); w != nil {
+		used = int(w.added.Load())
+	}
+	if used < quota {
+		return 0
+	}
+	return quota
+}
+
+// tenantQuotaCap answers a tenant's accepts with a 429 once it reached its quota for the
+// window. The check is per request, so the batch that reaches the quota is still taken whole.
+func tenantQuotaCap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get("X-Tenant-ID")
+		quota := quotas.exceeded(tenant)
+		if quota == 0 {
+			next(w, r)
+			return
+		}
+		tenantQuotaRejections.WithLabelValues(tenant).Inc()
+		_, end, _ := currentWindow(tenant)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(end).Seconds())+1))
+		message := fmt.Sprintf("Tenant %s reached its quota of %d unique ids for this window", tenant, quota)
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			writeErrorV2(w, http.StatusTooManyRequests, "quota_exceeded", message)
+			return
+		}
+		http.Error(w, message, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresTenantStore keeps tenants as JSONB documents, with API key hashes in a separate
+// table that is cleaned up by ON DELETE CASCADE.
+type postgresTenantStore struct {
+	pool *pgxpool.Pool
+}
+
+func newPostgresTenantStore(ctx context.Context, dsn string) (*postgresTenantStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS verve_tenants (
+			id TEXT PRIMARY KEY,
+			doc JSONB NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS verve_tenant_keys (
+			key_hash TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL REFERENCES verve_tenants (id) ON DELETE CASCADE
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("failed to create postgres tenant tables: %w", err)
+		}
+	}
+	return &postgresTenantStore{pool: pool}, nil
+}
+
+func (s *postgresTenantStore) List(ctx context.Context) ([]tenant, error) {
+	rows, err := s.pool.Query(ctx, `SELECT doc FROM verve_tenants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []tenant{}
+	for rows.Next() {
+		var t tenant
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *postgresTenantStore) Get(ctx context.Context, id string) (tenant, error) {
+	var t tenant
+	err := s.pool.QueryRow(ctx, `SELECT doc FROM verve_tenants WHERE id = $1`, id).Scan(&t)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return tenant{}, errTenantNotFound
+	}
+	return t, err
+}
+
+func (s *postgresTenantStore) Put(ctx context.Context, t tenant) error {
+	doc, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO verve_tenants (id, doc) VALUES ($1, $2)
+			ON CONFLICT (id) DO UPDATE SET doc = EXCLUDED.doc`, t.ID, doc)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM verve_tenant_keys WHERE tenant_id = $1`, t.ID); err != nil {
+			return err
+		}
+		for _, hash := range t.KeyHashes {
+			_, err := tx.Exec(ctx, `INSERT INTO verve_tenant_keys (key_hash, tenant_id) VALUES ($1, $2)`, hash, t.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update changes the tenant in a transaction holding its row lock, so concurrent updates of a
+// tenant run one after the other.
+func (s *postgresTenantStore) Update(ctx context.Context, id string, change func(t *tenant) error) (tenant, error) {
+	var t tenant
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var old tenant
+		err := tx.QueryRow(ctx, `SELECT doc FROM verve_tenants WHERE id = $1 FOR UPDATE`, id).Scan(&old)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errTenantNotFound
+		}
+		if err != nil {
+			return err
+		}
+		t = old
+		t.KeyHashes = slices.Clone(old.KeyHashes)
+		t.SigningSecrets = maps.Clone(old.SigningSecrets)
+		if err := change(&t); err != nil {
+			return err
+		}
+		doc, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE verve_tenants SET doc = $2 WHERE id = $1`, id, doc); err != nil {
+			return err
+		}
+		added, removed := keyChanges(old.KeyHashes, t.KeyHashes)
+		for _, hash := range removed {
+			if _, err := tx.Exec(ctx, `DELETE FROM verve_tenant_keys WHERE key_hash = $1`, hash); err != nil {
+				return err
+			}
+		}
+		for _, hash := range added {
+			_, err := tx.Exec(ctx, `INSERT INTO verve_tenant_keys (key_hash, tenant_id) VALUES ($1, $2)`, hash, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (s *postgresTenantStore) Delete(ctx context.Context, id string) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM verve_tenants WHERE id = $1`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errTenantNotFound
+	}
+	return err
+}
+
+func (s *postgresTenantStore) TenantForKey(ctx context.Context, keyHash string) (string, error) {
+	var id string
+	err := s.pool.QueryRow(ctx, `SELECT tenant_id FROM verve_tenant_keys WHERE key_hash = $1`, keyHash).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errTenantNotFound
+	}
+	return id, err
+}
+
+func (s *postgresTenantStore) Close() error {
+	s.pool.Close()
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisTenantsKey    = "verve:tenants"
+	redisTenantKeysKey = "verve:tenant-keys"
+)
+
+// redisTenantStore keeps every tenant as a JSON field of one hash, plus a second hash mapping
+// API key hashes to tenant ids.
+type redisTenantStore struct {
+	client *redis.Client
+}
+
+func (s *redisTenantStore) List(ctx context.Context) ([]tenant, error) {
+	all, err := s.client.HGetAll(ctx, redisTenantsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]tenant, 0, len(all))
+	for _, value := range all {
+		var t tenant
+		if err := json.Unmarshal([]byte(value), &t); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+func (s *redisTenantStore) Get(ctx context.Context, id string) (tenant, error) {
+	value, err := s.client.HGet(ctx, redisTenantsKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return tenant{}, errTenantNotFound
+	}
+	if err != nil {
+		return tenant{}, err
+	}
+
+	var t tenant
+	err = json.Unmarshal([]byte(value), &t)
+	return t, err
+}
+
+func (s *redisTenantStore) Put(ctx context.Context, t tenant) error {
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	old, err := s.Get(ctx, t.ID)
+	if err != nil && !errors.Is(err, errTenantNotFound) {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hash := range old.KeyHashes {
+			pipe.HDel(ctx, redisTenantKeysKey, hash)
+		}
+		for _, hash := range t.KeyHashes {
+			pipe.HSet(ctx, redisTenantKeysKey, hash, t.ID)
+		}
+		pipe.HSet(ctx, redisTenantsKey, t.ID, value)
+		return nil
+	})
+	return err
+}
+
+// redisTenantUpdateAttempts bounds the retries of an update that keeps losing to other writes;
+// every lost attempt means another write went through.
+const redisTenantUpdateAttempts = 100
+
+// Update changes the tenant in a transaction watching the tenant hash, retried when another
+// write got in between; the key index is changed per key, so other tenants' keys stay put.
+func (s *redisTenantStore) Update(ctx context.Context, id string, change func(t *tenant) error) (tenant, error) {
+	var t tenant
+	for attempt := 0; attempt < redisTenantUpdateAttempts; attempt++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.HGet(ctx, redisTenantsKey, id).Result()
+			if errors.Is(err, redis.Nil) {
+				return errTenantNotFound
+			}
+			if err != nil {
+				return err
+			}
+			var old tenant
+			if err := json.Unmarshal([]byte(value), &old); err != nil {
+				return err
+			}
+			t = old
+			t.KeyHashes = slices.Clone(old.KeyHashes)
+			t.SigningSecrets = maps.Clone(old.SigningSecrets)
+			if err := change(&t); err != nil {
+				return err
+			}
+			updated, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+
+			added, removed := keyChanges(old.KeyHashes, t.KeyHashes)
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, hash := range removed {
+					pipe.HDel(ctx, redisTenantKeysKey, hash)
+				}
+				for _, hash := range added {
+					pipe.HSet(ctx, redisTenantKeysKey, hash, id)
+				}
+				pipe.HSet(ctx, redisTenantsKey, id, updated)
+				return nil
+			})
+			return err
+		}, redisTenantsKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return t, err
+		}
+	}
+	return tenant{}, fmt.Errorf("tenant %s kept changing while updating it", id)
+}
+
+func (s *redisTenantStore) Delete(ctx context.Context, id string) error {
+	old, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hash := range old.KeyHashes {
+			pipe.HDel(ctx, redisTenantKeysKey, hash)
+		}
+		pipe.HDel(ctx, redisTenantsKey, id)
+		return nil
+	})
+	return err
+}
+
+func (s *redisTenantStore) TenantForKey(ctx context.Context, keyHash string) (string, error) {
+	id, err := s.client.HGet(ctx, redisTenantKeysKey, keyHash).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", errTenantNotFound
+	}
+	return id, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// tenantWindows runs the windows of tenants configured with their own; nil without
+// TENANT_WINDOWS.
+var tenantWindows *tenantWindowSet
+
+// tenantWindowSet keeps a window per tenant whose configured window differs from the service
+// window. Each has its own ticker and dedupe namespace, so its ids are counted, flushed and
+// published on its own schedule and left out of the service window. The set follows the tenant
+// store, picking up window changes within refresh.
+type tenantWindowSet struct {
+	refresh time.Duration
+
+	mu      sync.RWMutex
+	windows map[string]*tenantWindow
+	// redis is the service's Redis deduplicator, copied with another prefix per tenant.
+	redis *redisDeduplicator
+}
+
+type tenantWindow struct {
+	tenant   string
+	interval time.Duration
+	dedup    Deduplicator
+	stop     context.CancelFunc
+	done     chan struct{}
+	// opened is when the current window started, in Unix nanoseconds.
+	opened atomic.Int64
+	// added counts the ids this instance added to the current window, for the tenant's quota.
+	added atomic.Int64
+}
+
+func newTenantWindowSet(refresh time.Duration) *tenantWindowSet {
+	return &tenantWindowSet{refresh: refresh, windows: map[string]*tenantWindow{}}
+}
+
+// lookup returns the window of tenant, nil when it reports with the service window.
+func (s *tenantWindowSet) lookup(tenant string) *tenantWindow {
+	if s == nil || tenant == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.windows[tenant]
+}
+
+func (s *tenantWindowSet) run(runCtx context.Context) error {
+	s.sync(runCtx)
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runCtx.Done():
+			s.mu.Lock()
+			windows := s.windows
+			s.windows = map[string]*tenantWindow{}
+			s.mu.Unlock()
+			for _, w := range windows {
+				w.stop()
+				<-w.done
+			}
+			return nil
+		case <-ticker.C:
+			s.sync(runCtx)
+		}
+	}
+}
+
+// sync starts, restarts and stops windows to match the tenant store. A window that is stopped
+// or changes length closes early, so the ids it holds are still reported.
+func (s *tenantWindowSet) sync(runCtx context.Context) {
+	listCtx, cancel := context.WithTimeout(runCtx, 5*time.Second)
+	defer cancel()
+	list, err := tenants.List(listCtx)
+	if err != nil {
+		log.Printf("Failed to list tenants, keeping their windows as they are: %v\n", err)
+		return
+	}
+	want := map[string]time.Duration{}
+	for _, t := range list {
+		if t.Window == "" {
+			continue
+		}
+		if interval, err := time.ParseDuration(t.Window); err == nil && interval != time.Minute {
+			want[t.ID] = interval
+		}
+	}
+
+	s.mu.Lock()
+	var stopped []*tenantWindow
+	for id, w := range s.windows {
+		if want[id] == w.interval {
+			continue
+		}
+		delete(s.windows, id)
+		stopped = append(stopped, w)
+	}
+	for id, interval := range want {
+		if s.windows[id] != nil {
+			continue
+		}
+		dedup, err := s.newDeduplicator(id, interval)
+		if err != nil {
+			log.Printf("Failed to start the %v window of tenant %s, its ids stay in the service window: %v\n", interval, id, err)
+			continue
+		}
+		windowCtx, stop := context.WithCancel(runCtx)
+		w := &tenantWindow{tenant: id, interval: interval, dedup: dedup, stop: stop, done: make(chan struct{})}
+		w.opened.Store(time.Now().UnixNano())
+		s.windows[id] = w
+		go w.run(windowCtx)
+		log.Printf("Started a %v window for tenant %s\n", interval, id)
+	}
+	tenantWindowCount.Set(float64(len(s.windows)))
+	s.mu.Unlock()
+
+	// Stopped and closed outside the lock, so accepts aren't held up while a window finishes
+	// publishing. Requests already see the new window or the service window
+	for _, w := range stopped {
+		w.stop()
+		<-w.done
+		w.close(time.Now())
+		log.Printf("Stopped the %v window of tenant %s\n", w.interval, w.tenant)
+	}
+}
+
+// newDeduplicator returns the dedupe namespace of a tenant window. With the Redis backend it is
+// a key prefix in the same Redis, shared by the replicas like the service window; other backends
+// keep tenant windows in process, in a cuckoo filter of TENANT_WINDOW_CAPACITY ids.
+func (s *tenantWindowSet) newDeduplicator(tenant string, interval time.Duration) (Deduplicator, error) {
+	if activeBackend() != "redis" {
+		return newCuckooDeduplicator(getEnvInt("TENANT_WINDOW_CAPACITY", 1<<16)), nil
+	}
+	if s.redis == nil {
+		d, err := newDeduplicator("redis")
+		if err != nil {
+			return nil, err
+		}
+		s.redis = d.(*redisDeduplicator)
+	}
+	// Named by the length too, so a window restarted with another one doesn't share its keys
+	// with the old one while that is still being closed
+	d := *s.redis
+	d.prefix, d.ttl = fmt.Sprintf("verve:window:%s:%s:", tenant, interval), interval
+	return &d, nil
+}
+
+func (w *tenantWindow) run(runCtx context.Context) {
+	defer close(w.done)
+	clock := newWindowClock(time.Now(), w.interval, getEnvDuration("CLOCK_SKEW_TOLERANCE", time.Second))
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runCtx.Done():
+			return
+		case now := <-ticker.C:
+			end := clock.boundary(now)
+			w.opened.Store(end.UnixNano())
+			w.added.Store(0)
+			w.close(end)
+		}
+	}
+}
+
+// add reports whether in is new in the tenant's window.
+func (w *tenantWindow) add(reqCtx context.Context, in dedupeInput) (bool, error) {
+	start := time.Now()
+	key := storedKey(in)
+	result, err := w.dedup.Add(reqCtx, key)
+	scaling.observeDedupe(time.Since(start))
+	if err != nil {
+		log.Printf("Error checking ID in the window of tenant %s: %v\n", w.tenant, err)
+		return false, err
+	}
+	if result {
+		replicator.replicateTenant(w.tenant, replicateAdd, key)
+		w.added.Add(1)
+		countUnique(reqCtx, 1)
+	}
+	return result, nil
+}
+
+// close flushes the window ending at end and publishes its count on the tenant's Kafka topic,
+// on the leader only like the service window. Other instances still start over an in-process
+// window, which only they can flush.
+func (w *tenantWindow) close(end time.Time) {
+	if !coordinator.IsLeader() {
+		if _, shared := w.dedup.(*redisDeduplicator); !shared {
+			if _, err := w.dedup.Flush(ctx); err != nil {
+				log.Printf("Error flushing the window of tenant %s: %v\n", w.tenant, err)
+			}
+		}
+		return
+	}
+	count, err := w.dedup.Flush(ctx)
+	if err != nil {
+		log.Printf("Error flushing the window of tenant %s: %v\n", w.tenant, err)
+		tenantWindowReports.WithLabelValues("failed").Inc()
+		return
+	}
+
+	build := currentBuild()
+	t := tenantReport{
+		Tenant:             w.tenant,
+		UniqueRequestCount: count,
+		Timestamp:          end.Format(time.RFC3339),
+		Version:            build.Version,
+		GitSHA:             build.GitSHA,
+		InstanceID:         instanceID(),
+		Backend:            activeBackend(),
+		Window:             w.interval.String(),
+	}
+	log.Printf("Tenant %s: unique requests in the %v window ending %s: %d\n", w.tenant, w.interval, t.Timestamp, count)
+	if tenantWriter == nil {
+		tenantWindowReports.WithLabelValues("logged").Inc()
+		return
+	}
+
+	// A window_start key is the window's own start, not a minute before its end
+	report := windowReport{
+		Timestamp:   t.Timestamp,
+		InstanceID:  t.InstanceID,
+		Period:      t.Window,
+		PeriodStart: end.Add(-w.interval).Format(time.RFC3339),
+	}
+	publishCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	m, err := tenantMessage(publishCtx, report, t)
+	if err == nil {
+		err = writeTenantMessages(publishCtx, []kafka.Message{m})
+	}
+	if err != nil {
+		log.Printf("Failed to publish the window of tenant %s: %v\n", w.tenant, err)
+		tenantWindowReports.WithLabelValues("failed").Inc()
+		return
+	}
+	tenantWindowReports.WithLabelValues("published").Inc()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// followerCoordinator is an instance that never leads.
+type followerCoordinator struct{ localCoordinator }
+
+func (followerCoordinator) IsLeader() bool { return false }
+
+func TestTenantWindowCloseOnFollower(t *testing.T) {
+	coordinator = followerCoordinator{}
+	dedupeKey, _ = parseKeyStrategy("id")
+	defer func() { coordinator = localCoordinator{} }()
+
+	w := &tenantWindow{tenant: "acme", interval: 5 * time.Minute, dedup: newCuckooDeduplicator(1024)}
+	in := dedupeInput{id: 1, tenant: "acme"}
+	if added, _ := w.add(context.Background(), in); !added {
+		t.Fatal("first add wasn't new")
+	}
+	// Only this instance can flush its in-process window, leader or not
+	w.close(time.Now())
+	if added, _ := w.add(context.Background(), in); !added {
+		t.Error("the id is still a duplicate in the next window")
+	}
+}
+
+func TestTenantWindowPrefix(t *testing.T) {
+	s := &tenantWindowSet{redis: &redisDeduplicator{}}
+	backendSwitch = newSwitchingDeduplicator(s.redis, "redis")
+	defer func() { backendSwitch = nil }()
+
+	five, _ := s.newDeduplicator("acme", 5*time.Minute)
+	ten, _ := s.newDeduplicator("acme", 10*time.Minute)
+	if a, b := five.(*redisDeduplicator).prefix, ten.(*redisDeduplicator).prefix; a == b {
+		t.Errorf("windows of different lengths share the prefix %s", a)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errTenantNotFound = errors.New("tenant not found")
+	errKeyNotFound    = errors.New("API key not found")
+)
+
+// tenantIDPattern keeps tenant ids usable in Redis keys, metric labels and URLs.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+var kafkaTopicPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// tenant is the configuration of one tenant, managed through the admin API.
+type tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Window is the tenant's reporting window, e.g. "5m"; empty uses the service window.
+	Window string `json:"window,omitempty"`
+	// Quota is the maximum number of unique ids per window, 0 means unlimited.
+	Quota int `json:"quota,omitempty"`
+	// KafkaTopic routes the tenant's window counts to its own topic; empty keeps them on the
+	// report topic, keyed (and so partitioned) by tenant id.
+	KafkaTopic string `json:"kafka_topic,omitempty"`
+	// KeyHashes are sha256 hashes of the tenant's API keys; keys themselves are never stored.
+	KeyHashes []string `json:"key_hashes,omitempty"`
+	// SigningSecrets are the REPLAY_PROTECTION secrets of the API keys, by key id. Unlike the
+	// keys they are never sent with a request, so they are stored as they are.
+	SigningSecrets map[string]string `json:"signing_secrets,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+func (t tenant) validate() error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("'id' must be 1-63 lowercase letters, digits, '-' or '_'")
+	}
+	if t.Window != "" {
+		window, err := time.ParseDuration(t.Window)
+		if err != nil || window < time.Second {
+			return fmt.Errorf("'window' must be a duration of at least 1s, e.g. \"5m\"")
+		}
+	}
+	if t.Quota < 0 {
+		return fmt.Errorf("'quota' must not be negative")
+	}
+	if t.KafkaTopic != "" && !kafkaTopicPattern.MatchString(t.KafkaTopic) {
+		return fmt.Errorf("'kafka_topic' must be a valid Kafka topic name")
+	}
+	return nil
+}
+
+// tenantStore persists tenants so that they can be changed without a redeploy.
+type tenantStore interface {
+	List(ctx context.Context) ([]tenant, error)
+	// Get returns errTenantNotFound for unknown tenants.
+	Get(ctx context.Context, id string) (tenant, error)
+	// Put creates or replaces a tenant, including the index of its API keys.
+	Put(ctx context.Context, t tenant) error
+	// Update applies change to the stored tenant and stores the result in one atomic step, so
+	// concurrent changes, e.g. two API keys created at once, aren't lost. An error from change
+	// leaves the tenant as it was; unknown tenants return errTenantNotFound.
+	Update(ctx context.Context, id string, change func(t *tenant) error) (tenant, error)
+	Delete(ctx context.Context, id string) error
+	// TenantForKey resolves an API key hash, returning errTenantNotFound for unknown keys.
+	TenantForKey(ctx context.Context, keyHash string) (string, error)
+}
+
+func newTenantStore(kind string) (tenantStore, error) {
+	switch kind {
+	case "redis":
+		if redisDB == nil {
+			return nil, fmt.Errorf("redis tenant store requires a Redis connection")
+		}
+		return &redisTenantStore{client: redisDB}, nil
+	case "postgres":
+		return newPostgresTenantStore(ctx, getEnv("POSTGRES_DSN", ""))
+	default:
+		return nil, fmt.Errorf("unknown tenant store %q", kind)
+	}
+}
+
+// newAPIKey returns a random API key and the hash it is stored under.
+func newAPIKey() (key, hash string) {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	key = "vk_" + hex.EncodeToString(buf)
+	return key, hashAPIKey(key)
+}
+
+// newSigningSecret returns a random secret for signing the requests of an API key.
+func newSigningSecret() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return "vs_" + hex.EncodeToString(buf)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyID is the short, non-secret name of an API key shown by the admin API.
+func keyID(hash string) string {
+	return hash[:12]
+}
+
+// keyChanges returns the key hashes after adds to before and those it drops, for updating a
+// store's index of API keys.
+func keyChanges(before, after []string) (added, removed []string) {
+	for _, hash := range after {
+		if !slices.Contains(before, hash) {
+			added = append(added, hash)
+		}
+	}
+	for _, hash := range before {
+		if !slices.Contains(after, hash) {
+			removed = append(removed, hash)
+		}
+	}
+	return added, removed
+}
+
+// removeKey drops the key with the given key id from t and reports whether it existed.
+func (t *tenant) removeKey(id string) bool {
+	for i, hash := range t.KeyHashes {
+		if keyID(hash) == id {
+			t.KeyHashes = append(t.KeyHashes[:i], t.KeyHashes[i+1:]...)
+			delete(t.SigningSecrets, id)
+			return true
+		}
+	}
+	return false
+}
+
+// tenantCounter counts the unique ids of the current window per tenant. Like the id buckets it
+// is kept per instance; an id counts for the tenant that sent it first in the window.
+type tenantCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newTenantCounter() *tenantCounter {
+	return &tenantCounter{counts: map[string]int{}}
+}
+
+func (c *tenantCounter) record(tenant string) {
+	c.mu.Lock()
+	c.counts[tenant]++
+	c.mu.Unlock()
+}
+
+func (c *tenantCounter) count(tenant string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[tenant]
+}
+
+func (c *tenantCounter) retract(tenant string) {
+	c.mu.Lock()
+	if c.counts[tenant] > 0 {
+		c.counts[tenant]--
+	}
+	c.mu.Unlock()
+}
+
+// flush returns the per-tenant counts of the finished window, nil when no tenant sent ids.
+func (c *tenantCounter) flush() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.counts) == 0 {
+		return nil
+	}
+	counts := c.counts
+	c.counts = map[string]int{}
+	return counts
+}
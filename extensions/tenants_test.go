@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisTenantStoreUpdate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := &redisTenantStore{client: client}
+	ctx := context.Background()
+	if err := store.Put(ctx, tenant{ID: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys created at once all land, none overwrites another
+	var wg sync.WaitGroup
+	hashes := make([]string, 20)
+	for i := range hashes {
+		_, hashes[i] = newAPIKey()
+		wg.Add(1)
+		go func(hash string) {
+			defer wg.Done()
+			if _, err := store.Update(ctx, "acme", func(t *tenant) error {
+				t.KeyHashes = append(t.KeyHashes, hash)
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}(hashes[i])
+	}
+	wg.Wait()
+	got, err := store.Get(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.KeyHashes) != len(hashes) {
+		t.Fatalf("got %d keys, want %d", len(got.KeyHashes), len(hashes))
+	}
+
+	if _, err := store.Update(ctx, "acme", func(t *tenant) error {
+		if !t.removeKey(keyID(hashes[0])) {
+			return errKeyNotFound
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TenantForKey(ctx, hashes[0]); err != errTenantNotFound {
+		t.Errorf("got %v for a revoked key, want errTenantNotFound", err)
+	}
+	if id, err := store.TenantForKey(ctx, hashes[1]); err != nil || id != "acme" {
+		t.Errorf("got %q, %v for a kept key, want acme", id, err)
+	}
+	if _, err := store.Update(ctx, "other", func(*tenant) error { return nil }); err != errTenantNotFound {
+		t.Errorf("got %v for an unknown tenant, want errTenantNotFound", err)
+	}
+}
+
+func TestTenantQuotaCap(t *testing.T) {
+	quotas = newTenantQuotas(0)
+	defer func() { quotas, tenantCounts = nil, newTenantCounter() }()
+	quotas.set("acme", 2)
+	handler := tenantQuotaCap(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	send := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v2/verve/accept", nil)
+		r.Header.Set("X-Tenant-ID", tenant)
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+	tenantCounts.record("acme")
+	if rec := send("acme"); rec.Code != http.StatusNoContent {
+		t.Errorf("got %d under the quota, want 204", rec.Code)
+	}
+	tenantCounts.record("acme")
+	if rec := send("acme"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d at the quota, want 429 with a Retry-After", rec.Code)
+	}
+	if rec := send("other"); rec.Code != http.StatusNoContent {
+		t.Errorf("got %d for a tenant without a quota, want 204", rec.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// A traffic recording (RECORD_PATH) is a header followed by one record per accept request:
+//
+//	header = "VERVEREC" 0x01 uvarint(start, unix microseconds)
+//	record = uvarint(microseconds since the previous record, or the start) uvarint(n) n*uvarint(id)
+//
+// A record with one id was a single accept, one with several a batch. Only valid ids are
+// recorded, and with RECORD_SAMPLE only those whose hash falls in the sample, so every
+// occurrence of a sampled id is kept and duplicates replay as duplicates.
+const (
+	recordMagic   = "VERVEREC"
+	recordVersion = 1
+)
+
+// traffic records accept traffic for `verve replay`; nil without RECORD_PATH.
+var traffic *trafficRecorder
+
+type trafficRecorder struct {
+	path string
+	// threshold keeps ids whose hash is below it, math.MaxUint64 keeps all.
+	threshold uint64
+	maxBytes  int64
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	last    time.Time
+	written int64
+	full    bool
+	buf     []byte
+}
+
+// newTrafficRecorder creates the recording at path, replacing an older one. maxBytes stops the
+// recording once it is reached, 0 records until shutdown.
+func newTrafficRecorder(path string, sample float64, maxBytes int64) (*trafficRecorder, error) {
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("sample must be in (0, 1], got %v", sample)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &trafficRecorder{path: path, threshold: math.MaxUint64, maxBytes: maxBytes, file: f, w: bufio.NewWriterSize(f, 64<<10), last: time.Now()}
+	if sample < 1 {
+		r.threshold = uint64(sample * math.MaxUint64)
+	}
+	header := binary.AppendUvarint(append([]byte(recordMagic), recordVersion), uint64(r.last.UnixMicro()))
+	if _, err := r.w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.written = int64(len(header))
+	return r, nil
+}
+
+// record appends the valid, sampled ids of one request.
+func (r *trafficRecorder) record(ins []dedupeInput) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		return
+	}
+
+	now := time.Now()
+	var ids []uint64
+	for _, in := range ins {
+		if in.id > 0 && (r.threshold == math.MaxUint64 || xxhash.Sum64String(strconv.Itoa(in.id)) < r.threshold) {
+			ids = append(ids, uint64(in.id))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	b := binary.AppendUvarint(r.buf[:0], uint64(now.Sub(r.last).Microseconds()))
+	b = binary.AppendUvarint(b, uint64(len(ids)))
+	for _, id := range ids {
+		b = binary.AppendUvarint(b, id)
+	}
+	r.buf = b
+	if r.maxBytes > 0 && r.written+int64(len(b)) > r.maxBytes {
+		log.Printf("Traffic recording %s reached RECORD_MAX_MB, recording stopped\n", r.path)
+		r.full = true
+		return
+	}
+	if _, err := r.w.Write(b); err != nil {
+		log.Printf("Failed to write traffic recording, recording stopped: %v\n", err)
+		r.full = true
+		return
+	}
+	// Microseconds are truncated, so the next delta is taken from where this one ended
+	r.last = r.last.Add(time.Duration(now.Sub(r.last).Microseconds()) * time.Microsecond)
+	r.written += int64(len(b))
+	recordedRequests.Inc()
+	recordedIDs.Add(float64(len(ids)))
+}
+
+// run flushes the recording every second, so a crash loses at most that, and closes it on
+// shutdown.
+func (r *trafficRecorder) run(runCtx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			if err := r.w.Flush(); err != nil {
+				log.Printf("Failed to flush traffic recording: %v\n", err)
+			}
+			r.mu.Unlock()
+		case <-runCtx.Done():
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.full = true
+			if err := r.w.Flush(); err != nil {
+				r.file.Close()
+				return err
+			}
+			log.Printf("Traffic recording %s closed after %d bytes\n", r.path, r.written)
+			return r.file.Close()
+		}
+	}
+}
+
+// recordingReader reads a recording back for `verve replay`.
+type recordingReader struct {
+	r     *bufio.Reader
+	start time.Time
+	// offset is the time of the last record read, relative to start.
+	offset time.Duration
+}
+
+func newRecordingReader(r io.Reader) (*recordingReader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	magic := make([]byte, len(recordMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic[:len(recordMagic)]) != recordMagic {
+		return nil, errors.New("not a verve traffic recording")
+	}
+	if magic[len(recordMagic)] != recordVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", magic[len(recordMagic)])
+	}
+	start, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recording header: %w", err)
+	}
+	return &recordingReader{r: br, start: time.UnixMicro(int64(start))}, nil
+}
+
+// next returns the next request's offset from the start and its ids, io.EOF after the last.
+func (rr *recordingReader) next() (time.Duration, []int, error) {
+	delta, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil || n == 0 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("malformed record at %v", rr.offset)
+	}
+	ids := make([]int, n)
+	for i := range ids {
+		id, err := binary.ReadUvarint(rr.r)
+		if err != nil || id > math.MaxInt {
+			return 0, nil, fmt.Errorf("malformed record at %v", rr.offset)
+		}
+		ids[i] = int(id)
+	}
+	rr.offset += time.Duration(delta) * time.Microsecond
+	return rr.offset, ids, nil
+}
+
+// prepareRecord handles `verve record [-out file] [-sample f] [-max-mb n] [service flags]`,
+// which runs the service as usual with RECORD_PATH, RECORD_SAMPLE and RECORD_MAX_MB set from
+// its flags. It returns the service's remaining arguments.
+func prepareRecord(args []string) ([]string, error) {
+	flags := flag.NewFlagSet("record", flag.ContinueOnError)
+	out := flags.String("out", getEnv("RECORD_PATH", "traffic.rec"), "file the accept traffic is recorded to")
+	sampleDefault, err := strconv.ParseFloat(getEnv("RECORD_SAMPLE", "1"), 64)
+	if err != nil {
+		sampleDefault = 1
+	}
+	sample := flags.Float64("sample", sampleDefault, "fraction of ids recorded, by id hash, so all or none of an id's requests are kept")
+	maxMB := flags.Int("max-mb", getEnvInt("RECORD_MAX_MB", 0), "stop recording at this size, 0 records until shutdown")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	os.Setenv("RECORD_PATH", *out)
+	os.Setenv("RECORD_SAMPLE", strconv.FormatFloat(*sample, 'g', -1, 64))
+	os.Setenv("RECORD_MAX_MB", strconv.Itoa(*maxMB))
+	return flags.Args(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordTraffic records requests, one slice of ids each, and closes the recording.
+func recordTraffic(t *testing.T, sample float64, maxBytes int64, requests ...[]int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+	rec, err := newTrafficRecorder(path, sample, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ids := range requests {
+		ins := make([]dedupeInput, len(ids))
+		for i, id := range ids {
+			ins[i] = dedupeInput{id: id}
+		}
+		rec.record(ins)
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rec.run(runCtx); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readRecording returns the ids of every request in the recording at path.
+func readRecording(t *testing.T, path string) [][]int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rr, err := newRecordingReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests [][]int
+	var last int64
+	for {
+		offset, ids, err := rr.next()
+		if errors.Is(err, io.EOF) {
+			return requests
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(offset) < last {
+			t.Fatalf("offset %v went back from %v", offset, last)
+		}
+		last = int64(offset)
+		requests = append(requests, ids)
+	}
+}
+
+func TestTrafficRecordingRoundTrip(t *testing.T) {
+	path := recordTraffic(t, 1, 0, []int{1}, []int{0}, []int{2, 0, 1})
+	if got := fmt.Sprint(readRecording(t, path)); got != "[[1] [2 1]]" {
+		t.Errorf("read back %s, want the valid ids of the requests that had any", got)
+	}
+	if _, err := newRecordingReader(strings.NewReader("")); err == nil {
+		t.Error("an empty file was read as a recording")
+	}
+}
+
+func TestTrafficRecordingSample(t *testing.T) {
+	var requests [][]int
+	for round := 0; round < 2; round++ {
+		for id := 1; id <= 200; id++ {
+			requests = append(requests, []int{id})
+		}
+	}
+	seen := map[int]int{}
+	for _, ids := range readRecording(t, recordTraffic(t, 0.5, 0, requests...)) {
+		seen[ids[0]]++
+	}
+	if len(seen) < 60 || len(seen) > 140 {
+		t.Errorf("%d of 200 ids sampled at 0.5", len(seen))
+	}
+	for id, n := range seen {
+		if n != 2 {
+			t.Errorf("id %d recorded %d times, want both of its requests", id, n)
+		}
+	}
+}
+
+func TestTrafficRecordingMaxBytes(t *testing.T) {
+	var requests [][]int
+	for id := 1; id <= 100; id++ {
+		requests = append(requests, []int{id})
+	}
+	path := recordTraffic(t, 1, 64, requests...)
+	if info, err := os.Stat(path); err != nil || info.Size() > 64 {
+		t.Errorf("got a %d byte recording, want at most 64", info.Size())
+	}
+	if n := len(readRecording(t, path)); n == 0 || n == 100 {
+		t.Errorf("%d requests recorded, want the ones that fit", n)
+	}
+}
+
+func TestReplayRecording(t *testing.T) {
+	h, err := newIntegrationHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	path := recordTraffic(t, 1, 0, []int{1}, []int{2, 1}, []int{3})
+
+	if code := runReplay([]string{"-file", path, "-target", h.Server.URL, "-speed", "0"}); code != 0 {
+		t.Fatalf("replay exited with %d", code)
+	}
+	if err := expectCount(h.Client, 3); err != nil {
+		t.Error(err)
+	}
+	if code := runReplay([]string{"-file", filepath.Join(t.TempDir(), "missing.rec")}); code != 1 {
+		t.Errorf("replay of a missing recording exited with %d, want 1", code)
+	}
+}
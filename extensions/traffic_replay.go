@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/client"
+)
+
+// replayStats counts what `verve replay` sent.
+type replayStats struct {
+	mu         sync.Mutex
+	requests   int
+	ids        int
+	accepted   int
+	duplicates int
+	failed     int
+	// maxLag is how far behind its schedule a request was sent at most.
+	maxLag time.Duration
+}
+
+// runReplay serves `verve replay`: it sends a recording's requests to a verve instance, single
+// ids through the v2 accept endpoint and batches through the batch endpoint, at their recorded
+// pace divided by -speed. With the default single worker requests go out in recorded order, so
+// a replay against an empty window reproduces the recorded accept and duplicate answers.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	file := flags.String("file", "traffic.rec", "recording written by `verve record` or RECORD_PATH")
+	target := flags.String("target", "http://localhost:8080", "base URL of the instance to replay against")
+	speed := flags.Float64("speed", 1, "replay this many times faster than recorded, 0 sends as fast as possible")
+	workers := flags.Int("workers", 1, "concurrent requests; more than one can reorder requests that were close together")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *speed < 0 || *workers <= 0 {
+		log.Printf("-speed must not be negative and -workers must be positive")
+		return 2
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Printf("replay failed: %v", err)
+		return 1
+	}
+	defer f.Close()
+	rec, err := newRecordingReader(f)
+	if err != nil {
+		log.Printf("replay failed: %s: %v", *file, err)
+		return 1
+	}
+
+	// Retrying would send a request twice, turning its ids into duplicates the recording
+	// doesn't have
+	c := client.New(*target, client.WithRetries(0, 0))
+	stats := &replayStats{}
+	requests := make(chan []int, *workers)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ids := range requests {
+				stats.send(c, ids)
+			}
+		}()
+	}
+
+	log.Printf("Replaying %s, recorded from %s, against %s at %vx\n", *file, rec.start.Format(time.RFC3339), *target, *speed)
+	start := time.Now()
+	var readErr error
+	for {
+		offset, ids, err := rec.next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErr = err
+			}
+			break
+		}
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(offset) / *speed))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			} else {
+				stats.lag(-d)
+			}
+		}
+		requests <- ids
+	}
+	close(requests)
+	wg.Wait()
+
+	fmt.Printf("%d requests with %d ids in %v: %d accepted, %d duplicates, %d failed ids; sent at most %v behind schedule\n",
+		stats.requests, stats.ids, time.Since(start).Round(time.Millisecond), stats.accepted, stats.duplicates, stats.failed,
+		stats.maxLag.Round(time.Millisecond))
+	if readErr != nil {
+		log.Printf("replay stopped early: %v", readErr)
+		return 1
+	}
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (s *replayStats) send(c *client.Client, ids []int) {
+	var results []client.AcceptResult
+	var err error
+	if len(ids) == 1 {
+		var result client.AcceptResult
+		result, err = c.Accept(ctx, ids[0])
+		results = []client.AcceptResult{result}
+	} else {
+		results, err = c.AcceptBatch(ctx, ids)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.ids += len(ids)
+	if err != nil {
+		log.Printf("Replayed request failed: %v\n", err)
+		s.failed += len(ids)
+		return
+	}
+	for _, result := range results {
+		switch {
+		case result.Invalid:
+			s.failed++
+		case result.Duplicate:
+			s.duplicates++
+		default:
+			s.accepted++
+		}
+	}
+}
+
+func (s *replayStats) lag(d time.Duration) {
+	s.mu.Lock()
+	s.maxLag = max(s.maxLag, d)
+	s.mu.Unlock()
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkError    = "error"
+	checkDisabled = "disabled"
+)
+
+type checkResult struct {
+	name   string
+	status string
+	detail string
+}
+
+// startupReport summarizes the effective configuration and the reachability of dependencies.
+type startupReport struct {
+	checks []checkResult
+	limits [][2]string
+}
+
+func (r *startupReport) add(name, status, format string, args ...interface{}) {
+	r.checks = append(r.checks, checkResult{name: name, status: status, detail: fmt.Sprintf(format, args...)})
+}
+
+// failed reports whether any check found a problem that would stop or break the service.
+func (r *startupReport) failed() bool {
+	for _, c := range r.checks {
+		if c.status == checkError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *startupReport) print() {
+	log.Printf("Startup validation:")
+	for _, c := range r.checks {
+		log.Printf("  %-9s %-22s %s", c.status, c.name, c.detail)
+	}
+	log.Printf("Effective limits:")
+	for _, l := range r.limits {
+		log.Printf("  %-24s %s", l[0], l[1])
+	}
+}
+
+// Settings whose invalid values would otherwise silently fall back to their defaults.
+var (
+	intSettings = []string{
+		"BATCH_MAX_IDS", "NOTIFY_WORKERS", "NOTIFY_QUEUE_SIZE", "NOTIFY_MAX_PER_HOST", "NOTIFY_HOST_QUEUE_SIZE",
+		"CUCKOO_CAPACITY", "ID_HASH_BUCKETS", "REDIS_PIPELINE_SIZE", "REDIS_STREAM_MAXLEN",
+		"KAFKA_TOPIC_PARTITIONS", "KAFKA_TOPIC_REPLICATION_FACTOR", "MAX_CONNECTIONS", "ROARING_MEMORY_BUDGET_MB",
+		"STANDBY_QUEUE_SIZE", "MAX_INFLIGHT_REQUESTS", "MAX_GOROUTINES", "DEDUPE_MEMORY_LIMIT_MB",
+		"RATE_LIMIT_RPS", "RATE_LIMIT_BURST", "RATE_LIMIT_SOFT_PERCENT",
+		"DUPLICATE_WEBHOOK_BATCH", "DUPLICATE_WEBHOOK_QUEUE_SIZE", "CANARY_PERCENT",
+		"NOTIFY_HEDGE_PERCENTILE", "WINDOW_MAX_UNIQUE", "REPORT_KEEP", "REPORT_TOP_K",
+		"SCALING_TARGET_RPS", "SCALING_TARGET_INFLIGHT", "RECORD_MAX_MB", "TENANT_WINDOW_CAPACITY",
+		"REDIS_MAX_KEYS", "REDIS_MAX_MEMORY_MB", "NOTIFY_TREND_WINDOWS",
+	}
+	durationSettings = []string{
+		"SHUTDOWN_TIMEOUT", "LEADER_TTL", "NOTIFY_TIMEOUT", "ROARING_SNAPSHOT_INTERVAL", "PROFILING_INTERVAL",
+		"PROFILING_CPU_DURATION", "RECONCILE_INTERVAL", "OUTBOX_RETRY_INTERVAL", "ROLLUP_GRACE", "HISTORY_RETENTION",
+		"HISTORY_MINUTE_RETENTION", "HISTORY_HOUR_RETENTION", "HISTORY_COMPACT_INTERVAL",
+		"HTTP_IDLE_TIMEOUT", "INGEST_TCP_IDLE_TIMEOUT", "REQUEST_BUDGET", "NOTIFY_COUNT_TTL", "WINDOW_GRACE", "HEARTBEAT_INTERVAL", "STATS_CACHE_TTL",
+		"REPLAY_MAX_SKEW", "CORS_MAX_AGE", "SLO_LATENCY", "DUPLICATE_WEBHOOK_INTERVAL",
+		"REMOTE_WRITE_TIMEOUT", "NOTIFY_HEDGE_MIN_DELAY", "SCALING_TARGET_DEDUPE_LATENCY",
+		"REGION_SKETCH_WAIT", "AGGREGATE_WAIT", "CLOCK_SKEW_TOLERANCE", "TENANT_WINDOW_REFRESH", "TENANT_QUOTA_REFRESH", "REDIS_KEYSPACE_INTERVAL",
+	}
+	boolSettings = []string{
+		"DYNAMODB_CREATE_TABLE", "RECONCILE", "HTTP_KEEPALIVES", "DRY_RUN", "STANDBY", "REPLAY_PROTECTION", "HISTORY_DOWNSAMPLE",
+		"NOTIFY_ENDPOINT_PARAM", "TENANT_WINDOWS", "NOTIFY_TREND",
+	}
+)
+
+// validateStartup checks the configuration and probes the dependencies it needs, without
+// changing any state, so it can run as a pre-deploy check (--validate-only).
+func validateStartup() *startupReport {
+	r := &startupReport{}
+
+	for _, key := range intSettings {
+		if value := lookupEnv(key); value != "" {
+			if _, err := strconv.Atoi(value); err != nil {
+				r.add(key, checkError, "%q is not an integer", value)
+			}
+		}
+	}
+	for _, key := range durationSettings {
+		if value := lookupEnv(key); value != "" {
+			if _, err := time.ParseDuration(value); err != nil {
+				r.add(key, checkError, "%q is not a duration", value)
+			}
+		}
+	}
+	for _, key := range boolSettings {
+		if value := lookupEnv(key); value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				r.add(key, checkError, "%q is not a boolean", value)
+			}
+		}
+	}
+
+	coordinatorKind := getEnv("COORDINATOR", "none")
+	switch coordinatorKind {
+	case "none":
+		r.add("coordinator", checkOK, "single instance, always leader")
+	case "redis", "etcd":
+		r.add("coordinator", checkOK, "%s leader election", coordinatorKind)
+	default:
+		r.add("coordinator", checkError, "unknown coordinator %q", coordinatorKind)
+	}
+	if coordinatorKind == "etcd" {
+		for _, endpoint := range strings.Split(getEnv("ETCD_ENDPOINTS", "localhost:2379"), ",") {
+			probeTCP(r, "etcd "+endpoint, endpoint)
+		}
+	}
+
+	backend := getEnv("DEDUPE_BACKEND", "redis")
+	switch backend {
+	case "redis", "cuckoo", "roaring", "bolt", "memcached", "dynamodb", "postgres":
+		status := checkOK
+		detail := "shared by all instances"
+		if !sharedBackends[backend] {
+			detail = "local to this instance"
+			if coordinatorKind != "none" {
+				status = checkDegraded
+				detail += ", only the leader's ids are reported"
+			}
+		}
+		r.add("dedupe backend", status, "%s, %s", backend, detail)
+	default:
+		r.add("dedupe backend", checkError, "unknown dedupe backend %q", backend)
+	}
+	if canary := getEnv("CANARY_BACKEND", ""); canary != "" {
+		percent := getEnvInt("CANARY_PERCENT", 1)
+		switch {
+		case canary == backend:
+			r.add("canary backend", checkError, "CANARY_BACKEND must differ from DEDUPE_BACKEND")
+		case !slices.Contains([]string{"redis", "cuckoo", "roaring", "bolt", "memcached", "dynamodb", "postgres"}, canary):
+			r.add("canary backend", checkError, "unknown dedupe backend %q", canary)
+		case percent < 0 || percent > 100:
+			r.add("canary backend", checkError, "CANARY_PERCENT must be between 0 and 100")
+		case sharedBackends[canary] != sharedBackends[backend] && coordinatorKind != "none":
+			r.add("canary backend", checkDegraded, "%s is %s, its decisions on other instances' ids will differ from the primary's", canary, map[bool]string{true: "shared", false: "local"}[sharedBackends[canary]])
+		default:
+			r.add("canary backend", checkOK, "%s answers %d%% of ids", canary, percent)
+		}
+	}
+	if backend == "memcached" {
+		for _, server := range strings.Split(getEnv("MEMCACHED_SERVERS", "localhost:11211"), ",") {
+			probeTCP(r, "memcached "+server, server)
+		}
+	}
+	if backend == "postgres" && getEnv("POSTGRES_DSN", "") == "" {
+		r.add("postgres", checkError, "POSTGRES_DSN is not set")
+	}
+
+	if spec := getEnv("DEDUPE_KEY", "id"); spec != "id" {
+		if _, err := parseKeyStrategy(spec); err != nil {
+			r.add("dedupe key", checkError, "%v", err)
+		} else if backend == "roaring" {
+			r.add("dedupe key", checkError, "the roaring backend only supports DEDUPE_KEY=id")
+		} else {
+			r.add("dedupe key", checkOK, "%s", spec)
+		}
+	}
+
+	if limit := getEnvInt("WINDOW_MAX_UNIQUE", 0); limit > 0 {
+		if approximate, err := parseWindowOverflow(getEnv("WINDOW_OVERFLOW", "report")); err != nil {
+			r.add("window cap", checkError, "%v", err)
+		} else if approximate && sharedBackends[backend] {
+			r.add("window cap", checkError, "WINDOW_OVERFLOW=approximate only works with in-process backends, %s is shared", backend)
+		} else {
+			r.add("window cap", checkOK, "%d unique ids, overflow %s", limit, getEnv("WINDOW_OVERFLOW", "report"))
+		}
+	}
+	if spec := getEnv("ID_NORMALIZE", ""); spec != "" {
+		if n, err := parseIDNormalize(spec); err != nil {
+			r.add("id normalization", checkError, "%v", err)
+		} else {
+			r.add("id normalization", checkOK, "%s", n)
+		}
+	}
+	for _, name := range []string{"CUCKOO_HASH", "ROLLUP_HASH"} {
+		if spec := getEnv(name, ""); spec != "" {
+			if _, err := newIDHash(spec); err != nil {
+				r.add("id hashing", checkError, "%s: %v", name, err)
+			}
+		}
+	}
+
+	if spec := getEnv("ID_SOURCE", "query:id"); spec != "query:id" {
+		if _, err := parseIDSource(spec); err != nil {
+			r.add("id source", checkError, "%v", err)
+		} else {
+			r.add("id source", checkOK, "%s", spec)
+		}
+	}
+
+	switch mode := getEnv("PRIVACY_MODE", "off"); {
+	case mode == "off":
+	case mode != "hash":
+		r.add("privacy mode", checkError, "unknown privacy mode %q", mode)
+	case backend == "roaring":
+		r.add("privacy mode", checkError, "the roaring backend can't store hashed ids")
+	case getEnv("PRIVACY_SECRET", "") == "" && coordinatorKind != "none":
+		r.add("privacy mode", checkError, "PRIVACY_SECRET is required with a coordinator")
+	default:
+		r.add("privacy mode", checkOK, "ids are stored as salted hashes")
+	}
+
+	if getEnvBool("STANDBY", false) {
+		switch {
+		case coordinatorKind == "none":
+			r.add("standby", checkError, "STANDBY needs a COORDINATOR")
+		case sharedBackends[backend]:
+			r.add("standby", checkDegraded, "the %s backend is already shared, standbys don't need a replicated window", backend)
+		default:
+			r.add("standby", checkOK, "replicating the window through %s", getEnv("STANDBY_STREAM", "verve:window:replication"))
+		}
+	}
+
+	if getEnvBool("REPLAY_PROTECTION", false) {
+		kind := getEnv("REPLAY_NONCE_STORE", "memory")
+		switch {
+		case getEnv("TENANT_STORE", "") == "":
+			r.add("replay protection", checkError, "REPLAY_PROTECTION needs a TENANT_STORE with API keys")
+		case kind != "memory" && kind != "redis":
+			r.add("replay protection", checkError, "unknown nonce store %q", kind)
+		case getEnvDuration("REPLAY_MAX_SKEW", 5*time.Minute) <= 0:
+			r.add("replay protection", checkError, "REPLAY_MAX_SKEW must be positive")
+		case kind == "memory" && coordinatorKind != "none":
+			r.add("replay protection", checkDegraded, "nonces are only remembered per instance, a request can be replayed against another replica; use REPLAY_NONCE_STORE=redis")
+		default:
+			r.add("replay protection", checkOK, "%s nonces, max skew %v", kind, getEnvDuration("REPLAY_MAX_SKEW", 5*time.Minute))
+		}
+	}
+
+	httpSpec, apiSpec := getEnv("HTTP_MIDDLEWARE", defaultHTTPMiddleware), getEnv("API_MIDDLEWARE", defaultAPIMiddleware)
+	httpNames, httpErr := parseLayerNames(httpSpec, httpLayers)
+	apiNames, apiErr := parseLayerNames(apiSpec, apiLayers)
+	if apiErr == nil {
+		_, apiErr = parseAPIChain(apiSpec)
+	}
+	if apiErr == nil {
+		apiErr = requireAPIAuth(apiSpec, getEnv("TENANT_STORE", ""))
+	}
+	problems := len(r.checks)
+	if httpErr != nil {
+		r.add("middleware", checkError, "HTTP_MIDDLEWARE: %v", httpErr)
+	}
+	if apiErr != nil {
+		r.add("middleware", checkError, "API_MIDDLEWARE: %v", apiErr)
+	}
+	if httpErr == nil && !slices.Contains(httpNames, "recovery") {
+		r.add("middleware", checkDegraded, "without the recovery layer a handler panic drops the connection instead of answering 500")
+	}
+	if httpErr == nil && slices.Contains(httpNames, "rate_limit") && getEnvInt("RATE_LIMIT_RPS", 0) <= 0 {
+		r.add("middleware", checkDegraded, "the rate_limit layer does nothing without RATE_LIMIT_RPS")
+	}
+	if httpErr == nil && !slices.Contains(httpNames, "rate_limit") && getEnvInt("RATE_LIMIT_RPS", 0) > 0 {
+		r.add("middleware", checkError, "RATE_LIMIT_RPS is set but the rate_limit layer isn't in HTTP_MIDDLEWARE")
+	}
+	if soft := getEnvInt("RATE_LIMIT_SOFT_PERCENT", 20); soft < 0 || soft > 100 {
+		r.add("middleware", checkError, "RATE_LIMIT_SOFT_PERCENT must be between 0 and 100")
+	}
+	if httpErr == nil && slices.Contains(httpNames, "cors") && getEnv("CORS_ALLOWED_ORIGINS", "") == "" {
+		r.add("middleware", checkDegraded, "the cors layer allows no origin without CORS_ALLOWED_ORIGINS")
+	}
+	if apiErr == nil && !slices.Contains(apiNames, "replay") && getEnvBool("REPLAY_PROTECTION", false) {
+		r.add("middleware", checkError, "REPLAY_PROTECTION is set but the replay layer isn't in API_MIDDLEWARE")
+	}
+	if len(r.checks) == problems {
+		r.add("middleware", checkOK, "http %s; api %s", layerList(httpNames), layerList(apiNames))
+	}
+
+	resolver, err := parseRealIP(getEnv("TRUSTED_PROXIES", ""), getEnv("REAL_IP_HEADERS", "X-Forwarded-For,X-Real-IP,Forwarded"))
+	switch {
+	case err != nil:
+		r.add("client ip", checkError, "%v", err)
+	case resolver == nil:
+		r.add("client ip", checkOK, "peer address, no TRUSTED_PROXIES")
+	default:
+		r.add("client ip", checkOK, "%s from %d trusted proxy ranges", strings.Join(resolver.headers, ", "), len(resolver.trusted))
+	}
+	if _, err := parseCIDRList(getEnv("ADMIN_ALLOWED_CIDRS", "")); err != nil {
+		r.add("admin", checkError, "ADMIN_ALLOWED_CIDRS: %v", err)
+	}
+
+	if bucket := getEnv("ID_SET_BUCKET", ""); bucket != "" {
+		switch format := getEnv("ID_SET_FORMAT", "roaring"); {
+		case format != "roaring" && format != "varint":
+			r.add("id set export", checkError, "unknown ID_SET_FORMAT %q, expected roaring or varint", format)
+		case getEnv("ID_SET_ENDPOINT", "") == "" && getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", "")) == "":
+			r.add("id set export", checkDegraded, "s3://%s without AWS_REGION relies on the shared AWS config for the region", bucket)
+		default:
+			r.add("id set export", checkOK, "%s sets to s3://%s/%s", format, bucket, getEnv("ID_SET_PREFIX", "verve/id-sets/"))
+		}
+	}
+	if addr := getEnv("HTTP3_ADDR", ""); addr != "" {
+		if servers, err := newHTTP3Servers(addr, getEnv("HTTP3_CERT_FILE", ""), getEnv("HTTP3_KEY_FILE", ""), nil, 0); err != nil {
+			r.add("http3", checkError, "%v", err)
+		} else {
+			r.add("http3", checkOK, "%d UDP listeners, advertised in Alt-Svc", len(servers))
+		}
+	}
+	if c, err := newCallerClassifier(getEnv("INTERNAL_CIDRS", ""), getEnv("INTERNAL_API_KEY_IDS", ""), getEnv("VERBOSE_RESPONSES", "internal")); err != nil {
+		r.add("caller classes", checkError, "%v", err)
+	} else if c.verbose == "internal" {
+		r.add("caller classes", checkOK, "verbose responses for %d internal networks and %d API keys", len(c.networks), len(c.keyIDs))
+	} else {
+		r.add("caller classes", checkOK, "VERBOSE_RESPONSES=%s for every caller", c.verbose)
+	}
+
+	if hints, err := parseShardHints(getEnv("SHARD_HINT_PEERS", ""), getEnv("SHARD_HINT_SELF", "")); err != nil {
+		r.add("shard hints", checkError, "SHARD_HINT_PEERS: %v", err)
+	} else if hints != nil && hints.self == "" {
+		r.add("shard hints", checkDegraded, "this instance isn't one of the %d SHARD_HINT_PEERS, set SHARD_HINT_SELF to count misrouted ids", len(hints.peers))
+	} else if hints != nil {
+		r.add("shard hints", checkOK, "%s of %d peers", hints.self, len(hints.peers))
+	}
+
+	if path := getEnv("POLICY_FILE", ""); path != "" {
+		if set, err := loadPolicies(path); err != nil {
+			r.add("policy", checkError, "POLICY_FILE: %v", err)
+		} else {
+			r.add("policy", checkOK, "%d rules from %s", len(set.rules), path)
+		}
+	}
+
+	if addr := getEnv("INGEST_TCP_ADDR", ""); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			r.add("tcp ingest", checkError, "INGEST_TCP_ADDR %q: %v", addr, err)
+		} else if allowed, err := parseCIDRList(getEnv("INGEST_TCP_ALLOWED_CIDRS", "")); err != nil {
+			r.add("tcp ingest", checkError, "INGEST_TCP_ALLOWED_CIDRS: %v", err)
+		} else if len(allowed) == 0 {
+			r.add("tcp ingest", checkError, "%s requires INGEST_TCP_ALLOWED_CIDRS, the protocol has no API key", addr)
+		} else {
+			r.add("tcp ingest", checkOK, "%s for %d address ranges", addr, len(allowed))
+		}
+	}
+
+	if path := getEnv("RECORD_PATH", ""); path != "" {
+		sample, err := strconv.ParseFloat(getEnv("RECORD_SAMPLE", "1"), 64)
+		switch {
+		case err != nil || sample <= 0 || sample > 1:
+			r.add("traffic recording", checkError, "RECORD_SAMPLE must be a fraction in (0, 1], got %q", getEnv("RECORD_SAMPLE", "1"))
+		case getEnv("PRIVACY_MODE", "off") != "off":
+			r.add("traffic recording", checkError, "%s would hold raw ids, which PRIVACY_MODE keeps out of everything else", path)
+		case getEnvInt("RECORD_MAX_MB", 0) <= 0:
+			r.add("traffic recording", checkDegraded, "%s grows until shutdown, set RECORD_MAX_MB to bound it", path)
+		default:
+			r.add("traffic recording", checkOK, "%s, sample %v, at most %d MB", path, sample, getEnvInt("RECORD_MAX_MB", 0))
+		}
+	}
+
+	if _, err := parseScalingWeights(getEnv("SCALING_WEIGHTS", "rps=0.5,inflight=0.3,dedupe_latency=0.2")); err != nil {
+		r.add("scaling", checkError, "SCALING_WEIGHTS: %v", err)
+	} else if getEnvInt("SCALING_TARGET_RPS", 2000) <= 0 || getEnvInt("SCALING_TARGET_INFLIGHT", 200) <= 0 || getEnvDuration("SCALING_TARGET_DEDUPE_LATENCY", 5*time.Millisecond) <= 0 {
+		r.add("scaling", checkError, "SCALING_TARGET_RPS, SCALING_TARGET_INFLIGHT and SCALING_TARGET_DEDUPE_LATENCY must be positive")
+	}
+
+	if threshold := getEnvDuration("SLO_LATENCY", 0); threshold > 0 {
+		if target, err := parseSLOTarget(getEnv("SLO_TARGET", "99")); err != nil {
+			r.add("latency slo", checkError, "%v", err)
+		} else {
+			r.add("latency slo", checkOK, "%g%% within %v", target*100, threshold)
+		}
+	}
+
+	if hook := getEnv("DUPLICATE_WEBHOOK_URL", ""); hook != "" {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.add("duplicate webhook", checkError, "DUPLICATE_WEBHOOK_URL %q is not an http(s) URL", hook)
+		} else if getEnvDuration("DUPLICATE_WEBHOOK_INTERVAL", 5*time.Second) <= 0 {
+			r.add("duplicate webhook", checkError, "DUPLICATE_WEBHOOK_INTERVAL must be positive")
+		} else {
+			r.add("duplicate webhook", checkOK, "batches of up to %d to %s", getEnvInt("DUPLICATE_WEBHOOK_BATCH", 100), u.Host)
+		}
+	}
+	if topic, target := getEnv("DUPLICATE_REPORT_TOPIC", ""), getEnv("DUPLICATE_REPORT_URL", ""); topic != "" || target != "" {
+		var destinations []string
+		if topic != "" {
+			destinations = append(destinations, "topic "+topic)
+		}
+		if target != "" {
+			destinations = append(destinations, target)
+		}
+		if u, err := url.Parse(target); target != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			r.add("duplicate report", checkError, "DUPLICATE_REPORT_URL %q is not an http(s) URL", target)
+		} else if topic != "" && getEnv("KAFKA_BROKER", "") == "" {
+			r.add("duplicate report", checkError, "DUPLICATE_REPORT_TOPIC requires KAFKA_BROKER")
+		} else {
+			r.add("duplicate report", checkOK, "every window to %s", strings.Join(destinations, " and "))
+		}
+	}
+
+	sinkSpec := getEnv("SINKS", "kafka")
+	var sinkNames []string
+	for _, kind := range strings.Split(sinkSpec, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case "":
+		case "kafka", "graphite", "redis_stream", "history", "remote_write", "file", "region":
+			sinkNames = append(sinkNames, kind)
+		default:
+			r.add("sinks", checkError, "unknown sink %q", kind)
+		}
+	}
+	if len(sinkNames) == 0 {
+		r.add("sinks", checkError, "no sink configured")
+	} else {
+		r.add("sinks", checkOK, "%s", strings.Join(sinkNames, ", "))
+	}
+	regionSink := false
+	for _, name := range sinkNames {
+		regionSink = regionSink || name == "region"
+	}
+	aggregate := getEnv("AGGREGATE_REGIONS", "")
+	switch regions, err := parseRegions(aggregate); {
+	case err != nil:
+		r.add("region", checkError, "AGGREGATE_REGIONS: %v", err)
+	case aggregate != "" && regionSink:
+		r.add("region", checkError, "an aggregator (AGGREGATE_REGIONS) can't also publish a region with the region sink")
+	case aggregate != "" && getEnv("KAFKA_BROKER", "") == "":
+		r.add("region", checkError, "the aggregator reads %s and requires KAFKA_BROKER", regionTopic())
+	case aggregate != "":
+		r.add("region", checkOK, "aggregating %s from %s", strings.Join(regions, ", "), regionTopic())
+	case regionSink && (getEnv("REGION", "") == "" || getEnv("KAFKA_BROKER", "") == ""):
+		r.add("region", checkError, "the region sink requires REGION and KAFKA_BROKER")
+	case regionSink:
+		r.add("region", checkOK, "publishing region %s to %s", getEnv("REGION", ""), regionTopic())
+	}
+	if strings.Contains(sinkSpec, "kafka") {
+		if broker := getEnv("KAFKA_BROKER", ""); broker == "" {
+			r.add("kafka", checkError, "KAFKA_BROKER is not set")
+		} else {
+			probeTCP(r, "kafka", broker)
+		}
+		keySpec := getEnv("KAFKA_KEY", "tenant")
+		if _, err := parseMessageKeyStrategy(keySpec, ""); err != nil {
+			r.add("kafka key", checkError, "%v", err)
+		} else if keySpec != "tenant" && strings.Contains(getEnv("KAFKA_TOPIC_CLEANUP_POLICY", ""), "compact") {
+			r.add("kafka key", checkDegraded, "the compacted topic only keeps the latest message per %s key, including tenant messages", keySpec)
+		} else if keySpec == "constant" && getEnvInt("KAFKA_TOPIC_PARTITIONS", 1) > 1 {
+			r.add("kafka key", checkDegraded, "a constant key puts every message on one of the %d partitions", getEnvInt("KAFKA_TOPIC_PARTITIONS", 1))
+		} else {
+			r.add("kafka key", checkOK, "%s", keySpec)
+		}
+	}
+	if strings.Contains(sinkSpec, "kafka") {
+		if _, err := newPayloadSerializer(getEnv("KAFKA_FORMAT", "json")); err != nil {
+			r.add("payload formats", checkError, "KAFKA_FORMAT: %v", err)
+		}
+		if _, err := parseKafkaCompression(getEnv("KAFKA_COMPRESSION", "none")); err != nil {
+			r.add("kafka", checkError, "%v", err)
+		}
+	}
+	if strings.Contains(sinkSpec, "redis_stream") {
+		if _, err := newPayloadSerializer(getEnv("REDIS_STREAM_FORMAT", "json")); err != nil {
+			r.add("payload formats", checkError, "REDIS_STREAM_FORMAT: %v", err)
+		}
+	}
+	if _, err := parseNotifyFormats(getEnv("NOTIFY_FORMAT", "json"), getEnv("NOTIFY_HOST_FORMATS", "")); err != nil {
+		r.add("payload formats", checkError, "notifications: %v", err)
+	}
+	if getEnvBool("NOTIFY_TREND", false) {
+		switch format := getEnv("NOTIFY_FORMAT", "json"); {
+		case getEnvInt("NOTIFY_TREND_WINDOWS", 5) < 1:
+			r.add("notify trend", checkError, "NOTIFY_TREND_WINDOWS must be at least 1")
+		case format != "json" && format != "protobuf":
+			r.add("notify trend", checkDegraded, "NOTIFY_FORMAT=%s doesn't carry the trend, only json and protobuf do", format)
+		default:
+			r.add("notify trend", checkOK, "moving average over %d windows", getEnvInt("NOTIFY_TREND_WINDOWS", 5))
+		}
+	}
+	if getEnvBool("HISTORY_DOWNSAMPLE", false) {
+		minutes := getEnvDuration("HISTORY_MINUTE_RETENTION", 7*24*time.Hour)
+		hours := getEnvDuration("HISTORY_HOUR_RETENTION", 90*24*time.Hour)
+		switch retention := historyRetention(); {
+		case !strings.Contains(sinkSpec, "history"):
+			r.add("history", checkDegraded, "HISTORY_DOWNSAMPLE does nothing without the history sink")
+		case getEnvDuration("HISTORY_COMPACT_INTERVAL", time.Hour) <= 0:
+			r.add("history", checkError, "HISTORY_COMPACT_INTERVAL must be positive")
+		case minutes < 2*time.Hour || hours < minutes+48*time.Hour:
+			r.add("history", checkError, "HISTORY_MINUTE_RETENTION must be at least 2h and HISTORY_HOUR_RETENTION two days longer")
+		case retention > 0 && retention < hours:
+			r.add("history", checkError, "HISTORY_RETENTION %v drops reports before they are downsampled to days", retention)
+		case !strings.Contains(getEnv("ROLLUPS", ""), "hour"):
+			r.add("history", checkDegraded, "without hour rollups (ROLLUPS) minutes are summed into hours, an upper bound of the unique count")
+		default:
+			r.add("history", checkOK, "minutes for %v, hours for %v, days for %s", minutes, hours, map[bool]string{true: "ever", false: retention.String()}[retention == 0])
+		}
+	}
+	if strings.Contains(sinkSpec, "remote_write") {
+		if target := getEnv("REMOTE_WRITE_URL", ""); target == "" {
+			r.add("remote write", checkError, "REMOTE_WRITE_URL is not set")
+		} else if u, err := url.Parse(target); err != nil || u.Host == "" {
+			r.add("remote write", checkError, "REMOTE_WRITE_URL %q is not a URL", target)
+		} else {
+			probeTCP(r, "remote write", hostPort(u))
+		}
+	}
+	if strings.Contains(sinkSpec, "graphite") {
+		if addr := getEnv("GRAPHITE_ADDR", ""); addr == "" {
+			r.add("graphite", checkError, "GRAPHITE_ADDR is not set")
+		} else {
+			probeTCP(r, "graphite", addr)
+		}
+	}
+	if slices.Contains(sinkNames, "file") {
+		if dir := getEnv("REPORT_DIR", ""); dir == "" {
+			r.add("report files", checkError, "REPORT_DIR is not set")
+		} else if getEnvInt("REPORT_KEEP", 0) < 0 || getEnvInt("REPORT_TOP_K", 10) < 0 {
+			r.add("report files", checkError, "REPORT_KEEP and REPORT_TOP_K must not be negative")
+		} else {
+			r.add("report files", checkOK, "%s", dir)
+		}
+	}
+
+	needsRedis := backend == "redis" && getEnv("REDIS_SHARDS", "") == "" ||
+		getEnv("CANARY_BACKEND", "") == "redis" && getEnv("REDIS_SHARDS", "") == "" ||
+		coordinatorKind == "redis" ||
+		getEnvBool("RECONCILE", false) ||
+		getEnvBool("STANDBY", false) ||
+		getEnvBool("REPLAY_PROTECTION", false) && getEnv("REPLAY_NONCE_STORE", "memory") == "redis" ||
+		getEnv("TENANT_STORE", "") == "redis" ||
+		getEnv("SUBSCRIPTION_STORE", "") == "redis" ||
+		strings.Contains(sinkSpec, "redis_stream") ||
+		strings.Contains(sinkSpec, "history") && getEnv("HISTORY_STORE", "bolt") == "redis"
+	if needsRedis {
+		probeRedis(r, "redis", os.Getenv("REDIS_HOST")+":"+os.Getenv("REDIS_PORT"))
+	}
+	if addrs := getEnv("REDIS_REPLICAS", ""); addrs != "" {
+		if getEnv("REDIS_SHARDS", "") != "" {
+			r.add("redis replicas", checkDegraded, "REDIS_REPLICAS only applies to REDIS_HOST, not to REDIS_SHARDS")
+		}
+		for _, addr := range strings.Split(addrs, ",") {
+			probeRedis(r, "redis replica "+strings.TrimSpace(addr), strings.TrimSpace(addr))
+		}
+	}
+	if shards := getEnv("REDIS_SHARDS", ""); backend == "redis" && shards != "" {
+		for _, shard := range strings.Split(shards, ",") {
+			probeRedis(r, "redis shard "+strings.TrimSpace(shard), strings.TrimSpace(shard))
+		}
+	}
+	if err := (&redisDeduplicator{}).setLayout(getEnv("REDIS_LAYOUT", "keys"), 1); err != nil {
+		r.add("redis layout", checkError, "%v", err)
+	}
+
+	if _, err := newIDBuckets(getEnv("ID_BUCKET_RANGES", ""), getEnvInt("ID_HASH_BUCKETS", 0)); err != nil {
+		r.add("id buckets", checkError, "%v", err)
+	}
+	if _, err := newRollupTracker(getEnv("ROLLUPS", ""), nil, 0); err != nil {
+		r.add("rollups", checkError, "%v", err)
+	}
+	if _, err := newResponseContract(getEnv("NOTIFY_EXPECT_STATUS", ""), getEnv("NOTIFY_EXPECT_FIELDS", "")); err != nil {
+		r.add("notification contract", checkError, "%v", err)
+	}
+	if _, err := parseNotifyHedge(getEnv("NOTIFY_HEDGE_HOSTS", ""), getEnvInt("NOTIFY_HEDGE_PERCENTILE", 95), getEnvDuration("NOTIFY_HEDGE_MIN_DELAY", 50*time.Millisecond)); err != nil {
+		r.add("notification hedging", checkError, "%v", err)
+	}
+	if getEnv("AUDIT_LOG_KEY", "") == "" {
+		r.add("audit log", checkDegraded, "no AUDIT_LOG_KEY, the hash chain can be recomputed by anyone who can write the file")
+	} else {
+		r.add("audit log", checkOK, "chain keyed by AUDIT_LOG_KEY")
+	}
+	if getEnv("ADMIN_TOKEN", "") == "" {
+		r.add("admin api", checkDisabled, "ADMIN_TOKEN is not set")
+	} else {
+		r.add("admin api", checkOK, "enabled")
+	}
+	if kind := getEnv("TENANT_STORE", ""); kind != "" && kind != "redis" && kind != "postgres" {
+		r.add("tenant store", checkError, "unknown tenant store %q", kind)
+	}
+	var sealErr error
+	if key := getEnv("SUBSCRIPTION_SECRET_KEY", ""); key != "" {
+		_, sealErr = newSecretSealer(key)
+	}
+	switch kind := getEnv("SUBSCRIPTION_STORE", ""); {
+	case kind != "" && kind != "redis" && kind != "postgres":
+		r.add("subscriptions", checkError, "unknown subscription store %q", kind)
+	case kind == "postgres" && getEnv("POSTGRES_DSN", "") == "":
+		r.add("subscriptions", checkError, "the postgres subscription store requires POSTGRES_DSN")
+	case kind != "" && sealErr != nil:
+		r.add("subscriptions", checkError, "%v", sealErr)
+	case kind == "" && getEnvBool("NOTIFY_ENDPOINT_PARAM", false):
+		r.add("subscriptions", checkDisabled, "no SUBSCRIPTION_STORE, only the endpoints named in accept requests are notified")
+	case kind == "":
+		r.add("subscriptions", checkDisabled, "no SUBSCRIPTION_STORE and NOTIFY_ENDPOINT_PARAM is off, nothing is notified")
+	case kind != "" && getEnv("ADMIN_TOKEN", "") == "":
+		r.add("subscriptions", checkDegraded, "%s store, but subscriptions can't be managed without ADMIN_TOKEN", kind)
+	case kind != "" && getEnv("SUBSCRIPTION_SECRET_KEY", "") == "":
+		r.add("subscriptions", checkDegraded, "%s store, but subscriptions can't have auth without SUBSCRIPTION_SECRET_KEY", kind)
+	case kind != "":
+		r.add("subscriptions", checkOK, "%s store, auth secrets sealed", kind)
+	}
+	limited := getEnvInt("REDIS_MAX_KEYS", 0) > 0 || getEnvInt("REDIS_MAX_MEMORY_MB", 0) > 0
+	switch interval := getEnvDuration("REDIS_KEYSPACE_INTERVAL", 30*time.Second); {
+	case backend != "redis" && limited:
+		r.add("redis keyspace", checkError, "REDIS_MAX_KEYS and REDIS_MAX_MEMORY_MB only apply to the redis backend")
+	case backend != "redis":
+	case interval <= 0 && limited:
+		r.add("redis keyspace", checkError, "REDIS_MAX_KEYS and REDIS_MAX_MEMORY_MB need the keyspace sampled, REDIS_KEYSPACE_INTERVAL is 0")
+	case !limited:
+		r.add("redis keyspace", checkDisabled, "no REDIS_MAX_KEYS or REDIS_MAX_MEMORY_MB")
+	default:
+		r.add("redis keyspace", checkOK, "sampled every %v, at most %d keys and %d MiB", interval, getEnvInt("REDIS_MAX_KEYS", 0), getEnvInt("REDIS_MAX_MEMORY_MB", 0))
+	}
+	switch {
+	case !getEnvBool("TENANT_WINDOWS", false):
+	case getEnv("TENANT_STORE", "") == "":
+		r.add("tenant windows", checkError, "TENANT_WINDOWS reads the tenants' windows from the TENANT_STORE, set one")
+	case !slices.Contains(sinkNames, "kafka"):
+		r.add("tenant windows", checkDegraded, "tenant windows are published on Kafka, without the kafka sink they are only logged")
+	case backend != "redis":
+		r.add("tenant windows", checkDegraded, "tenant windows are deduped in process with the %s backend, per instance", backend)
+	default:
+		r.add("tenant windows", checkOK, "refreshed every %v", getEnvDuration("TENANT_WINDOW_REFRESH", 30*time.Second))
+	}
+	if !getEnvBool("NOTIFY_ENDPOINT_PARAM", false) && strings.Contains(getEnv("DEDUPE_KEY", "id"), "endpoint") {
+		r.add("dedupe key", checkError, "DEDUPE_KEY uses the endpoint, which is rejected unless NOTIFY_ENDPOINT_PARAM=true")
+	}
+	if getEnv("OUTBOX_PATH", "") == "" {
+		r.add("outbox", checkDisabled, "window reports are published at most once")
+	} else {
+		r.add("outbox", checkOK, "%s", getEnv("OUTBOX_PATH", ""))
+	}
+	if topic := getEnv("HEARTBEAT_TOPIC", ""); topic != "" && getEnv("KAFKA_BROKER", "") == "" {
+		r.add("heartbeat", checkError, "HEARTBEAT_TOPIC requires KAFKA_BROKER")
+	} else if getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second) <= 0 {
+		r.add("heartbeat", checkDisabled, "HEARTBEAT_INTERVAL is 0")
+	} else if topic != "" {
+		r.add("heartbeat", checkOK, "every %v to %s", getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second), topic)
+	} else {
+		r.add("heartbeat", checkOK, "every %v, metrics only", getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second))
+	}
+	if getEnvDuration("WINDOW_GRACE", 0) >= time.Minute {
+		r.add("window grace", checkError, "WINDOW_GRACE must be shorter than the one minute window")
+	}
+	if getEnvInt("DEDUPE_MEMORY_LIMIT_MB", 0) > 0 && backend != "roaring" && backend != "cuckoo" {
+		r.add("resource caps", checkDegraded, "the %s backend doesn't keep the window in memory, DEDUPE_MEMORY_LIMIT_MB is ignored", backend)
+	}
+	if n := getEnvInt("MAX_GOROUTINES", 0); n > 0 && n <= getEnvInt("NOTIFY_WORKERS", 8)+100 {
+		r.add("resource caps", checkError, "MAX_GOROUTINES=%d leaves no room beyond the notification workers and background components", n)
+	}
+	if dryRun || getEnvBool("DRY_RUN", false) {
+		r.add("dry run", checkDegraded, "sinks and notifications only log what they would send")
+	}
+
+	r.limits = [][2]string{
+		{"listen", getEnv("LISTEN_ADDR", ":8080")},
+		{"internal listen", getEnv("INTERNAL_ADDR", "(none)")},
+		{"http3 listen", getEnv("HTTP3_ADDR", "(none)")},
+		{"max connections", strconv.Itoa(getEnvInt("MAX_CONNECTIONS", 0))},
+		{"batch max ids", strconv.Itoa(getEnvInt("BATCH_MAX_IDS", 1000))},
+		{"notify workers", strconv.Itoa(getEnvInt("NOTIFY_WORKERS", 8))},
+		{"notify queue", strconv.Itoa(getEnvInt("NOTIFY_QUEUE_SIZE", 1000))},
+		{"notify per host", strconv.Itoa(getEnvInt("NOTIFY_MAX_PER_HOST", 2))},
+		{"max in-flight requests", strconv.Itoa(getEnvInt("MAX_INFLIGHT_REQUESTS", 0))},
+		{"max goroutines", strconv.Itoa(getEnvInt("MAX_GOROUTINES", 0))},
+		{"dedupe memory limit MB", strconv.Itoa(getEnvInt("DEDUPE_MEMORY_LIMIT_MB", 0))},
+		{"rate limit rps", strconv.Itoa(getEnvInt("RATE_LIMIT_RPS", 0))},
+		{"request budget", getEnvDuration("REQUEST_BUDGET", 0).String()},
+		{"window grace", getEnvDuration("WINDOW_GRACE", 0).String()},
+		{"shutdown timeout", getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second).String()},
+		{"GOMAXPROCS", strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{"GOMEMLIMIT", formatMemLimit(debug.SetMemoryLimit(-1))},
+	}
+	return r
+}
+
+func probeTCP(r *startupReport, name, addr string) {
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil {
+		r.add(name, checkError, "%s unreachable: %v", addr, err)
+		return
+	}
+	conn.Close()
+	r.add(name, checkOK, "%s reachable", addr)
+}
+
+func probeRedis(r *startupReport, name, addr string) {
+	client := redis.NewClient(&redis.Options{Addr: addr, DialTimeout: 3 * time.Second})
+	defer client.Close()
+
+	pingCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		r.add(name, checkError, "%s unreachable: %v", addr, err)
+		return
+	}
+	r.add(name, checkOK, "%s reachable", addr)
+}
+
+// hostPort is the address to probe for u, with the scheme's default port.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
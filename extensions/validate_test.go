@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// middlewareChecks runs the startup validation and returns the details of its middleware
+// checks by status.
+func middlewareChecks(t *testing.T) map[string][]string {
+	t.Helper()
+	checks := map[string][]string{}
+	for _, c := range validateStartup().checks {
+		if c.name == "middleware" {
+			checks[c.status] = append(checks[c.status], c.detail)
+		}
+	}
+	return checks
+}
+
+func TestValidateRateLimitWithoutLayer(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "10")
+	if errs := middlewareChecks(t)[checkError]; len(errs) != 1 || !strings.Contains(errs[0], "rate_limit layer") {
+		t.Errorf("got middleware errors %q, want RATE_LIMIT_RPS without the rate_limit layer", errs)
+	}
+
+	t.Setenv("HTTP_MIDDLEWARE", "request_id,recovery,rate_limit")
+	if errs := middlewareChecks(t)[checkError]; len(errs) != 0 {
+		t.Errorf("got middleware errors %q with the rate_limit layer", errs)
+	}
+}
+
+func TestValidateReportsEveryMiddlewareProblem(t *testing.T) {
+	t.Setenv("HTTP_MIDDLEWARE", "request_id")
+	t.Setenv("API_MIDDLEWARE", "standby,auth")
+	t.Setenv("REPLAY_PROTECTION", "true")
+	checks := middlewareChecks(t)
+	if degraded := checks[checkDegraded]; len(degraded) != 1 || !strings.Contains(degraded[0], "recovery") {
+		t.Errorf("got degraded middleware checks %q, want the missing recovery layer", degraded)
+	}
+	if errs := checks[checkError]; len(errs) != 1 || !strings.Contains(errs[0], "replay layer") {
+		t.Errorf("got middleware errors %q, want the missing replay layer", errs)
+	}
+	if ok := checks[checkOK]; len(ok) != 0 {
+		t.Errorf("got ok middleware checks %q next to the problems", ok)
+	}
+}
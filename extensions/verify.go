@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// verifyResponse is the count a window was reported with, as kept in the history.
+type verifyResponse struct {
+	Window             string `json:"window"`
+	Period             string `json:"period"`
+	UniqueRequestCount int    `json:"unique_request_count"`
+	Tenant             string `json:"tenant,omitempty"`
+	// Checksum is reportChecksum of what was published, so a consumer can compare it with the
+	// checksum of what it received without comparing the breakdowns field by field.
+	Checksum     string         `json:"checksum"`
+	SketchDigest string         `json:"sketch_digest,omitempty"`
+	Tenants      map[string]int `json:"tenants,omitempty"`
+	Approximate  bool           `json:"approximate,omitempty"`
+	Overflowed   bool           `json:"overflowed,omitempty"`
+	Compacted    bool           `json:"compacted,omitempty"`
+	InstanceID   string         `json:"instance_id,omitempty"`
+}
+
+// reportChecksum is the SHA-256 of a window's timestamp, count, sketch digest when it has one
+// and per-tenant counts, one per line and tenants in byte order:
+//
+//	2024-01-01T12:00:00Z
+//	42
+//	sha256:9f86d081...
+//	acme=40
+//	globex=2
+//
+// A tenant's checksum is taken over its timestamp, count and name, the fields of the tenant
+// message: "2024-01-01T12:00:00Z\n40\nacme\n".
+func reportChecksum(timestamp string, count int, sketchDigest string, tenants map[string]int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n", timestamp, count)
+	if sketchDigest != "" {
+		fmt.Fprintf(h, "%s\n", sketchDigest)
+	}
+	for _, tenant := range sortedKeys(tenants) {
+		fmt.Fprintf(h, "%s=%d\n", tenant, tenants[tenant])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func tenantChecksum(timestamp string, count int, tenant string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s\n", timestamp, count, tenant)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// errWindowFound stops the history scan at the window asked for.
+var errWindowFound = errors.New("window found")
+
+// Return the count a window was reported with, so Kafka consumers and notified endpoints
+// can check what they received against the history. With a tenant store callers only verify
+// their own tenant's message, the one they were sent.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		writeErrorV2(w, http.StatusNotImplemented, "history_disabled", "Window history is disabled, add 'history' to SINKS to enable it")
+		return
+	}
+
+	query := r.URL.Query()
+	tenant := query.Get("tenant")
+	if tenants != nil {
+		// tenantFromAPIKey only leaves the tenant of a valid key
+		own := r.Header.Get("X-Tenant-ID")
+		if own == "" {
+			writeErrorV2(w, http.StatusUnauthorized, "api_key_required", "Verifying a window requires an API key")
+			return
+		}
+		if tenant != "" && tenant != own {
+			writeErrorV2(w, http.StatusForbidden, "forbidden_tenant", "Only the API key's own tenant can be verified")
+			return
+		}
+		tenant = own
+	}
+	at, err := parseWindowParam(query.Get("window"))
+	if err != nil {
+		writeErrorV2(w, http.StatusBadRequest, "invalid_window", "'window' must be the RFC 3339 or Unix time a window ended at")
+		return
+	}
+	period := query.Get("period")
+	if period == "minute" {
+		period = ""
+	}
+
+	var found *windowReport
+	err = history.Scan(r.Context(), at, at.Add(time.Second), func(report windowReport) error {
+		if report.Period != period {
+			return nil
+		}
+		found = &report
+		return errWindowFound
+	})
+	if err != nil && !errors.Is(err, errWindowFound) {
+		log.Printf("Error scanning window history: %v\n", err)
+		writeErrorV2(w, http.StatusInternalServerError, "history_failed", "Failed to read the window history")
+		return
+	}
+	if found == nil {
+		writeErrorV2(w, http.StatusNotFound, "window_not_found", "No report of that window is kept in the history")
+		return
+	}
+
+	resp := verifyResponse{
+		Window:             found.Timestamp,
+		Period:             periodName(found.Period),
+		UniqueRequestCount: found.UniqueRequestCount,
+		Checksum:           reportChecksum(found.Timestamp, found.UniqueRequestCount, found.SketchDigest, found.Tenants),
+		SketchDigest:       found.SketchDigest,
+		Tenants:            found.Tenants,
+		Approximate:        found.Approximate,
+		Overflowed:         found.Overflowed,
+		Compacted:          found.Compacted,
+		InstanceID:         found.InstanceID,
+	}
+	if tenant != "" {
+		count, ok := found.Tenants[tenant]
+		if !ok {
+			writeErrorV2(w, http.StatusNotFound, "window_not_found", "The tenant sent no ids in that window")
+			return
+		}
+		// The sketch is over every tenant's ids, which a tenant's message doesn't carry
+		resp.Tenant, resp.UniqueRequestCount, resp.Tenants, resp.SketchDigest = tenant, count, nil, ""
+		resp.Checksum = tenantChecksum(found.Timestamp, count, tenant)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseWindowParam parses the end of a window given as RFC 3339 or Unix seconds.
+func parseWindowParam(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyHandler(t *testing.T) {
+	store, err := newBoltHistory(filepath.Join(t.TempDir(), "history.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = store
+	defer func() { history, tenants = nil, nil }()
+	report := windowReport{UniqueRequestCount: 3, Timestamp: "2026-10-14T07:01:00Z", Tenants: map[string]int{"acme": 2, "globex": 1}, SketchDigest: "sha256:00"}
+	if err := store.Append(context.Background(), report); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(tenant, query string) (int, verifyResponse) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v2/verve/verify?window=2026-10-14T07:01:00Z"+query, nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		rec := httptest.NewRecorder()
+		verifyHandler(rec, r)
+		var resp verifyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, resp := verify("", "")
+	if want := reportChecksum(report.Timestamp, 3, "sha256:00", report.Tenants); code != http.StatusOK || resp.Checksum != want {
+		t.Errorf("window: got %d %+v, want checksum %s", code, resp, want)
+	}
+
+	tenants = fakeTenantStore{t: tenant{ID: "acme"}}
+	if code, _ := verify("", ""); code != http.StatusUnauthorized {
+		t.Errorf("without a key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := verify("acme", "&tenant=globex"); code != http.StatusForbidden {
+		t.Errorf("another tenant: got %d, want %d", code, http.StatusForbidden)
+	}
+	code, resp = verify("acme", "")
+	if code != http.StatusOK || resp.Tenant != "acme" || resp.UniqueRequestCount != 2 || resp.Tenants != nil {
+		t.Errorf("own tenant: got %d %+v", code, resp)
+	}
+}
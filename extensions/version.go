@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set at build time, e.g. go build -ldflags "-X main.version=1.2.0 -X main.gitSHA=$(git rev-parse HEAD)".
+// Without ldflags the VCS stamp embedded by the Go toolchain is used where available.
+var (
+	version   = "dev"
+	gitSHA    = ""
+	buildTime = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+var currentBuild = sync.OnceValue(func() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GitSHA:    gitSHA,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.GitSHA == "":
+				info.GitSHA = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+	if info.GitSHA == "" {
+		info.GitSHA = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+})
+
+// attributeLogs prefixes every following log line with the instance, version and dedupe
+// backend, so that lines from different replicas can be told apart once they are aggregated.
+func attributeLogs() {
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix(fmt.Sprintf("instance=%s version=%s backend=%s ", instanceID(), currentBuild().Version, activeBackend()))
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentBuild())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// windowGrace keeps track of the accept requests in flight, so that closing a window can wait
+// for the ones that arrived before the boundary (WINDOW_GRACE) instead of counting them in the
+// next window, or not at all when they land between the count and the cleanup of the flush.
+type windowGrace struct {
+	mu      sync.Mutex
+	current *graceGeneration
+}
+
+// graceGeneration holds the requests that arrived within one window.
+type graceGeneration struct {
+	wg      sync.WaitGroup
+	pending atomic.Int64
+}
+
+var acceptGrace = &windowGrace{current: &graceGeneration{}}
+
+func (g *windowGrace) begin() *graceGeneration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gen := g.current
+	gen.wg.Add(1)
+	gen.pending.Add(1)
+	return gen
+}
+
+func (gen *graceGeneration) done() {
+	gen.pending.Add(-1)
+	gen.wg.Done()
+}
+
+// close ends the window: later requests belong to the next one. It waits up to grace for the
+// requests of the closing window to finish, or for the whole grace when full is set, because
+// requests in flight on other instances can't be seen from here.
+func (g *windowGrace) close(grace time.Duration, full bool) {
+	g.mu.Lock()
+	gen := g.current
+	g.current = &graceGeneration{}
+	g.mu.Unlock()
+	if grace <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	drained := make(chan struct{})
+	go func() {
+		gen.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		if full {
+			<-timer.C
+		}
+	case <-timer.C:
+		if n := gen.pending.Load(); n > 0 {
+			windowGraceStragglers.Add(float64(n))
+			log.Printf("%d requests of the closing window are still in flight after %v, they may count in the next window\n", n, grace)
+		}
+	}
+}
+
+type arrivedKey struct{}
+
+// inWindow attributes a request to the window it arrived in.
+func inWindow(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gen := acceptGrace.begin()
+		defer gen.done()
+		next(w, r.WithContext(context.WithValue(r.Context(), arrivedKey{}, time.Now())))
+	}
+}
+
+// arrivedAt is when inWindow attributed r to its window, or now outside of it.
+func arrivedAt(r *http.Request) time.Time {
+	if at, ok := r.Context().Value(arrivedKey{}).(time.Time); ok {
+		return at
+	}
+	return time.Now()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStoredKeyKeepsArrivalSalt(t *testing.T) {
+	dedupeKey, _ = parseKeyStrategy("id")
+	idHash = newIDHasher("secret")
+	defer func() { idHash = nil }()
+
+	var in dedupeInput
+	inWindow(func(w http.ResponseWriter, r *http.Request) {
+		in = newDedupeInput(r, 42, "", nil)
+	})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/verve/accept?id=42", nil))
+
+	// A request still in flight after the boundary hashes with its own window's salt
+	arrived := in.arrived
+	key := storedKey(in)
+	idHash.saltFor(arrived.Add(time.Minute))
+	if got := storedKey(in); got != key {
+		t.Errorf("the stored key changed from %s to %s once the next minute's salt was in use", key, got)
+	}
+	in.arrived = arrived.Add(time.Minute)
+	if storedKey(in) == key {
+		t.Error("the next minute hashed with the same salt")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cespare/xxhash/v2"
+)
+
+// idSets exports the unique ids of every window to object storage; nil without ID_SET_BUCKET.
+var idSets *idSetExporter
+
+// idSetExporter collects the keys this instance counted as new in the current service window
+// and, once it closes, uploads them to an S3 bucket as <prefix><window start>/<instance id>.<ext>,
+// with the start truncated to the minute so every instance's object of a window shares the
+// prefix whatever second it ticks on. With a shared backend every key is new on exactly one
+// instance, so the union of a window's objects is its full set. Uploads wait in a small queue;
+// a full queue drops the newest window.
+//
+// The set holds the stored dedupe keys: numeric ones, the ids with DEDUPE_KEY=id, as they are,
+// others (composite keys and PRIVACY_MODE hashes) as their 64-bit xxhash, so a window's object
+// never holds more than its dedupe backend does.
+type idSetExporter struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	// format is "roaring", a portable 64-bit roaring bitmap, or "varint": the id count followed by
+	// the sorted ids as uvarint deltas, each from the previous id (the first from 0).
+	format string
+
+	mu    sync.Mutex
+	ids   *roaring64.Bitmap
+	queue chan idSet
+}
+
+type idSet struct {
+	// start names the object, timestamp is when the window ended.
+	start     string
+	timestamp string
+	ids       *roaring64.Bitmap
+}
+
+func newIDSetExporter(ctx context.Context, bucket, prefix, endpoint, format string) (*idSetExporter, error) {
+	if format != "roaring" && format != "varint" {
+		return nil, fmt.Errorf("unknown ID_SET_FORMAT %q, expected roaring or varint", format)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryMaxAttempts(5))
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// S3 compatible stores like MinIO don't serve virtual-hosted bucket names
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &idSetExporter{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+		format: format,
+		ids:    roaring64.New(),
+		queue:  make(chan idSet, 4),
+	}, nil
+}
+
+// idSetValue is the set member of a stored dedupe key.
+func idSetValue(key string) uint64 {
+	if v, err := strconv.ParseUint(key, 10, 64); err == nil {
+		return v
+	}
+	return xxhash.Sum64String(key)
+}
+
+func (e *idSetExporter) record(key string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.ids.Add(idSetValue(key))
+	e.mu.Unlock()
+}
+
+// remove takes a retracted or purged key out of the current window's set.
+func (e *idSetExporter) remove(key string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.ids.Remove(idSetValue(key))
+	e.mu.Unlock()
+}
+
+// rotate starts a new set and queues the one of the window that started at start and ended at
+// timestamp. Empty windows are exported too, so a window without ids is told apart from a
+// missing object.
+func (e *idSetExporter) rotate(start time.Time, timestamp string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	set := idSet{start: start.UTC().Truncate(time.Minute).Format(time.RFC3339), timestamp: timestamp, ids: e.ids}
+	e.ids = roaring64.New()
+	e.mu.Unlock()
+
+	select {
+	case e.queue <- set:
+	default:
+		log.Printf("ID set export queue full, dropping the %d ids of the window ending %s\n", set.ids.GetCardinality(), timestamp)
+		idSetExports.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (e *idSetExporter) run(runCtx context.Context) error {
+	for {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case set := <-e.queue:
+			e.upload(runCtx, set)
+		}
+	}
+}
+
+func (e *idSetExporter) upload(runCtx context.Context, set idSet) {
+	body, err := e.encode(set.ids)
+	if err != nil {
+		log.Printf("Failed to encode the ID set of the window ending %s: %v\n", set.timestamp, err)
+		idSetExports.WithLabelValues("failed").Inc()
+		return
+	}
+	key := e.key(set.start)
+	if skipDryRun("id set export", "s3://%s/%s (%d ids, %d bytes)", e.bucket, key, set.ids.GetCardinality(), len(body)) {
+		return
+	}
+	uploadCtx, cancel := context.WithTimeout(runCtx, time.Minute)
+	defer cancel()
+
+	_, err = e.client.PutObject(uploadCtx, &s3.PutObjectInput{
+		Bucket:      aws.String(e.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata: map[string]string{
+			"window-start": set.start,
+			"window":       set.timestamp,
+			"instance-id":  instanceID(),
+			"format":       e.format,
+			"ids":          strconv.FormatUint(set.ids.GetCardinality(), 10),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to upload the ID set of the window ending %s to s3://%s/%s: %v\n", set.timestamp, e.bucket, key, err)
+		idSetExports.WithLabelValues("failed").Inc()
+		return
+	}
+	idSetExports.WithLabelValues("uploaded").Inc()
+	idSetExportBytes.Add(float64(len(body)))
+}
+
+func (e *idSetExporter) key(start string) string {
+	ext := ".roaring"
+	if e.format == "varint" {
+		ext = ".varint"
+	}
+	return e.prefix + start + "/" + instanceID() + ext
+}
+
+func (e *idSetExporter) encode(ids *roaring64.Bitmap) ([]byte, error) {
+	var buf bytes.Buffer
+	if e.format == "roaring" {
+		ids.RunOptimize()
+		_, err := ids.WriteTo(&buf)
+		return buf.Bytes(), err
+	}
+
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], ids.GetCardinality())])
+	var previous uint64
+	for it := ids.Iterator(); it.HasNext(); {
+		id := it.Next()
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], id-previous)])
+		previous = id
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+func TestIDSetExporter(t *testing.T) {
+	e := &idSetExporter{prefix: "sets/", format: "roaring", ids: roaring64.New(), queue: make(chan idSet, 1)}
+	e.record("42")
+	e.record("hash:3f2a")
+	e.record("7")
+	e.remove("7")
+
+	start := time.Date(2026, 10, 14, 7, 0, 37, 0, time.UTC)
+	e.rotate(start, "2026-10-14T07:01:37Z")
+	set := <-e.queue
+	if got := set.ids.ToArray(); len(got) != 2 || !set.ids.Contains(42) || !set.ids.Contains(idSetValue("hash:3f2a")) {
+		t.Errorf("got set %v, want 42 and the hash of hash:3f2a", got)
+	}
+	if got, want := e.key(set.start), "sets/2026-10-14T07:00:00Z/"+instanceID()+".roaring"; got != want {
+		t.Errorf("got key %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+// Package harness runs the dependencies of the verve service in-process for end-to-end tests:
+// Redis on an embedded miniredis, Kafka as an in-memory writer, and the service's handler on an
+// httptest server with an SDK client.
+//
+//	rdb, err := harness.NewRedis()
+//	kafka := &harness.Kafka{Topic: "unique-id-count"}
+//	// wire the service onto rdb.Client and kafka, then
+//	srv := harness.NewServer(handler)
+//	status, err := srv.AcceptAs("acme", 42)
+//
+// The service keeps its configuration in package state, so wiring it onto these is left to the
+// service's own tests.
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abhishek818/verve-technical-challenge/client"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka keeps the messages written to it, standing in for a kafka.Writer.
+type Kafka struct {
+	// Topic is given to messages without one, like a writer with a fixed topic.
+	Topic string
+
+	mu       sync.Mutex
+	messages []kafka.Message
+}
+
+func (k *Kafka) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, m := range msgs {
+		if m.Topic == "" {
+			m.Topic = k.Topic
+		}
+		m.Time = time.Now()
+		k.messages = append(k.messages, m)
+	}
+	return nil
+}
+
+func (k *Kafka) Close() error { return nil }
+
+// Messages returns the messages written to topic so far.
+func (k *Kafka) Messages(topic string) []kafka.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var msgs []kafka.Message
+	for _, m := range k.messages {
+		if m.Topic == topic {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Redis is an embedded miniredis with a client connected to it.
+type Redis struct {
+	Server *miniredis.Miniredis
+	Client *redis.Client
+}
+
+func NewRedis() (*Redis, error) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		return nil, fmt.Errorf("start miniredis: %w", err)
+	}
+	return &Redis{Server: mr, Client: redis.NewClient(&redis.Options{Addr: mr.Addr(), ContextTimeoutEnabled: true})}, nil
+}
+
+func (r *Redis) Close() {
+	r.Client.Close()
+	r.Server.Close()
+}
+
+// Server serves a handler on an httptest server, with an SDK client that doesn't retry.
+type Server struct {
+	*httptest.Server
+	Client *client.Client
+}
+
+func NewServer(handler http.Handler) *Server {
+	srv := httptest.NewServer(handler)
+	return &Server{Server: srv, Client: client.New(srv.URL, client.WithRetries(0, 0))}
+}
+
+// AcceptAs accepts id through the v2 API on behalf of tenant, returning the status.
+func (s *Server) AcceptAs(tenant string, id int) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/api/v2/verve/accept", strings.NewReader(fmt.Sprintf(`{"id": %d}`, id)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", tenant)
+	resp, err := s.Server.Client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode %d response: %w", resp.StatusCode, err)
+	}
+	return body.Status, nil
+}
@@ -0,0 +1,38 @@
+package harness
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaMessagesByTopic(t *testing.T) {
+	k := &Kafka{Topic: "reports"}
+	if err := k.WriteMessages(context.Background(), kafka.Message{Value: []byte("a")}, kafka.Message{Topic: "tenants", Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := k.Messages("reports"); len(msgs) != 1 || string(msgs[0].Value) != "a" {
+		t.Errorf("got %d messages on the default topic, want a", len(msgs))
+	}
+	if msgs := k.Messages("tenants"); len(msgs) != 1 || string(msgs[0].Value) != "b" {
+		t.Errorf("got %d messages on their own topic, want b", len(msgs))
+	}
+}
+
+func TestServerAcceptAs(t *testing.T) {
+	srv := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/verve/accept" || r.Header.Get("X-Tenant-ID") != "acme" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 1, "status": "accepted"}`))
+	}))
+	defer srv.Close()
+
+	if status, err := srv.AcceptAs("acme", 1); err != nil || status != "accepted" {
+		t.Errorf("AcceptAs() = %q, %v, want accepted", status, err)
+	}
+}